@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level" xml:"level"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	level, err := jsonlog.ParseLevel(input.Level)
+	if err != nil {
+		v.AddError("level", "must be one of debug, info, warn, error, fatal or off")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.logger.SetLevel(level)
+	app.logger.PrintInfo("log level changed", map[string]string{
+		"level": level.String(),
+	})
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"log_level": level.String()}, nil)
+}
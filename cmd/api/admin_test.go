@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+)
+
+func TestUpdateLogLevel(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+
+	var buf bytes.Buffer
+	app.logger = jsonlog.New(&buf, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+	routes := app.routes()
+
+	admin := newSession(t, app, 1)
+	editor := newSession(t, app, 2)
+
+	steps := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+		level jsonlog.Level
+	}{
+		{"without admin:write", editor, `{"level":"debug"}`, http.StatusForbidden, jsonlog.LevelInfo},
+		{"unknown level", admin, `{"level":"verbose"}`, http.StatusUnprocessableEntity, jsonlog.LevelInfo},
+		{"lowered", admin, `{"level":"debug"}`, http.StatusOK, jsonlog.LevelDebug},
+		{"raised", admin, `{"level":"error"}`, http.StatusOK, jsonlog.LevelError},
+	}
+
+	for _, step := range steps {
+		r := httptest.NewRequest(http.MethodPut, "/v1/admin/log-level", strings.NewReader(step.body))
+		r.Header.Set("Authorization", "Bearer "+step.token)
+
+		rr := serve(routes, r)
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+		if got := app.logger.GetLevel(); got != step.level {
+			t.Fatalf("%s: the level is %s; want %s", step.name, got, step.level)
+		}
+		if step.want == http.StatusOK && !strings.Contains(rr.Body.String(), `"log_level":"`+step.level.String()+`"`) {
+			t.Errorf("%s: the response doesn't report the new level: %s", step.name, rr.Body)
+		}
+
+		buf.Reset()
+		app.logger.PrintDebug("probe", nil)
+		logged := strings.Contains(buf.String(), "probe")
+		if want := step.level == jsonlog.LevelDebug; logged != want {
+			t.Errorf("%s: debug message logged = %t; want %t", step.name, logged, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// memoryAudit keeps audit entries in memory, newest last, and records the
+// filters it was listed with.
+type memoryAudit struct {
+	entries []data.AuditEntry
+	filters data.Filters
+}
+
+// record stores the entry ctx carries, as the models do in the write's
+// transaction.
+func (m *memoryAudit) record(ctx context.Context) {
+	entry := data.AuditEntryFrom(ctx)
+	if entry == nil {
+		return
+	}
+	entry.ID = int64(len(m.entries) + 1)
+	entry.CreatedAt = time.Now()
+	m.entries = append(m.entries, *entry)
+}
+
+func (m *memoryAudit) GetAll(ctx context.Context, actorID *int64, action, targetType string, targetID *int64, filters data.Filters) ([]*data.AuditEntry, data.Metadata, error) {
+	m.filters = filters
+	entries := []*data.AuditEntry{}
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		entry := m.entries[i]
+		if actorID != nil && (entry.ActorID == nil || *entry.ActorID != *actorID) {
+			continue
+		}
+		if action != "" && entry.Action != action {
+			continue
+		}
+		if targetType != "" && entry.TargetType != targetType {
+			continue
+		}
+		if targetID != nil && (entry.TargetID == nil || *entry.TargetID != *targetID) {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, data.Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1, LastPage: 1, TotalRecords: len(entries)}, nil
+}
+
+// auditedMovies records the audit entry of each successful update.
+type auditedMovies struct {
+	*rollbackMovies
+	audit *memoryAudit
+}
+
+func (m auditedMovies) Update(ctx context.Context, movie *data.Movie) error {
+	err := m.rollbackMovies.Update(ctx, movie)
+	if err == nil && !data.IsDryRun(ctx) {
+		m.audit.record(ctx)
+	}
+	return err
+}
+
+func TestMovieUpdateAudit(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	audit := &memoryAudit{}
+	app.models.Audit = audit
+	app.models.Movies = auditedMovies{
+		rollbackMovies: &rollbackMovies{movies: map[int64]data.Movie{
+			1: {Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1},
+		}},
+		audit: audit,
+	}
+	routes := app.routes()
+	admin, editor := newSession(t, app, 1), newSession(t, app, 2)
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serve(routes, r)
+	}
+
+	rr := send(http.MethodPatch, "/v1/movies/1", editor, `{"title":"Moana 2","year":2017}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("updating the movie got status %d: %s", rr.Code, rr.Body)
+	}
+	// Neither a dry run nor an invalid update is recorded.
+	rr = send(http.MethodPatch, "/v1/movies/1?dry_run=true", editor, `{"title":"Moana 3"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("the dry run got status %d: %s", rr.Code, rr.Body)
+	}
+	rr = send(http.MethodPatch, "/v1/movies/1", editor, `{"title":""}`)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("the invalid update got status %d: %s", rr.Code, rr.Body)
+	}
+
+	// Only admins can read the log.
+	const target = "/v1/admin/audit?target_type=movie&target_id=1&page=1&page_size=10"
+	if rr := send(http.MethodGet, target, "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("an anonymous request got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := send(http.MethodGet, target, editor, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("an editor got status %d; want %d", rr.Code, http.StatusForbidden)
+	}
+
+	rr = send(http.MethodGet, target, admin, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("an admin got status %d: %s", rr.Code, rr.Body)
+	}
+	if audit.filters.Page != 1 || audit.filters.PageSize != 10 || audit.filters.Sort != "-id" {
+		t.Errorf("listed with page %d, page size %d and sort %q; want 1, 10 and -id", audit.filters.Page, audit.filters.PageSize, audit.filters.Sort)
+	}
+
+	var body struct {
+		Audit    []data.AuditEntry `json:"audit"`
+		Metadata data.Metadata     `json:"metadata"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Audit) != 1 || body.Metadata.TotalRecords != 1 {
+		t.Fatalf("got entries %+v; want only the update", body.Audit)
+	}
+
+	entry := body.Audit[0]
+	if entry.ActorID == nil || *entry.ActorID != 2 || entry.Action != data.AuditMovieUpdate || entry.TargetType != "movie" || entry.TargetID == nil || *entry.TargetID != 1 {
+		t.Errorf("got entry %+v; want the update of movie 1 by user 2", entry)
+	}
+	// The diff summary holds the fields that changed and nothing else.
+	if want := "map[title:map[from:Moana to:Moana 2] year:map[from:2016 to:2017]]"; fmt.Sprint(entry.Changes) != want {
+		t.Errorf("got changes %v; want %s", entry.Changes, want)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// cachedResponse is a serialized movie listing and the headers that go with
+// it.
+type cachedResponse struct {
+	contentType  string
+	link         []string
+	etag         string
+	lastModified time.Time
+	body         []byte
+	expires      time.Time
+}
+
+type listCacheItem struct {
+	key      string
+	response *cachedResponse
+}
+
+// listCache is a size-bounded LRU cache of movie listings. Every movie write
+// invalidates the whole cache; the generation counter lets a listing that was
+// being computed while a write happened notice, so it isn't stored stale.
+//
+// The cache is local to the process, but an entry is only served while its
+// ETag matches the one the database gives for the listing now, so writes made
+// through another instance are seen straight away.
+type listCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	generation uint64
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+func newListCache(size int, ttl time.Duration) *listCache {
+	return &listCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *listCache) enabled() bool {
+	return c != nil && c.size > 0
+}
+
+// get returns the unexpired response for key, if any, along with the current
+// generation to pass to set on a miss.
+func (c *listCache) get(key string) (*cachedResponse, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, c.generation
+	}
+
+	item := element.Value.(*listCacheItem)
+	if time.Now().After(item.response.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, c.generation
+	}
+
+	c.order.MoveToFront(element)
+	return item.response, c.generation
+}
+
+// set stores the response unless the cache was invalidated since generation
+// was read, evicting the least recently used entry when the cache is full.
+func (c *listCache) set(key string, response *cachedResponse, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	response.expires = time.Now().Add(c.ttl)
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*listCacheItem).response = response
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&listCacheItem{key: key, response: response})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*listCacheItem).key)
+	}
+}
+
+func (c *listCache) invalidate() {
+	if !c.enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// listCacheKey identifies a listing by its media type, whether it is pretty
+// printed and its normalized query string, so parameters given in a different
+// order share an entry.
+func (app *application) listCacheKey(r *http.Request) string {
+	return fmt.Sprintf("%s %t %s", app.negotiateContentType(r), prettyJSON(r), r.URL.Query().Encode())
+}
+
+// bufferedResponse captures a response so that it can be cached before it is
+// sent.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// listETag is the ETag of the listing identified by key, the listCacheKey of
+// the request, whose content is summarized by summary. It changes whenever
+// any movie in the page does, without the page having to be fetched.
+func listETag(key string, summary *data.MovieListSummary) string {
+	sum := sha256.Sum256([]byte(key + "\n" + summary.Fingerprint))
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// listNotModified reports whether the client already has the listing with the
+// given validators. If-Modified-Since is only consulted when there is no
+// If-None-Match, as RFC 9110 requires.
+func (app *application) listNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return app.etagMatches(header, etag)
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.Truncate(time.Second).After(since)
+}
+
+// writeNotModified sends 304 Not Modified for a listing.
+func (app *application) writeNotModified(w http.ResponseWriter, etag string, lastModified time.Time) {
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "X-Pretty")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// cacheResponse turns a captured listing into a cache entry with the
+// validators it was computed under.
+func cacheResponse(b *bufferedResponse, etag string, lastModified time.Time) *cachedResponse {
+	return &cachedResponse{
+		contentType:  b.header.Get("Content-Type"),
+		link:         b.header.Values("Link"),
+		etag:         etag,
+		lastModified: lastModified,
+		body:         b.body.Bytes(),
+	}
+}
+
+// writeCachedResponse sends a cached listing.
+func (app *application) writeCachedResponse(w http.ResponseWriter, r *http.Request, response *cachedResponse) {
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "X-Pretty")
+	w.Header().Set("ETag", response.etag)
+	w.Header().Set("Last-Modified", response.lastModified.UTC().Format(http.TimeFormat))
+
+	for _, link := range response.link {
+		w.Header().Add("Link", link)
+	}
+	w.Header().Set("Content-Type", response.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(response.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(response.body)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// movieCatalogue is an in-memory movie store that counts how often the full
+// listing is fetched.
+type movieCatalogue struct {
+	data.MockMovieModel
+	movies       []*data.Movie
+	lastModified time.Time
+	listings     int
+}
+
+func (c *movieCatalogue) Insert(ctx context.Context, movie *data.Movie) error {
+	movie.Id = int64(len(c.movies) + 1)
+	movie.Version = 1
+	c.movies = append(c.movies, movie)
+	c.lastModified = c.lastModified.Add(time.Minute)
+	return nil
+}
+
+func (c *movieCatalogue) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	c.listings++
+	return c.movies, data.Metadata{TotalRecords: len(c.movies)}, nil
+}
+
+func (c *movieCatalogue) GetAllSummary(ctx context.Context, title string, genres []string, genresMode string, filters data.Filters) (*data.MovieListSummary, error) {
+	versions := make([]string, len(c.movies))
+	for i, movie := range c.movies {
+		versions[i] = fmt.Sprintf("%d.%d", movie.Id, movie.Version)
+	}
+	return &data.MovieListSummary{
+		Fingerprint:  fmt.Sprintf("%d;%s", len(c.movies), strings.Join(versions, ",")),
+		LastModified: c.lastModified,
+	}, nil
+}
+
+func newListTestApplication(t *testing.T, cacheSize int) (*application, *movieCatalogue) {
+	t.Helper()
+
+	catalogue := &movieCatalogue{lastModified: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	catalogue.Insert(context.Background(), &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG"})
+
+	app := newTestApplication(t)
+	app.models.Movies = catalogue
+	app.listCache = newListCache(cacheSize, time.Minute)
+	return app, catalogue
+}
+
+// listMovies sends GET /v1/movies with the given headers.
+func listMovies(app *application, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	r = app.contextSetUser(r, data.AnonymousUser)
+	return serve(http.HandlerFunc(app.listMoviesHandler), r)
+}
+
+func TestListMoviesCache(t *testing.T) {
+	for _, cacheSize := range []int{0, 16} {
+		t.Run(fmt.Sprintf("cache size %d", cacheSize), func(t *testing.T) {
+			app, catalogue := newListTestApplication(t, cacheSize)
+
+			first := listMovies(app, nil)
+			if first.Code != http.StatusOK {
+				t.Fatalf("got status %d; want %d", first.Code, http.StatusOK)
+			}
+			etag := first.Header().Get("ETag")
+			if etag == "" || first.Header().Get("Last-Modified") == "" {
+				t.Fatalf("missing validators in %v", first.Header())
+			}
+
+			// A repeat is served from the cache when there is one.
+			second := listMovies(app, nil)
+			if second.Code != http.StatusOK || second.Body.String() != first.Body.String() || second.Header().Get("ETag") != etag {
+				t.Fatalf("repeat got status %d, ETag %s; want 200 and the first response", second.Code, second.Header().Get("ETag"))
+			}
+			wantListings := 2
+			if cacheSize > 0 {
+				wantListings = 1
+			}
+			if catalogue.listings != wantListings {
+				t.Errorf("listing fetched %d times; want %d", catalogue.listings, wantListings)
+			}
+
+			// Conditional requests never fetch the listing.
+			before := catalogue.listings
+			conditional := []map[string]string{
+				{"If-None-Match": etag},
+				{"If-None-Match": `"other", ` + etag},
+				{"If-Modified-Since": first.Header().Get("Last-Modified")},
+			}
+			for _, headers := range conditional {
+				rr := listMovies(app, headers)
+				if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+					t.Errorf("%v got status %d with %d bytes; want 304 and no body", headers, rr.Code, rr.Body.Len())
+				}
+				if rr.Header().Get("ETag") != etag {
+					t.Errorf("%v got ETag %q; want %q", headers, rr.Header().Get("ETag"), etag)
+				}
+			}
+			if catalogue.listings != before {
+				t.Errorf("conditional requests fetched the listing %d times", catalogue.listings-before)
+			}
+
+			stale := []map[string]string{
+				{"If-None-Match": `"other"`},
+				{"If-Modified-Since": catalogue.lastModified.Add(-time.Second).Format(http.TimeFormat)},
+				// If-None-Match wins over If-Modified-Since.
+				{"If-None-Match": `"other"`, "If-Modified-Since": first.Header().Get("Last-Modified")},
+			}
+			for _, headers := range stale {
+				if rr := listMovies(app, headers); rr.Code != http.StatusOK {
+					t.Errorf("%v got status %d; want 200", headers, rr.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestListMoviesCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(t *testing.T, app *application, catalogue *movieCatalogue)
+	}{
+		{
+			name: "create through this instance",
+			write: func(t *testing.T, app *application, catalogue *movieCatalogue) {
+				body := `{"title":"Black Panther","year":2018,"runtime":134,"genres":["action"],"director":"Ryan Coogler","rating":"PG-13"}`
+				r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+				r = app.contextSetUser(r, data.AnonymousUser)
+
+				rr := serve(http.HandlerFunc(app.createMovieHandler), r)
+				if rr.Code != http.StatusCreated {
+					t.Fatalf("create got status %d: %s", rr.Code, rr.Body)
+				}
+			},
+		},
+		{
+			// Another instance's write doesn't invalidate this cache, but it
+			// does change the summary.
+			name: "update through another instance",
+			write: func(t *testing.T, app *application, catalogue *movieCatalogue) {
+				catalogue.movies[0].Title = "Moana 2"
+				catalogue.movies[0].Version++
+				catalogue.lastModified = catalogue.lastModified.Add(time.Minute)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, catalogue := newListTestApplication(t, 16)
+
+			first := listMovies(app, nil)
+			etag := first.Header().Get("ETag")
+
+			tt.write(t, app, catalogue)
+			listings := catalogue.listings
+
+			rr := listMovies(app, map[string]string{"If-None-Match": etag})
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d after the write; want 200", rr.Code)
+			}
+			if rr.Header().Get("ETag") == etag {
+				t.Error("ETag didn't change after the write")
+			}
+			if rr.Body.String() == first.Body.String() {
+				t.Error("listing didn't change after the write")
+			}
+			if catalogue.listings != listings+1 {
+				t.Errorf("listing fetched %d times after the write; want 1", catalogue.listings-listings)
+			}
+		})
+	}
+}
+
+func TestListMoviesCachePretty(t *testing.T) {
+	app, catalogue := newListTestApplication(t, 16)
+
+	compact := listMovies(app, nil)
+	pretty := listMovies(app, map[string]string{"X-Pretty": "true"})
+	if compact.Code != http.StatusOK || pretty.Code != http.StatusOK {
+		t.Fatalf("got statuses %d and %d; want 200", compact.Code, pretty.Code)
+	}
+	// The two forms are cached separately.
+	if catalogue.listings != 2 {
+		t.Errorf("listing fetched %d times; want 2", catalogue.listings)
+	}
+	if !strings.Contains(pretty.Body.String(), "\n  ") || strings.Contains(compact.Body.String(), "\n  ") {
+		t.Errorf("got compact body %s and pretty body %s", compact.Body, pretty.Body)
+	}
+
+	var fromCompact, fromPretty any
+	if json.Unmarshal(compact.Body.Bytes(), &fromCompact) != nil || json.Unmarshal(pretty.Body.Bytes(), &fromPretty) != nil || !reflect.DeepEqual(fromCompact, fromPretty) {
+		t.Errorf("compact %s and pretty %s bodies differ", compact.Body, pretty.Body)
+	}
+
+	// A cached response carries the length of its own form.
+	cached := listMovies(app, map[string]string{"X-Pretty": "true"})
+	if catalogue.listings != 2 {
+		t.Errorf("listing fetched %d times; want the repeat from the cache", catalogue.listings)
+	}
+	for name, rr := range map[string]*httptest.ResponseRecorder{"compact": compact, "pretty": pretty, "cached": cached} {
+		if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(rr.Body.Len()) {
+			t.Errorf("%s got Content-Length %s for %d bytes", name, got, rr.Body.Len())
+		}
+	}
+	if cached.Body.String() != pretty.Body.String() {
+		t.Errorf("cached got body %s; want %s", cached.Body, pretty.Body)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decompress returns the body of rr decoded according to its
+// Content-Encoding.
+func decompress(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var (
+		r   io.Reader
+		err error
+	)
+	switch encoding := rr.Header().Get("Content-Encoding"); encoding {
+	case "":
+		return rr.Body.String()
+	case "gzip":
+		r, err = gzip.NewReader(rr.Body)
+	case "deflate":
+		r, err = zlib.NewReader(rr.Body)
+	default:
+		t.Fatalf("unexpected Content-Encoding %q", encoding)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCompress(t *testing.T) {
+	large := `{"movies":[` + strings.Repeat(`{"title":"Moana","year":2016},`, 40) + `{}]}`
+	small := `{"movie":{"title":"Moana"}}`
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		preEncoded     bool
+		body           string
+		wantEncoding   string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", body: large, wantEncoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", body: large, wantEncoding: "deflate"},
+		{name: "gzip preferred", acceptEncoding: "deflate, gzip", body: large, wantEncoding: "gzip"},
+		{name: "gzip refused", acceptEncoding: "gzip;q=0, deflate", body: large, wantEncoding: "deflate"},
+		{name: "nothing accepted", body: large},
+		{name: "unsupported encoding", acceptEncoding: "br", body: large},
+		{name: "below the minimum size", acceptEncoding: "gzip", body: small},
+		{name: "XML", acceptEncoding: "gzip", contentType: mediaTypeXML, body: "<movies>" + strings.Repeat("<movie/>", 200) + "</movies>", wantEncoding: "gzip"},
+		{name: "incompressible type", acceptEncoding: "gzip", contentType: "image/png", body: large},
+		{name: "already encoded", acceptEncoding: "gzip", preEncoded: true, body: large, wantEncoding: "gzip"},
+		{name: "HEAD", method: http.MethodHead, acceptEncoding: "gzip", body: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.compression.enabled = true
+			app.config.compression.level = gzip.BestSpeed
+			app.config.compression.minSize = 256
+
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = mediaTypeJSON
+			}
+			body := tt.body
+			if tt.preEncoded {
+				var buf bytes.Buffer
+				zw := gzip.NewWriter(&buf)
+				zw.Write([]byte(body))
+				zw.Close()
+				body = buf.String()
+			}
+
+			handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("ETag", `"7"`)
+				if tt.preEncoded {
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+				// Write in pieces so that the threshold is crossed part way.
+				for body := body; body != ""; {
+					n := 100
+					if len(body) < n {
+						n = len(body)
+					}
+					w.Write([]byte(body[:n]))
+					body = body[n:]
+				}
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/v1/movies", nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			rr := serve(handler, r)
+
+			if encoding := rr.Header().Get("Content-Encoding"); encoding != tt.wantEncoding {
+				t.Fatalf("got Content-Encoding %q; want %q", encoding, tt.wantEncoding)
+			}
+			if got := rr.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("got Vary %q; want Accept-Encoding", got)
+			}
+			if got := decompress(t, rr); got != tt.body {
+				t.Errorf("round trip changed the body:\n got %q\nwant %q", got, tt.body)
+			}
+
+			// The ETag describes the uncompressed entity, so a response the
+			// middleware compressed only carries it as a weak validator.
+			wantETag := `"7"`
+			if tt.wantEncoding != "" && !tt.preEncoded {
+				wantETag = `W/"7"`
+			}
+			if got := rr.Header().Get("ETag"); got != wantETag {
+				t.Errorf("got ETag %q; want %q", got, wantETag)
+			}
+		})
+	}
+}
+
+func TestCompressDisabled(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = false
+
+	body := bytes.Repeat([]byte("a"), 4096)
+	handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rr := serve(handler, r)
+
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q with compression disabled", got)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), body) {
+		t.Error("the body was changed with compression disabled")
+	}
+}
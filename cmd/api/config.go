@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// validate checks the parsed configuration as a whole and returns every
+// problem found, keyed by flag name (or by environment variable for values
+// that couldn't be parsed), so that a misconfigured deployment fails at
+// startup with a complete report rather than one error at a time.
+func (cfg config) validate() map[string]string {
+	v := validator.New()
+
+	for env, problem := range cfg.envErrors {
+		v.AddError(env, problem)
+	}
+
+	port, err := strconv.Atoi(cfg.port)
+	v.Check(err == nil && port >= 1 && port <= 65535, "port", "must be a number between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+	v.Check(validator.PermittedValue(cfg.logFormat, "json", "text"), "log-format", "must be json or text")
+
+	v.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert", "must be set together with tls-key")
+	if cfg.tls.redirectPort != "" {
+		redirectPort, err := strconv.Atoi(cfg.tls.redirectPort)
+		v.Check(err == nil && redirectPort >= 1 && redirectPort <= 65535, "tls-redirect-port", "must be a number between 1 and 65535")
+		v.Check(cfg.tls.redirectPort != cfg.port, "tls-redirect-port", "must be different from port")
+		v.Check(cfg.tls.certFile != "", "tls-redirect-port", "must only be set when tls-cert is set")
+	}
+	v.Check(cfg.tls.hstsMaxAge >= 0, "hsts-max-age", "must not be negative")
+
+	v.Check((cfg.debug.username == "") == (cfg.debug.password == ""), "debug-username", "must be set together with debug-password")
+	if cfg.env == "production" && (cfg.debug.enabled || cfg.prometheus.enabled) {
+		v.Check(cfg.debug.username != "", "debug-username", "must be set in production unless debug-enabled and prometheus-enabled are false")
+	}
+	v.Check(!cfg.debug.panicTrace || cfg.env == "development", "debug-panic-trace", "must only be enabled in development")
+
+	v.Check(cfg.shutdownTimeout > 0, "shutdown-timeout", "must be greater than zero")
+	v.Check(cfg.drainDelay >= 0, "shutdown-drain-delay", "must not be negative")
+	v.Check(cfg.listCache.size >= 0, "list-cache-size", "must not be negative")
+	if cfg.listCache.size > 0 {
+		v.Check(cfg.listCache.ttl > 0, "list-cache-ttl", "must be greater than zero")
+	}
+	v.Check(cfg.movieLimits.MaxGenres >= 1, "movie-max-genres", "must be at least 1")
+	v.Check(cfg.movieLimits.MaxGenreLength >= 1, "movie-max-genre-length", "must be at least 1")
+	v.Check(cfg.movieHistoryDepth >= 0, "movie-history-depth", "must not be negative")
+	v.Check(validator.PermittedValue(cfg.movieDefaultSort, movieSortSafeList...), "movies-default-sort", "must be one of "+strings.Join(movieSortSafeList, ", "))
+	v.Check(cfg.http.timeout > 0, "http-timeout", "must be greater than zero")
+	v.Check(cfg.http.maxRequestBody > 0, "max-request-body", "must be greater than zero")
+	v.Check(cfg.compression.level >= -1 && cfg.compression.level <= 9, "compression-level", "must be between -1 and 9")
+	v.Check(cfg.compression.minSize >= 0, "compression-min-size", "must not be negative")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.db.maxOpenConns > 0, "db-max-open-conns", "must be greater than zero")
+	v.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	v.Check(cfg.db.maxIdleConns <= cfg.db.maxOpenConns, "db-max-idle-conns", "must not be greater than db-max-open-conns")
+	v.Check(cfg.db.maxIdleTime > 0, "db-max-idle-time", "must be greater than zero")
+	v.Check(cfg.db.queryTimeout > 0, "db-query-timeout", "must be greater than zero")
+	v.Check(cfg.db.bulkTimeout > 0, "db-bulk-timeout", "must be greater than zero")
+	v.Check(cfg.db.slowQuery >= 0, "db-slow-query-threshold", "must not be negative")
+	v.Check(cfg.db.attempts >= 1, "db-connect-attempts", "must be at least 1")
+	v.Check(cfg.db.backoff >= 0, "db-connect-backoff", "must not be negative")
+
+	v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+	v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than zero")
+	v.Check(cfg.limiter.authRPS > 0, "limiter-auth-rps", "must be greater than zero")
+	v.Check(cfg.limiter.authBurst > 0, "limiter-auth-burst", "must be greater than zero")
+	v.Check(validator.PermittedValue(cfg.limiter.key, "ip", "user"), "limiter-key", "must be ip or user")
+	v.Check(validator.PermittedValue(cfg.limiter.store, "memory", "redis"), "limiter-store", "must be memory or redis")
+	if cfg.limiter.store == "redis" {
+		v.Check(cfg.redis.url != "", "redis-url", "must be provided when limiter-store is redis")
+	}
+
+	v.Check(cfg.smtp.workers > 0, "smtp-workers", "must be greater than zero")
+	v.Check(cfg.smtp.queueSize > 0, "smtp-queue-size", "must be greater than zero")
+	v.Check(cfg.smtp.maxAttempts > 0, "smtp-max-attempts", "must be greater than zero")
+	if cfg.smtp.host != "" {
+		v.Check(cfg.smtp.port >= 1 && cfg.smtp.port <= 65535, "smtp-port", "must be a number between 1 and 65535")
+		v.Check(cfg.smtp.sender != "", "smtp-sender", "must be provided when smtp-host is set")
+		v.Check((cfg.smtp.username == "") == (cfg.smtp.password == ""), "smtp-username", "must be set together with smtp-password")
+	}
+
+	v.Check(cfg.healthcheck.dbTimeout > 0, "healthcheck-db-timeout", "must be greater than zero")
+	v.Check(cfg.lockout.maxAttempts >= 0, "lockout-max-attempts", "must not be negative")
+	if cfg.lockout.maxAttempts > 0 {
+		v.Check(cfg.lockout.duration > 0, "lockout-duration", "must be greater than zero")
+	}
+
+	v.Check(cfg.idempotency.ttl > 0, "idempotency-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.purgeInterval >= 0, "token-purge-interval", "must not be negative")
+	v.Check(cfg.tokens.activationTTL > 0, "activation-token-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.authenticationTTL > 0, "authentication-token-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.refreshTTL > 0, "refresh-token-ttl", "must be greater than zero")
+	v.Check(cfg.tokens.passwordResetTTL > 0, "password-reset-token-ttl", "must be greater than zero")
+
+	v.Check(validator.PermittedValue(cfg.auth.mode, authModeStateful, authModeJWT), "auth-mode", "must be stateful or jwt")
+	// Unlike the cursor secret, a random JWT secret would log everyone out on
+	// every restart and break multi-instance deployments, so insist on one.
+	if cfg.auth.mode == authModeJWT {
+		v.Check(len(cfg.auth.jwtSecret) >= 32, "jwt-secret", "must be at least 32 bytes long in jwt auth mode")
+	}
+	v.Check(cfg.auth.jwtUserCache >= 0, "jwt-user-cache-ttl", "must not be negative")
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(validOrigin(origin), "cors-trusted-origins", fmt.Sprintf("%q is not a valid origin", origin))
+	}
+	for _, method := range cfg.cors.allowedMethods {
+		v.Check(method == strings.ToUpper(method), "cors-allowed-methods", fmt.Sprintf("%q must be upper case", method))
+	}
+	v.Check(cfg.cors.maxAge >= 0, "cors-max-age", "must not be negative")
+	v.Check(!cfg.cors.allowCredentials || !validator.PermittedValue("*", cfg.cors.trustedOrigins...), "cors-allow-credentials", "must not be set when every origin (*) is trusted")
+
+	for _, endpoint := range cfg.webhooks.urls {
+		u, err := url.Parse(endpoint)
+		v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "webhook-urls", fmt.Sprintf("%q is not a valid http or https URL", endpoint))
+	}
+	if len(cfg.webhooks.urls) > 0 {
+		v.Check(cfg.webhooks.secret != "", "webhook-secret", "must be provided when webhook-urls is set")
+		v.Check(cfg.webhooks.maxAttempts > 0, "webhook-max-attempts", "must be greater than zero")
+	}
+
+	return v.Errors
+}
+
+// splitList splits a comma or space separated list, dropping empty entries.
+func splitList(val string) []string {
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// splitOrigins splits a comma or space separated list of origins, dropping
+// empty entries and any trailing slash.
+func splitOrigins(val string) []string {
+	fields := splitList(val)
+
+	origins := make([]string, 0, len(fields))
+	for _, field := range fields {
+		origins = append(origins, strings.TrimSuffix(field, "/"))
+	}
+	return origins
+}
+
+// parseTrustedOrigins parses a comma or space separated list of CORS origins,
+// rejecting any that isn't an origin.
+func parseTrustedOrigins(val string) ([]string, error) {
+	origins := splitOrigins(val)
+	for _, origin := range origins {
+		if !validOrigin(origin) {
+			return nil, fmt.Errorf("%q is not a valid origin", origin)
+		}
+	}
+	return origins, nil
+}
+
+// trustedOriginsFromEnv is used when -cors-trusted-origins isn't given. It
+// reads CORS_TRUSTED_ORIGINS, or CORS_TRUSTED_ORIGIN, the name this setting
+// was originally read from, and defaults to "*". A malformed origin is
+// reported like any other unparsable variable, and "*" is used meanwhile.
+func (fs configFlags) trustedOriginsFromEnv() []string {
+	for _, env := range []string{"CORS_TRUSTED_ORIGINS", "CORS_TRUSTED_ORIGIN"} {
+		val := os.Getenv(env)
+		if val == "" {
+			continue
+		}
+
+		origins, err := parseTrustedOrigins(val)
+		if err != nil {
+			fs.envErrors[env] = err.Error()
+			break
+		}
+		return origins
+	}
+	return []string{"*"}
+}
+
+// validOrigin accepts "*" or a bare scheme://host[:port] origin, which is the
+// only form a browser ever sends in the Origin header.
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") &&
+		u.Host != "" &&
+		u.User == nil &&
+		u.Path == "" &&
+		u.RawQuery == "" &&
+		u.Fragment == ""
+}
+
+// configFlags defines the command-line flags whose defaults are read from
+// environment variables, and remembers which variables each flag reads so
+// that loadConfigFile can tell a value set in the environment from a default.
+// Variables that can't be parsed are collected in envErrors, keyed by name,
+// and the flag keeps its default.
+type configFlags struct {
+	*flag.FlagSet
+	envs      map[string][]string
+	envErrors map[string]string
+}
+
+func newConfigFlags(fs *flag.FlagSet) configFlags {
+	return configFlags{FlagSet: fs, envs: make(map[string][]string), envErrors: make(map[string]string)}
+}
+
+// checkEnv records err, if any, as the problem with env.
+func (fs configFlags) checkEnv(env string, err error) {
+	if err != nil {
+		fs.envErrors[env] = err.Error()
+	}
+}
+
+func (fs configFlags) stringVar(p *string, name, env, value, usage string) {
+	fs.envs[name] = []string{env}
+	fs.StringVar(p, name, getEnv(env, value), usage)
+}
+
+func (fs configFlags) intVar(p *int, name, env string, value int, usage string) {
+	fs.envs[name] = []string{env}
+	n, err := getIntEnv(env, value)
+	fs.checkEnv(env, err)
+	fs.IntVar(p, name, n, usage)
+}
+
+func (fs configFlags) int64Var(p *int64, name, env string, value int64, usage string) {
+	fs.envs[name] = []string{env}
+	n, err := getIntEnv(env, int(value))
+	fs.checkEnv(env, err)
+	fs.Int64Var(p, name, int64(n), usage)
+}
+
+func (fs configFlags) float64Var(p *float64, name, env string, value float64, usage string) {
+	fs.envs[name] = []string{env}
+	n, err := getFloatEnv(env, value)
+	fs.checkEnv(env, err)
+	fs.Float64Var(p, name, n, usage)
+}
+
+func (fs configFlags) boolVar(p *bool, name, env string, value bool, usage string) {
+	fs.envs[name] = []string{env}
+	b, err := getBoolEnv(env, value)
+	fs.checkEnv(env, err)
+	fs.BoolVar(p, name, b, usage)
+}
+
+func (fs configFlags) durationVar(p *time.Duration, name, env string, value time.Duration, usage string) {
+	fs.envs[name] = []string{env}
+	d, err := getDurationEnv(env, value)
+	fs.checkEnv(env, err)
+	fs.DurationVar(p, name, d, usage)
+}
+
+// funcVar defines a flag parsed by fn. Its value isn't read from envs here:
+// the caller falls back to them after parsing when the flag wasn't set.
+func (fs configFlags) funcVar(name, usage string, fn func(string) error, envs ...string) {
+	fs.envs[name] = envs
+	fs.Func(name, usage, fn)
+}
+
+// fromEnv reports whether any environment variable the flag reads is set.
+func (fs configFlags) fromEnv(name string) bool {
+	for _, env := range fs.envs[name] {
+		if os.Getenv(env) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfigFile reads a JSON config file and applies it to the flag set. Keys
+// are flag names, and nested objects are joined with dashes, so
+// {"limiter": {"rps": 5}} sets -limiter-rps. A value from the file is only
+// used when the flag wasn't given on the command line and none of the
+// environment variables it reads are set, giving the precedence
+// flag > env > file > default. Keys that don't match any flag are returned so
+// they can be reported.
+func loadConfigFile(fs configFlags, path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+
+	var tree map[string]any
+	err = dec.Decode(&tree)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flattenConfig("", tree, values)
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var unknown []string
+	for name, value := range values {
+		if fs.Lookup(name) == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		if set[name] || fs.fromEnv(name) {
+			continue
+		}
+
+		err = fs.Set(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: invalid value for %s: %w", path, name, err)
+		}
+	}
+
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// warnUnknownConfigKeys logs a warning for each config file key that
+// loadConfigFile ignored, which is usually a misspelt flag name.
+func warnUnknownConfigKeys(logger *jsonlog.Logger, keys []string) {
+	for _, key := range keys {
+		logger.PrintWarning("ignoring unknown config file key", map[string]string{"key": key})
+	}
+}
+
+func flattenConfig(prefix string, value any, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			name := key
+			if prefix != "" {
+				name = prefix + "-" + key
+			}
+			flattenConfig(name, child, values)
+		}
+
+	case []any:
+		items := make([]string, len(v))
+		for i := range v {
+			items[i] = fmt.Sprint(v[i])
+		}
+		values[prefix] = strings.Join(items, ",")
+
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+// parseCIDRs parses a comma or space separated list of CIDR blocks. Bare
+// addresses are accepted and treated as a single-host network.
+func parseCIDRs(val string) ([]*net.IPNet, error) {
+	fields := strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+
+	networks := make([]*net.IPNet, 0, len(fields))
+	for _, field := range fields {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a valid IP address or CIDR block", field)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid IP address or CIDR block", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+)
+
+func TestEnvParseErrorsAreValidated(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		define func(fs configFlags, env string)
+		want   string
+	}{
+		{"int", "abc", func(fs configFlags, env string) { fs.intVar(new(int), "setting", env, 25, "") }, `must be an integer, got "abc"`},
+		{"int64", "1e6", func(fs configFlags, env string) { fs.int64Var(new(int64), "setting", env, 25, "") }, `must be an integer, got "1e6"`},
+		{"float", "1,5", func(fs configFlags, env string) { fs.float64Var(new(float64), "setting", env, 2.5, "") }, `must be a number, got "1,5"`},
+		{"bool", "yes please", func(fs configFlags, env string) { fs.boolVar(new(bool), "setting", env, true, "") }, `must be true or false, got "yes please"`},
+		{"duration", "5", func(fs configFlags, env string) { fs.durationVar(new(time.Duration), "setting", env, time.Second, "") }, `must be a duration such as 5s or 1m, got "5"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const env = "GREENLIGHT_TEST_SETTING"
+			t.Setenv(env, tt.value)
+
+			fs := newConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+			tt.define(fs, env)
+
+			problems := config{envErrors: fs.envErrors}.validate()
+			if problems[env] != tt.want {
+				t.Errorf("got %q for %s=%q; want %q", problems[env], env, tt.value, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvParsedValues(t *testing.T) {
+	const env = "GREENLIGHT_TEST_SETTING"
+
+	t.Setenv(env, "12")
+	if got, err := getIntEnv(env, 25); got != 12 || err != nil {
+		t.Errorf("getIntEnv = %d, %v; want 12, nil", got, err)
+	}
+	t.Setenv(env, "90s")
+	if got, err := getDurationEnv(env, time.Second); got != 90*time.Second || err != nil {
+		t.Errorf("getDurationEnv = %s, %v; want 1m30s, nil", got, err)
+	}
+	t.Setenv(env, "")
+	if got, err := getBoolEnv(env, true); !got || err != nil {
+		t.Errorf("getBoolEnv of an unset variable = %t, %v; want the default", got, err)
+	}
+
+	t.Setenv(env, "abc")
+	if got, err := getIntEnv(env, 25); got != 25 || err == nil {
+		t.Errorf("getIntEnv of a malformed value = %d, %v; want the default and an error", got, err)
+	}
+}
+
+func TestEnvErrorsArePerFlagSet(t *testing.T) {
+	const env = "GREENLIGHT_TEST_SETTING"
+	t.Setenv(env, "abc")
+
+	first := newConfigFlags(flag.NewFlagSet("first", flag.ContinueOnError))
+	var n int
+	first.intVar(&n, "setting", env, 25, "")
+	if n != 25 {
+		t.Errorf("got %d for a malformed value; want the default 25", n)
+	}
+
+	t.Setenv(env, "12")
+	second := newConfigFlags(flag.NewFlagSet("second", flag.ContinueOnError))
+	second.intVar(&n, "setting", env, 25, "")
+	if n != 12 {
+		t.Errorf("got %d; want 12", n)
+	}
+
+	if _, ok := first.envErrors[env]; !ok {
+		t.Errorf("first flag set didn't record %s", env)
+	}
+	if problem, ok := (config{envErrors: second.envErrors}).validate()[env]; ok {
+		t.Errorf("second flag set reported %q from the first", problem)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	const file = `{
+		"port": 5000,
+		"env": "staging",
+		"limiter": {"rps": 5, "enabled": false},
+		"cors": {"trusted": {"origins": ["https://a.example", "https://b.example"]}},
+		"smtp": {"hostname": "smtp.example"},
+		"portt": 6000
+	}`
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		want        map[string]string
+		wantUnknown []string
+	}{
+		{
+			name: "file over default",
+			want: map[string]string{"port": "5000", "env": "staging", "limiter-rps": "5", "limiter-enabled": "false", "cors-trusted-origins": "https://a.example,https://b.example"},
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"GREENLIGHT_TEST_PORT": "6000", "GREENLIGHT_TEST_LIMITER_RPS": "9"},
+			want: map[string]string{"port": "6000", "env": "staging", "limiter-rps": "9"},
+		},
+		{
+			name: "flag over env and file",
+			args: []string{"-port=7000", "-limiter-enabled"},
+			env:  map[string]string{"GREENLIGHT_TEST_PORT": "6000"},
+			want: map[string]string{"port": "7000", "limiter-enabled": "true"},
+		},
+		{
+			name: "any env a flag reads",
+			env:  map[string]string{"GREENLIGHT_TEST_OLD_ORIGIN": "https://c.example"},
+			want: map[string]string{"cors-trusted-origins": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+
+			var (
+				port           int
+				env            string
+				rps            float64
+				enabled        bool
+				trustedOrigins string
+			)
+			fs := newConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+			fs.intVar(&port, "port", "GREENLIGHT_TEST_PORT", 4000, "")
+			fs.stringVar(&env, "env", "GREENLIGHT_TEST_ENV", "development", "")
+			fs.float64Var(&rps, "limiter-rps", "GREENLIGHT_TEST_LIMITER_RPS", 2, "")
+			fs.boolVar(&enabled, "limiter-enabled", "GREENLIGHT_TEST_LIMITER_ENABLED", true, "")
+			fs.funcVar("cors-trusted-origins", "", func(val string) error {
+				trustedOrigins = val
+				return nil
+			}, "GREENLIGHT_TEST_ORIGINS", "GREENLIGHT_TEST_OLD_ORIGIN")
+
+			err := fs.Parse(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			err = os.WriteFile(path, []byte(file), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unknown, err := loadConfigFile(fs, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The file's unknown keys are reported whatever else applies.
+			if want := []string{"portt", "smtp-hostname"}; !reflect.DeepEqual(unknown, want) {
+				t.Errorf("got unknown keys %q; want %q", unknown, want)
+			}
+
+			var logged bytes.Buffer
+			warnUnknownConfigKeys(jsonlog.New(&logged, jsonlog.LevelInfo, jsonlog.JSONFormatter), unknown)
+			var warned []string
+			for _, entry := range logEntries(t, &logged) {
+				if entry.Level != jsonlog.LevelWarning.String() {
+					t.Errorf("logged %q at level %s; want %s", entry.Message, entry.Level, jsonlog.LevelWarning)
+				}
+				warned = append(warned, entry.Properties["key"])
+			}
+			if !reflect.DeepEqual(warned, unknown) {
+				t.Errorf("warned about keys %q; want %q", warned, unknown)
+			}
+
+			got := map[string]string{
+				"port":                 fmt.Sprint(port),
+				"env":                  env,
+				"limiter-rps":          fmt.Sprint(rps),
+				"limiter-enabled":      fmt.Sprint(enabled),
+				"cors-trusted-origins": trustedOrigins,
+			}
+			for name, want := range tt.want {
+				if got[name] != want {
+					t.Errorf("%s = %q; want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{"malformed", `{"port": `, "unexpected EOF"},
+		{"not an object", `[1, 2]`, "cannot unmarshal array"},
+		{"invalid value", `{"port": "many"}`, "invalid value for port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var port int
+			fs := newConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+			fs.intVar(&port, "port", "GREENLIGHT_TEST_PORT", 4000, "")
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			err := os.WriteFile(path, []byte(tt.contents), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadConfigFile(fs, path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v; want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	var cfg config
+	cfg.db.maxOpenConns = 3
+	cfg.db.maxIdleConns = 1
+	cfg.db.maxIdleTime = time.Minute
+
+	db := sql.OpenDB(stubConnector{})
+	defer db.Close()
+	configurePool(db, cfg)
+
+	if got := db.Stats().MaxOpenConnections; got != cfg.db.maxOpenConns {
+		t.Errorf("got %d max open connections; want %d", got, cfg.db.maxOpenConns)
+	}
+
+	ctx := context.Background()
+	conns := make([]*sql.Conn, cfg.db.maxOpenConns)
+	for i := range conns {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	stats := db.Stats()
+	if stats.Idle != cfg.db.maxIdleConns {
+		t.Errorf("got %d idle connections; want %d", stats.Idle, cfg.db.maxIdleConns)
+	}
+	if stats.MaxIdleClosed != int64(cfg.db.maxOpenConns-cfg.db.maxIdleConns) {
+		t.Errorf("closed %d connections over the idle limit; want %d", stats.MaxIdleClosed, cfg.db.maxOpenConns-cfg.db.maxIdleConns)
+	}
+}
+
+func TestOpenDBLogsSlowQueries(t *testing.T) {
+	dsn := os.Getenv(datatest.DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", datatest.DSNEnv)
+	}
+
+	cfg := validConfig()
+	cfg.db.slowQuery = 50 * time.Millisecond
+
+	var logs bytes.Buffer
+	logger := jsonlog.New(&logs, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+	db, err := openDB(cfg, dsn, "replica", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("SELECT pg_sleep(0.1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var slow []jsonlog.Entry
+	for _, entry := range logEntries(t, &logs) {
+		if entry.Message == "slow query" {
+			slow = append(slow, entry)
+		}
+	}
+	if len(slow) != 1 {
+		t.Fatalf("logged %v; want one slow query", slow)
+	}
+
+	properties := slow[0].Properties
+	if properties["pool"] != "replica" || properties["statement"] != "SELECT pg_sleep(0.1)" {
+		t.Errorf("logged pool %q and statement %q", properties["pool"], properties["statement"])
+	}
+	elapsed, err := time.ParseDuration(properties["elapsed"])
+	if err != nil || elapsed < 100*time.Millisecond {
+		t.Errorf("logged elapsed %q; want at least 100ms", properties["elapsed"])
+	}
+}
+
+func TestRetryConnect(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		attempts int
+		failures int
+		calls    int
+		waits    []time.Duration
+		wantErr  string
+	}{
+		{name: "reachable", attempts: 5, calls: 1},
+		{name: "reachable on the third attempt", attempts: 5, failures: 2, calls: 3, waits: []time.Duration{time.Millisecond, 2 * time.Millisecond}},
+		{name: "never reachable", attempts: 3, failures: 3, calls: 3, waits: []time.Duration{time.Millisecond, 2 * time.Millisecond}, wantErr: "giving up after 3 attempts: connection refused"},
+		{name: "a single attempt", attempts: 1, failures: 1, calls: 1, wantErr: "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			var waits []time.Duration
+
+			err := retryConnect(tt.attempts, time.Millisecond, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errDown
+				}
+				return nil
+			}, func(attempt int, wait time.Duration, err error) {
+				if attempt != len(waits)+1 || !errors.Is(err, errDown) {
+					t.Errorf("retry %d was told attempt %d and err %v", len(waits)+1, attempt, err)
+				}
+				waits = append(waits, wait)
+			})
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got err %v; want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr || !errors.Is(err, errDown)) {
+				t.Fatalf("got err %v; want %q", err, tt.wantErr)
+			}
+			if calls != tt.calls {
+				t.Errorf("connected %d times; want %d", calls, tt.calls)
+			}
+			if fmt.Sprint(waits) != fmt.Sprint(tt.waits) {
+				t.Errorf("waited %v; want %v", waits, tt.waits)
+			}
+		})
+	}
+}
+
+// flakyConnector refuses the first failures connections and then opens
+// connections that do nothing.
+type flakyConnector struct {
+	failures int
+	attempts int
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) {
+	c.attempts++
+	if c.attempts <= c.failures {
+		return nil, errors.New("connection refused")
+	}
+	return idleConn{}, nil
+}
+
+func (c *flakyConnector) Driver() driver.Driver {
+	return nil
+}
+
+type idleConn struct{}
+
+func (idleConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (idleConn) Close() error                        { return nil }
+func (idleConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestOpenConnectorRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		wantErr  bool
+		retries  int
+	}{
+		{name: "reachable", retries: 0},
+		{name: "reachable after a wait", failures: 2, retries: 2},
+		{name: "unreachable", failures: 3, wantErr: true, retries: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.db.attempts = 3
+			cfg.db.backoff = time.Millisecond
+
+			var logs bytes.Buffer
+			logger := jsonlog.New(&logs, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+			connector := &flakyConnector{failures: tt.failures}
+
+			db, err := openConnector(cfg, connector, "primary", logger)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts") {
+					t.Fatalf("got err %v; want to give up", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.Close()
+			}
+			if want := tt.retries + 1; connector.attempts != want {
+				t.Errorf("connected %d times; want %d", connector.attempts, want)
+			}
+
+			// Each retry is logged with the attempt it follows and the wait.
+			var retries []jsonlog.Entry
+			for _, entry := range logEntries(t, &logs) {
+				if entry.Message == "database unreachable, retrying" {
+					retries = append(retries, entry)
+				}
+			}
+			if len(retries) != tt.retries {
+				t.Fatalf("logged %d retries; want %d", len(retries), tt.retries)
+			}
+			for i, entry := range retries {
+				properties := entry.Properties
+				wait := (time.Millisecond << i).String()
+				if entry.Level != "INFO" || properties["pool"] != "primary" || properties["error"] != "connection refused" ||
+					properties["attempt"] != strconv.Itoa(i+1) || properties["attempts"] != "3" || properties["retry_in"] != wait {
+					t.Errorf("retry %d logged %s %v", i+1, entry.Level, properties)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCORSCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		trusted     []string
+		credentials bool
+		rejected    bool
+	}{
+		{name: "listed origins with credentials", trusted: []string{"https://app.example.com"}, credentials: true},
+		{name: "wildcard without credentials", trusted: []string{"*"}},
+		{name: "wildcard with credentials", trusted: []string{"*"}, credentials: true, rejected: true},
+		{name: "wildcard among others with credentials", trusted: []string{"https://app.example.com", "*"}, credentials: true, rejected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.cors.trustedOrigins = tt.trusted
+			cfg.cors.allowCredentials = tt.credentials
+
+			_, rejected := cfg.validate()["cors-allow-credentials"]
+			if rejected != tt.rejected {
+				t.Errorf("rejected %t; want %t", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+// validConfig returns a configuration that passes validate, close to the
+// flag defaults.
+func validConfig() config {
+	var cfg config
+	cfg.port = "4000"
+	cfg.env = "development"
+	cfg.logFormat = "json"
+	cfg.shutdownTimeout = 30 * time.Second
+	cfg.movieLimits = data.DefaultMovieLimits
+	cfg.movieDefaultSort = "id"
+	cfg.http.timeout = 30 * time.Second
+	cfg.http.maxRequestBody = 1 << 20
+	cfg.db.dsn = "postgres://greenlight@localhost/greenlight"
+	cfg.db.maxOpenConns = 25
+	cfg.db.maxIdleConns = 25
+	cfg.db.maxIdleTime = 15 * time.Minute
+	cfg.db.queryTimeout = 3 * time.Second
+	cfg.db.bulkTimeout = 30 * time.Second
+	cfg.db.attempts = 1
+	cfg.limiter.rps = 2
+	cfg.limiter.burst = 4
+	cfg.limiter.authRPS = 0.1
+	cfg.limiter.authBurst = 5
+	cfg.limiter.key = "ip"
+	cfg.limiter.store = "memory"
+	cfg.smtp.workers = 1
+	cfg.smtp.queueSize = 100
+	cfg.smtp.maxAttempts = 3
+	cfg.healthcheck.dbTimeout = time.Second
+	cfg.idempotency.ttl = 24 * time.Hour
+	cfg.tokens.activationTTL = 72 * time.Hour
+	cfg.tokens.authenticationTTL = 24 * time.Hour
+	cfg.tokens.refreshTTL = 30 * 24 * time.Hour
+	cfg.tokens.passwordResetTTL = 45 * time.Minute
+	cfg.auth.mode = authModeStateful
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	if problems := validConfig().validate(); len(problems) != 0 {
+		t.Fatalf("valid config reported %v", problems)
+	}
+
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		key    string
+	}{
+		{name: "non-numeric port", change: func(cfg *config) { cfg.port = "http" }, key: "port"},
+		{name: "port zero", change: func(cfg *config) { cfg.port = "0" }, key: "port"},
+		{name: "port out of range", change: func(cfg *config) { cfg.port = "65536" }, key: "port"},
+		{name: "unknown env", change: func(cfg *config) { cfg.env = "qa" }, key: "env"},
+		{name: "unknown log format", change: func(cfg *config) { cfg.logFormat = "logfmt" }, key: "log-format"},
+		{name: "zero limiter rps", change: func(cfg *config) { cfg.limiter.rps = 0 }, key: "limiter-rps"},
+		{name: "negative limiter burst", change: func(cfg *config) { cfg.limiter.burst = -1 }, key: "limiter-burst"},
+		{name: "zero auth limiter rps", change: func(cfg *config) { cfg.limiter.authRPS = 0 }, key: "limiter-auth-rps"},
+		{name: "zero auth limiter burst", change: func(cfg *config) { cfg.limiter.authBurst = 0 }, key: "limiter-auth-burst"},
+		{name: "unknown limiter key", change: func(cfg *config) { cfg.limiter.key = "token" }, key: "limiter-key"},
+		{name: "redirect port without TLS", change: func(cfg *config) { cfg.tls.redirectPort = "80" }, key: "tls-redirect-port"},
+		{name: "redirect port same as port", change: func(cfg *config) {
+			cfg.tls.certFile, cfg.tls.keyFile = "cert.pem", "key.pem"
+			cfg.tls.redirectPort = cfg.port
+		}, key: "tls-redirect-port"},
+		{name: "redirect port out of range", change: func(cfg *config) {
+			cfg.tls.certFile, cfg.tls.keyFile = "cert.pem", "key.pem"
+			cfg.tls.redirectPort = "70000"
+		}, key: "tls-redirect-port"},
+		{name: "negative hsts max-age", change: func(cfg *config) { cfg.tls.hstsMaxAge = -time.Second }, key: "hsts-max-age"},
+		{name: "zero activation token ttl", change: func(cfg *config) { cfg.tokens.activationTTL = 0 }, key: "activation-token-ttl"},
+		{name: "negative authentication token ttl", change: func(cfg *config) { cfg.tokens.authenticationTTL = -time.Hour }, key: "authentication-token-ttl"},
+		{name: "zero refresh token ttl", change: func(cfg *config) { cfg.tokens.refreshTTL = 0 }, key: "refresh-token-ttl"},
+		{name: "negative password reset token ttl", change: func(cfg *config) { cfg.tokens.passwordResetTTL = -time.Minute }, key: "password-reset-token-ttl"},
+		{name: "unknown default sort", change: func(cfg *config) { cfg.movieDefaultSort = "rating" }, key: "movies-default-sort"},
+		{name: "relevance as the default sort", change: func(cfg *config) { cfg.movieDefaultSort = "-relevance" }, key: "movies-default-sort"},
+		{name: "empty default sort", change: func(cfg *config) { cfg.movieDefaultSort = "" }, key: "movies-default-sort"},
+		{name: "debug username without a password", change: func(cfg *config) { cfg.debug.username = "ops" }, key: "debug-username"},
+		{name: "debug password without a username", change: func(cfg *config) { cfg.debug.password = "s3cret" }, key: "debug-username"},
+		{name: "expvar in production without credentials", change: func(cfg *config) {
+			cfg.env = "production"
+			cfg.debug.enabled = true
+		}, key: "debug-username"},
+		{name: "prometheus in production without credentials", change: func(cfg *config) {
+			cfg.env = "production"
+			cfg.prometheus.enabled = true
+		}, key: "debug-username"},
+		{name: "zero db connect attempts", change: func(cfg *config) { cfg.db.attempts = 0 }, key: "db-connect-attempts"},
+		{name: "negative db connect backoff", change: func(cfg *config) { cfg.db.backoff = -time.Second }, key: "db-connect-backoff"},
+		{name: "smtp host without a sender", change: func(cfg *config) {
+			cfg.smtp.host = "smtp.example.com"
+			cfg.smtp.port = 587
+		}, key: "smtp-sender"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(&cfg)
+
+			problems := cfg.validate()
+			if _, ok := problems[tt.key]; !ok || len(problems) != 1 {
+				t.Errorf("got problems %v; want only %s", problems, tt.key)
+			}
+		})
+	}
+}
+
+func TestValidateDebugInProduction(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+	}{
+		{name: "both disabled", change: func(cfg *config) {}},
+		{name: "credentials set", change: func(cfg *config) {
+			cfg.debug.enabled = true
+			cfg.prometheus.enabled = true
+			cfg.debug.username = "ops"
+			cfg.debug.password = "s3cret"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			cfg.env = "production"
+			tt.change(&cfg)
+
+			if problems := cfg.validate(); len(problems) != 0 {
+				t.Errorf("got problems %v; want none", problems)
+			}
+		})
+	}
+}
+
+func TestTrustedOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    []string
+		wantErr string
+	}{
+		{name: "default", want: []string{"*"}},
+		{
+			name: "command line",
+			args: []string{"-cors-trusted-origins", "https://a.example, https://b.example:8443/ http://localhost:3000"},
+			env:  map[string]string{"CORS_TRUSTED_ORIGINS": "https://env.example"},
+			want: []string{"https://a.example", "https://b.example:8443", "http://localhost:3000"},
+		},
+		{
+			name:    "malformed on the command line",
+			args:    []string{"-cors-trusted-origins", "https://a.example/path"},
+			wantErr: `"https://a.example/path" is not a valid origin`,
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"CORS_TRUSTED_ORIGINS": "https://a.example,https://b.example"},
+			want: []string{"https://a.example", "https://b.example"},
+		},
+		{
+			name: "original environment name",
+			env:  map[string]string{"CORS_TRUSTED_ORIGIN": "https://a.example"},
+			want: []string{"https://a.example"},
+		},
+		{
+			name: "current environment name first",
+			env:  map[string]string{"CORS_TRUSTED_ORIGINS": "https://a.example", "CORS_TRUSTED_ORIGIN": "https://b.example"},
+			want: []string{"https://a.example"},
+		},
+		{
+			name:    "malformed in the environment",
+			env:     map[string]string{"CORS_TRUSTED_ORIGINS": "a.example"},
+			want:    []string{"*"},
+			wantErr: `"a.example" is not a valid origin`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, env := range []string{"CORS_TRUSTED_ORIGINS", "CORS_TRUSTED_ORIGIN"} {
+				t.Setenv(env, tt.env[env])
+			}
+
+			var origins []string
+			fs := newConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+			fs.SetOutput(io.Discard)
+			fs.funcVar("cors-trusted-origins", "", func(val string) error {
+				var err error
+				origins, err = parseTrustedOrigins(val)
+				return err
+			}, "CORS_TRUSTED_ORIGINS", "CORS_TRUSTED_ORIGIN")
+
+			err := fs.Parse(tt.args)
+			if len(tt.args) > 0 && tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if origins == nil {
+				origins = fs.trustedOriginsFromEnv()
+			}
+			if !reflect.DeepEqual(origins, tt.want) {
+				t.Errorf("got origins %q; want %q", origins, tt.want)
+			}
+
+			problem := config{envErrors: fs.envErrors}.validate()["CORS_TRUSTED_ORIGINS"]
+			if problem != tt.wantErr {
+				t.Errorf("got problem %q; want %q", problem, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/Soul-Remix/greenlight/internal/data"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey      = contextKey("user")
+	requestIDContextKey = contextKey("request_id")
+	routeContextKey     = contextKey("route")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -23,3 +28,36 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// routePattern is placed in the context by the metrics middleware and filled
+// in once the router has matched a route. It is atomic because the timeout
+// middleware runs handlers on a separate goroutine.
+type routePattern struct {
+	pattern atomic.Pointer[string]
+}
+
+func (app *application) contextSetRoutePattern(r *http.Request, route *routePattern) *http.Request {
+	ctx := context.WithValue(r.Context(), routeContextKey, route)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetRoutePattern(r *http.Request) string {
+	route, ok := r.Context().Value(routeContextKey).(*routePattern)
+	if !ok {
+		return ""
+	}
+	if pattern := route.pattern.Load(); pattern != nil {
+		return *pattern
+	}
+	return ""
+}
@@ -1,78 +1,273 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// Error codes are sent in the "code" member of every error response. Unlike
+// the messages, they are stable, so clients can branch on them.
+const (
+	codeServerError                = "SERVER_ERROR"
+	codeNotFound                   = "NOT_FOUND"
+	codeMethodNotAllowed           = "METHOD_NOT_ALLOWED"
+	codeNotAcceptable              = "NOT_ACCEPTABLE"
+	codeUnsupportedMediaType       = "UNSUPPORTED_MEDIA_TYPE"
+	codeNotSupported               = "NOT_SUPPORTED"
+	codeEditConflict               = "EDIT_CONFLICT"
+	codeVersionConflict            = "VERSION_CONFLICT"
+	codeHasDependents              = "HAS_DEPENDENTS"
+	codeIdempotencyKeyInProgress   = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	codeIdempotencyKeyMismatch     = "IDEMPOTENCY_KEY_MISMATCH"
+	codeDuplicateTitle             = "DUPLICATE_TITLE"
+	codePreconditionFailed         = "PRECONDITION_FAILED"
+	codeRateLimited                = "RATE_LIMITED"
+	codeAccountLocked              = "ACCOUNT_LOCKED"
+	codeRequestTimeout             = "REQUEST_TIMEOUT"
+	codeRequestTooLarge            = "REQUEST_TOO_LARGE"
+	codeBadRequest                 = "BAD_REQUEST"
+	codeValidationFailed           = "VALIDATION_FAILED"
+	codeInvalidCredentials         = "INVALID_CREDENTIALS"
+	codeInvalidAuthenticationToken = "INVALID_AUTHENTICATION_TOKEN"
+	codeAuthenticationRequired     = "AUTHENTICATION_REQUIRED"
+	codeInactiveAccount            = "INACTIVE_ACCOUNT"
+	codeNotPermitted               = "NOT_PERMITTED"
+	codeForbiddenAddress           = "FORBIDDEN_ADDRESS"
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message any) {
+	env := envelope{"code": code, "error": message}
 
-	app.writeJSON(w, r, status, env, nil)
+	app.writeResponse(w, r, status, env, nil)
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, codeServerError, message)
+}
+
+// panicResponse logs a recovered panic with the stack it happened on and sends
+// the same response as any other server error. With debug-panic-trace set,
+// which is only allowed in development, the response also lists the frames
+// that led to the panic.
+func (app *application) panicResponse(w http.ResponseWriter, r *http.Request, err error, stack []byte) {
+	app.logger.PrintErrorTrace(err, stack, map[string]string{
+		"request_id":     app.contextGetRequestID(r),
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+	})
+
+	message := "the server encountered a problem and could not process your request"
+	env := envelope{"code": codeServerError, "error": message}
+	if app.config.debug.panicTrace {
+		env["panic"] = err.Error()
+		env["trace"] = panicFrames(stack)
+	}
+
+	app.writeResponse(w, r, http.StatusInternalServerError, env, nil)
+}
+
+// panicFrames reduces a stack from debug.Stack to the frames below the panic,
+// each as its function and a file path shortened to its last two elements,
+// leaving out arguments, program counters and the Go runtime.
+func panicFrames(stack []byte) []string {
+	lines := strings.Split(strings.TrimSpace(string(stack)), "\n")
+
+	frames := []string{}
+	for i := 1; i+1 < len(lines); i += 2 {
+		function := lines[i]
+		if open := strings.LastIndex(function, "("); open > 0 {
+			function = function[:open]
+		}
+
+		if function == "panic" {
+			frames = frames[:0]
+			continue
+		}
+		if strings.HasPrefix(function, "runtime.") || strings.HasPrefix(function, "net/http.") || strings.HasPrefix(function, "created by ") {
+			continue
+		}
+
+		location, _, _ := strings.Cut(strings.TrimSpace(lines[i+1]), " ")
+		if dir, file := path.Split(location); dir != "" {
+			location = path.Base(dir) + "/" + file
+		}
+
+		frames = append(frames, function+" "+location)
+	}
+	return frames
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, codeNotFound, message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested media type is not supported, use application/json or application/xml"
+	app.writeJSON(w, r, http.StatusNotAcceptable, envelope{"code": codeNotAcceptable, "error": message}, nil)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, mediaType string) {
+	message := fmt.Sprintf("the request body must be %s", mediaType)
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, message)
+}
+
+// notSupportedResponse is for requests this server can't carry out in its
+// current configuration, such as revoking a single JWT.
+func (app *application) notSupportedResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusNotImplemented, codeNotSupported, message)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, codeEditConflict, message)
+}
+
+func (app *application) versionConflictResponse(w http.ResponseWriter, r *http.Request, currentVersion int32) {
+	env := envelope{
+		"code":            codeVersionConflict,
+		"error":           "unable to update the record because its version has changed, please retry against the current version",
+		"current_version": currentVersion,
+	}
+	app.writeResponse(w, r, http.StatusConflict, env, nil)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+func (app *application) movieHasDependentsResponse(w http.ResponseWriter, r *http.Request, dependents *data.MovieDependents) {
+	env := envelope{
+		"code":       codeHasDependents,
+		"error":      "the movie has dependent records, repeat the request with ?force=true to delete it permanently along with them",
+		"dependents": dependents,
+	}
+	app.writeResponse(w, r, http.StatusConflict, env, nil)
+}
+
+func (app *application) idempotencyKeyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this idempotency key is already being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, codeIdempotencyKeyInProgress, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this idempotency key has already been used with a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyMismatch, message)
+}
+
+func (app *application) duplicateTitleConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "another movie with this title already exists, rename it before restoring this one"
+	app.errorResponse(w, r, http.StatusConflict, codeDuplicateTitle, message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since the provided ETag was issued"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, codePreconditionFailed, message)
+}
+
+// setRetryAfter sets the Retry-After header to wait, rounded up to whole
+// seconds and never less than one, and returns the value it sent.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) int {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return retryAfter
+}
+
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	env := envelope{
+		"code":        codeRateLimited,
+		"error":       "rate limit exceeded",
+		"retry_after": setRetryAfter(w, wait),
+	}
+	app.writeResponse(w, r, http.StatusTooManyRequests, env, nil)
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, until time.Time) {
+	setRetryAfter(w, time.Until(until))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, codeAccountLocked, message)
+}
+
+func (app *application) requestTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server took too long to process your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, codeRequestTimeout, message)
+}
+
+func (app *application) requestTooLargeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the request body must not be larger than %d bytes", app.config.http.maxRequestBody)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, codeRequestTooLarge, message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		app.requestTooLargeResponse(w, r)
+		return
+	}
+
+	app.errorResponse(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
 }
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, codeValidationFailed, errors)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidCredentials, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidAuthenticationToken, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, codeAuthenticationRequired, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, codeInactiveAccount, message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, codeNotPermitted, message)
+}
+
+func (app *application) debugCredentialsRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="debug", charset="UTF-8"`)
+
+	message := "you must provide valid credentials to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, codeAuthenticationRequired, message)
+}
+
+func (app *application) forbiddenAddressResponse(w http.ResponseWriter, r *http.Request) {
+	message := "access from your network address is not permitted"
+	app.errorResponse(w, r, http.StatusForbidden, codeForbiddenAddress, message)
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/limiter"
+)
+
+// errorCode returns the code of the error response in rr.
+func errorCode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	var body struct {
+		Code  string `json:"code"`
+		Error any    `json:"error"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", rr.Body, err)
+	}
+	if body.Error == nil {
+		t.Errorf("got body %s; want an error alongside the code", rr.Body)
+	}
+	return body.Code
+}
+
+func TestValidationFailedCode(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies = &rollbackMovies{movies: map[int64]data.Movie{}}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(`{"title":"","year":2016,"runtime":"107 mins","genres":["animation"]}`))
+	rr := serve(http.HandlerFunc(app.createMovieHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	if got := errorCode(t, rr); got != codeValidationFailed {
+		t.Errorf("got code %q; want %q", got, codeValidationFailed)
+	}
+	// The field errors are still reported under "error".
+	if !strings.Contains(rr.Body.String(), `"title":"must be provided"`) {
+		t.Errorf("got body %s; want the title error", rr.Body)
+	}
+}
+
+func TestRateLimitedCode(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.key = "ip"
+	app.limiter = limiter.NewMemory(0.001, 1)
+	handler := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	if rr := serve(handler, httptest.NewRequest(http.MethodGet, "/v1/movies", nil)); rr.Code != http.StatusOK {
+		t.Fatalf("the first request got status %d; want 200", rr.Code)
+	}
+
+	rr := serve(handler, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusTooManyRequests, rr.Body)
+	}
+	if got := errorCode(t, rr); got != codeRateLimited {
+		t.Errorf("got code %q; want %q", got, codeRateLimited)
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		rps  float64
+		want int
+	}{
+		{"under a second", 4, 1},
+		{"whole seconds", 0.5, 2},
+		{"rounded up", 0.3, 4},
+		{"slow refill", 0.001, 1000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.limiter.enabled = true
+			app.config.limiter.key = "ip"
+			app.limiter = limiter.NewMemory(tt.rps, 1)
+			handler := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			// The first request empties the bucket and gets no Retry-After.
+			rr := serve(handler, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+			if rr.Code != http.StatusOK || rr.Header().Get("Retry-After") != "" {
+				t.Fatalf("the first request got status %d and Retry-After %q", rr.Code, rr.Header().Get("Retry-After"))
+			}
+
+			rr = serve(handler, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+			if rr.Code != http.StatusTooManyRequests {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+			}
+			if got := rr.Header().Get("Retry-After"); got != strconv.Itoa(tt.want) {
+				t.Errorf("got Retry-After %q; want %d", got, tt.want)
+			}
+
+			var body struct {
+				RetryAfter int `json:"retry_after"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.RetryAfter != tt.want {
+				t.Errorf("got retry_after %d; want %d, as in the header", body.RetryAfter, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{-time.Second, 1},
+		{0, 1},
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1001 * time.Millisecond, 2},
+		{90 * time.Second, 90},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		got := setRetryAfter(rr, tt.wait)
+		if got != tt.want || rr.Header().Get("Retry-After") != strconv.Itoa(tt.want) {
+			t.Errorf("waiting %s sent Retry-After %q and returned %d; want %d", tt.wait, rr.Header().Get("Retry-After"), got, tt.want)
+		}
+	}
+}
+
+func TestErrorResponseCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(app *application, w http.ResponseWriter, r *http.Request)
+		status  int
+		code    string
+	}{
+		{"server error", func(app *application, w http.ResponseWriter, r *http.Request) {
+			app.serverErrorResponse(w, r, errors.New("boom"))
+		}, http.StatusInternalServerError, codeServerError},
+		{"not found", (*application).notFoundResponse, http.StatusNotFound, codeNotFound},
+		{"method not allowed", (*application).methodNotAllowedResponse, http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"edit conflict", (*application).editConflictResponse, http.StatusConflict, codeEditConflict},
+		{"duplicate title", (*application).duplicateTitleConflictResponse, http.StatusConflict, codeDuplicateTitle},
+		{"idempotency key in progress", (*application).idempotencyKeyInProgressResponse, http.StatusConflict, codeIdempotencyKeyInProgress},
+		{"idempotency key mismatch", (*application).idempotencyKeyMismatchResponse, http.StatusUnprocessableEntity, codeIdempotencyKeyMismatch},
+		{"precondition failed", (*application).preconditionFailedResponse, http.StatusPreconditionFailed, codePreconditionFailed},
+		{"request timeout", (*application).requestTimeoutResponse, http.StatusServiceUnavailable, codeRequestTimeout},
+		{"request too large", (*application).requestTooLargeResponse, http.StatusRequestEntityTooLarge, codeRequestTooLarge},
+		{"bad request", func(app *application, w http.ResponseWriter, r *http.Request) {
+			app.badRequestResponse(w, r, errors.New("body contains badly-formed JSON"))
+		}, http.StatusBadRequest, codeBadRequest},
+		{"account locked", func(app *application, w http.ResponseWriter, r *http.Request) {
+			app.accountLockedResponse(w, r, time.Now().Add(time.Minute))
+		}, http.StatusTooManyRequests, codeAccountLocked},
+		{"invalid credentials", (*application).invalidCredentialsResponse, http.StatusUnauthorized, codeInvalidCredentials},
+		{"invalid authentication token", (*application).invalidAuthenticationTokenResponse, http.StatusUnauthorized, codeInvalidAuthenticationToken},
+		{"authentication required", (*application).authenticationRequiredResponse, http.StatusUnauthorized, codeAuthenticationRequired},
+		{"inactive account", (*application).inactiveAccountResponse, http.StatusForbidden, codeInactiveAccount},
+		{"not permitted", (*application).notPermittedResponse, http.StatusForbidden, codeNotPermitted},
+		{"forbidden address", (*application).forbiddenAddressResponse, http.StatusForbidden, codeForbiddenAddress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			rr := httptest.NewRecorder()
+			tt.respond(app, rr, httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil))
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := errorCode(t, rr); got != tt.code {
+				t.Errorf("got code %q; want %q", got, tt.code)
+			}
+		})
+	}
+}
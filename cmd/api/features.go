@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// featureFlag is one entry of the feature flags file. A flag that is enabled
+// without a rollout applies to every request; with one, it applies to that
+// percentage of users.
+type featureFlag struct {
+	Enabled bool `json:"enabled"`
+	Rollout *int `json:"rollout,omitempty"`
+}
+
+// featureFlags holds the flags read from a JSON file of the form
+// {"name": {"enabled": true, "rollout": 50}}. The file is read again by
+// reload, so flags can change without a restart.
+type featureFlags struct {
+	path string
+
+	mu       sync.RWMutex
+	flags    map[string]featureFlag
+	loadedAt time.Time
+}
+
+// newFeatureFlags reads the flags file at path. With an empty path there are
+// no flags and every feature is disabled.
+func newFeatureFlags(path string) (*featureFlags, error) {
+	f := &featureFlags{path: path, flags: map[string]featureFlag{}}
+	if path == "" {
+		return f, nil
+	}
+	return f, f.reload()
+}
+
+// reload replaces the flags with the current contents of the file. If the
+// file can't be read or is invalid, the flags in use are kept.
+func (f *featureFlags) reload() error {
+	contents, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+
+	flags := map[string]featureFlag{}
+	err = dec.Decode(&flags)
+	if err != nil {
+		return fmt.Errorf("feature flags file %s: %w", f.path, err)
+	}
+
+	for name, flag := range flags {
+		if flag.Rollout != nil && (*flag.Rollout < 0 || *flag.Rollout > 100) {
+			return fmt.Errorf("feature flags file %s: rollout of %s must be between 0 and 100", f.path, name)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.flags = flags
+	f.loadedAt = time.Now()
+	return nil
+}
+
+// enabled reports whether the named feature applies to the user. A partial
+// rollout puts each user in a bucket from a hash of their ID and the flag
+// name, so a user gets the same answer on every request and different flags
+// reach different users. Anonymous users are outside every partial rollout.
+func (f *featureFlags) enabled(name string, user *data.User) bool {
+	f.mu.RLock()
+	flag, ok := f.flags[name]
+	f.mu.RUnlock()
+
+	if !ok || !flag.Enabled {
+		return false
+	}
+	if flag.Rollout == nil || *flag.Rollout >= 100 {
+		return true
+	}
+	if user == nil || user.IsAnonymous() {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + strconv.FormatInt(user.Id, 10)))
+	return int(h.Sum32()%100) < *flag.Rollout
+}
+
+// featureEnabled reports whether the named feature applies to the request made
+// by user.
+func (app *application) featureEnabled(name string, user *data.User) bool {
+	if app.features == nil {
+		return false
+	}
+	return app.features.enabled(name, user)
+}
+
+// reloadFeatureFlagsOnHangup rereads the feature flags file whenever the
+// process receives SIGHUP.
+func (app *application) reloadFeatureFlagsOnHangup() {
+	if app.features == nil || app.features.path == "" {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	go func() {
+		for range hangup {
+			err := app.features.reload()
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"path": app.features.path})
+				continue
+			}
+			app.logger.PrintInfo("reloaded feature flags", map[string]string{"path": app.features.path})
+		}
+	}()
+}
+
+func (app *application) listFeatureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	var flags map[string]featureFlag
+	var loadedAt time.Time
+
+	if app.features != nil {
+		app.features.mu.RLock()
+		flags, loadedAt = app.features.flags, app.features.loadedAt
+		app.features.mu.RUnlock()
+	}
+
+	if flags == nil {
+		flags = map[string]featureFlag{}
+	}
+
+	env := envelope{"feature_flags": flags}
+	if !loadedAt.IsZero() {
+		env["loaded_at"] = loadedAt
+	}
+
+	app.writeResponse(w, r, http.StatusOK, env, nil)
+}
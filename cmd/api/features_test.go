@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// writeFeatureFlags writes contents to a flags file in a temporary directory
+// and returns its path.
+func writeFeatureFlags(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "flags.json")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFeatureFlagsBoolean(t *testing.T) {
+	features, err := newFeatureFlags(writeFeatureFlags(t, `{
+		"on": {"enabled": true},
+		"off": {"enabled": false},
+		"off with rollout": {"enabled": false, "rollout": 100},
+		"full rollout": {"enabled": true, "rollout": 100}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApplication(t)
+	app.features = features
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"on", true},
+		{"off", false},
+		{"off with rollout", false},
+		{"full rollout", true},
+		{"unknown", false},
+	}
+
+	users := []*data.User{data.AnonymousUser, {Id: 1}, {Id: 2}, nil}
+	for _, tt := range tests {
+		for _, user := range users {
+			if got := app.featureEnabled(tt.name, user); got != tt.want {
+				t.Errorf("%s for %+v got %t; want %t", tt.name, user, got, tt.want)
+			}
+		}
+	}
+
+	// Without a flags file, or without flags at all, every feature is off.
+	empty, err := newFeatureFlags("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, features := range []*featureFlags{empty, nil} {
+		app.features = features
+		if app.featureEnabled("on", &data.User{Id: 1}) {
+			t.Errorf("with features %v, on is enabled", features)
+		}
+	}
+}
+
+func TestFeatureFlagsRollout(t *testing.T) {
+	path := writeFeatureFlags(t, `{
+		"half": {"enabled": true, "rollout": 50},
+		"other half": {"enabled": true, "rollout": 50},
+		"none": {"enabled": true, "rollout": 0}
+	}`)
+	features, err := newFeatureFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const users = 1000
+
+	decide := func(features *featureFlags, name string) map[int64]bool {
+		decisions := make(map[int64]bool, users)
+		for id := int64(1); id <= users; id++ {
+			decisions[id] = features.enabled(name, &data.User{Id: id})
+		}
+		return decisions
+	}
+
+	half := decide(features, "half")
+	enabled := 0
+	for _, on := range half {
+		if on {
+			enabled++
+		}
+	}
+	if enabled < users*40/100 || enabled > users*60/100 {
+		t.Errorf("half is enabled for %d of %d users; want about half", enabled, users)
+	}
+
+	// Each user gets the same answer every time, after a reload and from
+	// another process reading the same file.
+	err = features.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := newFeatureFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, again := range []map[int64]bool{decide(features, "half"), decide(restarted, "half")} {
+		if fmt.Sprint(again) != fmt.Sprint(half) {
+			t.Fatal("a user got a different answer for the same flag")
+		}
+	}
+
+	// Another flag at the same percentage reaches a different set of users.
+	if fmt.Sprint(decide(features, "other half")) == fmt.Sprint(half) {
+		t.Error("two flags reached the same users")
+	}
+
+	for id, on := range decide(features, "none") {
+		if on {
+			t.Fatalf("none is enabled for user %d", id)
+		}
+	}
+
+	// Anonymous users are outside a partial rollout.
+	if features.enabled("half", data.AnonymousUser) || features.enabled("half", nil) {
+		t.Error("half is enabled for an anonymous user")
+	}
+}
+
+func TestFeatureFlagsReload(t *testing.T) {
+	path := writeFeatureFlags(t, `{"on": {"enabled": true}}`)
+	features, err := newFeatureFlags(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedAt := features.loadedAt
+
+	// A bad file is reported and the flags in use are kept.
+	for _, contents := range []string{
+		`{"on": {"enabled": false}`,
+		`{"on": {"enabled": false, "percent": 50}}`,
+		`{"on": {"enabled": false, "rollout": 101}}`,
+		`{"on": {"enabled": false, "rollout": -1}}`,
+	} {
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := features.reload(); err == nil {
+			t.Errorf("reloading %s succeeded", contents)
+		}
+		if !features.enabled("on", &data.User{Id: 1}) || features.loadedAt != loadedAt {
+			t.Errorf("reloading %s replaced the flags", contents)
+		}
+	}
+
+	// A good file replaces them.
+	time.Sleep(time.Millisecond)
+	err = os.WriteFile(path, []byte(`{"on": {"enabled": false}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = features.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features.enabled("on", &data.User{Id: 1}) || !features.loadedAt.After(loadedAt) {
+		t.Error("reloading a good file kept the old flags")
+	}
+
+	// A missing or bad file fails at startup.
+	_, err = newFeatureFlags(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+	_, err = newFeatureFlags(writeFeatureFlags(t, `{"on": {"enabled": "yes"}}`))
+	if err == nil {
+		t.Error("reading a bad file succeeded")
+	}
+}
+
+func TestListFeatureFlags(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	routes := app.routes()
+	admin, editor := newSession(t, app, 1), newSession(t, app, 2)
+
+	list := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/admin/feature-flags", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return serve(routes, r)
+	}
+
+	if rr := list(""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("an anonymous request got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := list(editor); rr.Code != http.StatusForbidden {
+		t.Errorf("an editor got status %d; want %d", rr.Code, http.StatusForbidden)
+	}
+
+	// Without flags, the list is empty and there is no load time.
+	rr := list(admin)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"feature_flags":{}}`+"\n" {
+		t.Errorf("got status %d and body %s; want no flags", rr.Code, rr.Body)
+	}
+
+	features, err := newFeatureFlags(writeFeatureFlags(t, `{"on": {"enabled": true}, "half": {"enabled": true, "rollout": 50}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.features = features
+
+	rr = list(admin)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	var body struct {
+		FeatureFlags map[string]featureFlag `json:"feature_flags"`
+		LoadedAt     time.Time              `json:"loaded_at"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := body.FeatureFlags["half"]
+	if len(body.FeatureFlags) != 2 || !body.FeatureFlags["on"].Enabled || body.FeatureFlags["on"].Rollout != nil || !half.Enabled || half.Rollout == nil || *half.Rollout != 50 {
+		t.Errorf("got flags %s; want on and half", rr.Body)
+	}
+	if !body.LoadedAt.Equal(features.loadedAt) {
+		t.Errorf("got loaded_at %s; want %s", body.LoadedAt, features.loadedAt)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "encoding/json"
+
+// sparseFields reduces record to the JSON fields named in fields, plus its id.
+// The record is returned untouched when no fields were requested. Fields the
+// record omits, such as an empty deleted_at, stay omitted.
+func sparseFields(record any, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return record, nil
+	}
+
+	js, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(js, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := map[string]json.RawMessage{"id": all["id"]}
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected, nil
+}
+
+// sparseFieldsAll applies sparseFields to each record in a list.
+func sparseFieldsAll[T any](records []T, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return records, nil
+	}
+
+	projected := make([]any, len(records))
+	for i := range records {
+		record, err := sparseFields(records[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		projected[i] = record
+	}
+	return projected, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// oneMovie serves a single movie, both on its own and as a listing.
+type oneMovie struct {
+	data.MockMovieModel
+	movie data.Movie
+}
+
+func (o oneMovie) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	if id != o.movie.Id {
+		return nil, data.ErrRecordNotFound
+	}
+	movie := o.movie
+	return &movie, nil
+}
+
+func (o oneMovie) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	movie := o.movie
+	return []*data.Movie{&movie}, data.Metadata{CurrentPage: 1, PageSize: filters.PageSize, FirstPage: 1, LastPage: 1, TotalRecords: 1}, nil
+}
+
+func TestMovieFieldsParam(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies = oneMovie{movie: data.Movie{Id: 7, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 3}}
+
+	endpoints := []struct {
+		name    string
+		handler http.HandlerFunc
+		// record extracts the movie's members from the response body.
+		record func(body []byte) (map[string]json.RawMessage, error)
+	}{
+		{
+			name:    "show",
+			handler: app.getMovieHandler,
+			record: func(body []byte) (map[string]json.RawMessage, error) {
+				var env struct {
+					Movie map[string]json.RawMessage `json:"movie"`
+				}
+				err := json.Unmarshal(body, &env)
+				return env.Movie, err
+			},
+		},
+		{
+			name:    "list",
+			handler: app.listMoviesHandler,
+			record: func(body []byte) (map[string]json.RawMessage, error) {
+				var env struct {
+					Movies []map[string]json.RawMessage `json:"movies"`
+				}
+				err := json.Unmarshal(body, &env)
+				if err != nil || len(env.Movies) != 1 {
+					return nil, err
+				}
+				return env.Movies[0], nil
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		fields string
+		status int
+		want   []string
+	}{
+		{name: "all fields", status: http.StatusOK, want: []string{"director", "genres", "id", "rating", "runtime", "title", "version", "year"}},
+		{name: "title and year", fields: "title,year", status: http.StatusOK, want: []string{"id", "title", "year"}},
+		{name: "repeated field", fields: "title,title,year", status: http.StatusOK, want: []string{"id", "title", "year"}},
+		{name: "id only", fields: "id", status: http.StatusOK, want: []string{"id"}},
+		{name: "unset optional field", fields: "deleted_at", status: http.StatusOK, want: []string{"id"}},
+		{name: "unknown field", fields: "title,budget", status: http.StatusUnprocessableEntity},
+		{name: "internal field", fields: "created_at", status: http.StatusUnprocessableEntity},
+	}
+
+	for _, endpoint := range endpoints {
+		for _, tt := range tests {
+			t.Run(endpoint.name+"/"+tt.name, func(t *testing.T) {
+				query := url.Values{}
+				if tt.fields != "" {
+					query.Set("fields", tt.fields)
+				}
+
+				r := httptest.NewRequest(http.MethodGet, "/v1/movies/7?"+query.Encode(), nil)
+				r = withIDParam(app.contextSetUser(r, data.AnonymousUser), 7)
+				rr := serve(endpoint.handler, r)
+
+				if rr.Code != tt.status {
+					t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+				}
+
+				if tt.status != http.StatusOK {
+					var env struct {
+						Error map[string]string `json:"error"`
+					}
+					err := json.Unmarshal(rr.Body.Bytes(), &env)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if env.Error["fields"] == "" {
+						t.Errorf("got errors %v; want one for fields", env.Error)
+					}
+					return
+				}
+
+				record, err := endpoint.record(rr.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for name := range record {
+					got = append(got, name)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got fields %v; want %v", got, tt.want)
+				}
+				if string(record["id"]) != "7" {
+					t.Errorf("got id %s; want 7", record["id"])
+				}
+			})
+		}
+	}
+}
+
+// TestMovieFieldsMatchJSON keeps the selectable fields in step with the
+// movie's JSON encoding.
+func TestMovieFieldsMatchJSON(t *testing.T) {
+	js, err := json.Marshal(data.Movie{DeletedAt: new(time.Time)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var members map[string]json.RawMessage
+	err = json.Unmarshal(js, &members)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var encoded []string
+	for name := range members {
+		encoded = append(encoded, name)
+	}
+	sort.Strings(encoded)
+
+	selectable := append([]string(nil), data.MovieFields...)
+	sort.Strings(selectable)
+
+	if !reflect.DeepEqual(encoded, selectable) {
+		t.Errorf("movie encodes %v; MovieFields lists %v", encoded, selectable)
+	}
+}
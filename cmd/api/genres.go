@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) addMovieGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Genre string `json:"genre" xml:"genre"`
+	}
+
+	err = app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	input.Genre = strings.TrimSpace(input.Genre)
+
+	v := validator.New()
+
+	if data.ValidateGenre(v, input.Genre, app.config.movieLimits); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ctx := app.withAudit(r, data.AuditMovieUpdate, "movie", id, map[string]any{"added_genre": input.Genre})
+
+	movie, changed, err := app.models.Movies.AddGenre(ctx, id, input.Genre, app.config.movieLimits.MaxGenres)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrTooManyGenres):
+			v.AddError("genre", "the movie already has the maximum number of genres")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeGenresResponse(w, r, movie, changed)
+}
+
+func (app *application) removeMovieGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre := strings.TrimSpace(httprouter.ParamsFromContext(r.Context()).ByName("genre"))
+
+	ctx := app.withAudit(r, data.AuditMovieUpdate, "movie", id, map[string]any{"removed_genre": genre})
+
+	movie, changed, err := app.models.Movies.RemoveGenre(ctx, id, genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrLastGenre):
+			v := validator.New()
+			v.AddError("genre", "a movie must keep at least 1 genre")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeGenresResponse(w, r, movie, changed)
+}
+
+// writeGenresResponse sends the movie after a genre change. No-op changes are
+// not reported as movie writes.
+func (app *application) writeGenresResponse(w http.ResponseWriter, r *http.Request, movie *data.Movie, changed bool) {
+	if changed {
+		app.movieChanged(webhook.EventMovieUpdated, movie.Id, movie.Version)
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, headers)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
+	"github.com/julienschmidt/httprouter"
+)
+
+// genreMovies changes genres in memory the way the model's single-statement
+// updates do.
+type genreMovies struct {
+	data.MockMovieModel
+	movie data.Movie
+}
+
+func (m *genreMovies) AddGenre(ctx context.Context, id int64, genre string, maxGenres int) (*data.Movie, bool, error) {
+	if id != m.movie.Id {
+		return nil, false, data.ErrRecordNotFound
+	}
+	for _, g := range m.movie.Genres {
+		if strings.EqualFold(g, genre) {
+			movie := m.movie
+			return &movie, false, nil
+		}
+	}
+	if len(m.movie.Genres) >= maxGenres {
+		return nil, false, data.ErrTooManyGenres
+	}
+	m.movie.Genres = append(append([]string{}, m.movie.Genres...), genre)
+	m.movie.Version++
+	movie := m.movie
+	return &movie, true, nil
+}
+
+func (m *genreMovies) RemoveGenre(ctx context.Context, id int64, genre string) (*data.Movie, bool, error) {
+	if id != m.movie.Id {
+		return nil, false, data.ErrRecordNotFound
+	}
+	var kept []string
+	for _, g := range m.movie.Genres {
+		if !strings.EqualFold(g, genre) {
+			kept = append(kept, g)
+		}
+	}
+	if len(kept) == len(m.movie.Genres) {
+		movie := m.movie
+		return &movie, false, nil
+	}
+	if len(kept) == 0 {
+		return nil, false, data.ErrLastGenre
+	}
+	m.movie.Genres = kept
+	m.movie.Version++
+	movie := m.movie
+	return &movie, true, nil
+}
+
+func TestMovieGenres(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.movieLimits.MaxGenres = 3
+	movies := &genreMovies{movie: data.Movie{Id: 1, Title: "Moana", Genres: []string{"animation"}, Version: 1}}
+	app.models.Movies = movies
+
+	var (
+		mu       sync.Mutex
+		notified []int32
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		notified = append(notified, event.Version)
+		mu.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	app.webhooks = webhook.New([]string{receiver.URL}, "s3cret", 1)
+
+	add := func(id int64, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/movies/1/genres", strings.NewReader(body))
+		return serve(http.HandlerFunc(app.addMovieGenreHandler), withIDParam(app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}), id))
+	}
+	remove := func(id int64, genre string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/movies/1/genres/"+genre, nil)
+		params := httprouter.Params{{Key: "id", Value: strconv.FormatInt(id, 10)}, {Key: "genre", Value: genre}}
+		r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+		return serve(http.HandlerFunc(app.removeMovieGenreHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+	}
+
+	steps := []struct {
+		name   string
+		send   func() *httptest.ResponseRecorder
+		status int
+		// genres and version are the movie's after the step.
+		genres  string
+		version int32
+	}{
+		{"append", func() *httptest.ResponseRecorder { return add(1, `{"genre":"musical"}`) }, http.StatusOK, "animation,musical", 2},
+		{"append again", func() *httptest.ResponseRecorder { return add(1, `{"genre":"musical"}`) }, http.StatusOK, "animation,musical", 2},
+		{"append in another case", func() *httptest.ResponseRecorder { return add(1, `{"genre":" Musical "}`) }, http.StatusOK, "animation,musical", 2},
+		{"append empty", func() *httptest.ResponseRecorder { return add(1, `{"genre":"  "}`) }, http.StatusUnprocessableEntity, "animation,musical", 2},
+		{"append to a missing movie", func() *httptest.ResponseRecorder { return add(2, `{"genre":"drama"}`) }, http.StatusNotFound, "animation,musical", 2},
+		{"append up to the limit", func() *httptest.ResponseRecorder { return add(1, `{"genre":"family"}`) }, http.StatusOK, "animation,musical,family", 3},
+		{"append beyond the limit", func() *httptest.ResponseRecorder { return add(1, `{"genre":"comedy"}`) }, http.StatusUnprocessableEntity, "animation,musical,family", 3},
+		{"remove", func() *httptest.ResponseRecorder { return remove(1, "family") }, http.StatusOK, "animation,musical", 4},
+		{"remove a missing genre", func() *httptest.ResponseRecorder { return remove(1, "western") }, http.StatusOK, "animation,musical", 4},
+		{"remove from a missing movie", func() *httptest.ResponseRecorder { return remove(2, "animation") }, http.StatusNotFound, "animation,musical", 4},
+		{"remove", func() *httptest.ResponseRecorder { return remove(1, "musical") }, http.StatusOK, "animation", 5},
+		{"remove the last genre", func() *httptest.ResponseRecorder { return remove(1, "animation") }, http.StatusUnprocessableEntity, "animation", 5},
+	}
+
+	for _, step := range steps {
+		rr := step.send()
+		if rr.Code != step.status {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.status, rr.Body)
+		}
+		if got := strings.Join(movies.movie.Genres, ","); got != step.genres || movies.movie.Version != step.version {
+			t.Fatalf("%s: the movie has genres %s at version %d; want %s at version %d", step.name, got, movies.movie.Version, step.genres, step.version)
+		}
+		if step.status != http.StatusOK {
+			continue
+		}
+
+		// Every answer, changed or not, is the movie as it now stands.
+		var body struct {
+			Movie data.Movie `json:"movie"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(body.Movie.Genres, ",") != step.genres || body.Movie.Version != step.version {
+			t.Errorf("%s: got movie %+v; want genres %s at version %d", step.name, body.Movie, step.genres, step.version)
+		}
+		if got := rr.Header().Get("ETag"); got != `"`+strconv.Itoa(int(step.version))+`"` {
+			t.Errorf("%s: got ETag %s; want version %d", step.name, got, step.version)
+		}
+	}
+
+	// Only the steps that changed the movie notify webhooks. Deliveries run
+	// in the background, so they may arrive in any order.
+	app.wg.Wait()
+	sort.Slice(notified, func(i, j int) bool { return notified[i] < notified[j] })
+	if got := fmt.Sprint(notified); got != "[2 3 4 5]" {
+		t.Errorf("notified webhooks of versions %s; want [2 3 4 5]", got)
+	}
+}
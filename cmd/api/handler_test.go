@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+)
+
+// stubConnector hands out connections that do nothing, or fails with err.
+type stubConnector struct {
+	err error
+}
+
+func (c stubConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return stubConn{}, nil
+}
+
+func (c stubConnector) Driver() driver.Driver {
+	return nil
+}
+
+type stubConn struct{}
+
+func (stubConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (stubConn) Close() error                        { return nil }
+func (stubConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func TestHealthcheckDoesNotLeakErrors(t *testing.T) {
+	const secret = "dial tcp db.internal:5432: password authentication failed for user \"greenlight\""
+
+	tests := []struct {
+		name   string
+		dbErr  error
+		query  string
+		status int
+		deps   map[string]string
+	}{
+		{name: "up", query: "?verbose=true", status: http.StatusOK, deps: map[string]string{"database": "up"}},
+		{name: "down", dbErr: errors.New(secret), query: "", status: http.StatusServiceUnavailable},
+		{name: "down verbose", dbErr: errors.New(secret), query: "?verbose=true", status: http.StatusServiceUnavailable, deps: map[string]string{"database": "down"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			app := newTestApplication(t)
+			app.logger = jsonlog.New(&logs, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+			app.config.healthcheck.dbTimeout = time.Second
+			app.db = sql.OpenDB(stubConnector{err: tt.dbErr})
+			defer app.db.Close()
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/healthcheck"+tt.query, nil)
+			rr := serve(http.HandlerFunc(app.healthcheckHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d", rr.Code, tt.status)
+			}
+			if strings.Contains(rr.Body.String(), "db.internal") {
+				t.Errorf("response leaks the error: %s", rr.Body)
+			}
+
+			var body struct {
+				Dependencies map[string]map[string]string `json:"dependencies"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Dependencies) != len(tt.deps) {
+				t.Fatalf("got dependencies %v; want %v", body.Dependencies, tt.deps)
+			}
+			for name, status := range tt.deps {
+				if got := body.Dependencies[name]["status"]; got != status {
+					t.Errorf("%s is %q; want %q", name, got, status)
+				}
+				if _, ok := body.Dependencies[name]["error"]; ok {
+					t.Errorf("%s has an error member: %v", name, body.Dependencies[name])
+				}
+			}
+
+			if logged := strings.Contains(logs.String(), "db.internal"); logged != (tt.dbErr != nil) {
+				t.Errorf("error logged %t; want %t: %s", logged, tt.dbErr != nil, logs.String())
+			}
+		})
+	}
+}
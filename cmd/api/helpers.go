@@ -5,9 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/mailer"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -24,8 +31,116 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 
 type envelope map[string]any
 
+// etagMatches reports whether etag is one of the entity tags in an
+// If-None-Match header, using the weak comparison RFC 9110 requires there.
+func (app *application) etagMatches(header, etag string) bool {
+	return matchETag(header, etag, false)
+}
+
+// etagMatchesStrong reports whether etag is one of the entity tags in an
+// If-Match header, using strong comparison: a weak tag never matches.
+func (app *application) etagMatchesStrong(header, etag string) bool {
+	return matchETag(header, etag, true)
+}
+
+func matchETag(header, etag string, strong bool) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if strong {
+			if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+				return true
+			}
+			continue
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// paginationHeaders returns a Link header (RFC 8288) pointing at the first,
+// previous, next and last pages described by metadata, or nil when there is
+// nothing to link to. Links reuse the request's path and query string so that
+// filters and sorting carry over; only the page or cursor is replaced.
+func (app *application) paginationHeaders(r *http.Request, metadata data.Metadata) http.Header {
+	var links []string
+
+	link := func(rel, param, value string) {
+		qs := r.URL.Query()
+		qs.Set(param, value)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, qs.Encode(), rel))
+	}
+
+	switch {
+	case r.URL.Query().Has("cursor"):
+		link("first", "cursor", "")
+		if metadata.NextCursor != "" {
+			link("next", "cursor", metadata.NextCursor)
+		}
+	case metadata.LastPage > 0:
+		link("first", "page", strconv.Itoa(metadata.FirstPage))
+		if metadata.CurrentPage > metadata.FirstPage {
+			link("prev", "page", strconv.Itoa(metadata.CurrentPage-1))
+		}
+		if metadata.CurrentPage < metadata.LastPage {
+			link("next", "page", strconv.Itoa(metadata.CurrentPage+1))
+		}
+		link("last", "page", strconv.Itoa(metadata.LastPage))
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	headers := make(http.Header)
+	headers.Set("Link", strings.Join(links, ", "))
+	return headers
+}
+
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) {
+	w.Header().Add("Vary", "Accept")
+
+	switch app.negotiateContentType(r) {
+	case mediaTypeXML:
+		app.writeXML(w, r, status, data, headers)
+	case mediaTypeJSON:
+		app.writeJSON(w, r, status, data, headers)
+	default:
+		app.notAcceptableResponse(w, r)
+	}
+}
+
+// prettyJSON reports whether the client asked for indented JSON, with a
+// "pretty" query parameter or an X-Pretty header set to a true value. Responses
+// are compact otherwise.
+func prettyJSON(r *http.Request) bool {
+	for _, s := range []string{r.URL.Query().Get("pretty"), r.Header.Get("X-Pretty")} {
+		if pretty, err := strconv.ParseBool(s); err == nil && pretty {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) {
-	js, err := json.MarshalIndent(data, "", "  ")
+	var js []byte
+	var err error
+
+	if prettyJSON(r) {
+		js, err = json.MarshalIndent(data, "", "  ")
+	} else {
+		js, err = json.Marshal(data)
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -37,15 +152,33 @@ func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status
 		w.Header()[key] = value
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "X-Pretty")
+	w.Header().Set("Content-Type", mediaTypeJSON)
+	w.Header().Set("Content-Length", strconv.Itoa(len(js)))
 	w.WriteHeader(status)
 	w.Write(js)
 }
 
-func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
-	maxBytes := 1_048_576
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+func (app *application) readRequest(w http.ResponseWriter, r *http.Request, dst any) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == mediaTypeXML || mediaType == "text/xml" {
+		return app.readXML(w, r, dst)
+	}
+	return app.readJSON(w, r, dst)
+}
+
+// Errors returned by readJSON. Messages that need more detail, such as the
+// offset of a syntax error or the name of a field, wrap one of these so that
+// callers can still tell the cases apart with errors.Is.
+var (
+	errMalformedJSON      = errors.New("body contains badly-formed JSON")
+	errIncorrectJSONType  = errors.New("body contains incorrect JSON type")
+	errUnknownJSONField   = errors.New("body contains unknown key")
+	errEmptyBody          = errors.New("body must not be empty")
+	errMultipleJSONValues = errors.New("body must only contain a single JSON value")
+)
 
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
@@ -56,19 +189,24 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 		var invalidUnmarshalError *json.InvalidUnmarshalError
 		switch {
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+			return fmt.Errorf("%w (at character %d)", errMalformedJSON, syntaxError.Offset)
 
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+			return errMalformedJSON
 
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+				return fmt.Errorf("%w for field %q", errIncorrectJSONType, unmarshalTypeError.Field)
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+			return fmt.Errorf("%w (at character %d)", errIncorrectJSONType, unmarshalTypeError.Offset)
+
+		// encoding/json has no error type for unknown fields, so match the
+		// message it uses, which is also what decodeMergePatch returns.
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return fmt.Errorf("%w %s", errUnknownJSONField, strings.TrimPrefix(err.Error(), "json: unknown field "))
 
 		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+			return errEmptyBody
 
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
@@ -80,16 +218,59 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 
 	err = dec.Decode(&struct{}{})
 	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+		return errMultipleJSONValues
 	}
 
 	return nil
 }
 
+// returnPreference returns the return preference (RFC 7240) from the
+// request's Prefer header, either "minimal" or "representation", and whether
+// the client stated one. The default is "representation".
+func returnPreference(r *http.Request) (string, bool) {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			preference, _, _ = strings.Cut(preference, ";")
+			name, value, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			if !strings.EqualFold(name, "return") {
+				continue
+			}
+
+			value = strings.Trim(value, `"`)
+			if value == "minimal" || value == "representation" {
+				return value, true
+			}
+		}
+	}
+	return "representation", false
+}
+
+// preferredLocale returns the first language tag listed in the request's
+// Accept-Language header, ignoring quality values, or the mailer's default
+// locale when none is usable.
+func preferredLocale(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag != "*" && validator.Matches(tag, validator.LocaleRX) {
+			return tag
+		}
+	}
+	return mailer.DefaultLocale
+}
+
+// formatTokenExpiry renders a token's expiry for emails. The TTLs are
+// configurable, so templates show when a token expires rather than how long
+// it lasts.
+func formatTokenExpiry(token *data.Token) string {
+	return token.Expiry.UTC().Format("2006-01-02 15:04 MST")
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.backgroundTasks.Add(1)
 	go func() {
 		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
 		defer func() {
 			if err := recover(); err != nil {
 				app.logger.PrintError(fmt.Errorf("%s", err), nil)
@@ -98,3 +279,35 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// movieChanged is called after every movie write. It drops cached listings,
+// which may include the movie, and notifies webhooks.
+func (app *application) movieChanged(eventType string, movieID int64, version int32) {
+	app.listCache.invalidate()
+	app.notifyWebhooks(eventType, movieID, version)
+}
+
+// notifyWebhooks delivers a movie event to every configured webhook endpoint
+// in the background, so a slow receiver never delays the response.
+func (app *application) notifyWebhooks(eventType string, movieID int64, version int32) {
+	event := webhook.Event{
+		Type:       eventType,
+		MovieID:    movieID,
+		Version:    version,
+		OccurredAt: time.Now().UTC(),
+	}
+
+	for _, url := range app.webhooks.URLs() {
+		url := url
+		app.background(func() {
+			err := app.webhooks.Deliver(url, event)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"webhook":  url,
+					"event":    event.Type,
+					"movie_id": strconv.FormatInt(event.MovieID, 10),
+				})
+			}
+		})
+	}
+}
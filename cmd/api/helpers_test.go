@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
+)
+
+func TestReadJSON(t *testing.T) {
+	type input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	tests := []struct {
+		name string
+		body string
+		err  error
+		want string
+	}{
+		{name: "valid", body: `{"title":"Moana","year":2016}`},
+		{name: "valid with trailing space", body: "{\"title\":\"Moana\"}\n \t"},
+		{name: "syntax error", body: `{"title":"Moana",}`, err: errMalformedJSON, want: "body contains badly-formed JSON (at character 18)"},
+		{name: "syntax error at start", body: `<movie/>`, err: errMalformedJSON, want: "body contains badly-formed JSON (at character 1)"},
+		{name: "unexpected EOF", body: `{"title":"Moana"`, err: errMalformedJSON, want: "body contains badly-formed JSON"},
+		{name: "wrong type for a field", body: `{"year":"2016"}`, err: errIncorrectJSONType, want: `body contains incorrect JSON type for field "year"`},
+		{name: "wrong type for the body", body: `["Moana"]`, err: errIncorrectJSONType, want: "body contains incorrect JSON type (at character 1)"},
+		{name: "unknown field", body: `{"title":"Moana","budget":1}`, err: errUnknownJSONField, want: `body contains unknown key "budget"`},
+		{name: "empty body", body: ``, err: errEmptyBody, want: "body must not be empty"},
+		{name: "multiple values", body: `{"title":"Moana"}{"title":"Moana 2"}`, err: errMultipleJSONValues, want: "body must only contain a single JSON value"},
+		{name: "garbage after the value", body: `{"title":"Moana"} x`, err: errMultipleJSONValues, want: "body must only contain a single JSON value"},
+		{name: "invalid runtime", body: `{"runtime":"107 hours"}`, err: data.ErrInvalidRuntimeFormat, want: data.ErrInvalidRuntimeFormat.Error()},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dst input
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(tt.body))
+			err := app.readJSON(httptest.NewRecorder(), r, &dst)
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got err %v; want %v", err, tt.err)
+			}
+			if err != nil && err.Error() != tt.want {
+				t.Errorf("got %q; want %q", err.Error(), tt.want)
+			}
+
+			// The message is what a client sees in the 400 response.
+			if err != nil {
+				rr := httptest.NewRecorder()
+				app.badRequestResponse(rr, r, err)
+
+				var body struct {
+					Code  string `json:"code"`
+					Error string `json:"error"`
+				}
+				jsErr := json.Unmarshal(rr.Body.Bytes(), &body)
+				if jsErr != nil {
+					t.Fatal(jsErr)
+				}
+				if rr.Code != http.StatusBadRequest || body.Code != codeBadRequest || body.Error != tt.want {
+					t.Errorf("got %d %s; want 400 with %q", rr.Code, rr.Body, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadJSONBodyTooLarge(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.http.maxRequestBody = 16
+
+	handler := app.limitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var dst map[string]string
+		err := app.readJSON(w, r, &dst)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+		}
+	}))
+
+	// A chunked body has no Content-Length, so only the reader catches it.
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(`{"title":"`+strings.Repeat("a", 32)+`"}`))
+	r.ContentLength = -1
+
+	if rr := serve(handler, r); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d; want %d: %s", rr.Code, http.StatusRequestEntityTooLarge, rr.Body)
+	}
+}
+
+// linkPattern matches one link-value of a Link header.
+var linkPattern = regexp.MustCompile(`^<([^>]+)>; rel="([a-z]+)"$`)
+
+func TestPaginationHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		metadata data.Metadata
+		// want maps each expected rel to the page or cursor it links to.
+		want map[string]string
+	}{
+		{
+			name:     "middle page",
+			target:   "/v1/movies?genres=drama&sort=-year&page=2&page_size=5",
+			metadata: data.Metadata{CurrentPage: 2, PageSize: 5, FirstPage: 1, LastPage: 3, TotalRecords: 12},
+			want:     map[string]string{"first": "1", "prev": "1", "next": "3", "last": "3"},
+		},
+		{
+			name:     "first page",
+			target:   "/v1/movies?genres=drama&sort=-year&page_size=5",
+			metadata: data.Metadata{CurrentPage: 1, PageSize: 5, FirstPage: 1, LastPage: 3, TotalRecords: 12},
+			want:     map[string]string{"first": "1", "next": "2", "last": "3"},
+		},
+		{
+			name:     "last page",
+			target:   "/v1/movies?genres=drama&sort=-year&page=3&page_size=5",
+			metadata: data.Metadata{CurrentPage: 3, PageSize: 5, FirstPage: 1, LastPage: 3, TotalRecords: 12},
+			want:     map[string]string{"first": "1", "prev": "2", "last": "3"},
+		},
+		{
+			name:     "only page",
+			target:   "/v1/movies?genres=drama&sort=-year",
+			metadata: data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 4},
+			want:     map[string]string{"first": "1", "last": "1"},
+		},
+		{
+			name:   "no results",
+			target: "/v1/movies?genres=drama&sort=-year",
+		},
+		{
+			name:     "cursor with more to come",
+			target:   "/v1/movies?genres=drama&sort=-year&cursor=abc",
+			metadata: data.Metadata{PageSize: 20, NextCursor: "def"},
+			want:     map[string]string{"first": "", "next": "def"},
+		},
+		{
+			name:     "last cursor page",
+			target:   "/v1/movies?genres=drama&sort=-year&cursor=def",
+			metadata: data.Metadata{PageSize: 20},
+			want:     map[string]string{"first": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+
+			headers := app.paginationHeaders(r, tt.metadata)
+			if tt.want == nil {
+				if headers != nil {
+					t.Fatalf("got Link %q; want none", headers.Get("Link"))
+				}
+				return
+			}
+
+			param := "page"
+			if r.URL.Query().Has("cursor") {
+				param = "cursor"
+			}
+
+			got := map[string]string{}
+			for _, value := range strings.Split(headers.Get("Link"), ", ") {
+				m := linkPattern.FindStringSubmatch(value)
+				if m == nil {
+					t.Fatalf("malformed link-value %q", value)
+				}
+				target, err := url.Parse(m[1])
+				if err != nil {
+					t.Fatalf("link %q: %v", m[1], err)
+				}
+				if target.Path != r.URL.Path {
+					t.Errorf("%s links to path %q; want %q", m[2], target.Path, r.URL.Path)
+				}
+
+				// Everything but the page or cursor carries over.
+				qs := target.Query()
+				for key := range r.URL.Query() {
+					if key != param && qs.Get(key) != r.URL.Query().Get(key) {
+						t.Errorf("%s link has %s=%q; want %q", m[2], key, qs.Get(key), r.URL.Query().Get(key))
+					}
+				}
+				got[m[2]] = qs.Get(param)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got links %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyWebhooks(t *testing.T) {
+	app := newTestApplication(t)
+	var logged bytes.Buffer
+	app.logger = jsonlog.New(&logged, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+
+	var (
+		mu       sync.Mutex
+		received []webhook.Event
+	)
+	accept := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhook.SignatureHeader) != webhook.Sign([]byte("s3cret"), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event webhook.Event
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	t.Cleanup(accept.Close)
+	reject := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	t.Cleanup(reject.Close)
+
+	app.webhooks = webhook.New([]string{accept.URL, reject.URL}, "s3cret", 1)
+
+	app.notifyWebhooks(webhook.EventMovieUpdated, 7, 3)
+	app.wg.Wait()
+
+	if len(received) != 1 || received[0].Type != webhook.EventMovieUpdated || received[0].MovieID != 7 || received[0].Version != 3 {
+		t.Errorf("received %+v; want one movie.updated event for movie 7 at version 3", received)
+	}
+
+	// A failed delivery doesn't affect the others and is logged.
+	entries := logEntries(t, &logged)
+	if len(entries) != 1 || entries[0].Properties["webhook"] != reject.URL || entries[0].Properties["event"] != webhook.EventMovieUpdated {
+		t.Errorf("logged %+v; want the failed delivery to %s", entries, reject.URL)
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	payload := envelope{"movie": map[string]any{"title": "Moana", "year": 2016, "genres": []string{"animation", "adventure"}}}
+	compact, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pretty, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both forms end in a newline.
+	compact, pretty = append(compact, '\n'), append(pretty, '\n')
+
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		want   []byte
+	}{
+		{name: "default", want: compact},
+		{name: "query", query: "?pretty=true", want: pretty},
+		{name: "query as a number", query: "?pretty=1", want: pretty},
+		{name: "header", header: "true", want: pretty},
+		{name: "query off", query: "?pretty=false", want: compact},
+		{name: "invalid query", query: "?pretty=please", want: compact},
+		{name: "invalid header", header: "yes", want: compact},
+		{name: "either one asks", query: "?pretty=false", header: "true", want: pretty},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Pretty", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			app.writeJSON(rr, r, http.StatusOK, payload, nil)
+
+			if !bytes.Equal(rr.Body.Bytes(), tt.want) {
+				t.Errorf("got body\n%s\nwant\n%s", rr.Body, tt.want)
+			}
+			if got := rr.Header().Get("Content-Length"); got != strconv.Itoa(len(tt.want)) {
+				t.Errorf("got Content-Length %s; want %d", got, len(tt.want))
+			}
+			if !strings.Contains(strings.Join(rr.Header().Values("Vary"), ", "), "X-Pretty") {
+				t.Errorf("got Vary %v; want it to include X-Pretty", rr.Header().Values("Vary"))
+			}
+		})
+	}
+
+	// Both forms decode to the same value.
+	var fromCompact, fromPretty any
+	if json.Unmarshal(compact, &fromCompact) != nil || json.Unmarshal(pretty, &fromPretty) != nil || !reflect.DeepEqual(fromCompact, fromPretty) {
+		t.Errorf("compact %s and pretty %s output differ", compact, pretty)
+	}
+}
+
+func TestWriteJSONPrettyCompressed(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.level = -1
+	app.config.compression.minSize = 256
+	payload := envelope{"movies": strings.Split(strings.Repeat("Moana,", 100), ",")}
+
+	handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.writeJSON(w, r, http.StatusOK, payload, nil)
+	}))
+
+	for _, query := range []string{"", "?pretty=true"} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/movies"+query, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rr := serve(handler, r)
+
+		// The length of the uncompressed body would be wrong once encoded.
+		if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Content-Length") != "" {
+			t.Errorf("%q got Content-Encoding %q and Content-Length %q; want gzip and no length", query, rr.Header().Get("Content-Encoding"), rr.Header().Get("Content-Length"))
+		}
+
+		var got envelope
+		err := json.Unmarshal([]byte(decompress(t, rr)), &got)
+		if err != nil {
+			t.Errorf("%q: %v", query, err)
+		}
+	}
+}
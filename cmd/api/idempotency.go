@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// idempotentRequest is a request that owns an Idempotency-Key. A nil
+// *idempotentRequest stands for a request without the header, and its methods
+// do nothing.
+type idempotentRequest struct {
+	userID int64
+	key    string
+}
+
+// startIdempotentRequest reserves the request's Idempotency-Key, if it has
+// one. The fingerprint of input ties the key to the request it was first used
+// with. When the key has already been used, replay is called with the stored
+// status and response, or an error is sent, and ok is false.
+func (app *application) startIdempotentRequest(w http.ResponseWriter, r *http.Request, input any, replay func(status int, response []byte)) (req *idempotentRequest, ok bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return nil, true
+	}
+
+	v := validator.New()
+
+	if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	js, err := json.Marshal(input)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	fingerprint := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), js...))
+
+	user := app.contextGetUser(r)
+
+	existing, err := app.models.Idempotency.Reserve(r.Context(), user.Id, key, fingerprint[:], app.config.idempotency.ttl)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	switch {
+	case existing == nil:
+		return &idempotentRequest{userID: user.Id, key: key}, true
+	case !bytes.Equal(existing.Fingerprint, fingerprint[:]):
+		app.idempotencyKeyMismatchResponse(w, r)
+	case existing.Status == 0:
+		app.idempotencyKeyInProgressResponse(w, r)
+	default:
+		w.Header().Set("Idempotent-Replayed", "true")
+		replay(existing.Status, existing.Response)
+	}
+	return nil, false
+}
+
+// finish stores the response so that retries with the same key replay it. The
+// request's own context is not used, so a client disconnecting after the work
+// is done doesn't leave the key stuck in progress.
+func (req *idempotentRequest) finish(app *application, r *http.Request, status int, response any) {
+	if req == nil {
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err == nil {
+		err = app.models.Idempotency.Complete(context.Background(), req.userID, req.key, status, js)
+	}
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// abandon frees the key after a failed request so that it can be retried.
+func (req *idempotentRequest) abandon(app *application, r *http.Request) {
+	if req == nil {
+		return
+	}
+
+	err := app.models.Idempotency.Release(context.Background(), req.userID, req.key)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
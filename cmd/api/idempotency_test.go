@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// idempotencyKeys holds keys in memory with the same reservation rules as the
+// idempotency_keys table.
+type idempotencyKeys struct {
+	mu   sync.Mutex
+	keys map[string]*data.IdempotencyKey
+}
+
+func (k *idempotencyKeys) id(userID int64, key string) string {
+	return fmt.Sprint(userID, "/", key)
+}
+
+func (k *idempotencyKeys) Reserve(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*data.IdempotencyKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	existing, ok := k.keys[k.id(userID, key)]
+	if ok && existing.Expiry.After(time.Now()) {
+		stored := *existing
+		return &stored, nil
+	}
+	k.keys[k.id(userID, key)] = &data.IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint, Expiry: time.Now().Add(ttl)}
+	return nil, nil
+}
+
+func (k *idempotencyKeys) Complete(ctx context.Context, userID int64, key string, status int, response []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if existing, ok := k.keys[k.id(userID, key)]; ok {
+		existing.Status = status
+		existing.Response = response
+	}
+	return nil
+}
+
+func (k *idempotencyKeys) Release(ctx context.Context, userID int64, key string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if existing, ok := k.keys[k.id(userID, key)]; ok && existing.Status == 0 {
+		delete(k.keys, k.id(userID, key))
+	}
+	return nil
+}
+
+// insertedMovies records every movie inserted. Inserts fail while failures
+// is positive, and wait for hold to be closed when it is set.
+type insertedMovies struct {
+	data.MockMovieModel
+	mu       sync.Mutex
+	movies   []*data.Movie
+	failures int
+	hold     chan struct{}
+}
+
+func (m *insertedMovies) Insert(ctx context.Context, movie *data.Movie) error {
+	if m.hold != nil {
+		<-m.hold
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("connection reset")
+	}
+	movie.Id = int64(len(m.movies) + 1)
+	movie.Version = 1
+	m.movies = append(m.movies, movie)
+	return nil
+}
+
+func (m *insertedMovies) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.movies)
+}
+
+func newIdempotencyTestApplication(t *testing.T) (*application, *insertedMovies) {
+	t.Helper()
+
+	movies := &insertedMovies{}
+
+	app := newTestApplication(t)
+	app.config.idempotency.ttl = time.Hour
+	app.models.Movies = movies
+	app.models.Idempotency = &idempotencyKeys{keys: map[string]*data.IdempotencyKey{}}
+	return app, movies
+}
+
+const (
+	moanaJSON        = `{"title":"Moana","year":2016,"runtime":107,"genres":["animation"],"director":"Ron Clements","rating":"PG"}`
+	blackPantherJSON = `{"title":"Black Panther","year":2018,"runtime":134,"genres":["action"],"director":"Ryan Coogler","rating":"PG-13"}`
+)
+
+// createMovie posts body as the user, with the Idempotency-Key if key isn't
+// empty.
+func createMovie(app *application, userID int64, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	r = app.contextSetUser(r, &data.User{Id: userID, Name: "Alice", Activated: true})
+	return serve(http.HandlerFunc(app.createMovieHandler), r)
+}
+
+func TestCreateMovieIdempotencyKey(t *testing.T) {
+	app, movies := newIdempotencyTestApplication(t)
+
+	first := createMovie(app, 1, "key-1", moanaJSON)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first create got status %d: %s", first.Code, first.Body)
+	}
+
+	tests := []struct {
+		name     string
+		userID   int64
+		key      string
+		body     string
+		status   int
+		replayed bool
+		inserts  int
+	}{
+		{name: "replayed", userID: 1, key: "key-1", body: moanaJSON, status: http.StatusCreated, replayed: true},
+		{name: "replayed again", userID: 1, key: "key-1", body: moanaJSON, status: http.StatusCreated, replayed: true},
+		{name: "same key, different request", userID: 1, key: "key-1", body: blackPantherJSON, status: http.StatusUnprocessableEntity},
+		{name: "same key, other user", userID: 2, key: "key-1", body: moanaJSON, status: http.StatusCreated, inserts: 1},
+		{name: "new key", userID: 1, key: "key-2", body: moanaJSON, status: http.StatusCreated, inserts: 1},
+		{name: "no key", userID: 1, body: moanaJSON, status: http.StatusCreated, inserts: 1},
+		{name: "key too long", userID: 1, key: strings.Repeat("k", 256), body: moanaJSON, status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := movies.count()
+
+			rr := createMovie(app, tt.userID, tt.key, tt.body)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+				t.Errorf("replayed: %t; want %t", got, tt.replayed)
+			}
+			if got := movies.count() - before; got != tt.inserts {
+				t.Errorf("inserted %d movies; want %d", got, tt.inserts)
+			}
+			if tt.replayed {
+				if !bytes.Equal(rr.Body.Bytes(), first.Body.Bytes()) || rr.Header().Get("Location") != first.Header().Get("Location") {
+					t.Errorf("replay got %s at %s; want the original %s at %s", rr.Body, rr.Header().Get("Location"), first.Body, first.Header().Get("Location"))
+				}
+			}
+		})
+	}
+}
+
+func TestCreateMovieIdempotencyKeyAfterFailure(t *testing.T) {
+	app, movies := newIdempotencyTestApplication(t)
+	movies.failures = 1
+
+	if rr := createMovie(app, 1, "key-1", moanaJSON); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("failed create got status %d; want %d", rr.Code, http.StatusInternalServerError)
+	}
+
+	// The failure released the key, so the retry is processed, not replayed.
+	rr := createMovie(app, 1, "key-1", moanaJSON)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry got status %d, replayed %q; want a fresh 201", rr.Code, rr.Header().Get("Idempotent-Replayed"))
+	}
+	if movies.count() != 1 {
+		t.Errorf("inserted %d movies; want 1", movies.count())
+	}
+}
+
+func TestCreateMovieIdempotencyKeyConcurrent(t *testing.T) {
+	const requests = 6
+
+	app, movies := newIdempotencyTestApplication(t)
+	movies.hold = make(chan struct{})
+
+	// Whichever request reserves the key first is held inside the insert
+	// while the others arrive.
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- createMovie(app, 1, "key-1", moanaJSON).Code
+		}()
+	}
+
+	counts := map[int]int{}
+	for i := 0; i < requests-1; i++ {
+		counts[<-codes]++
+	}
+	close(movies.hold)
+	wg.Wait()
+	counts[<-codes]++
+
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != requests-1 {
+		t.Fatalf("got statuses %v; want one 201 and %d 409s", counts, requests-1)
+	}
+	if movies.count() != 1 {
+		t.Fatalf("inserted %d movies; want 1", movies.count())
+	}
+
+	rr := createMovie(app, 1, "key-1", moanaJSON)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry after completion got status %d, replayed %q; want a replayed 201", rr.Code, rr.Header().Get("Idempotent-Replayed"))
+	}
+
+	var body struct {
+		Movie data.Movie `json:"movie"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Movie.Id != 1 {
+		t.Errorf("replayed movie %d; want 1", body.Movie.Id)
+	}
+}
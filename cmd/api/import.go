@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
+)
+
+// movieImportColumns are the columns an import must have. Columns are found by
+// their header, so a file written by the export, whose id and version columns
+// are ignored, can be imported as it is.
+var movieImportColumns = []string{"title", "year", "runtime", "genres", "director", "rating"}
+
+// movieImportRow is a movie read from one record of an import, with the line
+// it starts on.
+type movieImportRow struct {
+	line  int
+	movie *data.Movie
+}
+
+// readMovieImport parses a CSV import. Records that can't be turned into a
+// valid movie are reported by line in rowErrors rather than failing the whole
+// import; the returned error is only for files that can't be read at all.
+func (app *application) readMovieImport(body io.Reader) ([]movieImportRow, []envelope, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, errors.New("body must contain a header row")
+		}
+		return nil, nil, err
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	var missing []string
+	for _, name := range movieImportColumns {
+		if _, ok := columns[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, nil, fmt.Errorf("header is missing the %s columns", strings.Join(missing, ", "))
+	}
+
+	var rows []movieImportRow
+	var rowErrors []envelope
+	titles := make(map[string]bool)
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(rows)+len(rowErrors) == maxMovieBatchSize {
+			return nil, nil, fmt.Errorf("body must not contain more than %d movies", maxMovieBatchSize)
+		}
+
+		if len(record) != len(header) {
+			message := fmt.Sprintf("must have %d fields, like the header", len(header))
+			rowErrors = append(rowErrors, envelope{"line": line, "errors": map[string]string{"row": message}})
+			continue
+		}
+
+		v := validator.New()
+
+		movie := &data.Movie{
+			Title:    record[columns["title"]],
+			Genres:   []string{},
+			Director: record[columns["director"]],
+			Rating:   record[columns["rating"]],
+		}
+
+		// Genres are separated by "|", as in the export.
+		if genres := record[columns["genres"]]; genres != "" {
+			movie.Genres = data.NormalizeGenres(strings.Split(genres, "|"))
+		}
+
+		year, err := strconv.ParseInt(record[columns["year"]], 10, 32)
+		if err != nil {
+			v.AddError("year", "must be an integer")
+		}
+		movie.Year = int32(year)
+
+		err = movie.Runtime.UnmarshalText([]byte(record[columns["runtime"]]))
+		if err != nil {
+			v.AddError("runtime", "must be a number of minutes")
+		}
+
+		data.ValidateMovie(v, movie, app.config.movieLimits)
+
+		if app.config.movieUniqueTitles {
+			title := strings.ToLower(movie.Title)
+			v.Check(!titles[title], "title", "must not repeat the title of an earlier row")
+			titles[title] = true
+		}
+
+		if !v.Valid() {
+			rowErrors = append(rowErrors, envelope{"line": line, "errors": v.Errors})
+			continue
+		}
+		rows = append(rows, movieImportRow{line: line, movie: movie})
+	}
+
+	return rows, rowErrors, nil
+}
+
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		app.unsupportedMediaTypeResponse(w, r, "text/csv")
+		return
+	}
+
+	v := validator.New()
+
+	mode := app.readString(r.URL.Query(), "mode", "insert")
+	if v.Check(validator.PermittedValue(mode, "insert", "upsert"), "mode", "must be insert or upsert"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rows, rowErrors, err := app.readMovieImport(r.Body)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if v.Check(len(rows)+len(rowErrors) >= 1, "movies", "must contain at least 1 movie"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	imported := []envelope{}
+	created, updated := 0, 0
+
+	if len(rows) > 0 {
+		movies := make([]*data.Movie, len(rows))
+		titles := make([]string, len(rows))
+		for i, row := range rows {
+			movies[i] = row.movie
+			titles[i] = row.movie.Title
+		}
+		ctx := app.withAudit(r, data.AuditMovieImport, "movie", 0, map[string]any{"mode": mode, "titles": titles})
+
+		results, err := app.models.Movies.Import(ctx, movies, mode == "upsert")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for i, result := range results {
+			movie := rows[i].movie
+
+			switch result {
+			case data.ImportCreated:
+				created++
+				imported = append(imported, envelope{"line": rows[i].line, "id": movie.Id, "version": movie.Version, "status": "created"})
+				app.movieChanged(webhook.EventMovieCreated, movie.Id, movie.Version)
+				app.publishMovie(r, movie)
+			case data.ImportUpdated:
+				updated++
+				imported = append(imported, envelope{"line": rows[i].line, "id": movie.Id, "version": movie.Version, "status": "updated"})
+				app.movieChanged(webhook.EventMovieUpdated, movie.Id, movie.Version)
+			case data.ImportDuplicate:
+				rowErrors = append(rowErrors, envelope{"line": rows[i].line, "errors": map[string]string{"title": "a movie with this title already exists"}})
+			}
+		}
+	}
+
+	if rowErrors == nil {
+		rowErrors = []envelope{}
+	}
+	sort.SliceStable(rowErrors, func(i, j int) bool {
+		return rowErrors[i]["line"].(int) < rowErrors[j]["line"].(int)
+	})
+
+	app.writeResponse(w, r, http.StatusOK, envelope{
+		"created": created,
+		"updated": updated,
+		"failed":  len(rowErrors),
+		"movies":  imported,
+		"errors":  rowErrors,
+	}, nil)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// importMovies imports into a rollbackMovies, matching titles without regard
+// to case as the model does, and records the audit entry of each import.
+type importMovies struct {
+	*rollbackMovies
+	audit *memoryAudit
+}
+
+func (m importMovies) Import(ctx context.Context, movies []*data.Movie, upsert bool) ([]data.ImportResult, error) {
+	results := make([]data.ImportResult, len(movies))
+	for i, movie := range movies {
+		var existing *data.Movie
+		for _, stored := range m.movies {
+			if strings.EqualFold(stored.Title, movie.Title) {
+				stored := stored
+				existing = &stored
+			}
+		}
+
+		switch {
+		case existing == nil:
+			m.Insert(ctx, movie)
+			results[i] = data.ImportCreated
+		case upsert:
+			movie.Id, movie.Version = existing.Id, existing.Version
+			m.Update(ctx, movie)
+			results[i] = data.ImportUpdated
+		default:
+			results[i] = data.ImportDuplicate
+		}
+	}
+	m.audit.record(ctx)
+	return results, nil
+}
+
+// importReport is the body of a successful import.
+type importReport struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+	Movies  []struct {
+		Line    int    `json:"line"`
+		ID      int64  `json:"id"`
+		Version int32  `json:"version"`
+		Status  string `json:"status"`
+	} `json:"movies"`
+	Errors []struct {
+		Line   int               `json:"line"`
+		Errors map[string]string `json:"errors"`
+	} `json:"errors"`
+}
+
+func newImportTestApplication(t *testing.T) (*application, importMovies, string) {
+	t.Helper()
+
+	app := newSessionTestApplication(t,
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	movies := importMovies{
+		rollbackMovies: &rollbackMovies{movies: map[int64]data.Movie{
+			1: {Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1},
+		}, nextID: 1},
+		audit: &memoryAudit{},
+	}
+	app.models.Movies = movies
+	app.models.Audit = movies.audit
+	return app, movies, newSession(t, app, 2)
+}
+
+// importCSV posts body to the import endpoint as the editor.
+func importCSV(t *testing.T, app *application, token, query, body string) (*httptest.ResponseRecorder, importReport) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies/import"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer "+token)
+	rr := serve(app.routes(), r)
+
+	var report importReport
+	if rr.Code == http.StatusOK {
+		err := json.Unmarshal(rr.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, report
+}
+
+func TestImportMovies(t *testing.T) {
+	app, movies, token := newImportTestApplication(t)
+
+	// A file in the export's layout, whose id and version are ignored. Genres
+	// are normalized as they are for JSON.
+	body := "id,title,year,runtime,genres,version,director,rating\n" +
+		"7,Black Panther,2018,134,action| adventure|Action,3,Ryan Coogler,PG-13\n" +
+		"8,Deadpool,2016,108 mins,action|comedy,1,Tim Miller,R\n"
+
+	rr, report := importCSV(t, app, token, "", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if report.Created != 2 || report.Updated != 0 || report.Failed != 0 || len(report.Errors) != 0 {
+		t.Errorf("got report %+v; want two movies created", report)
+	}
+	if got := fmt.Sprint(report.Movies); got != "[{2 2 1 created} {3 3 1 created}]" {
+		t.Errorf("got movies %s; want lines 2 and 3 created as movies 2 and 3", got)
+	}
+
+	want := map[int64]string{
+		2: "Black Panther 2018 134 [action adventure] Ryan Coogler PG-13",
+		3: "Deadpool 2016 108 [action comedy] Tim Miller R",
+	}
+	for id, fields := range want {
+		movie := movies.movies[id]
+		if got := fmt.Sprintf("%s %d %d %v %s %s", movie.Title, movie.Year, movie.Runtime, movie.Genres, movie.Director, movie.Rating); got != fields {
+			t.Errorf("stored movie %d as %s; want %s", id, got, fields)
+		}
+	}
+
+	// The whole import is one audit entry.
+	if len(movies.audit.entries) != 1 || movies.audit.entries[0].Action != data.AuditMovieImport {
+		t.Errorf("got audit entries %+v; want one import", movies.audit.entries)
+	}
+}
+
+func TestImportMoviesMixed(t *testing.T) {
+	app, movies, token := newImportTestApplication(t)
+	app.config.movieUniqueTitles = true
+
+	// Columns may come in any order, and a quoted field may span lines.
+	body := "title,director,rating,year,runtime,genres\n" +
+		"Black Panther,Ryan Coogler,PG-13,2018,134,action\n" +
+		"Deadpool,Tim Miller,R,sometime,108,action\n" +
+		"MOANA,Ron Clements,PG,2016,107,animation\n" +
+		"Sing,Garth Jennings,PG\n" +
+		"\"The\nIrishman\",Martin Scorsese,X,2019,209,crime\n" +
+		"black panther,Ryan Coogler,PG-13,2018,134,action\n" +
+		"Coco,Lee Unkrich,PG,2017,105,animation|family\n"
+
+	rr, report := importCSV(t, app, token, "", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if report.Created != 2 || report.Updated != 0 || report.Failed != 5 {
+		t.Errorf("got created %d, updated %d and failed %d; want 2, 0 and 5", report.Created, report.Updated, report.Failed)
+	}
+	if got := fmt.Sprint(report.Movies); got != "[{2 2 1 created} {9 3 1 created}]" {
+		t.Errorf("got movies %s; want lines 2 and 9 created", got)
+	}
+
+	// Errors are reported by the line each record starts on, in order.
+	want := []string{
+		"3 map[year:must be an integer]",
+		"4 map[title:a movie with this title already exists]",
+		"5 map[row:must have 6 fields, like the header]",
+		"6 map[rating:must be one of G, PG, PG-13, R or NC-17]",
+		"8 map[title:must not repeat the title of an earlier row]",
+	}
+	if len(report.Errors) != len(want) {
+		t.Fatalf("got errors %+v; want %d", report.Errors, len(want))
+	}
+	for i, rowError := range report.Errors {
+		if got := fmt.Sprint(rowError.Line, " ", rowError.Errors); got != want[i] {
+			t.Errorf("errors[%d] is %s; want %s", i, got, want[i])
+		}
+	}
+
+	// Only the valid rows were written, and the existing movie is untouched.
+	if len(movies.movies) != 3 || movies.movies[1].Title != "Moana" || movies.movies[1].Version != 1 {
+		t.Errorf("got stored movies %+v; want Moana unchanged and two new movies", movies.movies)
+	}
+}
+
+func TestImportMoviesUpsert(t *testing.T) {
+	app, movies, token := newImportTestApplication(t)
+
+	body := "title,year,runtime,genres,director,rating\n" +
+		"moana,2016,107,animation|musical,Ron Clements,PG\n" +
+		"Coco,2017,105,animation,Lee Unkrich,PG\n"
+
+	rr, report := importCSV(t, app, token, "?mode=upsert", body)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if got := fmt.Sprint(report.Movies); got != "[{2 1 2 updated} {3 2 1 created}]" {
+		t.Errorf("got movies %s; want Moana updated and Coco created", got)
+	}
+	if report.Created != 1 || report.Updated != 1 || report.Failed != 0 {
+		t.Errorf("got report %+v; want one created and one updated", report)
+	}
+	if moana := movies.movies[1]; moana.Title != "moana" || fmt.Sprint(moana.Genres) != "[animation musical]" || moana.Version != 2 {
+		t.Errorf("stored Moana as %+v; want the imported row at version 2", moana)
+	}
+}
+
+func TestImportMoviesRejected(t *testing.T) {
+	const header = "title,year,runtime,genres,director,rating\n"
+	const row = "Coco,2017,105,animation,Lee Unkrich,PG\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		query       string
+		body        string
+		anonymous   bool
+		want        int
+	}{
+		{name: "anonymous", body: header + row, anonymous: true, want: http.StatusUnauthorized},
+		{name: "json", contentType: "application/json", body: `{"title":"Coco"}`, want: http.StatusUnsupportedMediaType},
+		{name: "unknown mode", query: "?mode=replace", body: header + row, want: http.StatusUnprocessableEntity},
+		{name: "empty body", want: http.StatusBadRequest},
+		{name: "missing columns", body: "title,year\nCoco,2017\n", want: http.StatusBadRequest},
+		{name: "header only", body: header, want: http.StatusUnprocessableEntity},
+		{name: "too many rows", body: header + strings.Repeat(row, maxMovieBatchSize+1), want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, movies, token := newImportTestApplication(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/import"+tt.query, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "text/csv")
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			if !tt.anonymous {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			rr := serve(app.routes(), r)
+			if rr.Code != tt.want {
+				t.Errorf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if len(movies.movies) != 1 || len(movies.audit.entries) != 0 {
+				t.Errorf("a rejected import stored %d movies and %d audit entries", len(movies.movies)-1, len(movies.audit.entries))
+			}
+		})
+	}
+}
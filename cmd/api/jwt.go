@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jwt"
+)
+
+const (
+	authModeStateful = "stateful"
+	authModeJWT      = "jwt"
+)
+
+// userClaims identifies the user and the token version the JWT was issued
+// under. Everything else about the user is loaded from the database, or from
+// the jwtUserCache, when the token is used.
+type userClaims struct {
+	jwt.RegisteredClaims
+	TokenVersion int `json:"ver"`
+}
+
+func (app *application) newJWT(user *data.User, ttl time.Duration) (*data.Token, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
+
+	claims := userClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(user.Id, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiry.Unix(),
+		},
+		TokenVersion: user.TokenVersion,
+	}
+
+	token, err := jwt.Sign(claims, app.config.auth.jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: token,
+		UserID:    user.Id,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+	}, nil
+}
+
+// userFromJWT verifies the token and loads the user it was issued to.
+// data.ErrRecordNotFound is returned if the user no longer exists or their
+// token version has moved on since the token was issued, which is how logging
+// out, resetting the password and ending every session revoke JWTs.
+//
+// The user is served from app.jwtUsers while the cached token version matches
+// the token's, so most requests are verified without a database round trip.
+func (app *application) userFromJWT(ctx context.Context, token string) (*data.User, error) {
+	var claims userClaims
+	err := jwt.Parse(token, app.config.auth.jwtSecret, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	if user, ok := app.jwtUsers.get(id); ok && user.TokenVersion == claims.TokenVersion {
+		return user, nil
+	}
+
+	user, err := app.models.Users.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	app.jwtUsers.set(user)
+
+	if user.TokenVersion != claims.TokenVersion {
+		return nil, data.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+type jwtUserCacheEntry struct {
+	user    data.User
+	expires time.Time
+}
+
+// jwtUserCache keeps the users JWTs were recently verified for, for ttl. A
+// write to a user through this process forgets them at once; one made through
+// another instance, such as a logout, is seen once the entry expires, so a
+// revoked JWT can be accepted elsewhere for up to ttl. A nil cache, or one
+// with a ttl of 0, caches nothing.
+type jwtUserCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[int64]jwtUserCacheEntry
+}
+
+const jwtUserCacheLen = 10000
+
+func newJWTUserCache(ttl time.Duration) *jwtUserCache {
+	return &jwtUserCache{ttl: ttl, entries: make(map[int64]jwtUserCacheEntry)}
+}
+
+func (c *jwtUserCache) get(id int64) (*data.User, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	user := entry.user
+	return &user, true
+}
+
+// set caches the user. When the cache is full, expired entries are swept and,
+// if that frees no room, the user isn't cached.
+func (c *jwtUserCache) set(user *data.User) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[user.Id]; !ok && len(c.entries) >= jwtUserCacheLen {
+		now := time.Now()
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= jwtUserCacheLen {
+			return
+		}
+	}
+	c.entries[user.Id] = jwtUserCacheEntry{user: *user, expires: time.Now().Add(c.ttl)}
+}
+
+// forget drops the user, after a write that changes their account or revokes
+// their tokens.
+func (c *jwtUserCache) forget(id int64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
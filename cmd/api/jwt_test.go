@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// jwtUsers is an in-memory user store holding just what JWT authentication
+// reads and writes.
+type jwtUsers struct {
+	data.IUserModel
+	users map[int64]*data.User
+	gets  int
+}
+
+func (m *jwtUsers) Get(ctx context.Context, id int64) (*data.User, error) {
+	m.gets++
+	user, ok := m.users[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (m *jwtUsers) RevokeTokens(ctx context.Context, userID int64) error {
+	if user, ok := m.users[userID]; ok {
+		user.TokenVersion++
+	}
+	return nil
+}
+
+func newJWTTestApplication(t *testing.T) (*application, *jwtUsers) {
+	t.Helper()
+
+	users := &jwtUsers{users: map[int64]*data.User{
+		1: {Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+		2: {Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1},
+	}}
+
+	app := newTestApplication(t)
+	app.config.auth.mode = authModeJWT
+	app.config.auth.jwtSecret = []byte(strings.Repeat("s", 32))
+	app.models.Users = users
+	return app, users
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	app, users := newJWTTestApplication(t)
+
+	issue := func(t *testing.T, id int64, ttl time.Duration) string {
+		t.Helper()
+		token, err := app.newJWT(users.users[id], ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Plaintext
+	}
+
+	tests := []struct {
+		name   string
+		token  func(t *testing.T) string
+		status int
+		userID int64
+	}{
+		{
+			name:   "valid",
+			token:  func(t *testing.T) string { return issue(t, 1, time.Minute) },
+			status: http.StatusOK,
+			userID: 1,
+		},
+		{
+			name:   "expired",
+			token:  func(t *testing.T) string { return issue(t, 1, -time.Second) },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "payload swapped for another user's",
+			token: func(t *testing.T) string {
+				alice := strings.Split(issue(t, 1, time.Minute), ".")
+				bob := strings.Split(issue(t, 2, time.Minute), ".")
+				return alice[0] + "." + bob[1] + "." + alice[2]
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signature altered",
+			token: func(t *testing.T) string {
+				parts := strings.Split(issue(t, 1, time.Minute), ".")
+				sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+				sig[0] ^= 0xff
+				return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signed with another secret",
+			token: func(t *testing.T) string {
+				secret := app.config.auth.jwtSecret
+				app.config.auth.jwtSecret = []byte(strings.Repeat("x", 32))
+				token, err := app.newJWT(users.users[1], time.Minute)
+				app.config.auth.jwtSecret = secret
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token.Plaintext
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "not a JWT",
+			token:  func(t *testing.T) string { return "ABCDEFGHIJKLMNOPQRSTUVWXYZ" },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "issued before the user's sessions were revoked",
+			token: func(t *testing.T) string {
+				token := issue(t, 2, time.Minute)
+				users.users[2].TokenVersion++
+				return token
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "user deleted",
+			token: func(t *testing.T) string {
+				users.users[3] = &data.User{Id: 3, Activated: true, TokenVersion: 1}
+				token := issue(t, 3, time.Minute)
+				delete(users.users, 3)
+				return token
+			},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var userID int64
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				userID = app.contextGetUser(r).Id
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token(t))
+
+			rr := serve(app.authenticate(next), r)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if userID != tt.userID {
+				t.Errorf("got user %d; want %d", userID, tt.userID)
+			}
+		})
+	}
+}
+
+func TestAuthenticateJWTReloadsUser(t *testing.T) {
+	app, users := newJWTTestApplication(t)
+
+	token, err := app.newJWT(users.users[1], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users.users[1].Activated = false
+	users.users[1].Role = "admin"
+
+	var user *data.User
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = app.contextGetUser(r)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+	rr := serve(app.authenticate(next), r)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+	}
+	if user.Activated || user.Role != "admin" {
+		t.Errorf("got activated %t and role %q; want the stored false and \"admin\"", user.Activated, user.Role)
+	}
+}
+
+func TestLogoutJWT(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		revoked bool
+	}{
+		{name: "every session", query: "", status: http.StatusOK, revoked: true},
+		{name: "current session only", query: "?current=true", status: http.StatusNotImplemented, revoked: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, users := newJWTTestApplication(t)
+
+			token, err := app.newJWT(users.users[1], time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := "Bearer " + token.Plaintext
+			logout := app.authenticate(http.HandlerFunc(app.deleteAuthenticationTokenHandler))
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/tokens/authentication"+tt.query, nil)
+			r.Header.Set("Authorization", auth)
+
+			rr := serve(logout, r)
+			if rr.Code != tt.status {
+				t.Fatalf("logout got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+
+			r = httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+			r.Header.Set("Authorization", auth)
+
+			rr = serve(app.authenticate(http.HandlerFunc(app.showCurrentUserHandler)), r)
+			if got := rr.Code == http.StatusUnauthorized; got != tt.revoked {
+				t.Errorf("token revoked %t; want %t (status %d)", got, tt.revoked, rr.Code)
+			}
+		})
+	}
+}
+
+func TestNewJWTCarriesTokenVersion(t *testing.T) {
+	app, users := newJWTTestApplication(t)
+	users.users[1].TokenVersion = 7
+
+	token, err := app.newJWT(users.users[1], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token.Plaintext, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"ver":` + strconv.Itoa(7); !strings.Contains(string(payload), want) {
+		t.Errorf("payload %s doesn't contain %s", payload, want)
+	}
+}
+
+func TestAuthenticateJWTUserCache(t *testing.T) {
+	app, users := newJWTTestApplication(t)
+	app.jwtUsers = newJWTUserCache(time.Minute)
+
+	authenticate := func(token *data.Token) int {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+		return serve(app.authenticate(http.HandlerFunc(app.showCurrentUserHandler)), r).Code
+	}
+
+	first, err := app.newJWT(users.users[1], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := authenticate(first); code != http.StatusOK {
+			t.Fatalf("request %d got status %d", i, code)
+		}
+	}
+	if users.gets != 1 {
+		t.Fatalf("loaded the user %d times for 3 requests; want 1", users.gets)
+	}
+
+	// Revoking through another instance isn't seen until the entry expires,
+	// but a token issued since then reloads the user.
+	users.users[1].TokenVersion++
+	second, err := app.newJWT(users.users[1], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := authenticate(first); code != http.StatusOK {
+		t.Errorf("old token before expiry got status %d; want the cached 200", code)
+	}
+	if code := authenticate(second); code != http.StatusOK {
+		t.Errorf("new token got status %d; want 200", code)
+	}
+	if code := authenticate(first); code != http.StatusUnauthorized {
+		t.Errorf("old token after reload got status %d; want 401", code)
+	}
+
+	// Revoking through this instance applies at once.
+	r := httptest.NewRequest(http.MethodDelete, "/v1/tokens/authentication", nil)
+	r.Header.Set("Authorization", "Bearer "+second.Plaintext)
+	if rr := serve(app.authenticate(http.HandlerFunc(app.deleteAuthenticationTokenHandler)), r); rr.Code != http.StatusOK {
+		t.Fatalf("logout got status %d: %s", rr.Code, rr.Body)
+	}
+	if code := authenticate(second); code != http.StatusUnauthorized {
+		t.Errorf("token after logout got status %d; want 401", code)
+	}
+}
+
+func TestJWTUserCacheDisabled(t *testing.T) {
+	app, users := newJWTTestApplication(t)
+	app.jwtUsers = newJWTUserCache(0)
+
+	token, err := app.newJWT(users.users[1], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+		r.Header.Set("Authorization", "Bearer "+token.Plaintext)
+		serve(app.authenticate(http.HandlerFunc(app.showCurrentUserHandler)), r)
+	}
+	if users.gets != 3 {
+		t.Errorf("loaded the user %d times for 3 requests; want 3", users.gets)
+	}
+}
@@ -1,100 +1,429 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"expvar"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/data"
 	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/limiter"
 	"github.com/Soul-Remix/greenlight/internal/mailer"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 )
 
 const version = "1.0.0"
 
 type config struct {
-	port string
-	env  string
-	db   struct {
+	port              string
+	env               string
+	logFormat         string
+	shutdownTimeout   time.Duration
+	drainDelay        time.Duration
+	strictPageSize    bool
+	movieLimits       data.MovieLimits
+	movieDefaultSort  string
+	movieHistoryDepth int
+	movieUniqueTitles bool
+	http              struct {
+		timeout        time.Duration
+		maxRequestBody int64
+	}
+	compression struct {
+		enabled bool
+		level   int
+		minSize int
+	}
+	db struct {
 		dsn          string
-		maxOpenConns string
-		maxIdleConns string
-		maxIdleTime  string
+		replicaDSN   string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  time.Duration
+		queryTimeout time.Duration
+		bulkTimeout  time.Duration
+		slowQuery    time.Duration
+		attempts     int
+		backoff      time.Duration
 	}
 	limiter struct {
-		rps     int
-		burst   int
-		enabled bool
+		rps       int
+		burst     int
+		enabled   bool
+		key       string
+		store     string
+		authRPS   float64
+		authBurst int
+	}
+	redis struct {
+		url string
 	}
 	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
+		host        string
+		port        int
+		username    string
+		password    string
+		sender      string
+		workers     int
+		queueSize   int
+		maxAttempts int
+	}
+	email struct {
+		verifyMX bool
 	}
 	cors struct {
-		trustedOrigins []string
+		trustedOrigins   []string
+		allowedMethods   []string
+		allowedHeaders   []string
+		exposedHeaders   []string
+		allowCredentials bool
+		maxAge           time.Duration
+	}
+	cursor struct {
+		secret []byte
+	}
+	trustedProxies []*net.IPNet
+	admin          struct {
+		allowCIDRs []*net.IPNet
+		denyCIDRs  []*net.IPNet
+	}
+	secureHeaders struct {
+		enabled bool
+		csp     string
+	}
+	prometheus struct {
+		enabled bool
+	}
+	featureFlags struct {
+		file string
+	}
+	debug struct {
+		enabled    bool
+		username   string
+		password   string
+		panicTrace bool
+	}
+	healthcheck struct {
+		dbTimeout time.Duration
+		smtp      bool
+	}
+	auth struct {
+		mode         string
+		jwtSecret    []byte
+		jwtUserCache time.Duration
 	}
+	tls struct {
+		certFile     string
+		keyFile      string
+		redirectPort string
+		hstsMaxAge   time.Duration
+	}
+	lockout struct {
+		maxAttempts int
+		duration    time.Duration
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	listCache struct {
+		size int
+		ttl  time.Duration
+	}
+	tokens struct {
+		purgeInterval     time.Duration
+		activationTTL     time.Duration
+		authenticationTTL time.Duration
+		refreshTTL        time.Duration
+		passwordResetTTL  time.Duration
+	}
+	webhooks struct {
+		urls        []string
+		secret      string
+		maxAttempts int
+	}
+
+	// envErrors holds the environment variables that couldn't be parsed,
+	// keyed by name, so that validate can report them with the rest.
+	envErrors map[string]string
 }
 
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config      config
+	db          *sql.DB
+	logger      *jsonlog.Logger
+	models      data.Models
+	mailer      mailer.IMailer
+	webhooks    webhook.Notifier
+	movieFeed   *movieFeed
+	listCache   *listCache
+	mxChecker   *mxChecker
+	jwtUsers    *jwtUserCache
+	features    *featureFlags
+	limiter     limiter.Limiter
+	authLimiter limiter.Limiter
+	wg          sync.WaitGroup
+
+	shuttingDown    atomic.Bool
+	inFlight        atomic.Int64
+	backgroundTasks atomic.Int64
+	httpMetrics     httpMetrics
 }
 
-func init() {
+func main() {
 	err := godotenv.Load(".env")
-
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
-}
 
-func main() {
 	var cfg config
 
-	flag.StringVar(&cfg.port, "port", getEnv("PORT", "4000"), "API server port")
-
-	flag.StringVar(&cfg.env, "env", getEnv("ENVIRONMENT", "development"), "Environment (development|staging|production)")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("GREENLIGHT_DB_DSN"), "PostgreSQL DSN")
-	flag.StringVar(&cfg.db.maxOpenConns, "db-max-open-conns", getEnv("DB_MAX_IDLE_TIME", "25"), "PostgreSQL max open connections")
-	flag.StringVar(&cfg.db.maxIdleConns, "db-max-idle-conns", getEnv("DB_MAX_IDLE_TIME", "25"), "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", getEnv("DB_MAX_IDLE_TIME", "15m"), "PostgreSQL max connection idle time")
-
-	flag.IntVar(&cfg.limiter.rps, "limiter-rps", getIntEnv("LIMITER_RPS", 2), "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", getIntEnv("LIMITER_BURST", 4), "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", getBoolEnv("LIMITER_ENABLED", true), "Enable rate limiter")
+	fs := newConfigFlags(flag.CommandLine)
+
+	var configFile string
+	fs.stringVar(&configFile, "config", "CONFIG_FILE", "", "Path to a JSON configuration file")
+
+	fs.stringVar(&cfg.port, "port", "PORT", "4000", "API server port")
+
+	fs.durationVar(&cfg.drainDelay, "shutdown-drain-delay", "SHUTDOWN_DRAIN_DELAY", 5*time.Second, "How long readyz fails before the listeners close on shutdown, so load balancers stop sending traffic")
+	fs.durationVar(&cfg.shutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", 20*time.Second, "Maximum time to wait for in-flight requests and background tasks on shutdown")
+
+	fs.boolVar(&cfg.strictPageSize, "strict-page-size", "STRICT_PAGE_SIZE", false, "Reject page_size values above the maximum instead of clamping them")
+	fs.intVar(&cfg.listCache.size, "list-cache-size", "LIST_CACHE_SIZE", 256, "Maximum number of cached movie listings (0 disables)")
+	fs.durationVar(&cfg.listCache.ttl, "list-cache-ttl", "LIST_CACHE_TTL", 10*time.Second, "How long a cached movie listing may be served")
+	fs.intVar(&cfg.movieLimits.MaxGenres, "movie-max-genres", "MOVIE_MAX_GENRES", data.DefaultMovieLimits.MaxGenres, "Maximum number of genres per movie")
+	fs.intVar(&cfg.movieLimits.MaxGenreLength, "movie-max-genre-length", "MOVIE_MAX_GENRE_LENGTH", data.DefaultMovieLimits.MaxGenreLength, "Maximum length of a genre in bytes")
+	fs.boolVar(&cfg.movieUniqueTitles, "movie-unique-titles", "MOVIE_UNIQUE_TITLES", false, "Reject a movie whose title, ignoring case, is taken by another live movie")
+	fs.intVar(&cfg.movieHistoryDepth, "movie-history-depth", "MOVIE_HISTORY_DEPTH", 20, "Number of prior versions kept for each movie (0 disables history)")
+	fs.stringVar(&cfg.movieDefaultSort, "movies-default-sort", "MOVIES_DEFAULT_SORT", "id", "Sort for movie listings that don't give one; prefix with - for descending order")
+
+	fs.stringVar(&cfg.tls.certFile, "tls-cert", "TLS_CERT", "", "Path to a PEM encoded TLS certificate (enables HTTPS)")
+	fs.stringVar(&cfg.tls.keyFile, "tls-key", "TLS_KEY", "", "Path to the PEM encoded TLS private key")
+	fs.stringVar(&cfg.tls.redirectPort, "tls-redirect-port", "TLS_REDIRECT_PORT", "", "Port for a plain HTTP listener that redirects to HTTPS (empty disables)")
+	fs.durationVar(&cfg.tls.hstsMaxAge, "hsts-max-age", "HSTS_MAX_AGE", 180*24*time.Hour, "Strict-Transport-Security max-age for HTTPS responses (0 disables)")
+
+	fs.durationVar(&cfg.http.timeout, "http-timeout", "HTTP_TIMEOUT", 10*time.Second, "Maximum time to process a request")
+
+	fs.int64Var(&cfg.http.maxRequestBody, "max-request-body", "MAX_REQUEST_BODY", 1_048_576, "Maximum request body size in bytes")
+
+	fs.boolVar(&cfg.compression.enabled, "compression-enabled", "COMPRESSION_ENABLED", true, "Enable gzip/deflate response compression")
+	fs.intVar(&cfg.compression.level, "compression-level", "COMPRESSION_LEVEL", gzip.DefaultCompression, "Response compression level (-1 to 9)")
+	fs.intVar(&cfg.compression.minSize, "compression-min-size", "COMPRESSION_MIN_SIZE", 1024, "Minimum response size in bytes before compressing")
+
+	fs.stringVar(&cfg.env, "env", "ENVIRONMENT", "development", "Environment (development|staging|production)")
+	fs.stringVar(&cfg.logFormat, "log-format", "LOG_FORMAT", "json", "Log output format (json|text)")
+	fs.stringVar(&cfg.db.dsn, "db-dsn", "GREENLIGHT_DB_DSN", "", "PostgreSQL DSN")
+	fs.stringVar(&cfg.db.replicaDSN, "db-replica-dsn", "DB_REPLICA_DSN", "", "PostgreSQL read replica DSN used for movie listings (defaults to the primary)")
+	fs.intVar(&cfg.db.maxOpenConns, "db-max-open-conns", "DB_MAX_OPEN_CONNS", 25, "PostgreSQL max open connections")
+	fs.intVar(&cfg.db.maxIdleConns, "db-max-idle-conns", "DB_MAX_IDLE_CONNS", 25, "PostgreSQL max idle connections")
+	fs.durationVar(&cfg.db.maxIdleTime, "db-max-idle-time", "DB_MAX_IDLE_TIME", 15*time.Minute, "PostgreSQL max connection idle time")
+	fs.durationVar(&cfg.db.queryTimeout, "db-query-timeout", "DB_QUERY_TIMEOUT", 3*time.Second, "PostgreSQL per-query timeout")
+	fs.durationVar(&cfg.db.bulkTimeout, "db-bulk-timeout", "DB_BULK_TIMEOUT", 30*time.Second, "PostgreSQL timeout for bulk writes such as batch inserts and imports")
+	fs.durationVar(&cfg.db.slowQuery, "db-slow-query-threshold", "DB_SLOW_QUERY_THRESHOLD", 0, "Log queries that take longer than this (0 disables)")
+	fs.intVar(&cfg.db.attempts, "db-connect-attempts", "DB_CONNECT_ATTEMPTS", 5, "Times to try reaching PostgreSQL at startup before giving up")
+	fs.durationVar(&cfg.db.backoff, "db-connect-backoff", "DB_CONNECT_BACKOFF", time.Second, "Wait before the first startup retry, doubled after each one")
+
+	fs.intVar(&cfg.limiter.rps, "limiter-rps", "LIMITER_RPS", 2, "Rate limiter maximum requests per second")
+	fs.intVar(&cfg.limiter.burst, "limiter-burst", "LIMITER_BURST", 4, "Rate limiter maximum burst")
+	fs.boolVar(&cfg.limiter.enabled, "limiter-enabled", "LIMITER_ENABLED", true, "Enable rate limiter")
+	fs.stringVar(&cfg.limiter.key, "limiter-key", "LIMITER_KEY", "ip", "Rate limiter key (ip|user)")
+	fs.stringVar(&cfg.limiter.store, "limiter-store", "LIMITER_STORE", "memory", "Rate limiter store (memory|redis)")
+	fs.float64Var(&cfg.limiter.authRPS, "limiter-auth-rps", "LIMITER_AUTH_RPS", 0.2, "Rate limiter maximum requests per second for registration and token endpoints")
+	fs.intVar(&cfg.limiter.authBurst, "limiter-auth-burst", "LIMITER_AUTH_BURST", 5, "Rate limiter maximum burst for registration and token endpoints")
+
+	fs.stringVar(&cfg.redis.url, "redis-url", "REDIS_URL", "redis://localhost:6379/0", "Redis URL")
+
+	fs.stringVar(&cfg.smtp.host, "smtp-host", "SMTP_HOST", "", "SMTP host")
+	fs.intVar(&cfg.smtp.port, "smtp-port", "SMTP_PORT", 25, "SMTP port")
+	fs.stringVar(&cfg.smtp.username, "smtp-username", "SMTP_USERNAME", "", "SMTP username")
+	fs.stringVar(&cfg.smtp.password, "smtp-password", "SMTP_PASSWORD", "", "SMTP password")
+	fs.stringVar(&cfg.smtp.sender, "smtp-sender", "SMTP_SENDER", "", "SMTP sender")
+	fs.intVar(&cfg.smtp.workers, "smtp-workers", "SMTP_WORKERS", 4, "Number of mail delivery workers")
+	fs.intVar(&cfg.smtp.queueSize, "smtp-queue-size", "SMTP_QUEUE_SIZE", 100, "Maximum number of queued emails")
+	fs.intVar(&cfg.smtp.maxAttempts, "smtp-max-attempts", "SMTP_MAX_ATTEMPTS", 3, "Maximum delivery attempts for transient SMTP failures")
+	fs.boolVar(&cfg.email.verifyMX, "email-verify-mx", "EMAIL_VERIFY_MX", false, "Reject email addresses whose domain has no MX record")
+
+	fs.funcVar("cors-trusted-origins", "Trusted CORS origins (comma or space separated)", func(val string) error {
+		origins, err := parseTrustedOrigins(val)
+		if err != nil {
+			return err
+		}
+		cfg.cors.trustedOrigins = origins
+		return nil
+	}, "CORS_TRUSTED_ORIGINS", "CORS_TRUSTED_ORIGIN")
+	fs.funcVar("cors-allowed-methods", "Methods allowed in CORS preflight responses (comma or space separated)", func(val string) error {
+		cfg.cors.allowedMethods = splitList(val)
+		return nil
+	}, "CORS_ALLOWED_METHODS")
+	fs.funcVar("cors-allowed-headers", "Request headers allowed in CORS preflight responses (comma or space separated)", func(val string) error {
+		cfg.cors.allowedHeaders = splitList(val)
+		return nil
+	}, "CORS_ALLOWED_HEADERS")
+	fs.funcVar("cors-exposed-headers", "Response headers exposed to CORS requests (comma or space separated)", func(val string) error {
+		cfg.cors.exposedHeaders = splitList(val)
+		return nil
+	}, "CORS_EXPOSED_HEADERS")
+	fs.boolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", "CORS_ALLOW_CREDENTIALS", false, "Allow credentialed CORS requests")
+	fs.durationVar(&cfg.cors.maxAge, "cors-max-age", "CORS_MAX_AGE", 0, "How long browsers may cache CORS preflight responses (0 omits the header)")
 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", getEnv("SMTP_HOST", ""), "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", getIntEnv("SMTP_PORT", 25), "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", getEnv("SMTP_USERNAME", ""), "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", getEnv("SMTP_PASSWORD", ""), "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", getEnv("SMTP_SENDER", "15m"), "SMTP sender")
+	fs.funcVar("webhook-urls", "Endpoints notified of movie changes (comma or space separated)", func(val string) error {
+		cfg.webhooks.urls = splitList(val)
+		return nil
+	}, "WEBHOOK_URLS")
+	fs.stringVar(&cfg.webhooks.secret, "webhook-secret", "WEBHOOK_SECRET", "", "Shared secret used to sign webhook payloads")
+	fs.intVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", "WEBHOOK_MAX_ATTEMPTS", 5, "Maximum delivery attempts for each webhook")
+
+	fs.funcVar("trusted-proxy-cidrs", "Proxies whose X-Forwarded-For header is trusted (comma separated CIDRs)", func(val string) error {
+		networks, err := parseCIDRs(val)
+		cfg.trustedProxies = networks
+		return err
+	}, "TRUSTED_PROXY_CIDRS")
+
+	fs.funcVar("admin-allow-cidrs", "Networks allowed to reach admin endpoints (comma separated CIDRs, empty allows all)", func(val string) error {
+		networks, err := parseCIDRs(val)
+		cfg.admin.allowCIDRs = networks
+		return err
+	}, "ADMIN_ALLOW_CIDRS")
+	fs.funcVar("admin-deny-cidrs", "Networks denied access to admin endpoints (comma separated CIDRs)", func(val string) error {
+		networks, err := parseCIDRs(val)
+		cfg.admin.denyCIDRs = networks
+		return err
+	}, "ADMIN_DENY_CIDRS")
+
+	fs.boolVar(&cfg.secureHeaders.enabled, "secure-headers-enabled", "SECURE_HEADERS_ENABLED", true, "Set security related response headers")
+	fs.stringVar(&cfg.secureHeaders.csp, "content-security-policy", "CONTENT_SECURITY_POLICY", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy header value (empty to omit)")
+
+	fs.boolVar(&cfg.prometheus.enabled, "prometheus-enabled", "PROMETHEUS_ENABLED", false, "Expose Prometheus metrics at /metrics")
+	fs.boolVar(&cfg.debug.enabled, "debug-enabled", "DEBUG_ENABLED", true, "Expose expvar metrics at /debug/vars")
+	fs.stringVar(&cfg.debug.username, "debug-username", "DEBUG_USERNAME", "", "Basic Auth username for /debug/vars and /metrics")
+	fs.stringVar(&cfg.debug.password, "debug-password", "DEBUG_PASSWORD", "", "Basic Auth password for /debug/vars and /metrics")
+	fs.stringVar(&cfg.featureFlags.file, "feature-flags-file", "FEATURE_FLAGS_FILE", "", "JSON file of feature flags, reread on SIGHUP")
+	fs.boolVar(&cfg.debug.panicTrace, "debug-panic-trace", "DEBUG_PANIC_TRACE", false, "Include the stack trace of a panic in its response (development only)")
+
+	fs.durationVar(&cfg.healthcheck.dbTimeout, "healthcheck-db-timeout", "HEALTHCHECK_DB_TIMEOUT", time.Second, "Healthcheck database ping timeout")
+	fs.boolVar(&cfg.healthcheck.smtp, "healthcheck-smtp", "HEALTHCHECK_SMTP", false, "Include SMTP connectivity in the healthcheck")
+	fs.intVar(&cfg.lockout.maxAttempts, "lockout-max-attempts", "LOCKOUT_MAX_ATTEMPTS", 5, "Consecutive failed logins before an account is locked (0 disables)")
+	fs.durationVar(&cfg.lockout.duration, "lockout-duration", "LOCKOUT_DURATION", 15*time.Minute, "How long an account stays locked")
+
+	fs.durationVar(&cfg.idempotency.ttl, "idempotency-ttl", "IDEMPOTENCY_TTL", 24*time.Hour, "How long Idempotency-Key responses are kept for replay")
+	fs.durationVar(&cfg.tokens.purgeInterval, "token-purge-interval", "TOKEN_PURGE_INTERVAL", time.Hour, "How often expired tokens are deleted (0 disables)")
+	fs.durationVar(&cfg.tokens.activationTTL, "activation-token-ttl", "ACTIVATION_TOKEN_TTL", 3*24*time.Hour, "How long activation tokens are valid")
+	fs.durationVar(&cfg.tokens.authenticationTTL, "authentication-token-ttl", "AUTHENTICATION_TOKEN_TTL", 24*time.Hour, "How long authentication tokens are valid")
+	fs.durationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", "REFRESH_TOKEN_TTL", 30*24*time.Hour, "How long refresh tokens are valid")
+	fs.durationVar(&cfg.tokens.passwordResetTTL, "password-reset-token-ttl", "PASSWORD_RESET_TOKEN_TTL", 45*time.Minute, "How long password reset tokens are valid")
+
+	fs.stringVar(&cfg.auth.mode, "auth-mode", "AUTH_MODE", authModeStateful, "Authentication token mode (stateful|jwt)")
+	fs.funcVar("jwt-secret", "Secret used to sign JWT authentication tokens", func(val string) error {
+		cfg.auth.jwtSecret = []byte(val)
+		return nil
+	}, "JWT_SECRET")
+	fs.durationVar(&cfg.auth.jwtUserCache, "jwt-user-cache-ttl", "JWT_USER_CACHE_TTL", 30*time.Second, "How long a JWT's user is cached between database checks; a revocation made through another instance takes up to this long to apply (0 disables)")
 
-	flag.Func("cors-trusted-origins", "Trusted CORS origins", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Split(getEnv("CORS_TRUSTED_ORIGIN", "*"), ",")
+	fs.funcVar("cursor-secret", "Secret used to sign pagination cursors", func(val string) error {
+		cfg.cursor.secret = []byte(val)
 		return nil
-	})
+	}, "CURSOR_SECRET")
 
 	flag.Parse()
 
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	var unknownConfigKeys []string
+	if configFile != "" {
+		var err error
+		unknownConfigKeys, err = loadConfigFile(fs, configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg.cors.trustedOrigins == nil {
+		cfg.cors.trustedOrigins = fs.trustedOriginsFromEnv()
+	}
+	if cfg.cors.allowedMethods == nil {
+		cfg.cors.allowedMethods = splitList(getEnv("CORS_ALLOWED_METHODS", "OPTIONS, PUT, PATCH, DELETE"))
+	}
+	if cfg.cors.allowedHeaders == nil {
+		cfg.cors.allowedHeaders = splitList(getEnv("CORS_ALLOWED_HEADERS", "Authorization, Content-Type, Idempotency-Key, Prefer"))
+	}
+	if cfg.cors.exposedHeaders == nil {
+		cfg.cors.exposedHeaders = splitList(getEnv("CORS_EXPOSED_HEADERS", ""))
+	}
+
+	if cfg.webhooks.urls == nil {
+		cfg.webhooks.urls = splitList(getEnv("WEBHOOK_URLS", ""))
+	}
+
+	if cfg.trustedProxies == nil {
+		networks, err := parseCIDRs(getEnv("TRUSTED_PROXY_CIDRS", ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.trustedProxies = networks
+	}
+
+	if cfg.admin.allowCIDRs == nil {
+		networks, err := parseCIDRs(getEnv("ADMIN_ALLOW_CIDRS", ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.admin.allowCIDRs = networks
+	}
+
+	if cfg.admin.denyCIDRs == nil {
+		networks, err := parseCIDRs(getEnv("ADMIN_DENY_CIDRS", ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.admin.denyCIDRs = networks
+	}
+
+	if len(cfg.cursor.secret) == 0 {
+		cfg.cursor.secret = []byte(os.Getenv("CURSOR_SECRET"))
+	}
+
+	if len(cfg.cursor.secret) == 0 {
+		cfg.cursor.secret = make([]byte, 32)
+		_, err := rand.Read(cfg.cursor.secret)
+		if err != nil {
+			log.Fatal("failed to generate cursor secret")
+		}
+	}
+
+	if len(cfg.auth.jwtSecret) == 0 {
+		cfg.auth.jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	}
+
+	cfg.envErrors = fs.envErrors
+
+	formatter := jsonlog.JSONFormatter
+	if cfg.logFormat == "text" {
+		formatter = jsonlog.TextFormatter
+	}
+
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo, formatter)
+
+	warnUnknownConfigKeys(logger, unknownConfigKeys)
+
+	if problems := cfg.validate(); len(problems) > 0 {
+		logger.PrintFatal(errors.New("invalid configuration"), problems)
+	}
 
-	db, err := openDB(cfg)
+	db, err := openDB(cfg, cfg.db.dsn, "primary", logger)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
@@ -102,6 +431,17 @@ func main() {
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil)
 
+	var replica *sql.DB
+	if cfg.db.replicaDSN != "" {
+		replica, err = openDB(cfg, cfg.db.replicaDSN, "replica", logger)
+		if err != nil {
+			logger.PrintFatal(err, map[string]string{"pool": "replica"})
+		}
+
+		defer replica.Close()
+		logger.PrintInfo("database replica connection pool established", nil)
+	}
+
 	expvar.NewString("version").Set(version)
 
 	expvar.Publish("goroutines", expvar.Func(func() any {
@@ -112,18 +452,62 @@ func main() {
 		return db.Stats()
 	}))
 
+	// Pulled out of the stats above so that pool saturation is easy to
+	// graph and alert on.
+	expvar.Publish("database_wait_count", expvar.Func(func() any {
+		return db.Stats().WaitCount
+	}))
+
+	expvar.Publish("database_wait_duration_μs", expvar.Func(func() any {
+		return db.Stats().WaitDuration.Microseconds()
+	}))
+
 	expvar.Publish("timestamp", expvar.Func(func() any {
 		return time.Now().Unix()
 	}))
 
+	lim, err := openLimiter(cfg, float64(cfg.limiter.rps), cfg.limiter.burst)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	authLim, err := openLimiter(cfg, cfg.limiter.authRPS, cfg.limiter.authBurst)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
-		wg:     sync.WaitGroup{},
+		config:      cfg,
+		db:          db,
+		logger:      logger,
+		models:      data.NewModels(db, replica, cfg.db.queryTimeout, cfg.db.bulkTimeout, cfg.movieHistoryDepth, cfg.movieUniqueTitles),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender, cfg.smtp.queueSize, cfg.smtp.maxAttempts, logger.PrintInfo),
+		webhooks:    webhook.New(cfg.webhooks.urls, cfg.webhooks.secret, cfg.webhooks.maxAttempts),
+		movieFeed:   newMovieFeed(),
+		listCache:   newListCache(cfg.listCache.size, cfg.listCache.ttl),
+		jwtUsers:    newJWTUserCache(cfg.auth.jwtUserCache),
+		limiter:     lim,
+		authLimiter: authLim,
+		wg:          sync.WaitGroup{},
+	}
+
+	expvar.Publish("mailer_queued", expvar.Func(func() any {
+		return app.mailer.Queued()
+	}))
+
+	app.features, err = newFeatureFlags(cfg.featureFlags.file)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.email.verifyMX {
+		app.mxChecker = newMXChecker(net.DefaultResolver, mxCacheTTL)
 	}
 
+	app.mailer.Start(cfg.smtp.workers, &app.wg, func(err error) {
+		logger.PrintError(err, nil)
+	})
+
 	err = app.serve()
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -137,56 +521,158 @@ func getEnv(env string, value string) string {
 	return value
 }
 
-func getIntEnv(env string, value int) int {
+// envError describes an environment variable value that couldn't be parsed.
+func envError(v, want string) error {
+	return fmt.Errorf("must be %s, got %q", want, v)
+}
+
+func getIntEnv(env string, value int) (int, error) {
 	v := os.Getenv(env)
 	if v == "" {
-		return value
+		return value, nil
 	}
 	n, err := strconv.Atoi(v)
 	if err != nil {
-		log.Fatal("failed to parse int env variable")
+		return value, envError(v, "an integer")
 	}
-	return n
+	return n, nil
 }
 
-func getBoolEnv(env string, value bool) bool {
+func getFloatEnv(env string, value float64) (float64, error) {
 	v := os.Getenv(env)
 	if v == "" {
-		return value
+		return value, nil
 	}
-	b, err := strconv.ParseBool(v)
+	n, err := strconv.ParseFloat(v, 64)
 	if err != nil {
-		log.Fatal("failed to parse bool env variable")
+		return value, envError(v, "a number")
 	}
-	return b
+	return n, nil
 }
 
-func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
+func getBoolEnv(env string, value bool) (bool, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return value, nil
+	}
+	b, err := strconv.ParseBool(v)
 	if err != nil {
-		return nil, err
+		return value, envError(v, "true or false")
 	}
+	return b, nil
+}
 
-	maxOpenCon, _ := strconv.Atoi(cfg.db.maxOpenConns)
-	maxIdleCon, _ := strconv.Atoi(cfg.db.maxIdleConns)
+func getDurationEnv(env string, value time.Duration) (time.Duration, error) {
+	v := os.Getenv(env)
+	if v == "" {
+		return value, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return value, envError(v, "a duration such as 5s or 1m")
+	}
+	return d, nil
+}
 
-	db.SetMaxOpenConns(maxOpenCon)
-	db.SetMaxIdleConns(maxIdleCon)
+func openLimiter(cfg config, rps float64, burst int) (limiter.Limiter, error) {
+	if cfg.limiter.store != "redis" {
+		return limiter.NewMemory(rps, burst), nil
+	}
 
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	opts, err := redis.ParseURL(cfg.redis.url)
 	if err != nil {
 		return nil, err
 	}
 
-	db.SetConnMaxIdleTime(duration)
+	client := redis.NewClient(opts)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err = db.PingContext(ctx)
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return limiter.NewRedis(client, rps, burst), nil
+}
+
+// openDB opens and pings the pool for dsn. With a slow query threshold set,
+// statements that exceed it are logged with the name of the pool.
+func openDB(cfg config, dsn, pool string, logger *jsonlog.Logger) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
 	if err != nil {
 		return nil, err
 	}
 
+	return openConnector(cfg, connector, pool, logger)
+}
+
+// openConnector is openDB for any driver.Connector, so that tests can stand
+// in for the database.
+func openConnector(cfg config, connector driver.Connector, pool string, logger *jsonlog.Logger) (*sql.DB, error) {
+	if cfg.db.slowQuery > 0 {
+		connector = data.SlowQueryConnector(connector, cfg.db.slowQuery, func(label string, elapsed time.Duration) {
+			logger.PrintInfo("slow query", map[string]string{
+				"pool":      pool,
+				"statement": label,
+				"elapsed":   elapsed.String(),
+			})
+		})
+	}
+
+	db := sql.OpenDB(connector)
+	configurePool(db, cfg)
+
+	err := retryConnect(cfg.db.attempts, cfg.db.backoff, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return db.PingContext(ctx)
+	}, func(attempt int, wait time.Duration, err error) {
+		logger.PrintInfo("database unreachable, retrying", map[string]string{
+			"pool":     pool,
+			"error":    err.Error(),
+			"attempt":  strconv.Itoa(attempt),
+			"attempts": strconv.Itoa(cfg.db.attempts),
+			"retry_in": wait.String(),
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// configurePool applies the pool settings from cfg to db.
+func configurePool(db *sql.DB, cfg config) {
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetConnMaxIdleTime(cfg.db.maxIdleTime)
+}
+
+// retryConnect calls connect up to attempts times until it succeeds, waiting
+// backoff before the first retry and twice as long before each one after
+// that. onRetry is told about each failure that will be retried.
+func retryConnect(attempts int, backoff time.Duration, connect func() error, onRetry func(attempt int, wait time.Duration, err error)) error {
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = connect()
+		if err == nil {
+			return nil
+		}
+
+		if attempt < attempts {
+			onRetry(attempt, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	if attempts > 1 {
+		return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+	}
+	return err
+}
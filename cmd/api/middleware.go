@@ -1,115 +1,559 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"expvar"
 	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jwt"
+	"github.com/Soul-Remix/greenlight/internal/limiter"
 	"github.com/Soul-Remix/greenlight/internal/validator"
-	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+var requestIDRX = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validator.Matches(id, requestIDRX) {
+			id = newRequestID()
+		}
+
+		r = app.contextSetRequestID(r, id)
+		w.Header().Set("X-Request-ID", id)
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		app.logger.PrintInfo("request completed", map[string]string{
+			"request_id":     id,
+			"request_method": r.Method,
+			"request_path":   r.URL.Path,
+			"remote_addr":    app.realIP(r),
+			"status":         strconv.Itoa(sr.status),
+			"bytes":          strconv.Itoa(sr.bytes),
+			"duration":       time.Since(start).String(),
+		})
+	})
+}
+
+// handlerPanic carries a panic from the goroutine it happened on, along with
+// the stack at that point, so that recoverPanic can report where it came from
+// rather than where it was passed on.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				p, ok := err.(handlerPanic)
+				if !ok {
+					p = handlerPanic{value: err, stack: debug.Stack()}
+				}
+
+				// net/http uses this value to abort a response silently.
+				if p.value == http.ErrAbortHandler {
+					panic(p.value)
+				}
+
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				app.panicResponse(w, r, fmt.Errorf("%v", p.value), p.stack)
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
 	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+	if !tw.wroteHeader {
+		tw.status = http.StatusOK
+		tw.wroteHeader = true
+	}
+	return tw.body.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.status = status
+	tw.wroteHeader = true
+}
+
+// timeout buffers the response of next so that nothing reaches the client if
+// the deadline passes first. Streaming endpoints that flush as they go can't
+// be buffered and are listed in skip.
+func (app *application) timeout(next http.Handler, skip ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if validator.PermittedValue(r.URL.Path, skip...) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.http.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
 
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan any, 1)
 
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					if _, ok := err.(handlerPanic); !ok {
+						err = handlerPanic{value: err, stack: debug.Stack()}
+					}
+					panicChan <- err
 				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case err := <-panicChan:
+			panic(err)
+
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			for key, value := range tw.header {
+				w.Header()[key] = value
+			}
+			if !tw.wroteHeader {
+				tw.status = http.StatusOK
 			}
-			mu.Unlock()
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			app.requestTimeoutResponse(w, r)
 		}
-	}()
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			ip := realip.FromRequest(r)
+	})
+}
 
-			mu.Lock()
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.secureHeaders.enabled {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("X-Frame-Options", "DENY")
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			if app.config.secureHeaders.csp != "" {
+				w.Header().Set("Content-Security-Policy", app.config.secureHeaders.csp)
 			}
-			clients[ip].lastSeen = time.Now()
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
+			// Browsers ignore HSTS received over plain HTTP, and sending it
+			// there could pin clients to HTTPS on a host that doesn't serve it.
+			if r.TLS != nil && app.config.tls.hstsMaxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d", int64(app.config.tls.hstsMaxAge.Seconds())))
 			}
-			mu.Unlock()
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) authenticate(next http.Handler) http.Handler {
+func (app *application) limitRequestBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Vary", "Authorization")
+		if r.ContentLength > app.config.http.maxRequestBody {
+			app.requestTooLargeResponse(w, r)
+			return
+		}
 
-		authorizationHeader := r.Header.Get("Authorization")
+		r.Body = http.MaxBytesReader(w, r.Body, app.config.http.maxRequestBody)
+		next.ServeHTTP(w, r)
+	})
+}
 
-		if authorizationHeader == "" {
-			r = app.contextSetUser(r, data.AnonymousUser)
-			next.ServeHTTP(w, r)
+// realIP returns the address of the client that made the request. The
+// X-Forwarded-For header is only believed when the direct peer is one of the
+// trusted proxies, in which case the header is walked from the right and the
+// first address that isn't itself a trusted proxy is the client.
+func (app *application) realIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		if !app.trustedProxy(hops[i]) {
+			return hops[i]
+		}
+		peer = hops[i]
+	}
+	return peer
+}
+
+func (app *application) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range app.config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireDebugCredentials protects the debug endpoints with HTTP Basic Auth
+// when debug credentials are configured. The credentials are hashed before
+// being compared in constant time, so that neither their content nor their
+// length leaks through timing.
+func (app *application) requireDebugCredentials(next http.Handler) http.Handler {
+	if app.config.debug.username == "" {
+		return next
+	}
+
+	expectedUsername := sha256.Sum256([]byte(app.config.debug.username))
+	expectedPassword := sha256.Sum256([]byte(app.config.debug.password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if ok {
+			usernameHash := sha256.Sum256([]byte(username))
+			passwordHash := sha256.Sum256([]byte(password))
+
+			usernameMatch := subtle.ConstantTimeCompare(usernameHash[:], expectedUsername[:]) == 1
+			passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], expectedPassword[:]) == 1
+			ok = usernameMatch && passwordMatch
+		}
+
+		if !ok {
+			app.debugCredentialsRequiredResponse(w, r)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipFilter returns a middleware that only lets through clients whose address
+// is covered by allow, when allow is non-empty, and not covered by deny. Deny
+// takes precedence over allow.
+func (app *application) ipFilter(allow, deny []*net.IPNet) func(http.HandlerFunc) http.HandlerFunc {
+	contains := func(networks []*net.IPNet, ip net.IP) bool {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if len(allow) == 0 && len(deny) == 0 {
+			return next
+		}
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(app.realIP(r))
+			if ip == nil || contains(deny, ip) || (len(allow) > 0 && !contains(allow, ip)) {
+				app.forbiddenAddressResponse(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+func (app *application) rateLimitKey(r *http.Request) string {
+	if app.config.limiter.key == "user" {
+		user, ok := r.Context().Value(userContextKey).(*data.User)
+		if ok && !user.IsAnonymous() {
+			return "user:" + strconv.FormatInt(user.Id, 10)
+		}
+	}
+	return "ip:" + app.realIP(r)
+}
+
+// allow consults lim for the request and writes a 429 response when the
+// client is over its limit. A broken limiter store shouldn't take the whole API
+// down with it, so failures are logged and the request is let through.
+func (app *application) allow(w http.ResponseWriter, r *http.Request, lim limiter.Limiter, key string) bool {
+	if !app.config.limiter.enabled {
+		return true
+	}
+
+	allowed, retryAfter, err := lim.Allow(r.Context(), key)
+	if err != nil {
+		app.logError(r, err)
+		return true
+	}
 
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+	if !allowed {
+		app.rateLimitExceededResponse(w, r, retryAfter)
+		return false
+	}
+	return true
+}
+
+// peek is allow for a limiter whose token is only taken once the outcome of
+// the request is known.
+func (app *application) peek(w http.ResponseWriter, r *http.Request, lim limiter.Limiter, key string) bool {
+	if !app.config.limiter.enabled {
+		return true
+	}
+
+	allowed, retryAfter, err := lim.Peek(r.Context(), key)
+	if err != nil {
+		app.logError(r, err)
+		return true
+	}
+
+	if !allowed {
+		app.rateLimitExceededResponse(w, r, retryAfter)
+		return false
+	}
+	return true
+}
+
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.allow(w, r, app.limiter, app.rateLimitKey(r)) {
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		token := headerParts[1]
+// rateLimitWith returns a middleware that applies an additional limiter to a
+// single route, on top of the global one. The scope is prefixed to the key so
+// that limiters sharing a store keep separate buckets.
+func (app *application) rateLimitWith(lim limiter.Limiter, scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !app.allow(w, r, lim, scope+":"+app.rateLimitKey(r)) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	}
+}
 
-		v := validator.New()
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
 
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+		user, err := app.userFromAuthorization(r)
+		if err != nil {
+			app.authenticationFailedResponse(w, r, err)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errInvalidAuthorization is returned by userFromAuthorization when the
+// request carries a token that is malformed, expired or unknown.
+var errInvalidAuthorization = errors.New("invalid authorization")
+
+// userFromAuthorization returns the user identified by the request's bearer
+// token, or the anonymous user when it has none.
+func (app *application) userFromAuthorization(r *http.Request) (*data.User, error) {
+	authorizationHeader := r.Header.Get("Authorization")
+
+	if authorizationHeader == "" {
+		return data.AnonymousUser, nil
+	}
+
+	headerParts := strings.Split(authorizationHeader, " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return nil, errInvalidAuthorization
+	}
+
+	token := headerParts[1]
+
+	if app.config.auth.mode == authModeJWT {
+		user, err := app.userFromJWT(r.Context(), token)
 		if err != nil {
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
+			case errors.Is(err, jwt.ErrInvalidToken), errors.Is(err, jwt.ErrExpiredToken), errors.Is(err, data.ErrRecordNotFound):
+				return nil, errInvalidAuthorization
 			default:
-				app.serverErrorResponse(w, r, err)
+				return nil, err
+			}
+		}
+		return user, nil
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, errInvalidAuthorization
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errInvalidAuthorization
+		default:
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+func (app *application) authenticationFailedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errInvalidAuthorization):
+		app.invalidAuthenticationTokenResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rateLimitByUser authenticates the request and rate limits it in one step,
+// keying the limiter by user for authenticated requests and by IP address for
+// anonymous ones. A request whose token doesn't authenticate is charged to a
+// separate bucket for its address, which is checked before the token is
+// looked up, so guessing tokens is limited like any anonymous traffic without
+// throttling the valid users who share that address.
+func (app *application) rateLimitByUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		ip := app.realIP(r)
+
+		if r.Header.Get("Authorization") == "" {
+			if !app.allow(w, r, app.limiter, "ip:"+ip) {
+				return
 			}
+			next.ServeHTTP(w, app.contextSetUser(r, data.AnonymousUser))
+			return
+		}
+
+		failureKey := "auth-failure:ip:" + ip
+		if !app.peek(w, r, app.limiter, failureKey) {
+			return
+		}
+
+		user, err := app.userFromAuthorization(r)
+		if err != nil {
+			if errors.Is(err, errInvalidAuthorization) && !app.allow(w, r, app.limiter, failureKey) {
+				return
+			}
+			app.authenticationFailedResponse(w, r, err)
 			return
 		}
 
 		r = app.contextSetUser(r, user)
 
+		if !app.allow(w, r, app.limiter, app.rateLimitKey(r)) {
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -138,16 +582,36 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// userHasPermission reports whether the code was granted to the user directly
+// or comes with the user's current role. Role permissions are never copied to
+// the user, so a role change takes effect on the next request.
+func (app *application) userHasPermission(ctx context.Context, user *data.User, code string) (bool, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.Id)
+	if err != nil {
+		return false, err
+	}
+
+	if !permissions.Include(code) && user.Role != "" {
+		rolePermissions, err := app.models.Permissions.GetAllForRole(ctx, user.Role)
+		if err != nil {
+			return false, err
+		}
+		permissions = append(permissions, rolePermissions...)
+	}
+
+	return permissions.Include(code), nil
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.Id)
+		permitted, err := app.userHasPermission(r.Context(), user, code)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 
-		if !permissions.Include(code) {
+		if !permitted {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -158,7 +622,17 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// enableCORS answers preflight requests and marks responses to trusted origins
+// as shareable. A listed origin is echoed, with credentials allowed if so
+// configured. The "*" origin shares responses with every site but never with
+// credentials, which would let any site act as the user; validate refuses
+// that combination, and it is not honored here either.
 func (app *application) enableCORS(next http.Handler) http.Handler {
+	allowedMethods := strings.Join(app.config.cors.allowedMethods, ", ")
+	allowedHeaders := strings.Join(app.config.cors.allowedHeaders, ", ")
+	exposedHeaders := strings.Join(app.config.cors.exposedHeaders, ", ")
+	maxAge := strconv.FormatInt(int64(app.config.cors.maxAge.Seconds()), 10)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
 
@@ -166,20 +640,29 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		if origin != "" {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] || app.config.cors.trustedOrigins[i] == "*" {
-					if app.config.cors.trustedOrigins[i] == "*" {
-						w.Header().Set("Access-Control-Allow-Origin", "*")
-					} else {
-
+					if origin == app.config.cors.trustedOrigins[i] {
 						w.Header().Set("Access-Control-Allow-Origin", origin)
+						if app.config.cors.allowCredentials {
+							w.Header().Set("Access-Control-Allow-Credentials", "true")
+						}
+					} else {
+						w.Header().Set("Access-Control-Allow-Origin", "*")
 					}
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+						w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+						if app.config.cors.maxAge > 0 {
+							w.Header().Set("Access-Control-Max-Age", maxAge)
+						}
 						w.WriteHeader(http.StatusOK)
 						return
 					}
 
+					if exposedHeaders != "" {
+						w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+					}
+
 					break
 				}
 			}
@@ -189,19 +672,62 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// expvarInt returns the published expvar.Int with the given name, publishing
+// it first if need be, so that routes can be built more than once.
+func expvarInt(name string) *expvar.Int {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+	return expvar.NewInt(name)
+}
+
+// expvarMap is expvarInt for an expvar.Map.
+func expvarMap(name string) *expvar.Map {
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	return expvar.NewMap(name)
+}
+
 func (app *application) metrics(next http.Handler) http.Handler {
 	var (
-		totalRequestsReceived           = expvar.NewInt("total_requests_received")
-		totalResponsesSent              = expvar.NewInt("total_responses_sent")
-		totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+		totalRequestsReceived           = expvarInt("total_requests_received")
+		totalResponsesSent              = expvarInt("total_responses_sent")
+		totalProcessingTimeMicroseconds = expvarInt("total_processing_time_μs")
+		totalResponsesSentByRoute       = expvarMap("total_responses_sent_by_route_and_status")
+		totalProcessingTimeByRoute      = expvarMap("total_processing_time_μs_by_route")
 	)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		totalRequestsReceived.Add(1)
-		next.ServeHTTP(w, r)
+		app.httpMetrics.requests.Add(1)
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
+
+		r = app.contextSetRoutePattern(r, &routePattern{})
+		sr := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(sr, r)
+
 		totalResponsesSent.Add(1)
-		duration := time.Since(start).Microseconds()
-		totalProcessingTimeMicroseconds.Add(duration)
+		duration := time.Since(start)
+		totalProcessingTimeMicroseconds.Add(duration.Microseconds())
+		app.httpMetrics.observe(duration)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		// Requests that never matched a route are grouped together so that
+		// scanners probing random paths can't grow the maps without bound.
+		route := app.contextGetRoutePattern(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		route = r.Method + " " + route
+
+		totalResponsesSentByRoute.Add(route+" "+strconv.Itoa(sr.status), 1)
+		totalProcessingTimeByRoute.Add(route, duration.Microseconds())
 	})
 }
@@ -1,23 +1,32 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/data"
 	"github.com/Soul-Remix/greenlight/internal/validator"
+	"github.com/Soul-Remix/greenlight/internal/webhook"
 )
 
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string   `json:"title"`
-		Year    int32    `json:"year"`
-		Runtime int32    `json:"runtime"`
-		Genres  []string `json:"genres"`
+		Title    string       `json:"title" xml:"title"`
+		Year     int32        `json:"year" xml:"year"`
+		Runtime  data.Runtime `json:"runtime" xml:"runtime"`
+		Genres   []string     `json:"genres" xml:"genres>genre"`
+		Director string       `json:"director" xml:"director"`
+		Rating   string       `json:"rating" xml:"rating"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -25,30 +34,189 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	v := validator.New()
 
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:    input.Title,
+		Year:     input.Year,
+		Runtime:  input.Runtime,
+		Genres:   data.NormalizeGenres(input.Genres),
+		Director: input.Director,
+		Rating:   input.Rating,
 	}
 
-	data.ValidateMovie(v, movie)
+	data.ValidateMovie(v, movie, app.config.movieLimits)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Movies.Insert(movie)
+	ctx := app.withAudit(r, data.AuditMovieCreate, "movie", 0, movieAuditFields(movie))
+
+	// A dry run never stores anything, so there is no response to replay.
+	var idempotent *idempotentRequest
+	if dryRun {
+		ctx = data.WithDryRun(ctx)
+	} else {
+		var ok bool
+		idempotent, ok = app.startIdempotentRequest(w, r, input, func(status int, response []byte) {
+			var movie data.Movie
+			err := json.Unmarshal(response, &movie)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.writeCreatedMovie(w, r, status, &movie)
+		})
+		if !ok {
+			return
+		}
+	}
+
+	err = app.models.Movies.Insert(ctx, movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		idempotent.abandon(app, r)
+		switch {
+		case errors.Is(err, data.ErrDuplicateTitle):
+			v.AddError("title", "a movie with this title already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
+	if dryRun {
+		app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie, "dry_run": true}, nil)
+		return
+	}
+
+	idempotent.finish(app, r, http.StatusCreated, movie)
+	app.movieChanged(webhook.EventMovieCreated, movie.Id, movie.Version)
+	app.publishMovie(r, movie)
+
+	app.writeCreatedMovie(w, r, http.StatusCreated, movie)
+}
+
+func (app *application) writeCreatedMovie(w http.ResponseWriter, r *http.Request, status int, movie *data.Movie) {
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.Id))
+	w.Header().Add("Vary", "Prefer")
+
+	preference, ok := returnPreference(r)
+	if ok {
+		headers.Set("Preference-Applied", "return="+preference)
+	}
+
+	if preference == "minimal" {
+		for key, value := range headers {
+			w.Header()[key] = value
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	app.writeResponse(w, r, status, envelope{"movie": movie}, headers)
+}
+
+const maxMovieBatchSize = 1000
+
+type batchMovie struct {
+	Title    string       `json:"title" xml:"title"`
+	Year     int32        `json:"year" xml:"year"`
+	Runtime  data.Runtime `json:"runtime" xml:"runtime"`
+	Genres   []string     `json:"genres" xml:"genres>genre"`
+	Director string       `json:"director" xml:"director"`
+	Rating   string       `json:"rating" xml:"rating"`
+}
+
+// movieBatch is the body of a batch create. In JSON it is an array of movies;
+// in XML it is a movies element with a movie element for each, the same shape
+// a list of movies has in XML responses.
+type movieBatch []batchMovie
+
+func (b *movieBatch) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var input struct {
+		Movies []batchMovie `xml:"movie"`
+	}
+	err := d.DecodeElement(&input, &start)
+	if err != nil {
+		return err
+	}
+	*b = input.Movies
+	return nil
+}
+
+func (app *application) createMovieBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var input movieBatch
 
-	app.writeJSON(w, r, http.StatusCreated, envelope{"movie": movie}, headers)
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input) >= 1, "movies", "must contain at least 1 movie")
+	v.Check(len(input) <= maxMovieBatchSize, "movies", fmt.Sprintf("must not contain more than %d movies", maxMovieBatchSize))
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies := make([]*data.Movie, len(input))
+	titles := make(map[string]bool, len(input))
+
+	for i := range input {
+		movies[i] = &data.Movie{
+			Title:    input[i].Title,
+			Year:     input[i].Year,
+			Runtime:  input[i].Runtime,
+			Genres:   data.NormalizeGenres(input[i].Genres),
+			Director: input[i].Director,
+			Rating:   input[i].Rating,
+		}
+
+		element := v.At(validator.Index("movies", i))
+		data.ValidateMovie(element, movies[i], app.config.movieLimits)
+
+		title := strings.ToLower(movies[i].Title)
+		element.Check(!titles[title], "title", "must not repeat the title of another movie in the batch")
+		titles[title] = true
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	batchTitles := make([]string, len(movies))
+	for i, movie := range movies {
+		batchTitles[i] = movie.Title
+	}
+	ctx := app.withAudit(r, data.AuditMovieCreate, "movie", 0, map[string]any{"count": len(movies), "titles": batchTitles})
+
+	err = app.models.Movies.InsertBatch(ctx, movies)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateTitle):
+			v.AddError("movies", "must not contain a title that already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	created := make([]envelope, len(movies))
+	for i, movie := range movies {
+		created[i] = envelope{"id": movie.Id, "version": movie.Version}
+		app.movieChanged(webhook.EventMovieCreated, movie.Id, movie.Version)
+		app.publishMovie(r, movie)
+	}
+
+	app.writeResponse(w, r, http.StatusCreated, envelope{"movies": created}, nil)
 }
 
 func (app *application) getMovieHandler(w http.ResponseWriter, r *http.Request) {
@@ -58,7 +226,16 @@ func (app *application) getMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	v := validator.New()
+
+	fields := app.readCSV(r.URL.Query(), "fields", nil)
+
+	if data.ValidateFields(v, fields, data.MovieFields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -69,7 +246,23 @@ func (app *application) getMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+	etag := movieETag(movie)
+	if app.etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := sparseFields(movie, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"movie": body}, headers)
 }
 
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
@@ -79,7 +272,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -90,83 +283,170 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	var input struct {
-		Title   *string  `json:"title"`
-		Year    *int32   `json:"year"`
-		Runtime *int32   `json:"runtime"`
-		Genres  []string `json:"genres"`
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !app.etagMatchesStrong(ifMatch, movieETag(movie)) {
+		app.preconditionFailedResponse(w, r)
+		return
 	}
 
-	err = app.readJSON(w, r, &input)
+	var input data.MoviePatch
+
+	err = app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	if input.Title != nil {
-		movie.Title = *input.Title
+	v := validator.New()
+
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+
+	if data.ValidateMoviePatch(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
-	if input.Year != nil {
-		movie.Year = *input.Year
+	before := *movie
+
+	input.Apply(movie)
+	movie.Genres = data.NormalizeGenres(movie.Genres)
+
+	data.ValidateMovie(v, movie, app.config.movieLimits)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
+	ctx := app.withAudit(r, data.AuditMovieUpdate, "movie", movie.Id, movieAuditDiff(&before, movie))
+	if dryRun {
+		ctx = data.WithDryRun(ctx)
 	}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+	err = app.models.Movies.Update(ctx, movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.movieEditConflictResponse(w, r, id)
+		case errors.Is(err, data.ErrDuplicateTitle):
+			v.AddError("title", "a movie with this title already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	v := validator.New()
+	if dryRun {
+		app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie, "dry_run": true}, nil)
+		return
+	}
+
+	app.movieChanged(webhook.EventMovieUpdated, movie.Id, movie.Version)
 
-	data.ValidateMovie(v, movie)
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
 
+	app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, headers)
+}
+
+func (app *application) movieEditConflictResponse(w http.ResponseWriter, r *http.Request, id int64) {
+	current, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.versionConflictResponse(w, r, current.Version)
+}
+
+func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	force := app.readBool(r.URL.Query(), "force", false, v)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	ctx := app.withAudit(r, data.AuditMovieDelete, "movie", id, map[string]any{"force": force})
+
+	// A soft delete is refused while the movie has dependents, but a forced
+	// one purges them with it, which is why it needs to be asked for.
+	var version int32
+	if force {
+		version, err = app.models.Movies.Purge(ctx, id)
+	} else {
+		version, err = app.models.Movies.Delete(ctx, id)
+	}
 	if err != nil {
+		var dependents *data.MovieDependentsError
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+		case errors.As(err, &dependents):
+			app.movieHasDependentsResponse(w, r, &dependents.Dependents)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+	app.movieChanged(webhook.EventMovieDeleted, id, version)
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
 }
 
-func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	ctx := app.withAudit(r, data.AuditMovieRestore, "movie", id, nil)
+
+	movie, err := app.models.Movies.Restore(ctx, id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateTitle):
+			app.duplicateTitleConflictResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+	app.movieChanged(webhook.EventMovieRestored, movie.Id, movie.Version)
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, headers)
 }
 
+// movieSortSafeList holds the sort values a movie listing accepts, apart from
+// relevance, which needs a title query.
+var movieSortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		Title      string
+		Genres     []string
+		GenresMode string
+		Fields     []string
 		data.Filters
 	}
 
@@ -176,21 +456,259 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.GenresMode = app.readString(qs, "genres_mode", data.GenresModeAll)
+	input.Fields = app.readCSV(qs, "fields", nil)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	app.readPageSize(qs, &input.Filters, v)
+	input.Filters.YearFrom = app.readInt(qs, "year_from", 0, v)
+	input.Filters.YearTo = app.readInt(qs, "year_to", 0, v)
+	input.Filters.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	input.Filters.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+	input.Filters.IncludeDeleted = app.readBool(qs, "include_deleted", false, v)
+	input.Filters.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.Filters.CreatedBefore = app.readTime(qs, "created_before", v)
+	input.Filters.CursorMode = qs.Has("cursor")
+	input.Filters.Cursor = qs.Get("cursor")
+	input.Filters.CursorKey = app.config.cursor.secret
+	input.Filters.SortSafeList = movieSortSafeList
+
+	// Cursors only page through movies in id order, so the configured
+	// default doesn't apply to them.
+	if input.Filters.CursorMode {
+		input.Filters.Sort = app.readString(qs, "sort", "id")
+	} else {
+		input.Filters.Sort = app.readString(qs, "sort", app.config.movieDefaultSort)
+	}
+
+	if input.Title != "" {
+		input.Filters.SortSafeList = append(input.Filters.SortSafeList, "relevance", "-relevance")
+	} else {
+		v.Check(strings.TrimPrefix(input.Filters.Sort, "-") != "relevance", "sort", "relevance sort requires a title query")
+	}
+
+	v.Check(validator.PermittedValue(input.GenresMode, data.GenresModeAll, data.GenresModeAny), "genres_mode", "must be any or all")
+	data.ValidateFields(v, input.Fields, data.MovieFields)
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Filters.IncludeDeleted {
+		permitted, err := app.userHasPermission(r.Context(), app.contextGetUser(r), "admin:read")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permitted {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	key := app.listCacheKey(r)
+
+	// The summary is far cheaper than the listing, so conditional requests
+	// and cache hits are answered without fetching or serializing any movie.
+	summary, err := app.models.Movies.GetAllSummary(r.Context(), input.Title, input.Genres, input.GenresMode, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	etag := listETag(key, summary)
+
+	if app.listNotModified(r, etag, summary.LastModified) {
+		app.writeNotModified(w, etag, summary.LastModified)
+		return
+	}
+
+	var generation uint64
+	if app.listCache.enabled() {
+		var cached *cachedResponse
+		cached, generation = app.listCache.get(key)
+		if cached != nil && cached.etag == etag {
+			app.writeCachedResponse(w, r, cached)
+			return
+		}
+	}
+
+	buf := &bufferedResponse{header: make(http.Header)}
+	app.writeMovieList(buf, r, input.Title, input.Genres, input.GenresMode, input.Fields, input.Filters)
+
+	if buf.status != http.StatusOK {
+		for name, values := range buf.header {
+			w.Header()[name] = append(w.Header()[name], values...)
+		}
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+		return
+	}
+
+	cached := cacheResponse(buf, etag, summary.LastModified)
+	if app.listCache.enabled() {
+		app.listCache.set(key, cached, generation)
+	}
+	app.writeCachedResponse(w, r, cached)
+}
+
+func (app *application) writeMovieList(w http.ResponseWriter, r *http.Request, title string, genres []string, genresMode string, fields []string, filters data.Filters) {
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), title, genres, genresMode, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	body, err := sparseFieldsAll(movies, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"movies": body, "metadata": metadata}, app.paginationHeaders(r, metadata))
+}
+
+func (app *application) movieStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.models.Movies.Stats(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"stats": stats}, nil)
+}
+
+// movieHistoryHandler lists the retained prior versions of a movie, oldest
+// first, along with the movie as it is now.
+func (app *application) movieHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	history, err := app.models.Movies.History(r.Context(), id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie, "history": history}, nil)
+}
+
+func (app *application) listSimilarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	app.readPageSize(qs, &input.Filters, v)
+	// Results are always ranked by genre overlap, so there is nothing to sort by.
+	input.Filters.Sort = "similarity"
+	input.Filters.SortSafeList = []string{"similarity"}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetSimilar(r.Context(), movie, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+	app.writeResponse(w, r, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, app.paginationHeaders(r, metadata))
+}
+
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d"`, movie.Version)
+}
+
+var movieCSVHeader = []string{"id", "title", "year", "runtime", "genres", "version", "director", "rating"}
+
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	// The server's write timeout would otherwise cut a large export off.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.csv"`)
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+
+	err := csvWriter.Write(movieCSVHeader)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	rows := 0
+	err = app.models.Movies.Export(r.Context(), func(movie *data.Movie) error {
+		err := csvWriter.Write([]string{
+			strconv.FormatInt(movie.Id, 10),
+			movie.Title,
+			strconv.Itoa(int(movie.Year)),
+			strconv.Itoa(int(movie.Runtime)),
+			strings.Join(movie.Genres, "|"),
+			strconv.Itoa(int(movie.Version)),
+			movie.Director,
+			movie.Rating,
+		})
+		if err != nil {
+			return err
+		}
+
+		rows++
+		if rows%100 == 0 {
+			csvWriter.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return csvWriter.Error()
+	})
+	if err != nil {
+		// Part of the file may already have been sent, so the best we can do
+		// is log the failure and leave the client with a truncated file.
+		app.logError(r, err)
+		return
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		app.logError(r, err)
+	}
 }
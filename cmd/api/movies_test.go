@@ -0,0 +1,1554 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// keysetMovies serves GetAll in cursor mode the way the keyset query does,
+// from a fixed list of ids in ascending order.
+type keysetMovies struct {
+	data.MockMovieModel
+	ids []int64
+}
+
+func (k keysetMovies) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	var after int64
+	if filters.Cursor != "" {
+		id, err := data.DecodeCursor(filters.CursorKey, filters.Cursor)
+		if err != nil {
+			return nil, data.Metadata{}, err
+		}
+		after = id
+	}
+
+	movies := []*data.Movie{}
+	for _, id := range k.ids {
+		if id > after {
+			movies = append(movies, &data.Movie{Id: id, Title: fmt.Sprintf("Movie %d", id), Version: 1})
+		}
+	}
+
+	metadata := data.Metadata{PageSize: filters.PageSize}
+	if len(movies) > filters.PageSize {
+		movies = movies[:filters.PageSize]
+		metadata.NextCursor = data.EncodeCursor(filters.CursorKey, movies[len(movies)-1].Id)
+	}
+	return movies, metadata, nil
+}
+
+func getMovies(app *application, query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/v1/movies?"+query.Encode(), nil)
+	r = app.contextSetUser(r, data.AnonymousUser)
+	return serve(http.HandlerFunc(app.listMoviesHandler), r)
+}
+
+func TestListMoviesCursorWalk(t *testing.T) {
+	ids := []int64{1, 2, 3, 5, 8, 13, 21}
+
+	app := newTestApplication(t)
+	app.models.Movies = keysetMovies{ids: ids}
+
+	for _, pageSize := range []int{1, 3, len(ids), len(ids) + 1} {
+		t.Run(fmt.Sprintf("page size %d", pageSize), func(t *testing.T) {
+			query := url.Values{"cursor": {""}, "page_size": {fmt.Sprint(pageSize)}}
+
+			var seen []int64
+			for pages := 0; ; pages++ {
+				if pages > len(ids) {
+					t.Fatalf("walk didn't end after %v", seen)
+				}
+
+				rr := getMovies(app, query)
+				if rr.Code != http.StatusOK {
+					t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+				}
+
+				var body struct {
+					Movies   []data.Movie  `json:"movies"`
+					Metadata data.Metadata `json:"metadata"`
+				}
+				err := json.Unmarshal(rr.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, movie := range body.Movies {
+					seen = append(seen, movie.Id)
+				}
+
+				// The Link header offers the next page only while there is one.
+				link := rr.Header().Get("Link")
+				if hasNext := strings.Contains(link, `rel="next"`); hasNext != (body.Metadata.NextCursor != "") {
+					t.Errorf("got Link %q with next cursor %q", link, body.Metadata.NextCursor)
+				}
+
+				if body.Metadata.NextCursor == "" {
+					break
+				}
+				query.Set("cursor", body.Metadata.NextCursor)
+			}
+
+			if fmt.Sprint(seen) != fmt.Sprint(ids) {
+				t.Errorf("visited %v; want %v", seen, ids)
+			}
+		})
+	}
+}
+
+func TestListMoviesInvalidCursor(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies = keysetMovies{ids: []int64{1, 2, 3}}
+
+	forged := data.EncodeCursor([]byte("not the server's cursor secret!!"), 2)
+
+	tests := []struct {
+		name  string
+		query url.Values
+		field string
+	}{
+		{name: "forged", query: url.Values{"cursor": {forged}}, field: "cursor"},
+		{name: "garbage", query: url.Values{"cursor": {"OFFSET 10"}}, field: "cursor"},
+		{name: "sorted by title", query: url.Values{"cursor": {""}, "sort": {"title"}}, field: "sort"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := getMovies(app, tt.query)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			var body struct {
+				Error map[string]string `json:"error"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Error[tt.field] == "" {
+				t.Errorf("got errors %v; want one for %s", body.Error, tt.field)
+			}
+		})
+	}
+}
+
+// contendedMovie stores one movie with optimistic locking. Its first readers
+// block until they have all loaded the movie, so that their updates race
+// from the same version.
+type contendedMovie struct {
+	data.MockMovieModel
+	mu      sync.Mutex
+	movie   data.Movie
+	readers int
+	reads   int
+	loaded  chan struct{}
+}
+
+func (c *contendedMovie) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	c.mu.Lock()
+	movie := c.movie
+	c.reads++
+	reads := c.reads
+	if reads == c.readers {
+		close(c.loaded)
+	}
+	c.mu.Unlock()
+
+	if movie.Id != id {
+		return nil, data.ErrRecordNotFound
+	}
+	if reads <= c.readers {
+		<-c.loaded
+	}
+	return &movie, nil
+}
+
+func (c *contendedMovie) Update(ctx context.Context, movie *data.Movie) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if movie.Version != c.movie.Version {
+		return data.ErrEditConflict
+	}
+	movie.Version++
+	c.movie = *movie
+	return nil
+}
+
+func TestUpdateMovieConcurrentConflict(t *testing.T) {
+	for _, writers := range []int{2, 5} {
+		t.Run(fmt.Sprintf("%d writers", writers), func(t *testing.T) {
+			store := &contendedMovie{
+				movie:   data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1},
+				readers: writers,
+				loaded:  make(chan struct{}),
+			}
+
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			responses := make([]*httptest.ResponseRecorder, writers)
+			var wg sync.WaitGroup
+			for i := range responses {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					body := fmt.Sprintf(`{"title":"Moana %d"}`, i)
+					r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(body))
+					r = withIDParam(app.contextSetUser(r, data.AnonymousUser), 1)
+					responses[i] = serve(http.HandlerFunc(app.updateMovieHandler), r)
+				}(i)
+			}
+			wg.Wait()
+
+			var codes []int
+			var winner int
+			for i, rr := range responses {
+				codes = append(codes, rr.Code)
+				if rr.Code == http.StatusOK {
+					winner = i
+					continue
+				}
+
+				var body struct {
+					Code           string `json:"code"`
+					CurrentVersion int32  `json:"current_version"`
+				}
+				err := json.Unmarshal(rr.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body.Code != codeVersionConflict || body.CurrentVersion != 2 {
+					t.Errorf("conflict body %s; want code %s and current_version 2", rr.Body, codeVersionConflict)
+				}
+			}
+
+			sort.Ints(codes)
+			want := []int{http.StatusOK}
+			for len(want) < writers {
+				want = append(want, http.StatusConflict)
+			}
+			if fmt.Sprint(codes) != fmt.Sprint(want) {
+				t.Fatalf("got statuses %v; want %v", codes, want)
+			}
+
+			if store.movie.Version != 2 || store.movie.Title != fmt.Sprintf("Moana %d", winner) {
+				t.Errorf("stored %q at version %d; want the winner's title at version 2", store.movie.Title, store.movie.Version)
+			}
+		})
+	}
+}
+
+// rollbackMovies stores movies the way MovieModel does, except that writes
+// made with a dry-run context are returned but never kept, as the model's
+// rolled-back transaction leaves them.
+type rollbackMovies struct {
+	data.MockMovieModel
+	movies map[int64]data.Movie
+	nextID int64
+}
+
+func (m *rollbackMovies) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	movie, ok := m.movies[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	return &movie, nil
+}
+
+func (m *rollbackMovies) Insert(ctx context.Context, movie *data.Movie) error {
+	m.nextID++
+	movie.Id = m.nextID
+	movie.Version = 1
+	if !data.IsDryRun(ctx) {
+		m.movies[movie.Id] = *movie
+	}
+	return nil
+}
+
+func (m *rollbackMovies) InsertBatch(ctx context.Context, movies []*data.Movie) error {
+	for _, movie := range movies {
+		m.Insert(ctx, movie)
+	}
+	return nil
+}
+
+func (m *rollbackMovies) Update(ctx context.Context, movie *data.Movie) error {
+	if movie.Version != m.movies[movie.Id].Version {
+		return data.ErrEditConflict
+	}
+	movie.Version++
+	if !data.IsDryRun(ctx) {
+		m.movies[movie.Id] = *movie
+	}
+	return nil
+}
+
+func TestMovieDryRun(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1}
+
+	tests := []struct {
+		name    string
+		method  string
+		query   string
+		body    string
+		status  int
+		dryRun  bool
+		title   string
+		version int32
+		stored  int
+	}{
+		{name: "create", method: http.MethodPost, query: "dry_run=true", body: blackPantherJSON, status: http.StatusOK, dryRun: true, title: "Black Panther", version: 1, stored: 1},
+		{name: "create, dry_run=1", method: http.MethodPost, query: "dry_run=1", body: blackPantherJSON, status: http.StatusOK, dryRun: true, title: "Black Panther", version: 1, stored: 1},
+		{name: "invalid create", method: http.MethodPost, query: "dry_run=true", body: `{"title":"Black Panther"}`, status: http.StatusUnprocessableEntity, stored: 1},
+		{name: "update", method: http.MethodPatch, query: "dry_run=true", body: `{"title":"Moana 2"}`, status: http.StatusOK, dryRun: true, title: "Moana 2", version: 2, stored: 1},
+		{name: "invalid update", method: http.MethodPatch, query: "dry_run=true", body: `{"year":1500}`, status: http.StatusUnprocessableEntity, stored: 1},
+		{name: "not a boolean", method: http.MethodPatch, query: "dry_run=maybe", body: `{"title":"Moana 2"}`, status: http.StatusUnprocessableEntity, stored: 1},
+		{name: "dry run off", method: http.MethodPost, query: "dry_run=false", body: blackPantherJSON, status: http.StatusCreated, title: "Black Panther", version: 1, stored: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{1: moana}, nextID: 1}
+			keys := &idempotencyKeys{keys: map[string]*data.IdempotencyKey{}}
+
+			app := newTestApplication(t)
+			app.config.idempotency.ttl = time.Hour
+			app.models.Movies = store
+			app.models.Idempotency = keys
+
+			handler := app.createMovieHandler
+			if tt.method == http.MethodPatch {
+				handler = app.updateMovieHandler
+			}
+
+			r := httptest.NewRequest(tt.method, "/v1/movies/1?"+tt.query, strings.NewReader(tt.body))
+			// The key must be ignored, since there is nothing to replay.
+			r.Header.Set("Idempotency-Key", "key-1")
+			r = withIDParam(app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}), 1)
+			rr := serve(http.HandlerFunc(handler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if len(store.movies) != tt.stored {
+				t.Errorf("stored %d movies; want %d", len(store.movies), tt.stored)
+			}
+			if store.movies[1].Title != moana.Title || store.movies[1].Version != moana.Version {
+				t.Errorf("stored movie 1 changed to %q at version %d", store.movies[1].Title, store.movies[1].Version)
+			}
+
+			if tt.status == http.StatusUnprocessableEntity {
+				return
+			}
+
+			var body struct {
+				Movie  data.Movie `json:"movie"`
+				DryRun bool       `json:"dry_run"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.DryRun != tt.dryRun {
+				t.Errorf("got dry_run %t; want %t", body.DryRun, tt.dryRun)
+			}
+			// A dry run answers with the movie as it would have been written.
+			if body.Movie.Title != tt.title || body.Movie.Version != tt.version {
+				t.Errorf("got %q at version %d; want %q at version %d", body.Movie.Title, body.Movie.Version, tt.title, tt.version)
+			}
+
+			if tt.dryRun {
+				if got := rr.Header().Get("Location") + rr.Header().Get("ETag"); got != "" {
+					t.Errorf("dry run set Location or ETag: %q", got)
+				}
+				if len(keys.keys) != 0 {
+					t.Errorf("dry run reserved %d idempotency keys", len(keys.keys))
+				}
+				if recent := len(app.movieFeed.recent); recent != 0 {
+					t.Errorf("dry run published %d movie events", recent)
+				}
+			}
+		})
+	}
+}
+
+// versionedMovie serves one movie and its retained versions.
+type versionedMovie struct {
+	data.MockMovieModel
+	movie    data.Movie
+	versions []*data.MovieVersion
+}
+
+func (v versionedMovie) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	if id != v.movie.Id {
+		return nil, data.ErrRecordNotFound
+	}
+	movie := v.movie
+	return &movie, nil
+}
+
+func (v versionedMovie) History(ctx context.Context, id int64) ([]*data.MovieVersion, error) {
+	return v.versions, nil
+}
+
+func TestMovieHistory(t *testing.T) {
+	movie := data.Movie{Id: 1, Title: "Moana 4", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 4}
+
+	var versions []*data.MovieVersion
+	replaced := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for version := int32(2); version < movie.Version; version++ {
+		replaced = replaced.Add(time.Hour)
+		versions = append(versions, &data.MovieVersion{Version: version, Title: fmt.Sprintf("Moana %d", version), ReplacedAt: replaced})
+	}
+
+	tests := []struct {
+		name     string
+		id       int64
+		versions []*data.MovieVersion
+		status   int
+		want     []int32
+	}{
+		{name: "oldest first", id: 1, versions: versions, status: http.StatusOK, want: []int32{2, 3}},
+		{name: "no history", id: 1, versions: []*data.MovieVersion{}, status: http.StatusOK, want: []int32{}},
+		{name: "unknown movie", id: 2, versions: versions, status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Movies = versionedMovie{movie: movie, versions: tt.versions}
+
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/movies/%d/history", tt.id), nil)
+			r = withIDParam(app.contextSetUser(r, data.AnonymousUser), tt.id)
+			rr := serve(http.HandlerFunc(app.movieHistoryHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Movie   data.Movie          `json:"movie"`
+				History []data.MovieVersion `json:"history"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.History == nil {
+				t.Fatalf("history is %s; want a list", rr.Body)
+			}
+
+			got := []int32{}
+			for _, version := range body.History {
+				got = append(got, version.Version)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got versions %v; want %v", got, tt.want)
+			}
+			if body.Movie.Version != movie.Version || body.Movie.Title != movie.Title {
+				t.Errorf("got current movie %q at version %d; want %q at version %d", body.Movie.Title, body.Movie.Version, movie.Title, movie.Version)
+			}
+		})
+	}
+}
+
+// exportedMovies serves Export from n generated movies, pausing for delay
+// before each one the way a slow cursor does.
+type exportedMovies struct {
+	data.MockMovieModel
+	n     int
+	delay time.Duration
+}
+
+func (e exportedMovies) Export(ctx context.Context, fn func(movie *data.Movie) error) error {
+	for i := 1; i <= e.n; i++ {
+		time.Sleep(e.delay)
+		err := fn(&data.Movie{Id: int64(i), Title: fmt.Sprintf("Movie %d", i), Year: 2000, Runtime: 90, Genres: []string{"drama", "comedy"}, Version: 1})
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func TestExportMovies(t *testing.T) {
+	const rows = 300
+
+	tests := []struct {
+		name         string
+		delay        time.Duration
+		writeTimeout time.Duration
+	}{
+		{name: "fast", writeTimeout: 5 * time.Second},
+		// The whole export takes about 600ms, well past the write timeout.
+		{name: "past the write timeout", delay: 2 * time.Millisecond, writeTimeout: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Movies = exportedMovies{n: rows, delay: tt.delay}
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				app.exportMoviesHandler(w, app.contextSetUser(r, data.AnonymousUser))
+			}))
+			ts.Config.WriteTimeout = tt.writeTimeout
+			ts.Start()
+			defer ts.Close()
+
+			resp, err := ts.Client().Get(ts.URL + "/v1/movies/export.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(got, "attachment") {
+				t.Errorf("got Content-Disposition %q; want an attachment", got)
+			}
+
+			records, err := csv.NewReader(resp.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("reading the export: %v", err)
+			}
+			if len(records) == 0 {
+				t.Fatal("export is empty")
+			}
+			if got, want := strings.Join(records[0], ","), strings.Join(movieCSVHeader, ","); got != want {
+				t.Errorf("got header %q; want %q", got, want)
+			}
+			if got := len(records) - 1; got != rows {
+				t.Fatalf("got %d rows; want %d", got, rows)
+			}
+			if last := records[rows]; last[0] != fmt.Sprint(rows) || last[4] != "drama|comedy" {
+				t.Errorf("got last row %v", last)
+			}
+		})
+	}
+}
+
+func TestGetMovieIfNoneMatch(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 3}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{name: "absent", status: http.StatusOK},
+		{name: "current", ifNoneMatch: `"3"`, status: http.StatusNotModified},
+		{name: "weak current", ifNoneMatch: `W/"3"`, status: http.StatusNotModified},
+		{name: "in a list", ifNoneMatch: `"1", "3"`, status: http.StatusNotModified},
+		{name: "wildcard", ifNoneMatch: "*", status: http.StatusNotModified},
+		{name: "stale", ifNoneMatch: `"2"`, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Movies = oneMovie{movie: moana}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			r = withIDParam(app.contextSetUser(r, data.AnonymousUser), 1)
+			rr := serve(http.HandlerFunc(app.getMovieHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("ETag"); got != `"3"` {
+				t.Errorf("got ETag %q; want %q", got, `"3"`)
+			}
+			if tt.status == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("304 has a body: %s", rr.Body)
+			}
+			if tt.status == http.StatusOK && !strings.Contains(rr.Body.String(), `"Moana"`) {
+				t.Errorf("got body %s; want the movie", rr.Body)
+			}
+		})
+	}
+}
+
+func TestUpdateMovieIfMatch(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 3}
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		status  int
+		title   string
+	}{
+		{name: "absent", status: http.StatusOK, title: "Moana 2"},
+		{name: "matching", ifMatch: `"3"`, status: http.StatusOK, title: "Moana 2"},
+		{name: "wildcard", ifMatch: "*", status: http.StatusOK, title: "Moana 2"},
+		{name: "not matching", ifMatch: `"2"`, status: http.StatusPreconditionFailed, title: "Moana"},
+		{name: "weak current", ifMatch: `W/"3"`, status: http.StatusPreconditionFailed, title: "Moana"},
+		{name: "in a list", ifMatch: `"2", "3"`, status: http.StatusOK, title: "Moana 2"},
+		{name: "weak in a list", ifMatch: `"2", W/"3"`, status: http.StatusPreconditionFailed, title: "Moana"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{1: moana}, nextID: 1}
+
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(`{"title":"Moana 2"}`))
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			r = withIDParam(app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}), 1)
+			rr := serve(http.HandlerFunc(app.updateMovieHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := store.movies[1].Title; got != tt.title {
+				t.Errorf("stored title %q; want %q", got, tt.title)
+			}
+
+			if tt.status == http.StatusOK {
+				if got := rr.Header().Get("ETag"); got != `"4"` {
+					t.Errorf("got ETag %q; want the new version %q", got, `"4"`)
+				}
+				return
+			}
+
+			var body struct {
+				Code  string `json:"code"`
+				Error string `json:"error"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != codePreconditionFailed || body.Error == "" {
+				t.Errorf("got body %s; want a %s error", rr.Body, codePreconditionFailed)
+			}
+		})
+	}
+}
+
+// dependentMovies serves one live movie with the given dependents and records
+// how it was deleted. Like the model, it refuses to soft-delete the movie
+// while it has dependents.
+type dependentMovies struct {
+	data.MockMovieModel
+	dependents data.MovieDependents
+	deleted    *string
+}
+
+func (d dependentMovies) Delete(ctx context.Context, id int64) (int32, error) {
+	if d.dependents.Total() > 0 {
+		return 0, &data.MovieDependentsError{Dependents: d.dependents}
+	}
+	*d.deleted = "soft"
+	return 2, nil
+}
+
+func (d dependentMovies) Purge(ctx context.Context, id int64) (int32, error) {
+	*d.deleted = "purged"
+	return 2, nil
+}
+
+func TestDeleteMovieDependents(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		dependents data.MovieDependents
+		status     int
+		deleted    string
+	}{
+		{name: "no dependents", dependents: data.MovieDependents{}, status: http.StatusOK, deleted: "soft"},
+		{name: "blocked", dependents: data.MovieDependents{Reviews: 2, Watchlist: 1}, status: http.StatusConflict},
+		{name: "forced", query: "?force=true", dependents: data.MovieDependents{Reviews: 2, Watchlist: 1}, status: http.StatusOK, deleted: "purged"},
+		{name: "forced without dependents", query: "?force=true", dependents: data.MovieDependents{}, status: http.StatusOK, deleted: "purged"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted string
+
+			app := newTestApplication(t)
+			app.models.Movies = dependentMovies{dependents: tt.dependents, deleted: &deleted}
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/movies/1"+tt.query, nil)
+			r = withIDParam(app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}), 1)
+			rr := serve(http.HandlerFunc(app.deleteMovieHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if deleted != tt.deleted {
+				t.Errorf("movie was deleted %q; want %q", deleted, tt.deleted)
+			}
+
+			if tt.status != http.StatusConflict {
+				return
+			}
+
+			var body struct {
+				Code       string               `json:"code"`
+				Dependents data.MovieDependents `json:"dependents"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != codeHasDependents || body.Dependents != tt.dependents {
+				t.Errorf("got body %s; want a %s error counting %+v", rr.Body, codeHasDependents, tt.dependents)
+			}
+		})
+	}
+}
+
+func TestUpdateMovieDirectorAndRating(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1}
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		director string
+		rating   string
+	}{
+		{"neither given", `{"title":"Moana 2"}`, http.StatusOK, "Ron Clements", "PG"},
+		{"rating given", `{"rating":"PG-13"}`, http.StatusOK, "Ron Clements", "PG-13"},
+		{"director given", `{"director":"John Musker"}`, http.StatusOK, "John Musker", "PG"},
+		{"invalid rating", `{"rating":"X"}`, http.StatusUnprocessableEntity, "Ron Clements", "PG"},
+		{"null rating", `{"rating":null}`, http.StatusUnprocessableEntity, "Ron Clements", "PG"},
+		{"empty director", `{"director":""}`, http.StatusUnprocessableEntity, "Ron Clements", "PG"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{1: moana}, nextID: 1}
+
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(tt.body))
+			r = withIDParam(app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}), 1)
+			rr := serve(http.HandlerFunc(app.updateMovieHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			stored := store.movies[1]
+			if stored.Director != tt.director || stored.Rating != tt.rating {
+				t.Errorf("stored director %q and rating %q; want %q and %q", stored.Director, stored.Rating, tt.director, tt.rating)
+			}
+		})
+	}
+}
+
+// listedMovies records the arguments listMoviesHandler passes to GetAll.
+type listedMovies struct {
+	data.MockMovieModel
+	genres     []string
+	genresMode string
+	filters    data.Filters
+}
+
+func (l *listedMovies) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	l.genres = genres
+	l.genresMode = genresMode
+	l.filters = filters
+	return []*data.Movie{}, data.Metadata{}, nil
+}
+
+func TestListMoviesGenresMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		mode   string
+	}{
+		{"default", url.Values{"genres": {"comedy,drama"}}, http.StatusOK, data.GenresModeAll},
+		{"all", url.Values{"genres": {"comedy,drama"}, "genres_mode": {"all"}}, http.StatusOK, data.GenresModeAll},
+		{"any", url.Values{"genres": {"comedy,drama"}, "genres_mode": {"any"}}, http.StatusOK, data.GenresModeAny},
+		{"invalid", url.Values{"genres": {"comedy,drama"}, "genres_mode": {"some"}}, http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+
+			rr := getMovies(app, tt.query)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if movies.genresMode != tt.mode {
+				t.Errorf("listed with genres mode %q; want %q", movies.genresMode, tt.mode)
+			}
+			if tt.status == http.StatusUnprocessableEntity && !strings.Contains(rr.Body.String(), "genres_mode") {
+				t.Errorf("got body %s; want a genres_mode error", rr.Body)
+			}
+		})
+	}
+}
+
+func TestListMoviesRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		want   data.Filters
+	}{
+		{"years", url.Values{"year_from": {"2000"}, "year_to": {"2010"}}, http.StatusOK, data.Filters{YearFrom: 2000, YearTo: 2010}},
+		{"one year", url.Values{"year_from": {"2000"}, "year_to": {"2000"}}, http.StatusOK, data.Filters{YearFrom: 2000, YearTo: 2000}},
+		{"runtimes", url.Values{"runtime_min": {"90"}, "runtime_max": {"120"}}, http.StatusOK, data.Filters{RuntimeMin: 90, RuntimeMax: 120}},
+		{"years inverted", url.Values{"year_from": {"2010"}, "year_to": {"2000"}}, http.StatusUnprocessableEntity, data.Filters{}},
+		{"runtimes inverted", url.Values{"runtime_min": {"120"}, "runtime_max": {"90"}}, http.StatusUnprocessableEntity, data.Filters{}},
+		{"year out of bounds", url.Values{"year_from": {"1800"}}, http.StatusUnprocessableEntity, data.Filters{}},
+		{"not a number", url.Values{"runtime_min": {"long"}}, http.StatusUnprocessableEntity, data.Filters{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+
+			rr := getMovies(app, tt.query)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+
+			got := movies.filters
+			if got.YearFrom != tt.want.YearFrom || got.YearTo != tt.want.YearTo || got.RuntimeMin != tt.want.RuntimeMin || got.RuntimeMax != tt.want.RuntimeMax {
+				t.Errorf("listed years %d-%d and runtimes %d-%d; want %d-%d and %d-%d",
+					got.YearFrom, got.YearTo, got.RuntimeMin, got.RuntimeMax,
+					tt.want.YearFrom, tt.want.YearTo, tt.want.RuntimeMin, tt.want.RuntimeMax)
+			}
+		})
+	}
+}
+
+func TestListMoviesCreatedWindow(t *testing.T) {
+	after := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	before := time.Date(2023, 3, 2, 9, 30, 0, 0, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+		// field is the one an error names, if any.
+		field         string
+		after, before time.Time
+	}{
+		{name: "none", query: url.Values{}, status: http.StatusOK},
+		{name: "after", query: url.Values{"created_after": {"2023-03-01T12:00:00Z"}}, status: http.StatusOK, after: after},
+		{name: "window", query: url.Values{"created_after": {"2023-03-01T12:00:00Z"}, "created_before": {"2023-03-02T09:30:00+02:00"}}, status: http.StatusOK, after: after, before: before},
+		{name: "with genres", query: url.Values{"created_after": {"2023-03-01T12:00:00Z"}, "genres": {"drama"}}, status: http.StatusOK, after: after},
+		{name: "not RFC 3339", query: url.Values{"created_after": {"2023-03-01"}}, status: http.StatusUnprocessableEntity, field: "created_after"},
+		{name: "not a time", query: url.Values{"created_before": {"yesterday"}}, status: http.StatusUnprocessableEntity, field: "created_before"},
+		{name: "inverted", query: url.Values{"created_after": {"2023-03-02T09:30:00+02:00"}, "created_before": {"2023-03-01T12:00:00Z"}}, status: http.StatusUnprocessableEntity, field: "created_after"},
+		{name: "empty", query: url.Values{"created_after": {"2023-03-01T12:00:00Z"}, "created_before": {"2023-03-01T14:00:00+02:00"}}, status: http.StatusUnprocessableEntity, field: "created_after"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+
+			rr := getMovies(app, tt.query)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.field != "" {
+				if !strings.Contains(rr.Body.String(), `"`+tt.field+`"`) {
+					t.Errorf("got body %s; want a %s error", rr.Body, tt.field)
+				}
+				return
+			}
+
+			got := movies.filters
+			if !got.CreatedAfter.Equal(tt.after) || !got.CreatedBefore.Equal(tt.before) {
+				t.Errorf("listed created after %s and before %s; want %s and %s", got.CreatedAfter, got.CreatedBefore, tt.after, tt.before)
+			}
+		})
+	}
+}
+
+func TestListMoviesDefaultSort(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		want  string
+	}{
+		{"no sort", url.Values{}, "-year"},
+		{"empty sort", url.Values{"sort": {""}}, "-year"},
+		{"ascending", url.Values{"sort": {"title"}}, "title"},
+		{"descending", url.Values{"sort": {"-id"}}, "-id"},
+		{"the default itself", url.Values{"sort": {"-year"}}, "-year"},
+		{"relevance", url.Values{"title": {"moana"}, "sort": {"relevance"}}, "relevance"},
+		// Cursors only page in id order, whatever the default.
+		{"cursor", url.Values{"cursor": {""}}, "id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.config.movieDefaultSort = "-year"
+			app.models.Movies = movies
+
+			rr := getMovies(app, tt.query)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+			if movies.filters.Sort != tt.want {
+				t.Errorf("listed with sort %q; want %q", movies.filters.Sort, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMoviesRelevanceSort(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		// wantErr is the error expected on the sort key, if any.
+		wantErr string
+	}{
+		{"relevance without title", url.Values{"sort": {"relevance"}}, "relevance sort requires a title query"},
+		{"-relevance without title", url.Values{"sort": {"-relevance"}}, "relevance sort requires a title query"},
+		{"-relevance with an empty title", url.Values{"title": {""}, "sort": {"-relevance"}}, "relevance sort requires a title query"},
+		{"relevance with title", url.Values{"title": {"moana"}, "sort": {"relevance"}}, ""},
+		{"-relevance with title", url.Values{"title": {"moana"}, "sort": {"-relevance"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+
+			rr := getMovies(app, tt.query)
+			if tt.wantErr == "" {
+				if rr.Code != http.StatusOK {
+					t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+				}
+				if movies.filters.Sort != tt.query.Get("sort") {
+					t.Errorf("listed with sort %q; want %q", movies.filters.Sort, tt.query.Get("sort"))
+				}
+				return
+			}
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+			var body struct {
+				Error map[string]string `json:"error"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Error["sort"] != tt.wantErr {
+				t.Errorf("got errors %v; want %q on sort", body.Error, tt.wantErr)
+			}
+			if movies.filters.Sort != "" {
+				t.Errorf("listed movies sorted by %q for an invalid request", movies.filters.Sort)
+			}
+		})
+	}
+}
+
+// softDeletedMovies keeps movies in memory along with which are deleted.
+type softDeletedMovies struct {
+	data.MockMovieModel
+	movies  map[int64]data.Movie
+	deleted map[int64]bool
+}
+
+func (m *softDeletedMovies) Get(ctx context.Context, id int64) (*data.Movie, error) {
+	movie, ok := m.movies[id]
+	if !ok || m.deleted[id] {
+		return nil, data.ErrRecordNotFound
+	}
+	return &movie, nil
+}
+
+func (m *softDeletedMovies) Delete(ctx context.Context, id int64) (int32, error) {
+	movie, ok := m.movies[id]
+	if !ok || m.deleted[id] {
+		return 0, data.ErrRecordNotFound
+	}
+	movie.Version++
+	m.movies[id] = movie
+	m.deleted[id] = true
+	return movie.Version, nil
+}
+
+func (m *softDeletedMovies) Restore(ctx context.Context, id int64) (*data.Movie, error) {
+	movie, ok := m.movies[id]
+	if !ok || !m.deleted[id] {
+		return nil, data.ErrRecordNotFound
+	}
+	movie.Version++
+	m.movies[id] = movie
+	delete(m.deleted, id)
+	return &movie, nil
+}
+
+func TestDeleteAndRestoreMovie(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1}
+
+	app := newTestApplication(t)
+	app.models.Movies = &softDeletedMovies{movies: map[int64]data.Movie{1: moana}, deleted: map[int64]bool{}}
+
+	user := &data.User{Id: 1, Name: "Alice", Activated: true}
+	steps := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"get", http.MethodGet, app.getMovieHandler, http.StatusOK},
+		{"delete", http.MethodDelete, app.deleteMovieHandler, http.StatusOK},
+		{"get deleted", http.MethodGet, app.getMovieHandler, http.StatusNotFound},
+		{"delete again", http.MethodDelete, app.deleteMovieHandler, http.StatusNotFound},
+		{"restore", http.MethodPost, app.restoreMovieHandler, http.StatusOK},
+		{"get restored", http.MethodGet, app.getMovieHandler, http.StatusOK},
+		{"restore live", http.MethodPost, app.restoreMovieHandler, http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, "/v1/movies/1", nil)
+		r = withIDParam(app.contextSetUser(r, user), 1)
+
+		rr := serve(step.handler, r)
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+	}
+}
+
+func TestListMoviesIncludeDeleted(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string
+		query  url.Values
+		status int
+	}{
+		{"viewer without deleted", data.RoleViewer, url.Values{}, http.StatusOK},
+		{"viewer with deleted", data.RoleViewer, url.Values{"include_deleted": {"true"}}, http.StatusForbidden},
+		{"admin with deleted", data.RoleAdmin, url.Values{"include_deleted": {"true"}}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+			app.models.Permissions = newMemoryPermissions()
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies?"+tt.query.Encode(), nil)
+			r = app.contextSetUser(r, &data.User{Id: 1, Activated: true, Role: tt.role})
+			rr := serve(http.HandlerFunc(app.listMoviesHandler), r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if want := tt.status == http.StatusOK && tt.query.Has("include_deleted"); movies.filters.IncludeDeleted != want {
+				t.Errorf("listed with include_deleted %t; want %t", movies.filters.IncludeDeleted, want)
+			}
+		})
+	}
+}
+
+func TestMovieStats(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, Role: data.RoleViewer, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	routes := app.routes()
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"without movies:read", newSession(t, app, 2), http.StatusForbidden},
+		{"with movies:read", newSession(t, app, 1), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/movies/stats", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rr := serve(routes, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			// An empty catalogue is reported as zeros, never nulls.
+			var body struct {
+				Stats map[string]json.RawMessage `json:"stats"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"total_movies": "0", "average_runtime": "0", "min_year": "0", "max_year": "0", "genres": "{}"}
+			for key, value := range want {
+				if got := string(body.Stats[key]); got != value {
+					t.Errorf("got %s %s; want %s", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateMovieReturnPreference(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefer     []string
+		wantStatus int
+		// applied is the Preference-Applied header, if one is sent.
+		applied string
+	}{
+		{name: "no preference", wantStatus: http.StatusCreated},
+		{name: "representation", prefer: []string{"return=representation"}, wantStatus: http.StatusCreated, applied: "return=representation"},
+		{name: "minimal", prefer: []string{"return=minimal"}, wantStatus: http.StatusNoContent, applied: "return=minimal"},
+		{name: "among other preferences", prefer: []string{"respond-async, wait=10", `return="minimal"; foo=bar`}, wantStatus: http.StatusNoContent, applied: "return=minimal"},
+		{name: "unknown return value", prefer: []string{"return=headers-only"}, wantStatus: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{}}
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(blackPantherJSON))
+			for _, prefer := range tt.prefer {
+				r.Header.Add("Prefer", prefer)
+			}
+			rr := serve(http.HandlerFunc(app.createMovieHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if len(store.movies) != 1 {
+				t.Errorf("stored %d movies; want 1", len(store.movies))
+			}
+			if got := rr.Header().Get("Location"); got != "/v1/movies/1" {
+				t.Errorf("got Location %q; want /v1/movies/1", got)
+			}
+			if got := rr.Header().Get("Preference-Applied"); got != tt.applied {
+				t.Errorf("got Preference-Applied %q; want %q", got, tt.applied)
+			}
+			if !strings.Contains(strings.Join(rr.Header().Values("Vary"), ","), "Prefer") {
+				t.Errorf("got Vary %q; want it to include Prefer", rr.Header().Values("Vary"))
+			}
+
+			if tt.wantStatus == http.StatusNoContent {
+				if rr.Body.Len() != 0 {
+					t.Errorf("got body %s; want none", rr.Body)
+				}
+				return
+			}
+			var body struct {
+				Movie data.Movie `json:"movie"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Movie.Id != 1 || body.Movie.Title != "Black Panther" {
+				t.Errorf("got movie %+v; want Black Panther with id 1", body.Movie)
+			}
+		})
+	}
+}
+
+func TestCreateMovieReturnPreferenceOnReplay(t *testing.T) {
+	app, movies := newIdempotencyTestApplication(t)
+
+	create := func(prefer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(moanaJSON))
+		r.Header.Set("Idempotency-Key", "key-1")
+		if prefer != "" {
+			r.Header.Set("Prefer", prefer)
+		}
+		return serve(http.HandlerFunc(app.createMovieHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+	}
+
+	// Each replay follows the preference of the request being answered,
+	// not of the one that created the movie.
+	steps := []struct {
+		prefer     string
+		wantStatus int
+		wantBody   bool
+	}{
+		{"return=minimal", http.StatusNoContent, false},
+		{"", http.StatusCreated, true},
+		{"return=minimal", http.StatusNoContent, false},
+	}
+
+	for i, step := range steps {
+		rr := create(step.prefer)
+		if rr.Code != step.wantStatus {
+			t.Fatalf("request %d with Prefer %q got status %d; want %d: %s", i+1, step.prefer, rr.Code, step.wantStatus, rr.Body)
+		}
+		if got := rr.Body.Len() > 0; got != step.wantBody {
+			t.Errorf("request %d got body %q", i+1, rr.Body)
+		}
+		if got := rr.Header().Get("Location"); got != "/v1/movies/1" {
+			t.Errorf("request %d got Location %q; want /v1/movies/1", i+1, got)
+		}
+	}
+	if movies.count() != 1 {
+		t.Errorf("inserted %d movies; want 1", movies.count())
+	}
+}
+
+func TestListMoviesPageSizeLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		pageSize string
+		status   int
+		// want and clamped are the page size GetAll is given and whether it
+		// was flagged as clamped.
+		want    int
+		clamped bool
+	}{
+		{name: "default", status: http.StatusOK, want: 20},
+		{name: "at the maximum", pageSize: "100", status: http.StatusOK, want: 100},
+		{name: "clamped", pageSize: "101", status: http.StatusOK, want: data.MaxPageSize, clamped: true},
+		{name: "clamped from far above", pageSize: "100000", status: http.StatusOK, want: data.MaxPageSize, clamped: true},
+		{name: "zero", pageSize: "0", status: http.StatusUnprocessableEntity},
+		{name: "strict at the maximum", strict: true, pageSize: "100", status: http.StatusOK, want: 100},
+		{name: "strict above the maximum", strict: true, pageSize: "101", status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := &listedMovies{}
+			app := newTestApplication(t)
+			app.models.Movies = movies
+			app.config.strictPageSize = tt.strict
+
+			query := url.Values{}
+			if tt.pageSize != "" {
+				query.Set("page_size", tt.pageSize)
+			}
+			rr := getMovies(app, query)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				if !strings.Contains(rr.Body.String(), "page_size") {
+					t.Errorf("got body %s; want a page_size error", rr.Body)
+				}
+				return
+			}
+			if movies.filters.PageSize != tt.want || movies.filters.PageSizeClamped != tt.clamped {
+				t.Errorf("listed %d per page, clamped %t; want %d, clamped %t", movies.filters.PageSize, movies.filters.PageSizeClamped, tt.want, tt.clamped)
+			}
+		})
+	}
+}
+
+func TestMovieGenresNormalized(t *testing.T) {
+	const want = "Action,Drama"
+	user := &data.User{Id: 1, Name: "Alice", Activated: true}
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		handler func(app *application) http.HandlerFunc
+	}{
+		{
+			name:    "create",
+			method:  http.MethodPost,
+			body:    `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["Action","action"," Drama "],"director":"Ron Clements","rating":"PG"}`,
+			handler: func(app *application) http.HandlerFunc { return app.createMovieHandler },
+		},
+		{
+			name:    "batch create",
+			method:  http.MethodPost,
+			body:    `[{"title":"Moana","year":2016,"runtime":"107 mins","genres":["Action","action"," Drama "],"director":"Ron Clements","rating":"PG"}]`,
+			handler: func(app *application) http.HandlerFunc { return app.createMovieBatchHandler },
+		},
+		{
+			name:    "update",
+			method:  http.MethodPatch,
+			body:    `{"genres":["Action","ACTION","Drama  "]}`,
+			handler: func(app *application) http.HandlerFunc { return app.updateMovieHandler },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{
+				1: {Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 1},
+			}, nextID: 1}
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			r = withIDParam(app.contextSetUser(r, user), 1)
+			rr := serve(tt.handler(app), r)
+			if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+
+			id := int64(1)
+			if tt.method == http.MethodPost {
+				id = 2
+			}
+			if got := strings.Join(store.movies[id].Genres, ","); got != want {
+				t.Errorf("stored genres %s; want %s", got, want)
+			}
+		})
+	}
+
+	// A batch is validated after normalizing, so genres that only repeat
+	// each other don't count against the limit.
+	app := newTestApplication(t)
+	app.config.movieLimits.MaxGenres = 2
+	app.models.Movies = &rollbackMovies{movies: map[int64]data.Movie{}}
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", strings.NewReader(
+		`[{"title":"Moana","year":2016,"runtime":"107 mins","genres":["Action","action","Drama","drama"],"director":"Ron Clements","rating":"PG"}]`))
+	if rr := serve(http.HandlerFunc(app.createMovieBatchHandler), app.contextSetUser(r, user)); rr.Code != http.StatusCreated {
+		t.Errorf("a batch with 2 distinct genres got status %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestCreateMovieBatchFieldPaths(t *testing.T) {
+	user := &data.User{Id: 1, Name: "Alice", Activated: true}
+	long := strings.Repeat("x", data.DefaultMovieLimits.MaxGenreLength+1)
+
+	tests := []struct {
+		name    string
+		body    string
+		handler func(app *application) http.HandlerFunc
+		want    []string
+	}{
+		{
+			name: "batch",
+			body: `[
+				{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"],"director":"Ron Clements","rating":"PG"},
+				{"title":"Black Panther","year":1800,"runtime":"134 mins","genres":["action","` + long + `"],"director":"Ryan Coogler","rating":"PG-13"},
+				{"title":"Deadpool","year":2016,"runtime":"108 mins","genres":["action"],"director":"Tim Miller","rating":"R"},
+				{"title":"moana","year":2016,"runtime":"107 mins","genres":["animation"],"rating":"PG"}
+			]`,
+			handler: func(app *application) http.HandlerFunc { return app.createMovieBatchHandler },
+			want:    []string{"movies[1].genres[1]", "movies[1].year", "movies[3].director", "movies[3].title"},
+		},
+		{
+			name:    "single movie",
+			body:    `{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation","` + long + `"],"director":"Ron Clements","rating":"PG"}`,
+			handler: func(app *application) http.HandlerFunc { return app.createMovieHandler },
+			want:    []string{"genres[1]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{}}
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(tt.body))
+			rr := serve(tt.handler(app), app.contextSetUser(r, user))
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+			}
+
+			var body struct {
+				Code  string            `json:"code"`
+				Error map[string]string `json:"error"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != codeValidationFailed {
+				t.Errorf("got code %q; want %q", body.Code, codeValidationFailed)
+			}
+
+			var got []string
+			for key := range body.Error {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got errors %v; want keys %v", body.Error, tt.want)
+			}
+			if len(store.movies) != 0 {
+				t.Errorf("stored %d movies from an invalid request", len(store.movies))
+			}
+		})
+	}
+}
+
+func TestCreateMovieBatch(t *testing.T) {
+	user := &data.User{Id: 1, Name: "Alice", Activated: true}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "JSON",
+			contentType: mediaTypeJSON,
+			body: `[
+				{"title":"Moana","year":2016,"runtime":"107 mins","genres":["animation"],"director":"Ron Clements","rating":"PG"},
+				{"title":"Black Panther","year":2018,"runtime":"134 mins","genres":["action"],"director":"Ryan Coogler","rating":"PG-13"},
+				{"title":"Deadpool","year":2016,"runtime":"108 mins","genres":["action","comedy"],"director":"Tim Miller","rating":"R"}
+			]`,
+		},
+		{
+			name:        "XML",
+			contentType: mediaTypeXML,
+			body: `<movies>
+				<movie><title>Moana</title><year>2016</year><runtime>107 mins</runtime><genres><genre>animation</genre></genres><director>Ron Clements</director><rating>PG</rating></movie>
+				<movie><title>Black Panther</title><year>2018</year><runtime>134 mins</runtime><genres><genre>action</genre></genres><director>Ryan Coogler</director><rating>PG-13</rating></movie>
+				<movie><title>Deadpool</title><year>2016</year><runtime>108 mins</runtime><genres><genre>action</genre><genre>comedy</genre></genres><director>Tim Miller</director><rating>R</rating></movie>
+			</movies>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{
+				1: {Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG", Version: 3},
+			}, nextID: 1}
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			rr := serve(http.HandlerFunc(app.createMovieBatchHandler), app.contextSetUser(r, user))
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+			}
+
+			var body struct {
+				Movies []struct {
+					Id      int64 `json:"id"`
+					Version int32 `json:"version"`
+				} `json:"movies"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The response lists the created movies in the order of the
+			// request, each with the id and version it was stored with.
+			titles := []string{"Moana", "Black Panther", "Deadpool"}
+			if len(body.Movies) != len(titles) {
+				t.Fatalf("got %d movies; want %d: %s", len(body.Movies), len(titles), rr.Body)
+			}
+			for i, movie := range body.Movies {
+				stored, ok := store.movies[movie.Id]
+				if !ok {
+					t.Errorf("movies[%d] has id %d, which wasn't stored", i, movie.Id)
+					continue
+				}
+				if movie.Id != int64(i+2) || stored.Title != titles[i] || movie.Version != stored.Version {
+					t.Errorf("movies[%d] is %q with id %d, version %d; want %q with id %d, version %d", i, stored.Title, movie.Id, movie.Version, titles[i], i+2, stored.Version)
+				}
+			}
+			if got := strings.Join(store.movies[4].Genres, ","); got != "action,comedy" {
+				t.Errorf("stored genres %s; want action,comedy", got)
+			}
+		})
+	}
+}
+
+func TestCreateMovieBatchSize(t *testing.T) {
+	user := &data.User{Id: 1, Name: "Alice", Activated: true}
+
+	body := func(n int) string {
+		movies := make([]string, n)
+		for i := range movies {
+			movies[i] = fmt.Sprintf(`{"title":"Movie %d","year":2016,"runtime":"90 mins","genres":["drama"],"director":"Ron Clements","rating":"PG"}`, i)
+		}
+		return "[" + strings.Join(movies, ",") + "]"
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		stored int
+	}{
+		{name: "empty", body: "[]", status: http.StatusUnprocessableEntity},
+		{name: "at the limit", body: body(maxMovieBatchSize), status: http.StatusCreated, stored: maxMovieBatchSize},
+		{name: "over the limit", body: body(maxMovieBatchSize + 1), status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &rollbackMovies{movies: map[int64]data.Movie{}}
+			app := newTestApplication(t)
+			app.models.Movies = store
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies/batch", strings.NewReader(tt.body))
+			rr := serve(http.HandlerFunc(app.createMovieBatchHandler), app.contextSetUser(r, user))
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if len(store.movies) != tt.stored {
+				t.Errorf("stored %d movies; want %d", len(store.movies), tt.stored)
+			}
+			if tt.status != http.StatusUnprocessableEntity {
+				return
+			}
+
+			var response struct {
+				Error map[string]string `json:"error"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := response.Error["movies"]; !ok || len(response.Error) != 1 {
+				t.Errorf("got errors %v; want one for movies", response.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// mxResolver is the part of *net.Resolver used to look up mail exchangers.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+type mxCacheEntry struct {
+	hasMX   bool
+	expires time.Time
+}
+
+// mxChecker reports whether email domains have a mail exchanger, caching the
+// answers for ttl so that a burst of sign-ups from one domain costs a single
+// lookup.
+type mxChecker struct {
+	resolver mxResolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mxCacheEntry
+}
+
+const (
+	mxLookupTimeout = 2 * time.Second
+	mxCacheTTL      = 5 * time.Minute
+	mxCacheSweepLen = 1024
+)
+
+func newMXChecker(resolver mxResolver, ttl time.Duration) *mxChecker {
+	return &mxChecker{
+		resolver: resolver,
+		ttl:      ttl,
+		cache:    make(map[string]mxCacheEntry),
+	}
+}
+
+// hasMX looks up the domain's MX records. A domain that doesn't exist, has
+// none, or publishes only a null MX (RFC 7505) has no mail exchanger. Other
+// lookup failures are returned and not cached.
+func (c *mxChecker) hasMX(ctx context.Context, domain string) (bool, error) {
+	domain = strings.ToLower(domain)
+
+	c.mu.Lock()
+	entry, ok := c.cache[domain]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.hasMX, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mxLookupTimeout)
+	defer cancel()
+
+	records, err := c.resolver.LookupMX(ctx, domain)
+
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return false, err
+	}
+
+	hasMX := false
+	for _, record := range records {
+		if record.Host != "." {
+			hasMX = true
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) >= mxCacheSweepLen {
+		now := time.Now()
+		for key, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, key)
+			}
+		}
+	}
+	c.cache[domain] = mxCacheEntry{hasMX: hasMX, expires: time.Now().Add(c.ttl)}
+
+	return hasMX, nil
+}
+
+// checkEmailDomain rejects an email address whose domain has no mail
+// exchanger, when MX verification is enabled. A failed lookup is logged and
+// the address let through, so a DNS outage doesn't stop sign-ups.
+func (app *application) checkEmailDomain(r *http.Request, v *validator.Validator, email string) {
+	if app.mxChecker == nil {
+		return
+	}
+
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return
+	}
+
+	hasMX, err := app.mxChecker.hasMX(r.Context(), domain)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	v.Check(hasMX, "email", "must use a domain that accepts email")
+}
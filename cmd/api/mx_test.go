@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/mailer"
+)
+
+// fakeResolver answers MX lookups from a table and counts them. Domains that
+// aren't in the table don't exist.
+type fakeResolver struct {
+	records map[string][]*net.MX
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	records, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func newFakeResolver() *fakeResolver {
+	return &fakeResolver{records: map[string][]*net.MX{
+		"example.com":    {{Host: "mx1.example.com.", Pref: 10}, {Host: "mx2.example.com.", Pref: 20}},
+		"null.example":   {{Host: ".", Pref: 0}},
+		"no-mx.example":  {},
+		"mixed.example":  {{Host: ".", Pref: 0}, {Host: "mx.mixed.example.", Pref: 10}},
+		"uppercase.test": {{Host: "mx.uppercase.test.", Pref: 10}},
+	}}
+}
+
+func TestMXCheckerHasMX(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"mixed.example", true},
+		{"UPPERCASE.test", true},
+		{"null.example", false},
+		{"no-mx.example", false},
+		{"gmial.con", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			resolver := newFakeResolver()
+			checker := newMXChecker(resolver, time.Minute)
+
+			for i := 0; i < 2; i++ {
+				got, err := checker.hasMX(context.Background(), tt.domain)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("got %t; want %t", got, tt.want)
+				}
+			}
+			// The second answer came from the cache.
+			if resolver.lookups != 1 {
+				t.Errorf("made %d lookups; want 1", resolver.lookups)
+			}
+		})
+	}
+}
+
+func TestMXCheckerCache(t *testing.T) {
+	resolver := newFakeResolver()
+	checker := newMXChecker(resolver, 20*time.Millisecond)
+	ctx := context.Background()
+
+	// Domains are cached without regard to case.
+	for _, domain := range []string{"example.com", "Example.COM"} {
+		if ok, err := checker.hasMX(ctx, domain); !ok || err != nil {
+			t.Fatalf("%s: got %t, %v", domain, ok, err)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("made %d lookups; want 1", resolver.lookups)
+	}
+
+	// Once the answer expires, the domain is looked up again.
+	time.Sleep(30 * time.Millisecond)
+	delete(resolver.records, "example.com")
+	if ok, err := checker.hasMX(ctx, "example.com"); ok || err != nil {
+		t.Errorf("after expiry got %t, %v; want the new answer", ok, err)
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("made %d lookups; want 2", resolver.lookups)
+	}
+
+	// Failures are returned and not cached.
+	resolver.err = &net.DNSError{Err: "server misbehaving", Name: "example.org", IsTemporary: true}
+	for i := 0; i < 2; i++ {
+		_, err := checker.hasMX(ctx, "example.org")
+		if !errors.Is(err, resolver.err) {
+			t.Errorf("got err %v; want %v", err, resolver.err)
+		}
+	}
+	if resolver.lookups != 4 {
+		t.Errorf("made %d lookups; want 4", resolver.lookups)
+	}
+}
+
+func TestRegisterUserMX(t *testing.T) {
+	tests := []struct {
+		name      string
+		verify    bool
+		email     string
+		failDNS   bool
+		want      int
+		lookups   int
+		loggedDNS bool
+	}{
+		{name: "verification off", email: "alice@gmial.con", want: http.StatusCreated},
+		{name: "domain with MX", verify: true, email: "alice@example.com", want: http.StatusCreated, lookups: 1},
+		{name: "domain without MX", verify: true, email: "alice@no-mx.example", want: http.StatusUnprocessableEntity, lookups: 1},
+		{name: "null MX", verify: true, email: "alice@null.example", want: http.StatusUnprocessableEntity, lookups: 1},
+		{name: "missing domain", verify: true, email: "alice@gmial.con", want: http.StatusUnprocessableEntity, lookups: 1},
+		{name: "invalid address", verify: true, email: "alice", want: http.StatusUnprocessableEntity},
+		{name: "lookup failure", verify: true, email: "alice@example.com", failDNS: true, want: http.StatusCreated, lookups: 1, loggedDNS: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			app := newSessionTestApplication(t)
+			app.logger = jsonlog.New(&logs, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+			app.config.tokens.activationTTL = time.Hour
+			app.mailer = &mailer.MockMailer{}
+			app.models.Permissions = newMemoryPermissions()
+
+			resolver := newFakeResolver()
+			if tt.failDNS {
+				resolver.err = errors.New("dns server unreachable")
+			}
+			if tt.verify {
+				app.mxChecker = newMXChecker(resolver, time.Minute)
+			}
+
+			body := `{"name":"Alice","email":"` + tt.email + `","password":"pa55word1234"}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body))
+			rr := serve(http.HandlerFunc(app.registerUserHandler), app.contextSetUser(r, data.AnonymousUser))
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want == http.StatusUnprocessableEntity && !strings.Contains(rr.Body.String(), `"email"`) {
+				t.Errorf("got body %s; want an email error", rr.Body)
+			}
+			if resolver.lookups != tt.lookups {
+				t.Errorf("made %d lookups; want %d", resolver.lookups, tt.lookups)
+			}
+			if logged := strings.Contains(logs.String(), "dns server unreachable"); logged != tt.loggedDNS {
+				t.Errorf("logged the lookup failure %t; want %t", logged, tt.loggedDNS)
+			}
+		})
+	}
+}
+
+func TestUpdateEmailMX(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    int
+		lookups int
+	}{
+		{name: "domain with MX", body: `{"email":"alice@example.com"}`, want: http.StatusOK, lookups: 1},
+		{name: "domain without MX", body: `{"email":"alice@no-mx.example"}`, want: http.StatusUnprocessableEntity, lookups: 1},
+		// Addresses that aren't changing aren't looked up, so a domain that
+		// has since lost its MX doesn't lock the user out of other changes.
+		{name: "unchanged email", body: `{"name":"Alicia","email":"alice@null.example"}`, want: http.StatusOK},
+		{name: "name only", body: `{"name":"Alicia"}`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := &data.User{Id: 1, Name: "Alice", Email: "alice@null.example", Activated: true, Locale: "en", Version: 1, TokenVersion: 1}
+			err := alice.Password.Set("pa55word1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := newSessionTestApplication(t, alice)
+			app.config.tokens.activationTTL = time.Hour
+			app.mailer = &mailer.MockMailer{}
+			resolver := newFakeResolver()
+			app.mxChecker = newMXChecker(resolver, time.Minute)
+
+			// The handler changes the user it is given, so it gets a copy.
+			user, err := app.models.Users.Get(context.Background(), alice.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/users/me", strings.NewReader(tt.body))
+			rr := serve(http.HandlerFunc(app.updateCurrentUserHandler), app.contextSetUser(r, user))
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if resolver.lookups != tt.lookups {
+				t.Errorf("made %d lookups; want %d", resolver.lookups, tt.lookups)
+			}
+			if stored := app.models.Users.(sessionUsers).store.users[1]; tt.want != http.StatusOK && stored.Email != "alice@null.example" {
+				t.Errorf("stored email %s after a rejected change", stored.Email)
+			}
+		})
+	}
+}
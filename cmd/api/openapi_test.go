@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes are served but deliberately left out of the spec, which
+// only covers the movie, user and token endpoints.
+var undocumentedRoutes = []string{
+	"GET /v1/livez",
+	"GET /v1/readyz",
+	"GET /v1/openapi.json",
+	"GET /v1/admin/audit",
+	"GET /v1/admin/tokens",
+	"GET /v1/admin/feature-flags",
+	"PUT /v1/admin/log-level",
+}
+
+type openapiParameter struct {
+	Ref  string `json:"$ref"`
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+type openapiOperation struct {
+	Parameters []openapiParameter         `json:"parameters"`
+	Responses  map[string]json.RawMessage `json:"responses"`
+}
+
+type openapiSpec struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Parameters map[string]openapiParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+// registeredRoutes returns "METHOD /path" for every route routes.go registers
+// on the API routers, with httprouter's :name parameters written as {name}.
+func registeredRoutes(t *testing.T) []string {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "routes.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	param := regexp.MustCompile(`:(\w+)`)
+
+	var routes []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) < 2 {
+			return true
+		}
+		fun, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || (fun.Sel.Name != "HandlerFunc" && fun.Sel.Name != "Handler") {
+			return true
+		}
+		recv, ok := fun.X.(*ast.Ident)
+		if !ok || (recv.Name != "router" && recv.Name != "fallback") {
+			return true
+		}
+
+		method, ok := call.Args[0].(*ast.SelectorExpr)
+		if !ok || !strings.HasPrefix(method.Sel.Name, "Method") {
+			t.Fatalf("route with a method that isn't an http.Method constant at offset %d", call.Pos())
+		}
+		lit, ok := call.Args[1].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			t.Fatalf("route with a path that isn't a literal at offset %d", call.Pos())
+		}
+		path, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routes = append(routes, strings.ToUpper(strings.TrimPrefix(method.Sel.Name, "Method"))+" "+param.ReplaceAllString(path, "{$1}"))
+		return true
+	})
+
+	if len(routes) == 0 {
+		t.Fatal("found no routes in routes.go")
+	}
+	return routes
+}
+
+func loadOpenAPISpec(t *testing.T) openapiSpec {
+	t.Helper()
+
+	var spec openapiSpec
+	err := json.Unmarshal(openapiDocument, &spec)
+	if err != nil {
+		t.Fatalf("openapi.json isn't valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("got openapi version %q; want 3.x", spec.OpenAPI)
+	}
+	return spec
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	methods := map[string]bool{"get": true, "put": true, "post": true, "patch": true, "delete": true, "head": true, "options": true}
+
+	documented := map[string]bool{}
+	for path, item := range spec.Paths {
+		for method := range item {
+			if methods[method] {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	routed := map[string]bool{}
+	for _, route := range registeredRoutes(t) {
+		routed[route] = true
+	}
+
+	skipped := map[string]bool{}
+	for _, route := range undocumentedRoutes {
+		skipped[route] = true
+		if !routed[route] {
+			t.Errorf("%s is listed as undocumented but isn't routed", route)
+		}
+		if documented[route] {
+			t.Errorf("%s is listed as undocumented but is in openapi.json", route)
+		}
+	}
+
+	var missing, stale []string
+	for route := range routed {
+		if !documented[route] && !skipped[route] {
+			missing = append(missing, route)
+		}
+	}
+	for route := range documented {
+		if !routed[route] {
+			stale = append(stale, route)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+
+	for _, route := range missing {
+		t.Errorf("%s is routed but missing from openapi.json", route)
+	}
+	for _, route := range stale {
+		t.Errorf("%s is in openapi.json but not routed", route)
+	}
+}
+
+func TestOpenAPIOperations(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	placeholder := regexp.MustCompile(`\{(\w+)\}`)
+
+	for path, item := range spec.Paths {
+		for method, raw := range item {
+			if method == "parameters" || method == "summary" || method == "description" {
+				continue
+			}
+
+			var op openapiOperation
+			err := json.Unmarshal(raw, &op)
+			if err != nil {
+				t.Errorf("%s %s: %v", method, path, err)
+				continue
+			}
+			if len(op.Responses) == 0 {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+
+			declared := map[string]bool{}
+			for _, p := range op.Parameters {
+				if p.Ref != "" {
+					name := strings.TrimPrefix(p.Ref, "#/components/parameters/")
+					resolved, ok := spec.Components.Parameters[name]
+					if !ok {
+						t.Errorf("%s %s refers to unknown parameter %s", method, path, p.Ref)
+						continue
+					}
+					p = resolved
+				}
+				if p.In == "path" {
+					declared[p.Name] = true
+				}
+			}
+
+			for _, match := range placeholder.FindAllStringSubmatch(path, -1) {
+				if !declared[match[1]] {
+					t.Errorf("%s %s doesn't declare path parameter %s", method, path, match[1])
+				}
+				delete(declared, match[1])
+			}
+			for name := range declared {
+				t.Errorf("%s %s declares path parameter %s that isn't in the path", method, path, name)
+			}
+		}
+	}
+}
+
+// TestOpenAPIRefs checks that every $ref in the document points at something
+// in it.
+func TestOpenAPIRefs(t *testing.T) {
+	var doc any
+	err := json.Unmarshal(openapiDocument, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(ref string) bool {
+		var node any = doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+			object, ok := node.(map[string]any)
+			if !ok {
+				return false
+			}
+			if node, ok = object[part]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch n := node.(type) {
+		case map[string]any:
+			for key, value := range n {
+				if ref, ok := value.(string); ok && key == "$ref" && (!strings.HasPrefix(ref, "#/") || !resolve(ref)) {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+				walk(value)
+			}
+		case []any:
+			for _, value := range n {
+				walk(value)
+			}
+		}
+	}
+	walk(doc)
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	rr := serve(http.HandlerFunc(app.openapiHandler), httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d with Content-Type %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if rr.Body.String() != string(openapiDocument) {
+		t.Error("served document differs from the embedded one")
+	}
+}
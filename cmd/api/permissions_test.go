@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// memoryPermissions keeps direct grants and role permissions in memory.
+type memoryPermissions struct {
+	direct map[int64]data.Permissions
+	roles  map[string]data.Permissions
+}
+
+func newMemoryPermissions() *memoryPermissions {
+	return &memoryPermissions{
+		direct: map[int64]data.Permissions{},
+		roles: map[string]data.Permissions{
+			data.RoleAdmin:  data.PermissionCodes,
+			data.RoleEditor: {"movies:read", "movies:write"},
+			data.RoleViewer: {"movies:read"},
+		},
+	}
+}
+
+func (p *memoryPermissions) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+	return p.direct[userID], nil
+}
+
+func (p *memoryPermissions) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	for _, code := range codes {
+		if !p.direct[userID].Include(code) {
+			p.direct[userID] = append(p.direct[userID], code)
+		}
+	}
+	return nil
+}
+
+func (p *memoryPermissions) GetAllForRole(ctx context.Context, role string) (data.Permissions, error) {
+	return p.roles[role], nil
+}
+
+func (p *memoryPermissions) RemoveForUser(ctx context.Context, userID int64, code string) error {
+	var kept data.Permissions
+	for _, c := range p.direct[userID] {
+		if c != code {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(p.direct[userID]) {
+		return data.ErrRecordNotFound
+	}
+	p.direct[userID] = kept
+	return nil
+}
+
+func TestUserHasPermission(t *testing.T) {
+	tests := []struct {
+		name   string
+		role   string
+		direct data.Permissions
+		code   string
+		want   bool
+	}{
+		{"no role or grants", "", nil, "movies:read", false},
+		{"direct grant without a role", "", data.Permissions{"movies:write"}, "movies:write", true},
+		{"direct grant of another code", "", data.Permissions{"movies:read"}, "movies:write", false},
+		{"from the role", data.RoleViewer, nil, "movies:read", true},
+		{"not in the role", data.RoleViewer, nil, "movies:write", false},
+		{"direct grant beyond the role", data.RoleViewer, data.Permissions{"movies:write"}, "movies:write", true},
+		{"admin", data.RoleAdmin, nil, "admin:write", true},
+		{"editor", data.RoleEditor, nil, "admin:read", false},
+		{"unknown role", "critic", nil, "movies:read", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			permissions := newMemoryPermissions()
+			permissions.direct[1] = tt.direct
+			app.models.Permissions = permissions
+
+			got, err := app.userHasPermission(context.Background(), &data.User{Id: 1, Role: tt.role}, tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequirePermissionFollowsRole(t *testing.T) {
+	app := newTestApplication(t)
+	permissions := newMemoryPermissions()
+	app.models.Permissions = permissions
+
+	user := &data.User{Id: 1, Activated: true}
+	write := app.requirePermission("movies:write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name string
+		step func()
+		want int
+	}{
+		{"editor", func() { user.Role = data.RoleEditor }, http.StatusNoContent},
+		{"demoted to viewer", func() { user.Role = data.RoleViewer }, http.StatusForbidden},
+		{"granted directly", func() { permissions.AddForUser(context.Background(), user.Id, "movies:write") }, http.StatusNoContent},
+		{"grant revoked", func() { permissions.RemoveForUser(context.Background(), user.Id, "movies:write") }, http.StatusForbidden},
+		{"no role", func() { user.Role = "" }, http.StatusForbidden},
+		{"promoted to admin", func() { user.Role = data.RoleAdmin }, http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.step()
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+			rr := serve(write, app.contextSetUser(r, user))
+			if rr.Code != tt.want {
+				t.Errorf("got status %d; want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantAndRevokePermissions(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+		&data.User{Id: 3, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	permissions := newMemoryPermissions()
+	app.models.Permissions = permissions
+	routes := app.routes()
+
+	admin := newSession(t, app, 1)
+	editor := newSession(t, app, 3)
+
+	steps := []struct {
+		name   string
+		token  string
+		method string
+		target string
+		body   string
+		want   int
+		// granted is Alice's direct grants after the step.
+		granted []string
+	}{
+		{"grant without admin:write", editor, http.MethodPost, "/v1/users/2/permissions", `{"codes":["movies:write"]}`, http.StatusForbidden, nil},
+		{"grant", admin, http.MethodPost, "/v1/users/2/permissions", `{"codes":["movies:write"]}`, http.StatusOK, []string{"movies:write"}},
+		{"duplicate grant", admin, http.MethodPost, "/v1/users/2/permissions", `{"codes":["movies:write"]}`, http.StatusOK, []string{"movies:write"}},
+		{"grant an unknown code", admin, http.MethodPost, "/v1/users/2/permissions", `{"codes":["movies:delete"]}`, http.StatusUnprocessableEntity, []string{"movies:write"}},
+		{"grant to a missing user", admin, http.MethodPost, "/v1/users/99/permissions", `{"codes":["movies:write"]}`, http.StatusNotFound, []string{"movies:write"}},
+		{"revoke without admin:write", editor, http.MethodDelete, "/v1/users/2/permissions/movies:write", "", http.StatusForbidden, []string{"movies:write"}},
+		{"revoke", admin, http.MethodDelete, "/v1/users/2/permissions/movies:write", "", http.StatusOK, nil},
+		{"revoke a grant that doesn't exist", admin, http.MethodDelete, "/v1/users/2/permissions/movies:write", "", http.StatusNotFound, nil},
+		{"revoke an unknown code", admin, http.MethodDelete, "/v1/users/2/permissions/movies:delete", "", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, step.target, strings.NewReader(step.body))
+		r.Header.Set("Authorization", "Bearer "+step.token)
+
+		rr := serve(routes, r)
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+		if got := permissions.direct[2]; !reflect.DeepEqual([]string(got), step.granted) {
+			t.Fatalf("%s: Alice has %q; want %q", step.name, got, step.granted)
+		}
+
+		if step.method == http.MethodPost && step.want == http.StatusOK {
+			var body struct {
+				Permissions []string `json:"permissions"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(body.Permissions, step.granted) {
+				t.Errorf("%s: response lists %q; want %q", step.name, body.Permissions, step.granted)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram buckets.
+var durationBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpMetrics accumulates the request figures exported on /metrics. The zero
+// value is ready to use.
+type httpMetrics struct {
+	requests     atomic.Uint64
+	responses    atomic.Uint64
+	buckets      [len(durationBuckets)]atomic.Uint64
+	durationSum  atomic.Uint64 // microseconds
+	durationOver atomic.Uint64 // observations above the largest bucket
+}
+
+func (m *httpMetrics) observe(d time.Duration) {
+	m.responses.Add(1)
+	m.durationSum.Add(uint64(d.Microseconds()))
+
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i].Add(1)
+			return
+		}
+	}
+	m.durationOver.Add(1)
+}
+
+func (app *application) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m := &app.httpMetrics
+
+	writeMetric(bw, "http_requests_total", "counter", "Total number of HTTP requests received.", float64(m.requests.Load()))
+	writeMetric(bw, "http_responses_total", "counter", "Total number of HTTP responses sent.", float64(m.responses.Load()))
+	writeMetric(bw, "http_requests_in_flight", "gauge", "Number of HTTP requests currently being served.", float64(app.inFlight.Load()))
+
+	fmt.Fprintln(bw, "# HELP http_request_duration_seconds Time taken to serve HTTP requests.")
+	fmt.Fprintln(bw, "# TYPE http_request_duration_seconds histogram")
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		cumulative += m.buckets[i].Load()
+		fmt.Fprintf(bw, "http_request_duration_seconds_bucket{le=%q} %d\n", formatFloat(bound), cumulative)
+	}
+	cumulative += m.durationOver.Load()
+	fmt.Fprintf(bw, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(bw, "http_request_duration_seconds_sum %s\n", formatFloat(float64(m.durationSum.Load())/1e6))
+	fmt.Fprintf(bw, "http_request_duration_seconds_count %d\n", cumulative)
+
+	if app.db != nil {
+		stats := app.db.Stats()
+		writeMetric(bw, "db_max_open_connections", "gauge", "Maximum number of open database connections.", float64(stats.MaxOpenConnections))
+		writeMetric(bw, "db_open_connections", "gauge", "Number of established database connections.", float64(stats.OpenConnections))
+		writeMetric(bw, "db_in_use_connections", "gauge", "Number of database connections currently in use.", float64(stats.InUse))
+		writeMetric(bw, "db_idle_connections", "gauge", "Number of idle database connections.", float64(stats.Idle))
+		writeMetric(bw, "db_wait_count_total", "counter", "Total number of connections waited for.", float64(stats.WaitCount))
+		writeMetric(bw, "db_wait_duration_seconds_total", "counter", "Total time spent waiting for a connection.", stats.WaitDuration.Seconds())
+	}
+
+	writeMetric(bw, "go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
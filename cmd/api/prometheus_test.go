@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape parses a Prometheus text exposition into its samples, keyed by name
+// and labels, and the metric types it declares.
+func scrape(t *testing.T, body string) (samples map[string]float64, types map[string]string) {
+	t.Helper()
+
+	samples = map[string]float64{}
+	types = map[string]string{}
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		line := sc.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed sample %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("malformed sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples, types
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.prometheus.enabled = true
+	app.db = sql.OpenDB(stubConnector{})
+	t.Cleanup(func() { app.db.Close() })
+	routes := app.routes()
+
+	for i := 0; i < 3; i++ {
+		serve(routes, httptest.NewRequest(http.MethodGet, "/v1/livez", nil))
+	}
+
+	rr := serve(routes, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d; want 200: %s", rr.Code, rr.Body)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q; want the Prometheus text format", got)
+	}
+
+	samples, types := scrape(t, rr.Body.String())
+
+	wantTypes := map[string]string{
+		"http_requests_total":            "counter",
+		"http_responses_total":           "counter",
+		"http_requests_in_flight":        "gauge",
+		"http_request_duration_seconds":  "histogram",
+		"db_max_open_connections":        "gauge",
+		"db_open_connections":            "gauge",
+		"db_in_use_connections":          "gauge",
+		"db_idle_connections":            "gauge",
+		"db_wait_count_total":            "counter",
+		"db_wait_duration_seconds_total": "counter",
+		"go_goroutines":                  "gauge",
+	}
+	for name, want := range wantTypes {
+		if got := types[name]; got != want {
+			t.Errorf("%s has type %q; want %q", name, got, want)
+		}
+	}
+
+	// The scrape is counted as it arrives but only answered once the
+	// figures are written.
+	if got := samples["http_requests_total"]; got < 4 {
+		t.Errorf("http_requests_total is %g; want at least 4", got)
+	}
+	if got := samples["http_requests_in_flight"]; got != 1 {
+		t.Errorf("http_requests_in_flight is %g; want 1, the scrape itself", got)
+	}
+
+	count := samples["http_request_duration_seconds_count"]
+	if count < 3 {
+		t.Errorf("http_request_duration_seconds_count is %g; want at least 3", count)
+	}
+	if got := samples[`http_request_duration_seconds_bucket{le="+Inf"}`]; got != count {
+		t.Errorf("the +Inf bucket holds %g; want the count %g", got, count)
+	}
+	previous := 0.0
+	for _, bound := range durationBuckets {
+		key := `http_request_duration_seconds_bucket{le="` + formatFloat(bound) + `"}`
+		got, ok := samples[key]
+		if !ok {
+			t.Fatalf("missing %s", key)
+		}
+		if got < previous {
+			t.Errorf("%s is %g, below the previous bucket's %g", key, got, previous)
+		}
+		previous = got
+	}
+	if _, ok := samples["http_request_duration_seconds_sum"]; !ok {
+		t.Error("missing http_request_duration_seconds_sum")
+	}
+}
+
+func TestPrometheusMetricsGating(t *testing.T) {
+	tests := []struct {
+		name       string
+		prometheus bool
+		debug      bool
+		username   string
+		// user and password are the Basic Auth credentials sent, if any.
+		user, password string
+		wantMetrics    int
+		wantVars       int
+	}{
+		{name: "disabled", debug: true, wantMetrics: http.StatusNotFound, wantVars: http.StatusOK},
+		{name: "enabled alongside expvar", prometheus: true, debug: true, wantMetrics: http.StatusOK, wantVars: http.StatusOK},
+		{name: "enabled without expvar", prometheus: true, wantMetrics: http.StatusOK, wantVars: http.StatusNotFound},
+		{name: "missing credentials", prometheus: true, debug: true, username: "ops", wantMetrics: http.StatusUnauthorized, wantVars: http.StatusUnauthorized},
+		{name: "wrong credentials", prometheus: true, debug: true, username: "ops", user: "ops", password: "guess", wantMetrics: http.StatusUnauthorized, wantVars: http.StatusUnauthorized},
+		{name: "right credentials", prometheus: true, debug: true, username: "ops", user: "ops", password: "s3cret", wantMetrics: http.StatusOK, wantVars: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.prometheus.enabled = tt.prometheus
+			app.config.debug.enabled = tt.debug
+			if tt.username != "" {
+				app.config.debug.username = tt.username
+				app.config.debug.password = "s3cret"
+			}
+			routes := app.routes()
+
+			for path, want := range map[string]int{"/metrics": tt.wantMetrics, "/debug/vars": tt.wantVars} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.user != "" {
+					r.SetBasicAuth(tt.user, tt.password)
+				}
+				rr := serve(routes, r)
+				if rr.Code != want {
+					t.Errorf("%s got status %d; want %d", path, rr.Code, want)
+				}
+			}
+		})
+	}
+}
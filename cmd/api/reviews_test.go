@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// memoryReviews keeps reviews in memory and, like the model, hides those of
+// soft-deleted movies.
+type memoryReviews struct {
+	data.IReviewModel
+	movies  *softDeletedMovies
+	reviews []data.Review
+	issued  int64
+	filters data.Filters
+}
+
+func (m *memoryReviews) visible(review data.Review) bool {
+	return !m.movies.deleted[review.MovieID]
+}
+
+func (m *memoryReviews) Insert(ctx context.Context, review *data.Review) error {
+	m.issued++
+	review.Id = m.issued
+	review.Version = 1
+	m.reviews = append(m.reviews, *review)
+	return nil
+}
+
+func (m *memoryReviews) Get(ctx context.Context, id int64) (*data.Review, error) {
+	for _, review := range m.reviews {
+		if review.Id == id && m.visible(review) {
+			return &review, nil
+		}
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+func (m *memoryReviews) GetAllForMovie(ctx context.Context, movieID int64, filters data.Filters) ([]*data.Review, data.Metadata, error) {
+	reviews := []*data.Review{}
+	for i := range m.reviews {
+		if m.reviews[i].MovieID == movieID && m.visible(m.reviews[i]) {
+			reviews = append(reviews, &m.reviews[i])
+		}
+	}
+	return reviews, data.Metadata{TotalRecords: len(reviews)}, nil
+}
+
+// GetAllForUser fills in the movie title, as the model's join does, and
+// records the filters it was given.
+func (m *memoryReviews) GetAllForUser(ctx context.Context, userID int64, filters data.Filters) ([]*data.Review, data.Metadata, error) {
+	m.filters = filters
+	reviews := []*data.Review{}
+	for i := range m.reviews {
+		if m.reviews[i].UserID == userID && m.visible(m.reviews[i]) {
+			review := m.reviews[i]
+			review.MovieTitle = m.movies.movies[review.MovieID].Title
+			reviews = append(reviews, &review)
+		}
+	}
+	return reviews, data.Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1, LastPage: 1, TotalRecords: len(reviews)}, nil
+}
+
+func (m *memoryReviews) Delete(ctx context.Context, id int64) error {
+	for i, review := range m.reviews {
+		if review.Id == id {
+			m.reviews = append(m.reviews[:i], m.reviews[i+1:]...)
+			return nil
+		}
+	}
+	return data.ErrRecordNotFound
+}
+
+func TestReviews(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Version: 1}
+
+	app := newTestApplication(t)
+	movies := &softDeletedMovies{movies: map[int64]data.Movie{1: moana}, deleted: map[int64]bool{}}
+	app.models.Movies = movies
+	app.models.Reviews = &memoryReviews{movies: movies}
+	app.models.Permissions = newMemoryPermissions()
+
+	alice := &data.User{Id: 1, Name: "Alice", Activated: true, Role: data.RoleViewer}
+	bob := &data.User{Id: 2, Name: "Bob", Activated: true, Role: data.RoleViewer}
+	admin := &data.User{Id: 3, Name: "Admin", Activated: true, Role: data.RoleAdmin}
+
+	send := func(user *data.User, method string, id int64, body string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		return serve(handler, withIDParam(app.contextSetUser(r, user), id))
+	}
+	listed := func() int {
+		t.Helper()
+
+		rr := send(alice, http.MethodGet, 1, "", app.listReviewsHandler)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("listing reviews got status %d: %s", rr.Code, rr.Body)
+		}
+		var body struct {
+			Reviews []data.Review `json:"reviews"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(body.Reviews)
+	}
+
+	creates := []struct {
+		name    string
+		user    *data.User
+		movieID int64
+		body    string
+		want    int
+	}{
+		{"by alice", alice, 1, `{"body":"Great","rating":5}`, http.StatusCreated},
+		{"by bob", bob, 1, `{"body":"Fine","rating":3}`, http.StatusCreated},
+		{"rating too high", alice, 1, `{"body":"Great","rating":6}`, http.StatusUnprocessableEntity},
+		{"rating too low", alice, 1, `{"body":"Awful","rating":0}`, http.StatusUnprocessableEntity},
+		{"empty body", alice, 1, `{"body":"","rating":4}`, http.StatusUnprocessableEntity},
+		{"body too long", alice, 1, `{"body":"` + strings.Repeat("a", 5001) + `","rating":4}`, http.StatusUnprocessableEntity},
+		{"missing movie", alice, 2, `{"body":"Great","rating":5}`, http.StatusNotFound},
+	}
+	for _, tt := range creates {
+		rr := send(tt.user, http.MethodPost, tt.movieID, tt.body, app.createReviewHandler)
+		if rr.Code != tt.want {
+			t.Fatalf("create %s: got status %d; want %d: %s", tt.name, rr.Code, tt.want, rr.Body)
+		}
+	}
+	if got := listed(); got != 2 {
+		t.Fatalf("%d reviews listed; want 2", got)
+	}
+
+	// Reviews 1 and 2 are Alice's and Bob's.
+	deletes := []struct {
+		name     string
+		user     *data.User
+		reviewID int64
+		want     int
+	}{
+		{"someone else's", bob, 1, http.StatusForbidden},
+		{"their own", bob, 2, http.StatusOK},
+		{"already deleted", bob, 2, http.StatusNotFound},
+		{"by an admin", admin, 1, http.StatusOK},
+	}
+	for _, tt := range deletes {
+		rr := send(tt.user, http.MethodDelete, tt.reviewID, "", app.deleteReviewHandler)
+		if rr.Code != tt.want {
+			t.Fatalf("delete %s: got status %d; want %d: %s", tt.name, rr.Code, tt.want, rr.Body)
+		}
+	}
+	if got := listed(); got != 0 {
+		t.Fatalf("%d reviews listed after deleting both; want 0", got)
+	}
+}
+
+// reviewedMovies counts a movie's reviews, hidden or not, as its dependents,
+// refuses to soft-delete a movie that has any and removes them when it is
+// purged.
+type reviewedMovies struct {
+	*softDeletedMovies
+	reviews *memoryReviews
+}
+
+func (m reviewedMovies) Delete(ctx context.Context, id int64) (int32, error) {
+	if _, ok := m.movies[id]; !ok || m.deleted[id] {
+		return 0, data.ErrRecordNotFound
+	}
+	var dependents data.MovieDependents
+	for _, review := range m.reviews.reviews {
+		if review.MovieID == id {
+			dependents.Reviews++
+		}
+	}
+	if dependents.Total() > 0 {
+		return 0, &data.MovieDependentsError{Dependents: dependents}
+	}
+	return m.softDeletedMovies.Delete(ctx, id)
+}
+
+func (m reviewedMovies) Purge(ctx context.Context, id int64) (int32, error) {
+	movie, ok := m.movies[id]
+	if !ok {
+		return 0, data.ErrRecordNotFound
+	}
+	delete(m.movies, id)
+	delete(m.deleted, id)
+
+	var kept []data.Review
+	for _, review := range m.reviews.reviews {
+		if review.MovieID != id {
+			kept = append(kept, review)
+		}
+	}
+	m.reviews.reviews = kept
+	return movie.Version + 1, nil
+}
+
+// TestDeleteReviewedMovie follows a movie's reviews through deleting the
+// movie. The API only soft-deletes a movie nobody has reviewed, so a review
+// can't be left hidden behind a soft delete; how the model hides one is
+// covered by TestReviewModelSoftDeletedMovie.
+func TestDeleteReviewedMovie(t *testing.T) {
+	moana := data.Movie{Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Version: 1}
+
+	app := newTestApplication(t)
+	softDeleted := &softDeletedMovies{movies: map[int64]data.Movie{1: moana}, deleted: map[int64]bool{}}
+	reviews := &memoryReviews{movies: softDeleted}
+	app.models.Movies = reviewedMovies{softDeletedMovies: softDeleted, reviews: reviews}
+	app.models.Reviews = reviews
+	app.models.Permissions = newMemoryPermissions()
+
+	alice := &data.User{Id: 1, Name: "Alice", Activated: true, Role: data.RoleAdmin}
+
+	steps := []struct {
+		name    string
+		method  string
+		target  string
+		handler http.HandlerFunc
+		id      int64
+		body    string
+		want    int
+		// reviews is the number of stored reviews after the step.
+		reviews int
+	}{
+		{"review", http.MethodPost, "/v1/movies/1/reviews", app.createReviewHandler, 1, `{"body":"Great","rating":5}`, http.StatusCreated, 1},
+		{"soft-delete the reviewed movie", http.MethodDelete, "/v1/movies/1", app.deleteMovieHandler, 1, "", http.StatusConflict, 1},
+		{"reviews are still listed", http.MethodGet, "/v1/movies/1/reviews", app.listReviewsHandler, 1, "", http.StatusOK, 1},
+		{"delete the review", http.MethodDelete, "/v1/reviews/1", app.deleteReviewHandler, 1, "", http.StatusOK, 0},
+		{"soft-delete the movie", http.MethodDelete, "/v1/movies/1", app.deleteMovieHandler, 1, "", http.StatusOK, 0},
+		{"review the deleted movie", http.MethodPost, "/v1/movies/1/reviews", app.createReviewHandler, 1, `{"body":"Again","rating":4}`, http.StatusNotFound, 0},
+		{"list reviews of the deleted movie", http.MethodGet, "/v1/movies/1/reviews", app.listReviewsHandler, 1, "", http.StatusNotFound, 0},
+		{"restore the movie", http.MethodPost, "/v1/movies/1/restore", app.restoreMovieHandler, 1, "", http.StatusOK, 0},
+		{"review the restored movie", http.MethodPost, "/v1/movies/1/reviews", app.createReviewHandler, 1, `{"body":"Still great","rating":5}`, http.StatusCreated, 1},
+		{"the new review is listed", http.MethodGet, "/v1/movies/1/reviews", app.listReviewsHandler, 1, "", http.StatusOK, 1},
+		{"purge the movie", http.MethodDelete, "/v1/movies/1?force=true", app.deleteMovieHandler, 1, "", http.StatusOK, 0},
+		{"list reviews of the purged movie", http.MethodGet, "/v1/movies/1/reviews", app.listReviewsHandler, 1, "", http.StatusNotFound, 0},
+		{"restore the purged movie", http.MethodPost, "/v1/movies/1/restore", app.restoreMovieHandler, 1, "", http.StatusNotFound, 0},
+	}
+
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, step.target, strings.NewReader(step.body))
+		rr := serve(step.handler, withIDParam(app.contextSetUser(r, alice), step.id))
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+		if got := len(reviews.reviews); got != step.reviews {
+			t.Fatalf("%s: %d reviews stored; want %d", step.name, got, step.reviews)
+		}
+	}
+}
+
+func TestListCurrentUserReviews(t *testing.T) {
+	movies := &softDeletedMovies{
+		movies: map[int64]data.Movie{
+			1: {Id: 1, Title: "Moana", Version: 1},
+			2: {Id: 2, Title: "Frozen", Version: 1},
+		},
+		deleted: map[int64]bool{},
+	}
+	reviews := &memoryReviews{movies: movies, reviews: []data.Review{
+		{Id: 1, MovieID: 1, UserID: 1, Body: "Great", Rating: 5},
+		{Id: 2, MovieID: 2, UserID: 1, Body: "Fine", Rating: 3},
+		{Id: 3, MovieID: 1, UserID: 2, Body: "Dull", Rating: 1},
+	}}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// sort, page and pageSize are the filters passed to the model.
+		sort     string
+		page     int
+		pageSize int
+	}{
+		{name: "defaults", status: http.StatusOK, sort: "-created_at", page: 1, pageSize: 20},
+		{name: "by rating", query: "?sort=-rating", status: http.StatusOK, sort: "-rating", page: 1, pageSize: 20},
+		{name: "oldest first", query: "?sort=created_at", status: http.StatusOK, sort: "created_at", page: 1, pageSize: 20},
+		{name: "second page", query: "?page=2&page_size=1", status: http.StatusOK, sort: "-created_at", page: 2, pageSize: 1},
+		{name: "unknown sort", query: "?sort=body", status: http.StatusUnprocessableEntity},
+		{name: "page zero", query: "?page=0", status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Movies = movies
+			app.models.Reviews = reviews
+			reviews.filters = data.Filters{}
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me/reviews"+tt.query, nil)
+			rr := serve(http.HandlerFunc(app.listCurrentUserReviewsHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			got := reviews.filters
+			if got.Sort != tt.sort || got.Page != tt.page || got.PageSize != tt.pageSize {
+				t.Errorf("listed sorted by %q, page %d of size %d; want %q, page %d of size %d", got.Sort, got.Page, got.PageSize, tt.sort, tt.page, tt.pageSize)
+			}
+
+			var body struct {
+				Reviews  []map[string]any `json:"reviews"`
+				Metadata data.Metadata    `json:"metadata"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Only Alice's reviews are listed, each with its movie's title.
+			want := map[float64]string{1: "Moana", 2: "Frozen"}
+			if len(body.Reviews) != len(want) {
+				t.Fatalf("listed %d reviews; want %d", len(body.Reviews), len(want))
+			}
+			for _, review := range body.Reviews {
+				if title := want[review["movie_id"].(float64)]; review["movie_title"] != title {
+					t.Errorf("review %v has movie_title %v; want %q", review["id"], review["movie_title"], title)
+				}
+			}
+			if body.Metadata.TotalRecords != 2 {
+				t.Errorf("got metadata %+v; want 2 records", body.Metadata)
+			}
+		})
+	}
+}
@@ -8,24 +8,116 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	// httprouter doesn't allow a static segment and a wildcard at the same
+	// position, so wildcard routes that collide with a static route are
+	// registered on the fallback router, which serves whatever router can't.
+	fallback := instrumentedRouter{httprouter.New()}
+	fallback.NotFound = http.HandlerFunc(app.notFoundResponse)
+	fallback.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router := instrumentedRouter{httprouter.New()}
+	router.NotFound = fallback
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
+	authLimit := app.rateLimitWith(app.authLimiter, "auth")
+	adminOnly := app.ipFilter(app.config.admin.allowCIDRs, app.config.admin.denyCIDRs)
+
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/livez", app.livezHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/readyz", app.readyzHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openapiHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.getMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/batch", app.requirePermission("movies:write", app.createMovieBatchHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/import", app.requirePermission("movies:write", app.importMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/stats", app.requirePermission("movies:read", app.movieStatsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/stream", app.requirePermission("movies:read", app.streamMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/export.csv", app.requirePermission("movies:read", app.exportMoviesHandler))
+
+	fallback.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.getMovieHandler))
+	fallback.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission("movies:write", app.restoreMovieHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/movies/:id/genres", app.requirePermission("movies:write", app.addMovieGenreHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/movies/:id/genres/:genre", app.requirePermission("movies:write", app.removeMovieGenreHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/movies/:id/history", adminOnly(app.requirePermission("admin:read", app.movieHistoryHandler)))
+	fallback.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.requirePermission("movies:read", app.listSimilarMoviesHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.listReviewsHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.createReviewHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/movies/:id/watchlist", app.requirePermission("movies:read", app.addToWatchlistHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/movies/:id/watchlist", app.requirePermission("movies:read", app.removeFromWatchlistHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/reviews/:id", app.requireActivatedUser(app.deleteReviewHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/users", adminOnly(app.requirePermission("admin:read", app.listUsersHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users", authLimit(app.registerUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireActivatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireAuthenticatedUser(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireAuthenticatedUser(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlist", app.requirePermission("movies:read", app.listWatchlistHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/reviews", app.requirePermission("movies:read", app.listCurrentUserReviewsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireAuthenticatedUser(app.changeCurrentUserPasswordHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.deleteSessionHandler))
 	router.HandlerFunc(http.MethodPut, "/v1/users/activate", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	fallback.HandlerFunc(http.MethodPost, "/v1/users/:id/permissions", adminOnly(app.requirePermission("admin:write", app.grantUserPermissionsHandler)))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id/permissions/:code", adminOnly(app.requirePermission("admin:write", app.revokeUserPermissionHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", authLimit(app.createAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", authLimit(app.refreshAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", authLimit(app.createActivationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", authLimit(app.createPasswordResetTokenHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit", adminOnly(app.requirePermission("admin:read", app.listAuditHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/tokens", adminOnly(app.requirePermission("admin:read", app.listTokensHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/feature-flags", adminOnly(app.requirePermission("admin:read", app.listFeatureFlagsHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", adminOnly(app.requirePermission("admin:write", app.updateLogLevelHandler)))
+
+	// Keying the limiter by user needs to know who is asking, so in that mode
+	// the limiter authenticates the request itself.
+	var handler http.Handler
+	if app.config.limiter.key == "user" {
+		handler = app.rateLimitByUser(router)
+	} else {
+		handler = app.rateLimit(app.authenticate(router))
+	}
+
+	// The debug endpoints take Basic Auth credentials, which authenticate
+	// would reject as a malformed token, so they are routed ahead of it.
+	debug := instrumentedRouter{httprouter.New()}
+	debug.NotFound = handler
+	debug.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	if app.config.debug.enabled {
+		debug.Handler(http.MethodGet, "/debug/vars", app.requireDebugCredentials(expvar.Handler()))
+	}
+
+	if app.config.prometheus.enabled {
+		debug.Handler(http.MethodGet, "/metrics", app.requireDebugCredentials(http.HandlerFunc(app.prometheusHandler)))
+	}
+
+	return app.logRequest(app.metrics(app.compress(app.recoverPanic(app.secureHeaders(app.timeout(app.enableCORS(app.limitRequestBody(debug)), "/v1/movies/export.csv", "/v1/movies/stream"))))))
+}
+
+// instrumentedRouter records the pattern of the matched route in the request
+// context, so metrics can be grouped by route rather than by raw path.
+type instrumentedRouter struct {
+	*httprouter.Router
+}
+
+func (ir instrumentedRouter) Handler(method, path string, handler http.Handler) {
+	ir.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(routeContextKey).(*routePattern); ok {
+			route.pattern.Store(&path)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+func (ir instrumentedRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	ir.Handler(method, path, handler)
 }
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -22,7 +26,48 @@ func (app *application) serve() error {
 		ErrorLog:     log.New(app.logger, "", 0),
 	}
 
-	shutdownError := make(chan error)
+	srv.RegisterOnShutdown(app.movieFeed.close)
+
+	tlsEnabled := app.config.tls.certFile != ""
+	if tlsEnabled {
+		srv.TLSConfig = tlsConfig()
+	}
+
+	var redirectSrv *http.Server
+	if tlsEnabled && app.config.tls.redirectPort != "" {
+		redirectSrv = &http.Server{
+			Addr:         fmt.Sprintf(":%s", app.config.tls.redirectPort),
+			Handler:      http.HandlerFunc(app.redirectToHTTPS),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+			ErrorLog:     log.New(app.logger, "", 0),
+		}
+
+		// Listening here rather than in the goroutine means a port that is
+		// already taken stops startup instead of only being logged.
+		ln, err := net.Listen("tcp", redirectSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			err := redirectSrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]string{"addr": redirectSrv.Addr})
+			}
+		}()
+
+		app.logger.PrintInfo("starting HTTPS redirect server", map[string]string{
+			"addr": redirectSrv.Addr,
+		})
+	}
+
+	shutdownError := make(chan error, 1)
+
+	stopJobs := make(chan struct{})
+	app.purgeExpiredTokens(app.config.tokens.purgeInterval, stopJobs)
+	app.reloadFeatureFlagsOnHangup()
 
 	go func() {
 		quit := make(chan os.Signal, 1)
@@ -30,26 +75,25 @@ func (app *application) serve() error {
 		s := <-quit
 
 		app.logger.PrintInfo("shutting down server", map[string]string{
-			"signal": s.String(),
-		})
-		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-		defer cancel()
-
-		shutdownError <- srv.Shutdown(ctx)
-
-		app.logger.PrintInfo("completing background tasks", map[string]string{
-			"addr": srv.Addr,
+			"signal":      s.String(),
+			"drain_delay": app.config.drainDelay.String(),
+			"timeout":     app.config.shutdownTimeout.String(),
 		})
-
-		app.wg.Wait()
-		shutdownError <- nil
+		shutdownError <- app.shutdown(srv, redirectSrv, stopJobs)
 	}()
 
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  strconv.FormatBool(tlsEnabled),
 	})
-	err := srv.ListenAndServe()
+
+	var err error
+	if tlsEnabled {
+		err = srv.ListenAndServeTLS(app.config.tls.certFile, app.config.tls.keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -64,3 +108,159 @@ func (app *application) serve() error {
 	})
 	return nil
 }
+
+// tlsConfig returns the configuration used when serving HTTPS.
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Only AEAD suites with forward secrecy. TLS 1.3 suites aren't
+		// configurable and are always enabled.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// shutdown marks the application as shutting down, so that readyz fails, and
+// waits for the drain delay to give load balancers time to notice before the
+// listeners close. It then waits up to the shutdown timeout for in-flight
+// requests and background tasks to finish. redirectSrv may be nil.
+func (app *application) shutdown(srv, redirectSrv *http.Server, stopJobs chan struct{}) error {
+	app.shuttingDown.Store(true)
+	time.Sleep(app.config.drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+	defer cancel()
+
+	stopProgress := app.logShutdownProgress(time.Second)
+	defer stopProgress()
+
+	// Redirects need no draining, so a failure here is only logged.
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(ctx); err != nil {
+			app.logger.PrintError(err, map[string]string{"addr": redirectSrv.Addr})
+		}
+	}
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"reason":    "in-flight requests did not finish before the shutdown timeout",
+			"in_flight": strconv.FormatInt(app.inFlight.Load(), 10),
+		})
+		return err
+	}
+
+	app.logger.PrintInfo("completing background tasks", map[string]string{
+		"addr": srv.Addr,
+	})
+
+	close(stopJobs)
+	app.mailer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		app.logger.PrintError(ctx.Err(), map[string]string{
+			"reason":           "background tasks did not finish before the shutdown timeout",
+			"background_tasks": strconv.FormatInt(app.backgroundTasks.Load(), 10),
+			"queued_emails":    strconv.Itoa(app.mailer.Queued()),
+		})
+		return ctx.Err()
+	}
+}
+
+// redirectToHTTPS permanently redirects a plain HTTP request to the same URL
+// on the HTTPS listener.
+func (app *application) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host == "" {
+		app.badRequestResponse(w, r, errors.New("the request must include a Host header"))
+		return
+	}
+
+	target := url.URL{Scheme: "https", Host: net.JoinHostPort(host, app.config.port), Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// logShutdownProgress logs what is still outstanding every interval until the
+// returned function is called. Nothing is logged once that function returns.
+func (app *application) logShutdownProgress(interval time.Duration) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.logger.PrintInfo("waiting for shutdown", map[string]string{
+					"in_flight":        strconv.FormatInt(app.inFlight.Load(), 10),
+					"background_tasks": strconv.FormatInt(app.backgroundTasks.Load(), 10),
+					"queued_emails":    strconv.Itoa(app.mailer.Queued()),
+				})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// purgeExpiredTokens deletes expired tokens every interval until stop is
+// closed. The loop is tracked by app.wg so that shutdown waits for a purge in
+// progress.
+func (app *application) purgeExpiredTokens(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+
+	app.wg.Add(1)
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := app.models.Tokens.DeleteExpired(context.Background())
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"job": "purge_expired_tokens"})
+					continue
+				}
+				app.logger.PrintInfo("purged expired tokens", map[string]string{
+					"job":    "purge_expired_tokens",
+					"purged": strconv.FormatInt(purged, 10),
+				})
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
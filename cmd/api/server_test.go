@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/Soul-Remix/greenlight/internal/mailer"
+)
+
+// startServer serves h on a free local port until the test ends, and returns
+// the server and its base URL.
+func startServer(t *testing.T, h http.Handler) (*http.Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: h}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, "http://" + ln.Addr().String()
+}
+
+// newShutdownTestApplication returns an application whose database pings
+// succeed and whose mailer can be closed.
+func newShutdownTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := newTestApplication(t)
+	app.mailer = &mailer.MockMailer{}
+	app.config.shutdownTimeout = 5 * time.Second
+	app.config.healthcheck.dbTimeout = time.Second
+	app.db = sql.OpenDB(stubConnector{})
+	t.Cleanup(func() { app.db.Close() })
+	return app
+}
+
+func TestShutdownFailsReadinessWhileDraining(t *testing.T) {
+	app := newShutdownTestApplication(t)
+	app.config.drainDelay = 300 * time.Millisecond
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/readyz", app.readyzHandler)
+	mux.HandleFunc("/v1/livez", app.livezHandler)
+	srv, url := startServer(t, mux)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	status := func(path string) (int, error) {
+		resp, err := client.Get(url + path)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	if code, err := status("/v1/readyz"); err != nil || code != http.StatusOK {
+		t.Fatalf("before shutdown readyz got %d, %v; want 200", code, err)
+	}
+
+	shutdownErr := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		shutdownErr <- app.shutdown(srv, nil, make(chan struct{}))
+	}()
+
+	// The listener stays open for the drain delay, so the load balancer
+	// sees readyz fail while the process is still alive.
+	for !app.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if code, err := status("/v1/readyz"); err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("while draining readyz got %d, %v; want 503", code, err)
+	}
+	if code, err := status("/v1/livez"); err != nil || code != http.StatusOK {
+		t.Errorf("while draining livez got %d, %v; want 200", code, err)
+	}
+
+	err := <-shutdownErr
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < app.config.drainDelay {
+		t.Errorf("shutdown took %s; want at least the %s drain delay", elapsed, app.config.drainDelay)
+	}
+
+	_, err = status("/v1/readyz")
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("after shutdown got err %v; want the connection refused", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// request and task say whether a slow request and a slow background
+		// task are running when shutdown starts, and finishAfter when they
+		// finish, or zero if they outlast the test.
+		request     bool
+		task        bool
+		finishAfter time.Duration
+		wantErr     error
+		// wantReason is what the error log gives for the shutdown failing, and
+		// wantCounts the counts logged with it.
+		wantReason string
+		wantCounts map[string]string
+	}{
+		{
+			name: "slow request finishes", timeout: 5 * time.Second,
+			request: true, finishAfter: 200 * time.Millisecond,
+		},
+		{
+			name: "slow request outlasts the timeout", timeout: 1200 * time.Millisecond,
+			request: true, wantErr: context.DeadlineExceeded,
+			wantReason: "in-flight requests did not finish before the shutdown timeout",
+			wantCounts: map[string]string{"in_flight": "1"},
+		},
+		{
+			name: "background task outlasts the timeout", timeout: 300 * time.Millisecond,
+			task: true, wantErr: context.DeadlineExceeded,
+			wantReason: "background tasks did not finish before the shutdown timeout",
+			wantCounts: map[string]string{"background_tasks": "1", "queued_emails": "0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newShutdownTestApplication(t)
+			app.config.shutdownTimeout = tt.timeout
+			var logged bytes.Buffer
+			app.logger = jsonlog.New(&logged, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+
+			release := make(chan struct{})
+			t.Cleanup(func() {
+				select {
+				case <-release:
+				default:
+					close(release)
+				}
+			})
+			if tt.finishAfter > 0 {
+				time.AfterFunc(tt.finishAfter, func() { close(release) })
+			}
+
+			started := make(chan struct{})
+			srv, url := startServer(t, app.metrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				w.WriteHeader(http.StatusNoContent)
+			})))
+
+			responded := make(chan int, 1)
+			if tt.request {
+				go func() {
+					resp, err := http.Get(url)
+					if err != nil {
+						responded <- 0
+						return
+					}
+					resp.Body.Close()
+					responded <- resp.StatusCode
+				}()
+				<-started
+			}
+			if tt.task {
+				app.background(func() { <-release })
+			}
+
+			start := time.Now()
+			err := app.shutdown(srv, nil, make(chan struct{}))
+			elapsed := time.Since(start)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("shutdown returned %v; want %v", err, tt.wantErr)
+			}
+
+			entries := logEntries(t, &logged)
+			var failure *jsonlog.Entry
+			for i, entry := range entries {
+				if entry.Level == jsonlog.LevelError.String() {
+					failure = &entries[i]
+				}
+			}
+
+			if tt.wantErr == nil {
+				if elapsed >= tt.timeout {
+					t.Errorf("shutdown took %s; want it done before the %s timeout", elapsed, tt.timeout)
+				}
+				if failure != nil {
+					t.Errorf("logged %q %v for a clean shutdown", failure.Message, failure.Properties)
+				}
+				if code := <-responded; code != http.StatusNoContent {
+					t.Errorf("the slow request got status %d; want %d", code, http.StatusNoContent)
+				}
+				return
+			}
+
+			if elapsed < tt.timeout {
+				t.Errorf("shutdown gave up after %s; want the %s timeout", elapsed, tt.timeout)
+			}
+			if failure == nil {
+				t.Fatal("nothing logged about the failed shutdown")
+			}
+			if got := failure.Properties["reason"]; got != tt.wantReason {
+				t.Errorf("logged reason %q; want %q", got, tt.wantReason)
+			}
+			for key, want := range tt.wantCounts {
+				if got := failure.Properties[key]; got != want {
+					t.Errorf("logged %s %q; want %q", key, got, want)
+				}
+			}
+
+			// Progress is logged every second while shutdown waits.
+			if tt.timeout > time.Second {
+				var progress *jsonlog.Entry
+				for i, entry := range entries {
+					if entry.Message == "waiting for shutdown" {
+						progress = &entries[i]
+					}
+				}
+				if progress == nil {
+					t.Fatal("no progress logged while waiting")
+				}
+				if got := progress.Properties["in_flight"]; got != "1" {
+					t.Errorf("progress logged in_flight %q; want 1", got)
+				}
+			}
+		})
+	}
+}
+
+// purgingTokens signals each purge on runs, when someone is waiting for it,
+// and reports purged tokens removed.
+type purgingTokens struct {
+	data.ITokenModel
+	purged int64
+	runs   chan struct{}
+}
+
+func (p purgingTokens) DeleteExpired(ctx context.Context) (int64, error) {
+	select {
+	case p.runs <- struct{}{}:
+	default:
+	}
+	return p.purged, nil
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+	app := newTestApplication(t)
+	var logged bytes.Buffer
+	app.logger = jsonlog.New(&logged, jsonlog.LevelInfo, jsonlog.JSONFormatter)
+	runs := make(chan struct{})
+	app.models.Tokens = purgingTokens{purged: 3, runs: runs}
+
+	stop := make(chan struct{})
+	app.purgeExpiredTokens(10*time.Millisecond, stop)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-runs:
+		case <-time.After(time.Second):
+			t.Fatalf("purge %d didn't run", i+1)
+		}
+	}
+
+	// Shutdown waits for the job through app.wg.
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the job didn't stop")
+	}
+
+	var reported int
+	for _, entry := range logEntries(t, &logged) {
+		if entry.Message == "purged expired tokens" {
+			reported++
+			if got := entry.Properties["purged"]; got != "3" {
+				t.Errorf("logged purged %q; want 3", got)
+			}
+		}
+	}
+	if reported < 2 {
+		t.Errorf("logged %d purges; want at least 2", reported)
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to a
+// temporary directory, and returns their paths and a pool that trusts the
+// certificate.
+func writeSelfSignedCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "greenlight test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	app := newTestApplication(t)
+	certFile, keyFile, pool := writeSelfSignedCert(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: app.routes(), TLSConfig: tlsConfig(), ErrorLog: log.New(io.Discard, "", 0)}
+	go srv.ServeTLS(ln, certFile, keyFile)
+	t.Cleanup(func() { srv.Close() })
+	addr := ln.Addr().String()
+
+	tests := []struct {
+		name         string
+		minVersion   uint16
+		maxVersion   uint16
+		cipherSuites []uint16
+		wantErr      bool
+	}{
+		{"TLS 1.3", tls.VersionTLS13, tls.VersionTLS13, nil, false},
+		{"TLS 1.2", tls.VersionTLS12, tls.VersionTLS12, nil, false},
+		{"TLS 1.1", tls.VersionTLS10, tls.VersionTLS11, nil, true},
+		{"CBC cipher suite", tls.VersionTLS12, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{
+				RootCAs:      pool,
+				MinVersion:   tt.minVersion,
+				MaxVersion:   tt.maxVersion,
+				CipherSuites: tt.cipherSuites,
+			})
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("the handshake succeeded; want it refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			defer conn.Close()
+
+			if got := conn.ConnectionState().Version; got != tt.maxVersion {
+				t.Errorf("negotiated version %#x; want %#x", got, tt.maxVersion)
+			}
+		})
+	}
+
+	// The API itself is served over the TLS connection.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + addr + "/v1/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("livez over HTTPS got status %d; want 200", resp.StatusCode)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		target string
+		status int
+		want   string
+	}{
+		{name: "root", host: "api.example.com", target: "/", status: http.StatusMovedPermanently, want: "https://api.example.com:4443/"},
+		{name: "path and query", host: "api.example.com", target: "/v1/movies?genres=drama&page=2", status: http.StatusMovedPermanently, want: "https://api.example.com:4443/v1/movies?genres=drama&page=2"},
+		{name: "host with port", host: "api.example.com:8080", target: "/v1/livez", status: http.StatusMovedPermanently, want: "https://api.example.com:4443/v1/livez"},
+		{name: "IPv6 host", host: "[::1]:8080", target: "/v1/livez", status: http.StatusMovedPermanently, want: "https://[::1]:4443/v1/livez"},
+		{name: "escaped path", host: "api.example.com", target: "/v1/movies/a%2Fb", status: http.StatusMovedPermanently, want: "https://api.example.com:4443/v1/movies/a%2Fb"},
+		{name: "POST", method: http.MethodPost, host: "api.example.com", target: "/v1/movies", status: http.StatusMovedPermanently, want: "https://api.example.com:4443/v1/movies"},
+		{name: "no host", target: "/v1/livez", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.config.port = "4443"
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.target, nil)
+			r.Host = tt.host
+
+			rr := serve(http.HandlerFunc(app.redirectToHTTPS), r)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("got Location %q; want %q", got, tt.want)
+			}
+			if got := rr.Header().Get("Strict-Transport-Security"); got != "" {
+				t.Errorf("a plain HTTP response carried Strict-Transport-Security %q", got)
+			}
+		})
+	}
+}
+
+func TestShutdownStopsRedirectServer(t *testing.T) {
+	app := newShutdownTestApplication(t)
+	app.config.port = "4443"
+
+	srv, _ := startServer(t, http.HandlerFunc(app.livezHandler))
+	redirectSrv, redirectURL := startServer(t, http.HandlerFunc(app.redirectToHTTPS))
+
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(redirectURL + "/v1/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || !strings.HasPrefix(resp.Header.Get("Location"), "https://127.0.0.1:4443/") {
+		t.Fatalf("got status %d and Location %q; want a redirect to port 4443", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	err = app.shutdown(srv, redirectSrv, make(chan struct{}))
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	_, err = client.Get(redirectURL + "/v1/livez")
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("after shutdown the redirect server got err %v; want the connection refused", err)
+	}
+}
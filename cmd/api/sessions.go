@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// sessionsNotTracked reports, with a response, that sessions can't be listed
+// or revoked one at a time because JWTs aren't stored.
+func (app *application) sessionsNotTracked(w http.ResponseWriter, r *http.Request) bool {
+	if app.config.auth.mode != authModeJWT {
+		return false
+	}
+	app.notSupportedResponse(w, r, "sessions are not tracked in jwt auth mode, log out to end them all")
+	return true
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.sessionsNotTracked(w, r) {
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetAllForUser(r.Context(), data.ScopeAuthentication, user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"sessions": sessions}, nil)
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if app.sessionsNotTracked(w, r) {
+		return
+	}
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Tokens.DeleteForUser(r.Context(), data.ScopeAuthentication, user.Id, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+}
+
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Scope  string
+		UserID *int64
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Scope = app.readString(qs, "scope", "")
+	if qs.Has("user_id") {
+		userID := int64(app.readInt(qs, "user_id", 0, v))
+		input.UserID = &userID
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	app.readPageSize(qs, &input.Filters, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortSafeList = []string{"id", "created_at", "expiry", "-id", "-created_at", "-expiry"}
+
+	if input.Scope != "" {
+		v.Check(validator.PermittedValue(input.Scope, data.ScopeActivation, data.ScopeAuthentication, data.ScopePasswordReset, data.ScopeRefresh), "scope", "must be activation, authentication, password-reset or refresh")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tokens, metadata, err := app.models.Tokens.GetAll(r.Context(), input.Scope, input.UserID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"tokens": tokens, "metadata": metadata}, app.paginationHeaders(r, metadata))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+const (
+	movieFeedBacklog      = 100
+	movieFeedBuffer       = 16
+	movieStreamHeartbeat  = 15 * time.Second
+	movieStreamRetryDelay = 3 * time.Second
+)
+
+// movieEvent is a created movie, ready to be written as an SSE message. The
+// movie ID doubles as the event ID.
+type movieEvent struct {
+	id   int64
+	data []byte
+}
+
+// movieFeed fans newly created movies out to stream subscribers. It keeps the
+// most recent events so that a client reconnecting with Last-Event-ID can
+// catch up on what it missed.
+type movieFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan movieEvent]struct{}
+	recent      []movieEvent
+	closed      bool
+	heartbeat   time.Duration
+}
+
+func newMovieFeed() *movieFeed {
+	return &movieFeed{
+		subscribers: make(map[chan movieEvent]struct{}),
+		heartbeat:   movieStreamHeartbeat,
+	}
+}
+
+func (f *movieFeed) publish(movie *data.Movie) error {
+	js, err := json.Marshal(movie)
+	if err != nil {
+		return err
+	}
+	event := movieEvent{id: movie.Id, data: js}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.recent = append(f.recent, event)
+	if len(f.recent) > movieFeedBacklog {
+		f.recent = f.recent[len(f.recent)-movieFeedBacklog:]
+	}
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// A subscriber that can't keep up is disconnected rather than
+			// allowed to hold up everyone else; it can resume from the
+			// backlog when it reconnects.
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// subscribe registers a subscriber and returns the retained events after
+// lastID. The channel is closed when the subscriber falls behind or the feed
+// is closed.
+func (f *movieFeed) subscribe(lastID int64) (<-chan movieEvent, []movieEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan movieEvent, movieFeedBuffer)
+	if f.closed {
+		close(ch)
+		return ch, nil, func() {}
+	}
+	f.subscribers[ch] = struct{}{}
+
+	var backlog []movieEvent
+	if lastID > 0 {
+		for _, event := range f.recent {
+			if event.id > lastID {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+
+	unsubscribe := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if _, ok := f.subscribers[ch]; ok {
+			delete(f.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, backlog, unsubscribe
+}
+
+// close disconnects every subscriber. It is registered to run on server
+// shutdown, which otherwise waits for streams that never go idle.
+func (f *movieFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for ch := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publishMovie pushes a newly created movie to stream subscribers.
+func (app *application) publishMovie(r *http.Request, movie *data.Movie) {
+	err := app.movieFeed.publish(movie)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) streamMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrorResponse(w, r, fmt.Errorf("%T does not support flushing", w))
+		return
+	}
+
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	// The server's write timeout would otherwise cut the stream off.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	events, backlog, unsubscribe := app.movieFeed.subscribe(lastID)
+	defer unsubscribe()
+
+	fmt.Fprintf(w, "retry: %d\n\n", movieStreamRetryDelay.Milliseconds())
+	for _, event := range backlog {
+		writeMovieEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(app.movieFeed.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			writeMovieEvent(w, event)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeMovieEvent(w http.ResponseWriter, event movieEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: movie.created\ndata: %s\n\n", event.id, event.data)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// sseMessage is one server-sent events message: its fields by name, with any
+// comment lines under "comment".
+type sseMessage map[string]string
+
+// readMessage reads the next message from an event stream.
+func readMessage(t *testing.T, r *bufio.Reader) sseMessage {
+	t.Helper()
+
+	msg := sseMessage{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return msg
+		}
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			msg["comment"] = strings.TrimSpace(comment)
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		msg[name] = strings.TrimPrefix(value, " ")
+	}
+}
+
+// openStream connects to the movie stream of app, resuming after lastEventID
+// if it is set, and reads past the opening retry message. Cancelling ctx
+// disconnects.
+func openStream(t *testing.T, ctx context.Context, app *application, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	_, url := startServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.streamMoviesHandler(w, app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+	}))
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got Content-Type %q; want text/event-stream", got)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("got Cache-Control %q; want no-cache", got)
+	}
+
+	body := bufio.NewReader(res.Body)
+	if msg := readMessage(t, body); msg["retry"] != "3000" {
+		t.Fatalf("opened with %v; want a retry of 3000ms", msg)
+	}
+	return body
+}
+
+// subscriberCount returns how many streams are subscribed to the feed.
+func subscriberCount(f *movieFeed) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers)
+}
+
+func TestStreamMovies(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Movies = &rollbackMovies{movies: map[int64]data.Movie{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := openStream(t, ctx, app, "")
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(blackPantherJSON))
+	rr := serve(http.HandlerFunc(app.createMovieHandler), app.contextSetUser(r, &data.User{Id: 1, Name: "Alice", Activated: true}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("creating the movie got status %d: %s", rr.Code, rr.Body)
+	}
+
+	msg := readMessage(t, stream)
+	if msg["id"] != "1" || msg["event"] != "movie.created" {
+		t.Fatalf("got %v; want movie.created with id 1", msg)
+	}
+	var movie data.Movie
+	err := json.Unmarshal([]byte(msg["data"]), &movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.Id != 1 || movie.Title != "Black Panther" {
+		t.Errorf("got movie %+v; want Black Panther with id 1", movie)
+	}
+
+	// Disconnecting ends the handler, which unsubscribes.
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for subscriberCount(app.movieFeed) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream stayed subscribed after the client went away")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Publishing with nobody listening still succeeds.
+	err = app.movieFeed.publish(&data.Movie{Id: 2, Title: "Moana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamMoviesLastEventID(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{"no header", "", nil},
+		{"resume", "1", []string{"2", "3"}},
+		{"up to date", "3", nil},
+		{"malformed", "abc", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			for id := int64(1); id <= 3; id++ {
+				err := app.movieFeed.publish(&data.Movie{Id: id, Title: "Moana"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stream := openStream(t, context.Background(), app, tt.lastEventID)
+
+			// A live event after the backlog marks where the backlog ends.
+			err := app.movieFeed.publish(&data.Movie{Id: 4, Title: "Moana"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for {
+				msg := readMessage(t, stream)
+				if msg["id"] == "4" {
+					break
+				}
+				got = append(got, msg["id"])
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("replayed %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamMoviesHeartbeat(t *testing.T) {
+	app := newTestApplication(t)
+	app.movieFeed.heartbeat = 10 * time.Millisecond
+
+	stream := openStream(t, context.Background(), app, "")
+	if msg := readMessage(t, stream); msg["comment"] != "heartbeat" || len(msg) != 1 {
+		t.Errorf("got %v; want a heartbeat comment", msg)
+	}
+}
+
+func TestStreamMoviesFeedClosed(t *testing.T) {
+	app := newTestApplication(t)
+	stream := openStream(t, context.Background(), app, "")
+
+	// Closing the feed, as shutdown does, ends the stream.
+	app.movieFeed.close()
+	_, err := stream.ReadString('\n')
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("got err %v; want the stream to end", err)
+	}
+}
+
+func TestMovieFeedSlowSubscriber(t *testing.T) {
+	feed := newMovieFeed()
+	events, _, unsubscribe := feed.subscribe(0)
+	defer unsubscribe()
+
+	// A subscriber that never reads is dropped once its buffer is full,
+	// without holding up the publisher.
+	for id := int64(1); id <= movieFeedBuffer+1; id++ {
+		err := feed.publish(&data.Movie{Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n != movieFeedBuffer {
+		t.Errorf("received %d events before being dropped; want %d", n, movieFeedBuffer)
+	}
+	if subscriberCount(feed) != 0 {
+		t.Error("the slow subscriber is still subscribed")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/jsonlog"
+	"github.com/julienschmidt/httprouter"
+)
+
+// newTestApplication returns an application with mock models and a logger
+// that discards everything. Tests set the config and models they rely on.
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	app := &application{
+		logger:    jsonlog.New(io.Discard, jsonlog.LevelOff, jsonlog.JSONFormatter),
+		models:    data.NewMockModels(),
+		movieFeed: newMovieFeed(),
+	}
+	app.config.env = "development"
+	app.config.auth.mode = authModeStateful
+	app.config.http.timeout = 5 * time.Second
+	app.config.http.maxRequestBody = 1 << 20
+	app.config.movieLimits = data.DefaultMovieLimits
+	app.config.movieDefaultSort = "id"
+	app.config.cursor.secret = []byte(strings.Repeat("c", 32))
+	return app
+}
+
+// serve sends r to h and returns the recorded response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+// withIDParam sets the :id route parameter the router would have matched.
+func withIDParam(r *http.Request, id int64) *http.Request {
+	params := httprouter.Params{{Key: "id", Value: strconv.FormatInt(id, 10)}}
+	return r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, params))
+}
@@ -0,0 +1,921 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/mailer"
+)
+
+// sessionStore keeps users and their opaque tokens in memory. sessionUsers
+// and sessionTokens expose it through the two models that share the tokens
+// table.
+type sessionStore struct {
+	users  map[int64]*data.User
+	tokens map[string]*data.Token
+	used   map[string]bool
+	issued int
+	// filters are those the admin token listing was last given.
+	filters data.Filters
+}
+
+func newSessionStore(users ...*data.User) *sessionStore {
+	store := &sessionStore{users: map[int64]*data.User{}, tokens: map[string]*data.Token{}, used: map[string]bool{}}
+	for _, user := range users {
+		store.users[user.Id] = user
+	}
+	return store
+}
+
+// deleteTokens removes the user's tokens in the given scopes.
+func (s *sessionStore) deleteTokens(userID int64, scopes ...string) {
+	for plaintext, token := range s.tokens {
+		for _, scope := range scopes {
+			if token.UserID == userID && token.Scope == scope {
+				delete(s.tokens, plaintext)
+			}
+		}
+	}
+}
+
+type sessionUsers struct {
+	data.IUserModel
+	store *sessionStore
+}
+
+func (u sessionUsers) Insert(ctx context.Context, user *data.User) error {
+	var last int64
+	for id, stored := range u.store.users {
+		if stored.Email == user.Email {
+			return data.ErrDuplicateEmail
+		}
+		if id > last {
+			last = id
+		}
+	}
+	user.Id = last + 1
+	user.Version = 1
+	user.TokenVersion = 1
+	stored := *user
+	u.store.users[user.Id] = &stored
+	return nil
+}
+
+func (u sessionUsers) Get(ctx context.Context, id int64) (*data.User, error) {
+	stored, ok := u.store.users[id]
+	if !ok {
+		return nil, data.ErrRecordNotFound
+	}
+	user := *stored
+	return &user, nil
+}
+
+func (u sessionUsers) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+	for _, stored := range u.store.users {
+		if stored.Email == email {
+			user := *stored
+			return &user, nil
+		}
+	}
+	return nil, data.ErrRecordNotFound
+}
+
+func (u sessionUsers) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+	token, ok := u.store.tokens[tokenPlaintext]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) || u.store.used[tokenPlaintext] {
+		return nil, data.ErrRecordNotFound
+	}
+	user := *u.store.users[token.UserID]
+	return &user, nil
+}
+
+func (u sessionUsers) RevokeTokens(ctx context.Context, userID int64) error {
+	u.store.deleteTokens(userID, data.ScopeAuthentication, data.ScopeRefresh)
+	u.store.users[userID].TokenVersion++
+	return nil
+}
+
+func (u sessionUsers) Update(ctx context.Context, user *data.User) error {
+	stored := u.store.users[user.Id]
+	if stored.Version != user.Version {
+		return data.ErrEditConflict
+	}
+	for id, other := range u.store.users {
+		if id != user.Id && other.Email == user.Email {
+			return data.ErrDuplicateEmail
+		}
+	}
+	user.Version++
+	*stored = *user
+	return nil
+}
+
+func (u sessionUsers) UpdatePassword(ctx context.Context, user *data.User) error {
+	stored := u.store.users[user.Id]
+	if stored.Version != user.Version {
+		return data.ErrEditConflict
+	}
+	user.Version++
+	user.TokenVersion++
+	*stored = *user
+	u.store.deleteTokens(user.Id, data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset)
+	return nil
+}
+
+func (u sessionUsers) RecordFailedLogin(ctx context.Context, user *data.User, maxAttempts int, lockout time.Duration) error {
+	stored := u.store.users[user.Id]
+	stored.FailedLogins++
+	if stored.FailedLogins >= maxAttempts {
+		stored.FailedLogins = 0
+		lockedUntil := time.Now().Add(lockout)
+		stored.LockedUntil = &lockedUntil
+	}
+	user.FailedLogins, user.LockedUntil = stored.FailedLogins, stored.LockedUntil
+	return nil
+}
+
+func (u sessionUsers) ResetFailedLogins(ctx context.Context, user *data.User) error {
+	stored := u.store.users[user.Id]
+	stored.FailedLogins, stored.LockedUntil = 0, nil
+	user.FailedLogins, user.LockedUntil = 0, nil
+	return nil
+}
+
+func (u sessionUsers) Delete(ctx context.Context, userID int64) error {
+	if _, ok := u.store.users[userID]; !ok {
+		return data.ErrRecordNotFound
+	}
+	delete(u.store.users, userID)
+	u.store.deleteTokens(userID, data.ScopeActivation, data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset)
+	return nil
+}
+
+type sessionTokens struct {
+	data.ITokenModel
+	store *sessionStore
+}
+
+// New numbers the tokens it issues, and the number doubles as the id of the
+// stored token.
+func (s sessionTokens) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+	s.store.issued++
+	token := &data.Token{
+		Plaintext: fmt.Sprintf("%026d", s.store.issued),
+		UserID:    userID,
+		Expiry:    time.Now().Add(ttl),
+		Scope:     scope,
+	}
+	s.store.tokens[token.Plaintext] = token
+	return token, nil
+}
+
+func (s sessionTokens) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	if token, ok := s.store.tokens[tokenPlaintext]; ok && token.Scope == scope {
+		delete(s.store.tokens, tokenPlaintext)
+	}
+	return nil
+}
+
+func (s sessionTokens) Use(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	token, ok := s.store.tokens[tokenPlaintext]
+	if !ok || token.Scope != scope || !token.Expiry.After(time.Now()) {
+		return 0, data.ErrRecordNotFound
+	}
+	if s.store.used[tokenPlaintext] {
+		return token.UserID, data.ErrTokenReused
+	}
+	s.store.used[tokenPlaintext] = true
+	return token.UserID, nil
+}
+
+func (s sessionTokens) GetAllForUser(ctx context.Context, scope string, userID int64) ([]*data.TokenSummary, error) {
+	sessions := []*data.TokenSummary{}
+	for plaintext, token := range s.store.tokens {
+		if token.UserID == userID && token.Scope == scope && token.Expiry.After(time.Now()) {
+			id, _ := strconv.ParseInt(plaintext, 10, 64)
+			sessions = append(sessions, &data.TokenSummary{ID: id, Identifier: fmt.Sprintf("%08x", id), Expiry: token.Expiry})
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID > sessions[j].ID })
+	return sessions, nil
+}
+
+// GetAll lists every token, expired ones included, newest first or by
+// expiry, and records the filters it was given.
+func (s sessionTokens) GetAll(ctx context.Context, scope string, userID *int64, filters data.Filters) ([]*data.TokenSummary, data.Metadata, error) {
+	s.store.filters = filters
+	tokens := []*data.TokenSummary{}
+	for plaintext, token := range s.store.tokens {
+		if (scope == "" || token.Scope == scope) && (userID == nil || token.UserID == *userID) {
+			id, _ := strconv.ParseInt(plaintext, 10, 64)
+			tokens = append(tokens, &data.TokenSummary{ID: id, Identifier: fmt.Sprintf("%08x", id), UserID: token.UserID, Scope: token.Scope, Expiry: token.Expiry})
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if strings.TrimPrefix(filters.Sort, "-") == "expiry" {
+			return tokens[i].Expiry.Before(tokens[j].Expiry) != strings.HasPrefix(filters.Sort, "-")
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, data.Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1, LastPage: 1, TotalRecords: len(tokens)}, nil
+}
+
+func (s sessionTokens) DeleteForUser(ctx context.Context, scope string, userID, id int64) error {
+	plaintext := fmt.Sprintf("%026d", id)
+	token, ok := s.store.tokens[plaintext]
+	if !ok || token.UserID != userID || token.Scope != scope {
+		return data.ErrRecordNotFound
+	}
+	delete(s.store.tokens, plaintext)
+	return nil
+}
+
+func (s sessionTokens) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	s.store.deleteTokens(userID, scope)
+	return nil
+}
+
+func newSessionTestApplication(t *testing.T, users ...*data.User) *application {
+	t.Helper()
+
+	store := newSessionStore(users...)
+
+	app := newTestApplication(t)
+	app.config.tokens.authenticationTTL = time.Hour
+	app.config.tokens.refreshTTL = 24 * time.Hour
+	app.models.Users = sessionUsers{store: store}
+	app.models.Tokens = sessionTokens{store: store}
+	return app
+}
+
+// newSession issues an authentication token for the user.
+func newSession(t *testing.T, app *application, userID int64) string {
+	t.Helper()
+
+	token, err := app.models.Tokens.New(context.Background(), userID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Plaintext
+}
+
+// authenticated sends r with the bearer token through authenticate to a
+// handler that requires an authenticated user.
+func authenticated(app *application, r *http.Request, token string, next http.HandlerFunc) *httptest.ResponseRecorder {
+	r.Header.Set("Authorization", "Bearer "+token)
+	return serve(app.authenticate(app.requireAuthenticatedUser(next)), r)
+}
+
+// whoami reports the status a request with the token gets.
+func whoami(app *application, token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+	rr := authenticated(app, r, token, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return rr.Code
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		otherStatus int
+	}{
+		{name: "current session", query: "?current=true", otherStatus: http.StatusNoContent},
+		{name: "every session", query: "", otherStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newSessionTestApplication(t,
+				&data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+				&data.User{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1},
+			)
+
+			current := newSession(t, app, 1)
+			other := newSession(t, app, 1)
+			unrelated := newSession(t, app, 2)
+
+			r := httptest.NewRequest(http.MethodDelete, "/v1/tokens/authentication"+tt.query, nil)
+			rr := authenticated(app, r, current, app.deleteAuthenticationTokenHandler)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("logout got status %d: %s", rr.Code, rr.Body)
+			}
+
+			if got := whoami(app, current); got != http.StatusUnauthorized {
+				t.Errorf("the logged out token got status %d; want %d", got, http.StatusUnauthorized)
+			}
+			if got := whoami(app, other); got != tt.otherStatus {
+				t.Errorf("the user's other session got status %d; want %d", got, tt.otherStatus)
+			}
+			if got := whoami(app, unrelated); got != http.StatusNoContent {
+				t.Errorf("another user's session got status %d; want %d", got, http.StatusNoContent)
+			}
+
+			// Logging out again with the revoked token is refused too.
+			r = httptest.NewRequest(http.MethodDelete, "/v1/tokens/authentication"+tt.query, nil)
+			if rr := authenticated(app, r, current, app.deleteAuthenticationTokenHandler); rr.Code != http.StatusUnauthorized {
+				t.Errorf("second logout got status %d; want %d", rr.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestPasswordResetRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		issueTokens bool
+	}{
+		{name: "without new tokens"},
+		{name: "with new tokens", issueTokens: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, Version: 1, TokenVersion: 1})
+
+			old := newSession(t, app, 1)
+			reset, err := app.models.Tokens.New(context.Background(), 1, time.Hour, data.ScopePasswordReset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := fmt.Sprintf(`{"password":"n3wpa55word1234","token":%q,"issue_tokens":%t}`, reset.Plaintext, tt.issueTokens)
+			r := httptest.NewRequest(http.MethodPut, "/v1/users/password", strings.NewReader(body))
+			rr := serve(http.HandlerFunc(app.updateUserPasswordHandler), r)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("password reset got status %d: %s", rr.Code, rr.Body)
+			}
+
+			if got := whoami(app, old); got != http.StatusUnauthorized {
+				t.Errorf("a token from before the reset got status %d; want %d", got, http.StatusUnauthorized)
+			}
+
+			var issued struct {
+				AuthenticationToken *data.Token `json:"authentication_token"`
+			}
+			err = json.Unmarshal(rr.Body.Bytes(), &issued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (issued.AuthenticationToken != nil) != tt.issueTokens {
+				t.Fatalf("got authentication token %v; want one: %t", issued.AuthenticationToken, tt.issueTokens)
+			}
+			if tt.issueTokens {
+				if got := whoami(app, issued.AuthenticationToken.Plaintext); got != http.StatusNoContent {
+					t.Errorf("the token issued by the reset got status %d; want %d", got, http.StatusNoContent)
+				}
+			}
+
+			// The reset token is spent along with the sessions.
+			r = httptest.NewRequest(http.MethodPut, "/v1/users/password", strings.NewReader(body))
+			if rr := serve(http.HandlerFunc(app.updateUserPasswordHandler), r); rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("reusing the reset token got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+		})
+	}
+}
+
+// refresh exchanges a refresh token and returns the response along with the
+// tokens it issued, if any.
+func refresh(t *testing.T, app *application, refreshToken string) (*httptest.ResponseRecorder, string, string) {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"refresh_token":%q}`, refreshToken)
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/refresh", strings.NewReader(body))
+	rr := serve(http.HandlerFunc(app.refreshAuthenticationTokenHandler), r)
+
+	var issued struct {
+		AuthenticationToken data.Token `json:"authentication_token"`
+		RefreshToken        data.Token `json:"refresh_token"`
+	}
+	if rr.Code == http.StatusCreated {
+		err := json.Unmarshal(rr.Body.Bytes(), &issued)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr, issued.AuthenticationToken.Plaintext, issued.RefreshToken.Plaintext
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1})
+
+	first, err := app.models.Tokens.New(context.Background(), 1, time.Hour, data.ScopeRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr, access, rotated := refresh(t, app, first.Plaintext)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("refresh got status %d: %s", rr.Code, rr.Body)
+	}
+	if rotated == "" || rotated == first.Plaintext {
+		t.Fatalf("got refresh token %q; want a new one", rotated)
+	}
+	if got := whoami(app, access); got != http.StatusNoContent {
+		t.Errorf("the new authentication token got status %d; want %d", got, http.StatusNoContent)
+	}
+
+	// The rotated token works once, like the first.
+	rr, access, latest := refresh(t, app, rotated)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("second refresh got status %d: %s", rr.Code, rr.Body)
+	}
+
+	// Presenting a spent token means it leaked: it is refused and every
+	// session the user has, including the latest, is ended.
+	if rr, _, _ := refresh(t, app, first.Plaintext); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if got := whoami(app, access); got != http.StatusUnauthorized {
+		t.Errorf("authentication token after reuse got status %d; want %d", got, http.StatusUnauthorized)
+	}
+	if rr, _, _ := refresh(t, app, latest); rr.Code != http.StatusUnauthorized {
+		t.Errorf("latest refresh token after reuse got status %d; want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  func(t *testing.T, app *application) string
+		status int
+	}{
+		{
+			name: "expired",
+			token: func(t *testing.T, app *application) string {
+				token, err := app.models.Tokens.New(context.Background(), 1, -time.Minute, data.ScopeRefresh)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return token.Plaintext
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "authentication token",
+			token: func(t *testing.T, app *application) string {
+				return newSession(t, app, 1)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown",
+			token: func(t *testing.T, app *application) string {
+				return strings.Repeat("A", 26)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "malformed",
+			token: func(t *testing.T, app *application) string {
+				return "short"
+			},
+			status: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1})
+
+			rr, access, _ := refresh(t, app, tt.token(t, app))
+			if rr.Code != tt.status {
+				t.Errorf("got status %d; want %d", rr.Code, tt.status)
+			}
+			if access != "" {
+				t.Error("issued an authentication token")
+			}
+		})
+	}
+}
+
+func TestChangePasswordRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     string
+		new         string
+		issueTokens bool
+		wantStatus  int
+	}{
+		{name: "wrong current password", current: "wr0ngpa55word", new: "n3wpa55word1234", wantStatus: http.StatusUnauthorized},
+		{name: "unchanged", current: "pa55word1234", new: "pa55word1234", wantStatus: http.StatusUnprocessableEntity},
+		{name: "without new tokens", current: "pa55word1234", new: "n3wpa55word1234", wantStatus: http.StatusOK},
+		{name: "with new tokens", current: "pa55word1234", new: "n3wpa55word1234", issueTokens: true, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, Version: 1, TokenVersion: 1}
+			err := alice.Password.Set("pa55word1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := newSessionTestApplication(t, alice, &data.User{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1})
+
+			current := newSession(t, app, 1)
+			other := newSession(t, app, 1)
+			bob := newSession(t, app, 2)
+
+			body := fmt.Sprintf(`{"current_password":%q,"new_password":%q,"issue_tokens":%t}`, tt.current, tt.new, tt.issueTokens)
+			r := httptest.NewRequest(http.MethodPut, "/v1/users/me/password", strings.NewReader(body))
+			rr := authenticated(app, r, current, app.changeCurrentUserPasswordHandler)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+
+			changed := tt.wantStatus == http.StatusOK
+			wantOld := http.StatusNoContent
+			if changed {
+				wantOld = http.StatusUnauthorized
+			}
+			for name, token := range map[string]string{"the changing session": current, "another session": other} {
+				if got := whoami(app, token); got != wantOld {
+					t.Errorf("%s got status %d; want %d", name, got, wantOld)
+				}
+			}
+			if got := whoami(app, bob); got != http.StatusNoContent {
+				t.Errorf("another user's session got status %d; want %d", got, http.StatusNoContent)
+			}
+
+			stored, err := app.models.Users.Get(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			match, err := stored.Password.Matches(tt.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.new != tt.current && match != changed {
+				t.Errorf("new password matches = %t; want %t", match, changed)
+			}
+			if changed && stored.TokenVersion != 2 {
+				t.Errorf("token version is %d; want 2", stored.TokenVersion)
+			}
+
+			var issued struct {
+				AuthenticationToken *data.Token `json:"authentication_token"`
+			}
+			if changed {
+				err = json.Unmarshal(rr.Body.Bytes(), &issued)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if (issued.AuthenticationToken != nil) != tt.issueTokens {
+				t.Fatalf("got authentication token %v; want one: %t", issued.AuthenticationToken, tt.issueTokens)
+			}
+			if tt.issueTokens {
+				if got := whoami(app, issued.AuthenticationToken.Plaintext); got != http.StatusNoContent {
+					t.Errorf("the token issued by the change got status %d; want %d", got, http.StatusNoContent)
+				}
+			}
+		})
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	alice := &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1}
+	err := alice.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newSessionTestApplication(t, alice)
+	app.config.lockout.maxAttempts = 3
+	app.config.lockout.duration = time.Hour
+
+	stored := app.models.Users.(sessionUsers).store.users[1]
+	right, wrong := "pa55word1234", "wr0ngpa55word"
+
+	steps := []struct {
+		name     string
+		password string
+		// before runs ahead of the login attempt.
+		before func()
+		want   int
+	}{
+		{"first failure", wrong, nil, http.StatusUnauthorized},
+		{"success resets the count", right, nil, http.StatusCreated},
+		{"failure after the reset", wrong, nil, http.StatusUnauthorized},
+		{"second failure", wrong, nil, http.StatusUnauthorized},
+		{"third failure locks", wrong, nil, http.StatusTooManyRequests},
+		{"right password while locked", right, nil, http.StatusTooManyRequests},
+		{"wrong password while locked", wrong, nil, http.StatusTooManyRequests},
+		{"after the cooldown", right, func() {
+			expired := time.Now().Add(-time.Second)
+			stored.LockedUntil = &expired
+		}, http.StatusCreated},
+		{"failure after the lockout cleared", wrong, nil, http.StatusUnauthorized},
+	}
+
+	for _, step := range steps {
+		if step.before != nil {
+			step.before()
+		}
+
+		body := `{"email":"alice@example.com","password":"` + step.password + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+		rr := serve(http.HandlerFunc(app.createAuthenticationTokenHandler), r)
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+
+		if step.want == http.StatusTooManyRequests {
+			retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+			if err != nil || retryAfter <= 0 || retryAfter > 3600 {
+				t.Errorf("%s: got Retry-After %q; want up to an hour", step.name, rr.Header().Get("Retry-After"))
+			}
+		}
+		if step.want == http.StatusCreated && (stored.FailedLogins != 0 || stored.LockedUntil != nil) {
+			t.Errorf("%s: the login left %d failures and a lock until %v", step.name, stored.FailedLogins, stored.LockedUntil)
+		}
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1},
+	)
+
+	current := newSession(t, app, 1)
+	laptop := newSession(t, app, 1)
+	bob := newSession(t, app, 2)
+
+	list := func(token string) []map[string]any {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/me/sessions", nil)
+		rr := authenticated(app, r, token, app.listSessionsHandler)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("listing sessions got status %d: %s", rr.Code, rr.Body)
+		}
+
+		var body struct {
+			Sessions []map[string]any `json:"sessions"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body.Sessions
+	}
+
+	sessions := list(current)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions; want 2", len(sessions))
+	}
+	for _, session := range sessions {
+		for _, key := range []string{"id", "identifier", "created_at", "expiry"} {
+			if _, ok := session[key]; !ok {
+				t.Errorf("session %v has no %s", session, key)
+			}
+		}
+		if _, ok := session["token"]; ok {
+			t.Errorf("session %v exposes the token", session)
+		}
+	}
+
+	revoke := func(token string, id int64) int {
+		r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/v1/users/me/sessions/%d", id), nil)
+		return authenticated(app, withIDParam(r, id), token, app.deleteSessionHandler).Code
+	}
+
+	laptopID, _ := strconv.ParseInt(laptop, 10, 64)
+	if got := revoke(bob, laptopID); got != http.StatusNotFound {
+		t.Errorf("revoking another user's session got status %d; want %d", got, http.StatusNotFound)
+	}
+	if got := whoami(app, laptop); got != http.StatusNoContent {
+		t.Fatalf("the session another user tried to revoke got status %d", got)
+	}
+
+	if got := revoke(current, laptopID); got != http.StatusOK {
+		t.Fatalf("revoking a session got status %d", got)
+	}
+	if got := whoami(app, laptop); got != http.StatusUnauthorized {
+		t.Errorf("the revoked session got status %d; want %d", got, http.StatusUnauthorized)
+	}
+	if got := whoami(app, current); got != http.StatusNoContent {
+		t.Errorf("the session that revoked it got status %d; want %d", got, http.StatusNoContent)
+	}
+	if got := len(list(current)); got != 1 {
+		t.Errorf("%d sessions listed after revoking one; want 1", got)
+	}
+	if got := revoke(current, laptopID); got != http.StatusNotFound {
+		t.Errorf("revoking it again got status %d; want %d", got, http.StatusNotFound)
+	}
+}
+
+func TestTokenTTLs(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Bob", Email: "bob@example.com", TokenVersion: 1},
+	)
+	app.config.tokens.activationTTL = 10 * time.Minute
+	app.config.tokens.authenticationTTL = 20 * time.Minute
+	app.config.tokens.refreshTTL = 2 * time.Hour
+	app.config.tokens.passwordResetTTL = 5 * time.Minute
+	app.config.auth.jwtSecret = []byte(strings.Repeat("s", 32))
+	m := &mailer.MockMailer{}
+	app.mailer = m
+	store := app.models.Users.(sessionUsers).store
+
+	// checkExpiry reports whether a token issued between before and now
+	// expires ttl later. JWT expiries are in whole seconds.
+	checkExpiry := func(what string, expiry, before time.Time, ttl time.Duration) {
+		t.Helper()
+		if expiry.Before(before.Add(ttl).Truncate(time.Second)) || expiry.After(time.Now().Add(ttl)) {
+			t.Errorf("%s expires at %s; want %s after issue", what, expiry, ttl)
+		}
+	}
+
+	// storedToken returns the only token held for the scope.
+	storedToken := func(scope string) *data.Token {
+		t.Helper()
+		var found []*data.Token
+		for _, token := range store.tokens {
+			if token.Scope == scope {
+				found = append(found, token)
+			}
+		}
+		if len(found) != 1 {
+			t.Fatalf("found %d %s tokens; want 1", len(found), scope)
+		}
+		return found[0]
+	}
+
+	// The emailed tokens go out with their actual expiry.
+	emails := []struct {
+		handler  http.HandlerFunc
+		email    string
+		scope    string
+		ttl      time.Duration
+		template string
+	}{
+		{app.createActivationTokenHandler, "bob@example.com", data.ScopeActivation, app.config.tokens.activationTTL, "token_activation.tmpl"},
+		{app.createPasswordResetTokenHandler, "alice@example.com", data.ScopePasswordReset, app.config.tokens.passwordResetTTL, "token_password_reset.tmpl"},
+	}
+	for i, e := range emails {
+		before := time.Now()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email":"`+e.email+`"}`))
+		rr := serve(e.handler, r)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("%s got status %d: %s", e.scope, rr.Code, rr.Body)
+		}
+
+		token := storedToken(e.scope)
+		checkExpiry(e.scope+" token", token.Expiry, before, e.ttl)
+
+		sent := m.Sent()
+		if len(sent) != i+1 || sent[i].TemplateFile != e.template {
+			t.Fatalf("sent %+v; want a %s", sent, e.template)
+		}
+		if got := sent[i].Data.(map[string]any)["tokenExpiry"]; got != formatTokenExpiry(token) {
+			t.Errorf("the %s email gives the expiry as %v; want %s", e.scope, got, formatTokenExpiry(token))
+		}
+	}
+
+	for _, mode := range []string{authModeStateful, authModeJWT} {
+		app.config.auth.mode = mode
+		store.deleteTokens(1, data.ScopeAuthentication, data.ScopeRefresh)
+
+		before := time.Now()
+		env, err := app.issueTokens(httptest.NewRequest(http.MethodPost, "/", nil), store.users[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkExpiry(mode+" authentication token", env["authentication_token"].(*data.Token).Expiry, before, app.config.tokens.authenticationTTL)
+		checkExpiry(mode+" refresh token", env["refresh_token"].(*data.Token).Expiry, before, app.config.tokens.refreshTTL)
+	}
+}
+
+func TestListTokens(t *testing.T) {
+	app := newSessionTestApplication(t,
+		&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	routes := app.routes()
+
+	admin, editor := newSession(t, app, 1), newSession(t, app, 2)
+	var plaintexts []string
+	for _, scope := range []string{data.ScopeRefresh, data.ScopeActivation, data.ScopePasswordReset} {
+		token, err := app.models.Tokens.New(context.Background(), 2, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintexts = append(plaintexts, token.Plaintext)
+	}
+	plaintexts = append(plaintexts, admin, editor)
+
+	tests := []struct {
+		name  string
+		token string
+		query string
+		want  int
+		// ids are the tokens listed, in order.
+		ids string
+	}{
+		{name: "anonymous", query: "", want: http.StatusUnauthorized},
+		{name: "not an admin", token: editor, query: "", want: http.StatusForbidden},
+		{name: "everything", token: admin, query: "", want: http.StatusOK, ids: "5,4,3,2,1"},
+		{name: "by scope", token: admin, query: "?scope=authentication", want: http.StatusOK, ids: "2,1"},
+		{name: "by scope and user", token: admin, query: "?scope=authentication&user_id=2", want: http.StatusOK, ids: "2"},
+		{name: "by user", token: admin, query: "?user_id=2&page=1&page_size=10", want: http.StatusOK, ids: "5,4,3,2"},
+		{name: "unknown scope", token: admin, query: "?scope=session", want: http.StatusUnprocessableEntity},
+		{name: "unknown sort", token: admin, query: "?sort=user_id", want: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/admin/tokens"+tt.query, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rr := serve(routes, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Tokens []data.TokenSummary `json:"tokens"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, token := range body.Tokens {
+				ids = append(ids, strconv.FormatInt(token.ID, 10))
+			}
+			if got := strings.Join(ids, ","); got != tt.ids {
+				t.Errorf("listed tokens %s; want %s", got, tt.ids)
+			}
+
+			for _, plaintext := range plaintexts {
+				if strings.Contains(rr.Body.String(), plaintext) {
+					t.Errorf("the listing gives away token %s: %s", plaintext, rr.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestListTokensSortsByExpiry(t *testing.T) {
+	app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1})
+	for _, ttl := range []time.Duration{2 * time.Hour, time.Hour, 3 * time.Hour} {
+		_, err := app.models.Tokens.New(context.Background(), 1, ttl, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := app.models.Tokens.(sessionTokens).store
+
+	tests := []struct {
+		sort string
+		ids  string
+	}{
+		{"expiry", "2,1,3"},
+		{"-expiry", "3,1,2"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/admin/tokens?sort="+tt.sort, nil)
+		rr := serve(http.HandlerFunc(app.listTokensHandler), r)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("sort %s got status %d: %s", tt.sort, rr.Code, rr.Body)
+		}
+		if store.filters.Sort != tt.sort {
+			t.Errorf("listed with sort %q; want %q", store.filters.Sort, tt.sort)
+		}
+
+		var body struct {
+			Tokens []data.TokenSummary `json:"tokens"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, token := range body.Tokens {
+			ids = append(ids, strconv.FormatInt(token.ID, 10))
+		}
+		if got := strings.Join(ids, ","); got != tt.ids {
+			t.Errorf("sort %s listed tokens %s; want %s", tt.sort, got, tt.ids)
+		}
+	}
+}
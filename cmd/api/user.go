@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/data"
@@ -11,20 +12,33 @@ import (
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name     string `json:"name" xml:"name"`
+		Email    string `json:"email" xml:"email"`
+		Password string `json:"password" xml:"password"`
+		Locale   string `json:"locale" xml:"locale"`
+		Role     string `json:"role" xml:"role"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
+
+	if input.Locale == "" {
+		input.Locale = preferredLocale(r)
+	}
+
+	if input.Role == "" {
+		input.Role = data.RoleViewer
+	}
+
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
 		Activated: false,
+		Locale:    input.Locale,
+		Role:      input.Role,
 	}
 
 	err = user.Password.Set(input.Password)
@@ -40,7 +54,35 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Users.Insert(user)
+	if app.checkEmailDomain(r, v, user.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Anyone may sign up as a viewer, but handing out any other role is an
+	// administrative action.
+	if user.Role != data.RoleViewer {
+		caller := app.contextGetUser(r)
+		if caller.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		permitted, err := app.userHasPermission(r.Context(), caller, "admin:write")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permitted {
+			app.notPermittedResponse(w, r)
+			return
+		}
+	}
+
+	ctx := app.withAudit(r, data.AuditUserCreate, "user", 0, map[string]any{"email": user.Email, "role": user.Role})
+
+	err = app.models.Users.Insert(ctx, user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -52,39 +94,211 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Permissions.AddForUser(user.Id, "movies:read")
+	token, err := app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.activationTTL, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.Id, 3*24*time.Hour, data.ScopeActivation)
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+		"tokenExpiry":     formatTokenExpiry(token),
+		"userId":          user.Id,
+	}
+
+	err = app.mailer.Enqueue(user.Email, user.Locale, "user_welcome.tmpl", data)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string
+		Email     string
+		Activated *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+	input.Email = app.readString(qs, "email", "")
+	if qs.Has("activated") {
+		activated := app.readBool(qs, "activated", false, v)
+		input.Activated = &activated
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	app.readPageSize(qs, &input.Filters, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafeList = []string{"id", "created_at", "name", "-id", "-created_at", "-name"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), input.Name, input.Email, input.Activated, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
+	app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, app.paginationHeaders(r, metadata))
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name   *string `json:"name" xml:"name"`
+		Email  *string `json:"email" xml:"email"`
+		Locale *string `json:"locale" xml:"locale"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	before := *user
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Locale != nil {
+		user.Locale = *input.Locale
+	}
+
+	emailChanged := input.Email != nil && *input.Email != user.Email
+	if emailChanged {
+		user.Email = *input.Email
+		user.Activated = false
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if emailChanged {
+		if app.checkEmailDomain(r, v, user.Email); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	ctx := app.withAudit(r, data.AuditUserUpdate, "user", user.Id, userAuditDiff(&before, user))
+
+	err = app.models.Users.Update(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.jwtUsers.forget(user.Id)
+
+	if emailChanged {
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.Id)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.activationTTL, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		data := map[string]any{
 			"activationToken": token.Plaintext,
-			"userId":          user.Id,
+			"tokenExpiry":     formatTokenExpiry(token),
 		}
 
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err = app.mailer.Enqueue(user.Email, user.Locale, "token_activation.tmpl", data)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.logError(r, err)
 		}
-	})
+	}
 
-	app.writeJSON(w, r, http.StatusCreated, envelope{"user": user}, nil)
+	app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+}
+
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password" xml:"password"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidatePasswordPlaintext(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	ctx := app.withAudit(r, data.AuditUserDelete, "user", user.Id, map[string]any{"email": user.Email})
+
+	err = app.models.Users.Delete(ctx, user.Id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.jwtUsers.forget(user.Id)
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"message": "user account successfully deleted"}, nil)
 }
 
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		TokenPlaintext string `json:"token"`
+		TokenPlaintext string `json:"token" xml:"token"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -96,7 +310,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -110,7 +324,16 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	user.Activated = true
 
-	err = app.models.Users.Update(user)
+	// Whoever holds the token acts as the user.
+	ctx := data.WithAudit(r.Context(), &data.AuditEntry{
+		ActorID:    &user.Id,
+		Action:     data.AuditUserUpdate,
+		TargetType: "user",
+		TargetID:   &user.Id,
+		Changes:    map[string]any{"activated": auditChange(false, true)},
+	})
+
+	err = app.models.Users.Update(ctx, user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -120,23 +343,24 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
+	app.jwtUsers.forget(user.Id)
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.Id)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.Id)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusOK, envelope{"user": user}, nil)
+	app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
 }
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email    string `json:"email" xml:"email"`
+		Password string `json:"password" xml:"password"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	err := app.readRequest(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
@@ -150,7 +374,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -161,6 +385,12 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	lockoutEnabled := app.config.lockout.maxAttempts > 0
+	if lockoutEnabled && user.IsLocked(time.Now()) {
+		app.accountLockedResponse(w, r, *user.LockedUntil)
+		return
+	}
+
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -168,15 +398,410 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	if !match {
+		if lockoutEnabled {
+			err = app.models.Users.RecordFailedLogin(r.Context(), user, app.config.lockout.maxAttempts, app.config.lockout.duration)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if user.IsLocked(time.Now()) {
+				app.accountLockedResponse(w, r, *user.LockedUntil)
+				return
+			}
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.Id, 24*time.Hour, data.ScopeAuthentication)
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		err = app.models.Users.ResetFailedLogins(r.Context(), user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	env, err := app.issueTokens(r, user)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.writeJSON(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	app.writeResponse(w, r, http.StatusCreated, env, nil)
+}
+
+// issueTokens creates a short-lived authentication token and a long-lived,
+// single-use refresh token for the user.
+func (app *application) issueTokens(r *http.Request, user *data.User) (envelope, error) {
+	var token *data.Token
+	var err error
+	if app.config.auth.mode == authModeJWT {
+		token, err = app.newJWT(user, app.config.tokens.authenticationTTL)
+	} else {
+		token, err = app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.authenticationTTL, data.ScopeAuthentication)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.refreshTTL, data.ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{"authentication_token": token, "refresh_token": refresh}, nil
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token" xml:"refresh_token"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userID, err := app.models.Tokens.Use(r.Context(), data.ScopeRefresh, input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			// A refresh token is only ever presented twice if someone other
+			// than its owner got hold of it, so end every session the user has.
+			err = app.revokeSessions(r, userID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env, err := app.issueTokens(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusCreated, env, nil)
+}
+
+// revokeSessions ends every session the user has, in either auth mode.
+func (app *application) revokeSessions(r *http.Request, userID int64) error {
+	err := app.models.Users.RevokeTokens(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	app.jwtUsers.forget(userID)
+	return nil
+}
+
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	current := app.readBool(r.URL.Query(), "current", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A JWT can't be revoked on its own, only together with every other
+	// token the user holds.
+	if current && app.config.auth.mode == authModeJWT {
+		app.notSupportedResponse(w, r, "logging out of only the current session is not supported in jwt auth mode")
+		return
+	}
+
+	var err error
+	if current {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		err = app.models.Tokens.Delete(r.Context(), data.ScopeAuthentication, token)
+	} else {
+		err = app.revokeSessions(r, user.Id)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeResponse(w, r, http.StatusOK, envelope{"message": "successfully logged out"}, nil)
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email" xml:"email"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an account with that email address exists, you will receive password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.passwordResetTTL, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := map[string]any{
+		"passwordResetToken": token.Plaintext,
+		"tokenExpiry":        formatTokenExpiry(token),
+	}
+
+	err = app.mailer.Enqueue(user.Email, user.Locale, "token_password_reset.tmpl", data)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	app.writeResponse(w, r, http.StatusAccepted, env, nil)
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email" xml:"email"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an unactivated account with that email address exists, you will receive activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		app.writeResponse(w, r, http.StatusAccepted, env, nil)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.Id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.Id, app.config.tokens.activationTTL, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := map[string]any{
+		"activationToken": token.Plaintext,
+		"tokenExpiry":     formatTokenExpiry(token),
+	}
+
+	err = app.mailer.Enqueue(user.Email, user.Locale, "token_activation.tmpl", data)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	app.writeResponse(w, r, http.StatusAccepted, env, nil)
+}
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password" xml:"password"`
+		TokenPlaintext string `json:"token" xml:"token"`
+		IssueTokens    bool   `json:"issue_tokens" xml:"issue_tokens"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ctx := data.WithAudit(r.Context(), &data.AuditEntry{
+		ActorID:    &user.Id,
+		Action:     data.AuditUserUpdate,
+		TargetType: "user",
+		TargetID:   &user.Id,
+		Changes:    map[string]any{"password": "reset"},
+	})
+
+	err = app.models.Users.UpdatePassword(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.jwtUsers.forget(user.Id)
+
+	app.passwordChangedResponse(w, r, user, "your password was successfully reset", input.IssueTokens)
+}
+
+// changeCurrentUserPasswordHandler changes the password of the signed-in user,
+// who must confirm the current one. Like a reset, it revokes every session.
+func (app *application) changeCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		CurrentPassword string `json:"current_password" xml:"current_password"`
+		NewPassword     string `json:"new_password" xml:"new_password"`
+		IssueTokens     bool   `json:"issue_tokens" xml:"issue_tokens"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	v.Check(input.NewPassword != input.CurrentPassword, "new_password", "must differ from the current password")
+	data.ValidatePasswordPlaintext(v, input.NewPassword)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ctx := app.withAudit(r, data.AuditUserUpdate, "user", user.Id, map[string]any{"password": "changed"})
+
+	err = app.models.Users.UpdatePassword(ctx, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.jwtUsers.forget(user.Id)
+
+	app.passwordChangedResponse(w, r, user, "your password was successfully changed", input.IssueTokens)
+}
+
+// passwordChangedResponse answers a password change. Every existing session
+// was just revoked, so a client that asks for it is signed straight back in.
+func (app *application) passwordChangedResponse(w http.ResponseWriter, r *http.Request, user *data.User, message string, issueTokens bool) {
+	env := envelope{"message": message}
+
+	if issueTokens {
+		tokens, err := app.issueTokens(r, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for key, value := range tokens {
+			env[key] = value
+		}
+	}
+
+	app.writeResponse(w, r, http.StatusOK, env, nil)
 }
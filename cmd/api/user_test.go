@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+	"github.com/Soul-Remix/greenlight/internal/mailer"
+)
+
+func TestShowCurrentUser(t *testing.T) {
+	alice := &data.User{Id: 1, CreatedAt: time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC), Name: "Alice", Email: "alice@example.com", Activated: true, Locale: "en", TokenVersion: 1}
+	err := alice.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newSessionTestApplication(t, alice, &data.User{Id: 2, Name: "Bob", Email: "bob@example.com", TokenVersion: 1})
+	show := app.authenticate(app.requireActivatedUser(app.showCurrentUserHandler))
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"invalid token", strings.Repeat("x", 26), http.StatusUnauthorized},
+		{"inactive user", newSession(t, app, 2), http.StatusForbidden},
+		{"activated user", newSession(t, app, 1), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rr := serve(show, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				User map[string]any `json:"user"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]any{
+				"id":         float64(1),
+				"name":       "Alice",
+				"email":      "alice@example.com",
+				"activated":  true,
+				"created_at": "2023-04-01T12:00:00Z",
+			}
+			for key, value := range want {
+				if body.User[key] != value {
+					t.Errorf("got %s %v; want %v", key, body.User[key], value)
+				}
+			}
+			for _, key := range []string{"password", "password_hash", "hash", "version", "token_version"} {
+				if _, ok := body.User[key]; ok {
+					t.Errorf("the profile exposes %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteCurrentUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"wrong password", "wr0ngpa55word", http.StatusUnauthorized},
+		{"right password", "pa55word1234", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice := &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1}
+			err := alice.Password.Set("pa55word1234")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := newSessionTestApplication(t, alice, &data.User{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, TokenVersion: 1})
+
+			token := newSession(t, app, 1)
+			bob := newSession(t, app, 2)
+
+			body := `{"password":"` + tt.password + `"}`
+			r := httptest.NewRequest(http.MethodDelete, "/v1/users/me", strings.NewReader(body))
+			rr := authenticated(app, r, token, app.deleteCurrentUserHandler)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+
+			deleted := tt.want == http.StatusOK
+			wantSession := http.StatusNoContent
+			if deleted {
+				wantSession = http.StatusUnauthorized
+			}
+			if got := whoami(app, token); got != wantSession {
+				t.Errorf("the user's session got status %d; want %d", got, wantSession)
+			}
+			if got := whoami(app, bob); got != http.StatusNoContent {
+				t.Errorf("another user's session got status %d; want %d", got, http.StatusNoContent)
+			}
+		})
+	}
+}
+
+func TestRegisterUserSendsWelcomeEmail(t *testing.T) {
+	app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1})
+	app.config.tokens.activationTTL = time.Hour
+	m := &mailer.MockMailer{}
+	app.mailer = m
+
+	tests := []struct {
+		name           string
+		body           string
+		acceptLanguage string
+		want           int
+		// sentTo is the recipient of the welcome email, if one is sent, and
+		// locale the language it is sent in.
+		sentTo string
+		locale string
+	}{
+		{"registered", `{"name":"Bob","email":"bob@example.com","password":"pa55word1234"}`, "", http.StatusCreated, "bob@example.com", "en"},
+		{"locale from the header", `{"name":"Chloé","email":"chloe@example.com","password":"pa55word1234"}`, "fr-CA, en;q=0.8", http.StatusCreated, "chloe@example.com", "fr-CA"},
+		{"locale given", `{"name":"Dana","email":"dana@example.com","password":"pa55word1234","locale":"fr"}`, "en", http.StatusCreated, "dana@example.com", "fr"},
+		{"duplicate email", `{"name":"Alice","email":"alice@example.com","password":"pa55word1234"}`, "", http.StatusUnprocessableEntity, "", ""},
+		{"invalid", `{"name":"","email":"carol@example.com","password":"short"}`, "", http.StatusUnprocessableEntity, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(m.Sent())
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(tt.body))
+			if tt.acceptLanguage != "" {
+				r.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			rr := serve(http.HandlerFunc(app.registerUserHandler), app.contextSetUser(r, data.AnonymousUser))
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+
+			sent := m.Sent()[before:]
+			if tt.sentTo == "" {
+				if len(sent) != 0 {
+					t.Errorf("sent %d emails; want none", len(sent))
+				}
+				return
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d emails; want 1", len(sent))
+			}
+
+			msg := sent[0]
+			if msg.Recipient != tt.sentTo || msg.TemplateFile != "user_welcome.tmpl" {
+				t.Errorf("sent %s to %s; want user_welcome.tmpl to %s", msg.TemplateFile, msg.Recipient, tt.sentTo)
+			}
+			if msg.Locale != tt.locale {
+				t.Errorf("sent in %q; want %q", msg.Locale, tt.locale)
+			}
+
+			// The email carries the activation token issued for the new user.
+			var body struct {
+				User struct {
+					Id int64 `json:"id"`
+				} `json:"user"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := msg.Data.(map[string]any)
+			if fields["userId"] != body.User.Id {
+				t.Errorf("email has userId %v; want %d", fields["userId"], body.User.Id)
+			}
+			plaintext, _ := fields["activationToken"].(string)
+			user, err := app.models.Users.GetForToken(context.Background(), data.ScopeActivation, plaintext)
+			if err != nil || user.Id != body.User.Id {
+				t.Fatalf("the email's activation token %q doesn't belong to the new user: %v", plaintext, err)
+			}
+			if user.Locale != tt.locale {
+				t.Errorf("stored locale %q; want %q", user.Locale, tt.locale)
+			}
+		})
+	}
+}
+
+func TestActivationEmailUsesStoredLocale(t *testing.T) {
+	app := newSessionTestApplication(t, &data.User{Id: 1, Name: "Chloé", Email: "chloe@example.com", Locale: "fr", TokenVersion: 1})
+	app.config.tokens.activationTTL = time.Hour
+	m := &mailer.MockMailer{}
+	app.mailer = m
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/activation", strings.NewReader(`{"email":"chloe@example.com"}`))
+	r.Header.Set("Accept-Language", "en")
+	rr := serve(http.HandlerFunc(app.createActivationTokenHandler), r)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+
+	sent := m.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d emails; want 1", len(sent))
+	}
+	if sent[0].TemplateFile != "token_activation.tmpl" || sent[0].Locale != "fr" {
+		t.Errorf("sent %s in %q; want token_activation.tmpl in the stored locale fr", sent[0].TemplateFile, sent[0].Locale)
+	}
+}
+
+func TestCreateActivationToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		// sent says whether an activation email goes out.
+		sent bool
+	}{
+		{"not yet activated", "bob@example.com", true},
+		{"already activated", "alice@example.com", false},
+		{"unknown email", "nobody@example.com", false},
+	}
+
+	var bodies []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newSessionTestApplication(t,
+				&data.User{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, TokenVersion: 1},
+				&data.User{Id: 2, Name: "Bob", Email: "bob@example.com", TokenVersion: 1},
+			)
+			app.config.tokens.activationTTL = time.Hour
+			m := &mailer.MockMailer{}
+			app.mailer = m
+
+			lost, err := app.models.Tokens.New(context.Background(), 2, time.Hour, data.ScopeActivation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/tokens/activation", strings.NewReader(`{"email":"`+tt.email+`"}`))
+			rr := serve(http.HandlerFunc(app.createActivationTokenHandler), r)
+			if rr.Code != http.StatusAccepted {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, http.StatusAccepted, rr.Body)
+			}
+			bodies = append(bodies, rr.Body.String())
+
+			sent := m.Sent()
+			if !tt.sent {
+				if len(sent) != 0 {
+					t.Errorf("sent %d emails; want none", len(sent))
+				}
+				return
+			}
+			if len(sent) != 1 || sent[0].Recipient != tt.email || sent[0].TemplateFile != "token_activation.tmpl" {
+				t.Fatalf("sent %+v; want one token_activation.tmpl to %s", sent, tt.email)
+			}
+
+			// The new token replaces the one that was lost.
+			_, err = app.models.Users.GetForToken(context.Background(), data.ScopeActivation, lost.Plaintext)
+			if err == nil {
+				t.Error("the earlier activation token still works")
+			}
+			plaintext, _ := sent[0].Data.(map[string]any)["activationToken"].(string)
+			user, err := app.models.Users.GetForToken(context.Background(), data.ScopeActivation, plaintext)
+			if err != nil || user.Email != tt.email {
+				t.Errorf("the emailed token %q doesn't activate %s: %v", plaintext, tt.email, err)
+			}
+		})
+	}
+
+	// The response doesn't reveal whether the account exists or is active.
+	for i := 1; i < len(bodies); i++ {
+		if bodies[i] != bodies[0] {
+			t.Errorf("%s got %s; %s got %s", tests[i].name, bodies[i], tests[0].name, bodies[0])
+		}
+	}
+}
+
+// listedUsers records the arguments listUsersHandler passes to GetAll and
+// lists every stored user.
+type listedUsers struct {
+	sessionUsers
+	name      string
+	email     string
+	activated *bool
+	filters   data.Filters
+}
+
+func (l *listedUsers) GetAll(ctx context.Context, name, email string, activated *bool, filters data.Filters) ([]*data.User, data.Metadata, error) {
+	l.name, l.email, l.activated, l.filters = name, email, activated, filters
+
+	users := []*data.User{}
+	for id := int64(1); id <= int64(len(l.store.users)); id++ {
+		users = append(users, l.store.users[id])
+	}
+	return users, data.Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1, LastPage: 1, TotalRecords: len(users)}, nil
+}
+
+func TestUpdateCurrentUser(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+		// email is alice's stored email after the request, and reactivate
+		// says whether she has to activate it again.
+		email      string
+		reactivate bool
+		// emailErr is the error expected on the email key, if any.
+		emailErr string
+	}{
+		{name: "new email", body: `{"email":"alice@example.org"}`, want: http.StatusOK, email: "alice@example.org", reactivate: true},
+		{name: "same email", body: `{"name":"Alice B","email":"alice@example.com"}`, want: http.StatusOK, email: "alice@example.com"},
+		{name: "name only", body: `{"name":"Alice B"}`, want: http.StatusOK, email: "alice@example.com"},
+		{name: "another user's email", body: `{"email":"bob@example.com"}`, want: http.StatusUnprocessableEntity, email: "alice@example.com", emailErr: "a user with this email address already exists"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := []*data.User{
+				{Id: 1, Name: "Alice", Email: "alice@example.com", Activated: true, Locale: "fr", Version: 1, TokenVersion: 1},
+				{Id: 2, Name: "Bob", Email: "bob@example.com", Activated: true, Version: 1, TokenVersion: 1},
+			}
+			for _, user := range users {
+				err := user.Password.Set("pa55word1234")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			app := newSessionTestApplication(t, users...)
+			app.config.tokens.activationTTL = time.Hour
+			m := &mailer.MockMailer{}
+			app.mailer = m
+			store := app.models.Tokens.(sessionTokens).store
+
+			token := newSession(t, app, 1)
+			old, err := app.models.Tokens.New(context.Background(), 1, time.Hour, data.ScopeActivation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPatch, "/v1/users/me", strings.NewReader(tt.body))
+			rr := authenticated(app, r, token, app.updateCurrentUserHandler)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+
+			alice := store.users[1]
+			if alice.Email != tt.email || alice.Activated == tt.reactivate {
+				t.Errorf("stored email %s, activated %t; want %s, activated %t", alice.Email, alice.Activated, tt.email, !tt.reactivate)
+			}
+
+			var activation []*data.Token
+			for _, token := range store.tokens {
+				if token.UserID == 1 && token.Scope == data.ScopeActivation {
+					activation = append(activation, token)
+				}
+			}
+			sent := m.Sent()
+
+			if !tt.reactivate {
+				if len(activation) != 1 || activation[0] != old {
+					t.Errorf("the activation tokens were replaced without an email change")
+				}
+				if len(sent) != 0 {
+					t.Errorf("sent %d emails; want none", len(sent))
+				}
+				if tt.emailErr == "" {
+					return
+				}
+
+				var body struct {
+					Error map[string]string `json:"error"`
+				}
+				err = json.Unmarshal(rr.Body.Bytes(), &body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body.Error["email"] != tt.emailErr {
+					t.Errorf("got errors %v; want %q on email", body.Error, tt.emailErr)
+				}
+				return
+			}
+
+			// The activation token issued before the change is gone, and the
+			// one that replaces it goes to the new address.
+			if len(activation) != 1 || activation[0] == old {
+				t.Fatalf("got %d activation tokens; want only a new one", len(activation))
+			}
+			if len(sent) != 1 {
+				t.Fatalf("sent %d emails; want 1", len(sent))
+			}
+			msg := sent[0]
+			if msg.Recipient != tt.email || msg.TemplateFile != "token_activation.tmpl" || msg.Locale != "fr" {
+				t.Errorf("sent %s to %s in %q; want token_activation.tmpl to %s in fr", msg.TemplateFile, msg.Recipient, msg.Locale, tt.email)
+			}
+			if got := msg.Data.(map[string]any)["activationToken"]; got != activation[0].Plaintext {
+				t.Errorf("the email carries token %v; want %s", got, activation[0].Plaintext)
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	admin := &data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1}
+	err := admin.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newSessionTestApplication(t,
+		admin,
+		&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+	)
+	app.models.Permissions = newMemoryPermissions()
+	users := &listedUsers{sessionUsers: app.models.Users.(sessionUsers)}
+	app.models.Users = users
+	routes := app.routes()
+
+	adminToken := newSession(t, app, 1)
+	editorToken := newSession(t, app, 2)
+
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		want   int
+		filter func(t *testing.T)
+	}{
+		{name: "anonymous", want: http.StatusUnauthorized},
+		{name: "without admin:read", token: editorToken, want: http.StatusForbidden},
+		{
+			name: "defaults", token: adminToken, want: http.StatusOK,
+			filter: func(t *testing.T) {
+				if users.name != "" || users.email != "" || users.activated != nil {
+					t.Errorf("got filters %q, %q and %v; want none", users.name, users.email, users.activated)
+				}
+				if users.filters.Page != 1 || users.filters.Sort != "id" {
+					t.Errorf("got page %d sorted by %q; want page 1 sorted by id", users.filters.Page, users.filters.Sort)
+				}
+			},
+		},
+		{
+			name: "filtered", token: adminToken, query: "activated=true&name=ali&email=example.com&sort=-name&page=2&page_size=5", want: http.StatusOK,
+			filter: func(t *testing.T) {
+				if users.name != "ali" || users.email != "example.com" || users.activated == nil || !*users.activated {
+					t.Errorf("got filters %q, %q and %v; want ali, example.com and true", users.name, users.email, users.activated)
+				}
+				if users.filters.Page != 2 || users.filters.PageSize != 5 || users.filters.Sort != "-name" {
+					t.Errorf("got page %d of %d sorted by %q; want page 2 of 5 sorted by -name", users.filters.Page, users.filters.PageSize, users.filters.Sort)
+				}
+			},
+		},
+		{name: "sorted by created_at", token: adminToken, query: "sort=created_at", want: http.StatusOK},
+		{name: "sorted by email", token: adminToken, query: "sort=email", want: http.StatusUnprocessableEntity},
+		{name: "activated not a boolean", token: adminToken, query: "activated=maybe", want: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/users?"+tt.query, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rr := serve(routes, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if tt.filter != nil {
+				tt.filter(t)
+			}
+
+			var body struct {
+				Users    []map[string]any `json:"users"`
+				Metadata data.Metadata    `json:"metadata"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Users) != 2 || body.Metadata.TotalRecords != 2 {
+				t.Errorf("listed %d users with metadata %+v; want 2", len(body.Users), body.Metadata)
+			}
+			for _, user := range body.Users {
+				for _, key := range []string{"password", "password_hash", "hash", "token_version"} {
+					if _, ok := user[key]; ok {
+						t.Errorf("the listing exposes %s", key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterUserRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller int64 // 0 for anonymous
+		role   string
+		want   int
+		// granted are the permissions the new user ends up with.
+		granted []string
+	}{
+		{name: "no role", want: http.StatusCreated, granted: []string{"movies:read"}},
+		{name: "viewer", role: data.RoleViewer, want: http.StatusCreated, granted: []string{"movies:read"}},
+		{name: "editor, anonymously", role: data.RoleEditor, want: http.StatusUnauthorized},
+		{name: "editor, by an editor", caller: 2, role: data.RoleEditor, want: http.StatusForbidden},
+		{name: "editor, by an admin", caller: 1, role: data.RoleEditor, want: http.StatusCreated, granted: []string{"movies:read", "movies:write"}},
+		{name: "admin, by an admin", caller: 1, role: data.RoleAdmin, want: http.StatusCreated, granted: data.PermissionCodes},
+		{name: "unknown role", caller: 1, role: "critic", want: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newSessionTestApplication(t,
+				&data.User{Id: 1, Name: "Admin", Email: "admin@example.com", Activated: true, Role: data.RoleAdmin, TokenVersion: 1},
+				&data.User{Id: 2, Name: "Eddie", Email: "eddie@example.com", Activated: true, Role: data.RoleEditor, TokenVersion: 1},
+			)
+			app.config.tokens.activationTTL = time.Hour
+			app.mailer = &mailer.MockMailer{}
+			app.models.Permissions = newMemoryPermissions()
+			routes := app.routes()
+
+			body := `{"name":"Carol","email":"carol@example.com","password":"pa55word1234"`
+			if tt.role != "" {
+				body += `,"role":"` + tt.role + `"`
+			}
+			r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body+"}"))
+			if tt.caller != 0 {
+				r.Header.Set("Authorization", "Bearer "+newSession(t, app, tt.caller))
+			}
+
+			rr := serve(routes, r)
+			if rr.Code != tt.want {
+				t.Fatalf("got status %d; want %d: %s", rr.Code, tt.want, rr.Body)
+			}
+
+			carol, err := app.models.Users.GetByEmail(context.Background(), "carol@example.com")
+			if tt.want != http.StatusCreated {
+				if err == nil {
+					t.Errorf("the user was stored with role %q", carol.Role)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, code := range data.PermissionCodes {
+				want := data.Permissions(tt.granted).Include(code)
+				got, err := app.userHasPermission(context.Background(), carol, code)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("as %q, has %s = %t; want %t", carol.Role, code, got, want)
+				}
+			}
+		})
+	}
+}
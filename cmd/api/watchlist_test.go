@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/data"
+)
+
+// memoryWatchlist keeps each user's watchlist in memory and, like the model,
+// only lists movies that aren't soft-deleted.
+type memoryWatchlist struct {
+	data.IWatchlistModel
+	movies  *softDeletedMovies
+	entries map[int64]map[int64]bool
+}
+
+func (m *memoryWatchlist) Add(ctx context.Context, userID, movieID int64) (bool, error) {
+	if m.entries[userID] == nil {
+		m.entries[userID] = map[int64]bool{}
+	}
+	added := !m.entries[userID][movieID]
+	m.entries[userID][movieID] = true
+	return added, nil
+}
+
+func (m *memoryWatchlist) Remove(ctx context.Context, userID, movieID int64) error {
+	if !m.entries[userID][movieID] {
+		return data.ErrRecordNotFound
+	}
+	delete(m.entries[userID], movieID)
+	return nil
+}
+
+func (m *memoryWatchlist) GetAllForUser(ctx context.Context, userID int64, filters data.Filters) ([]*data.Movie, data.Metadata, error) {
+	movies := []*data.Movie{}
+	for id := range m.entries[userID] {
+		if movie, ok := m.movies.movies[id]; ok && !m.movies.deleted[id] {
+			movies = append(movies, &movie)
+		}
+	}
+	sort.Slice(movies, func(i, j int) bool { return movies[i].Id < movies[j].Id })
+	return movies, data.Metadata{TotalRecords: len(movies)}, nil
+}
+
+// removeMovie takes the movie off every watchlist.
+func (m *memoryWatchlist) removeMovie(movieID int64) {
+	for _, entries := range m.entries {
+		delete(entries, movieID)
+	}
+}
+
+// watchlistedMovies counts watchlist entries as a movie's dependents and, like
+// the model, refuses to soft-delete a movie that has any and takes a purged
+// movie off every watchlist.
+type watchlistedMovies struct {
+	*softDeletedMovies
+	watchlist *memoryWatchlist
+}
+
+func (m watchlistedMovies) Delete(ctx context.Context, id int64) (int32, error) {
+	if _, ok := m.movies[id]; !ok || m.deleted[id] {
+		return 0, data.ErrRecordNotFound
+	}
+	var dependents data.MovieDependents
+	for _, entries := range m.watchlist.entries {
+		if entries[id] {
+			dependents.Watchlist++
+		}
+	}
+	if dependents.Total() > 0 {
+		return 0, &data.MovieDependentsError{Dependents: dependents}
+	}
+	return m.softDeletedMovies.Delete(ctx, id)
+}
+
+func (m watchlistedMovies) Purge(ctx context.Context, id int64) (int32, error) {
+	movie, ok := m.movies[id]
+	if !ok {
+		return 0, data.ErrRecordNotFound
+	}
+	delete(m.movies, id)
+	delete(m.deleted, id)
+	m.watchlist.removeMovie(id)
+	return movie.Version + 1, nil
+}
+
+func TestWatchlist(t *testing.T) {
+	app := newTestApplication(t)
+	movies := &softDeletedMovies{
+		movies: map[int64]data.Movie{
+			1: {Id: 1, Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Version: 1},
+			2: {Id: 2, Title: "Whiplash", Year: 2014, Runtime: 107, Genres: []string{"drama"}, Version: 1},
+		},
+		deleted: map[int64]bool{},
+	}
+	watchlist := &memoryWatchlist{movies: movies, entries: map[int64]map[int64]bool{}}
+	app.models.Movies = watchlistedMovies{softDeletedMovies: movies, watchlist: watchlist}
+	app.models.Watchlist = watchlist
+	app.models.Permissions = newMemoryPermissions()
+
+	alice := &data.User{Id: 1, Name: "Alice", Activated: true, Role: data.RoleAdmin}
+	bob := &data.User{Id: 2, Name: "Bob", Activated: true, Role: data.RoleViewer}
+
+	listed := func(user *data.User) []int64 {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/me/watchlist", nil)
+		rr := serve(http.HandlerFunc(app.listWatchlistHandler), app.contextSetUser(r, user))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("listing the watchlist got status %d: %s", rr.Code, rr.Body)
+		}
+		var body struct {
+			Movies []data.Movie `json:"movies"`
+		}
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int64{}
+		for _, movie := range body.Movies {
+			ids = append(ids, movie.Id)
+		}
+		return ids
+	}
+
+	steps := []struct {
+		name    string
+		user    *data.User
+		method  string
+		target  string
+		handler http.HandlerFunc
+		movieID int64
+		want    int
+		// alice and bob are the ids on each watchlist after the step.
+		alice, bob []int64
+	}{
+		{"add", alice, http.MethodPost, "/v1/movies/1/watchlist", app.addToWatchlistHandler, 1, http.StatusCreated, []int64{1}, []int64{}},
+		{"add again", alice, http.MethodPost, "/v1/movies/1/watchlist", app.addToWatchlistHandler, 1, http.StatusOK, []int64{1}, []int64{}},
+		{"add another", alice, http.MethodPost, "/v1/movies/2/watchlist", app.addToWatchlistHandler, 2, http.StatusCreated, []int64{1, 2}, []int64{}},
+		{"add a missing movie", alice, http.MethodPost, "/v1/movies/3/watchlist", app.addToWatchlistHandler, 3, http.StatusNotFound, []int64{1, 2}, []int64{}},
+		{"another user adds", bob, http.MethodPost, "/v1/movies/1/watchlist", app.addToWatchlistHandler, 1, http.StatusCreated, []int64{1, 2}, []int64{1}},
+		{"remove", alice, http.MethodDelete, "/v1/movies/2/watchlist", app.removeFromWatchlistHandler, 2, http.StatusOK, []int64{1}, []int64{1}},
+		{"remove again", alice, http.MethodDelete, "/v1/movies/2/watchlist", app.removeFromWatchlistHandler, 2, http.StatusNotFound, []int64{1}, []int64{1}},
+		{"delete a watchlisted movie", alice, http.MethodDelete, "/v1/movies/1", app.deleteMovieHandler, 1, http.StatusConflict, []int64{1}, []int64{1}},
+		{"force the delete", alice, http.MethodDelete, "/v1/movies/1?force=true", app.deleteMovieHandler, 1, http.StatusOK, []int64{}, []int64{}},
+		{"add the purged movie", alice, http.MethodPost, "/v1/movies/1/watchlist", app.addToWatchlistHandler, 1, http.StatusNotFound, []int64{}, []int64{}},
+	}
+
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, step.target, nil)
+		rr := serve(step.handler, withIDParam(app.contextSetUser(r, step.user), step.movieID))
+		if rr.Code != step.want {
+			t.Fatalf("%s: got status %d; want %d: %s", step.name, rr.Code, step.want, rr.Body)
+		}
+
+		for _, list := range []struct {
+			user *data.User
+			want []int64
+		}{{alice, step.alice}, {bob, step.bob}} {
+			if got := listed(list.user); !reflect.DeepEqual(got, list.want) {
+				t.Fatalf("%s: %s's watchlist has %v; want %v", step.name, list.user.Name, got, list.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	mediaTypeJSON = "application/json"
+	mediaTypeXML  = "application/xml"
+)
+
+func (app *application) negotiateContentType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return mediaTypeJSON
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+
+		switch mediaType {
+		case mediaTypeJSON, "application/*", "*/*":
+			return mediaTypeJSON
+		case mediaTypeXML, "text/xml":
+			return mediaTypeXML
+		}
+	}
+	return ""
+}
+
+func (e envelope) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	js, err := json.Marshal(map[string]any(e))
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var tree any
+	err = dec.Decode(&tree)
+	if err != nil {
+		return err
+	}
+
+	start.Name = xml.Name{Local: "response"}
+	return encodeXMLValue(enc, start, tree)
+}
+
+func encodeXMLValue(enc *xml.Encoder, start xml.StartElement, value any) error {
+	switch v := value.(type) {
+	case map[string]any:
+		err := enc.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			err = encodeXMLValue(enc, xmlMapElement(key), v[key])
+			if err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+
+	case []any:
+		err := enc.EncodeToken(start)
+		if err != nil {
+			return err
+		}
+
+		item := xml.StartElement{Name: xml.Name{Local: xmlItemName(start.Name.Local)}}
+		for i := range v {
+			err = encodeXMLValue(enc, item, v[i])
+			if err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+
+	case nil:
+		return enc.EncodeElement("", start)
+
+	default:
+		return enc.EncodeElement(fmt.Sprint(v), start)
+	}
+}
+
+// xmlMapElement returns the element for the map entry with the given key. A
+// key that is a valid XML name, as the fields of every response are, names
+// the element. Any other key, such as a genre or a validation error's
+// "movies[0].title", is kept in the key attribute of an entry element.
+func xmlMapElement(key string) xml.StartElement {
+	if isXMLName(key) {
+		return xml.StartElement{Name: xml.Name{Local: key}}
+	}
+	return xml.StartElement{
+		Name: xml.Name{Local: "entry"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+	}
+}
+
+// isXMLName reports whether s can be used as an element name. Names with a
+// colon, which would need a namespace, and names starting with "xml", which
+// are reserved, are not accepted.
+func isXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func xmlItemName(name string) string {
+	if len(name) > 1 && strings.HasSuffix(name, "s") {
+		return strings.TrimSuffix(name, "s")
+	}
+	return "item"
+}
+
+func (app *application) writeXML(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) {
+	body, err := xml.MarshalIndent(data, "", "  ")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	body = append([]byte(xml.Header), body...)
+	body = append(body, '\n')
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", mediaTypeXML)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (app *application) readXML(w http.ResponseWriter, r *http.Request, dst any) error {
+	dec := xml.NewDecoder(r.Body)
+
+	err := dec.Decode(dst)
+	if err != nil {
+		var syntaxError *xml.SyntaxError
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed XML (at line %d)", syntaxError.Line)
+
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
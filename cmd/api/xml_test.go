@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// xmlNode is a generic element, so that any response can be parsed back and
+// compared with what was sent.
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+// decodeXMLValue turns a parsed element back into the value it encodes:
+// entries and named children become map members, repeated item elements
+// become a slice and leaves become their text.
+func decodeXMLValue(n xmlNode) any {
+	if len(n.Children) == 0 {
+		return n.Text
+	}
+
+	if n.Children[0].XMLName.Local == xmlItemName(n.XMLName.Local) && len(n.Children[0].Attrs) == 0 {
+		items := make([]any, len(n.Children))
+		for i, child := range n.Children {
+			items[i] = decodeXMLValue(child)
+		}
+		return items
+	}
+
+	members := make(map[string]any, len(n.Children))
+	for _, child := range n.Children {
+		key := child.XMLName.Local
+		for _, attr := range child.Attrs {
+			if child.XMLName.Local == "entry" && attr.Name.Local == "key" {
+				key = attr.Value
+			}
+		}
+		members[key] = decodeXMLValue(child)
+	}
+	return members
+}
+
+func TestWriteXMLRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		env  envelope
+		want map[string]any
+	}{
+		{
+			name: "validation errors keyed by path",
+			env: envelope{"error": map[string]string{
+				"movies[0].title": "must be provided",
+				"genres[2]":       "must not be more than 50 bytes long",
+				"year":            "must not be in the future",
+			}},
+			want: map[string]any{"error": map[string]any{
+				"movies[0].title": "must be provided",
+				"genres[2]":       "must not be more than 50 bytes long",
+				"year":            "must not be in the future",
+			}},
+		},
+		{
+			name: "counts keyed by genre",
+			env:  envelope{"genres": map[string]int{"Science Fiction": 3, "xmlish": 1, "1980s": 2, "drama": 4}},
+			want: map[string]any{"genres": map[string]any{"Science Fiction": "3", "xmlish": "1", "1980s": "2", "drama": "4"}},
+		},
+		{
+			name: "keys with markup",
+			env:  envelope{"flags": map[string]bool{`a<b&"c"`: true}},
+			want: map[string]any{"flags": map[string]any{`a<b&"c"`: "true"}},
+		},
+		{
+			name: "list of records",
+			env: envelope{"movies": []map[string]any{
+				{"id": 1, "title": "Moana", "genres": []string{"animation", "adventure"}},
+				{"id": 2, "title": "Black Panther", "genres": []string{"action"}},
+			}},
+			want: map[string]any{"movies": []any{
+				map[string]any{"id": "1", "title": "Moana", "genres": []any{"animation", "adventure"}},
+				map[string]any{"id": "2", "title": "Black Panther", "genres": []any{"action"}},
+			}},
+		},
+	}
+
+	app := newTestApplication(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", mediaTypeXML)
+
+			rr := httptest.NewRecorder()
+			app.writeResponse(rr, r, http.StatusOK, tt.env, nil)
+
+			if ct := rr.Header().Get("Content-Type"); ct != mediaTypeXML {
+				t.Fatalf("got Content-Type %q; want %q", ct, mediaTypeXML)
+			}
+
+			var root xmlNode
+			err := xml.Unmarshal(rr.Body.Bytes(), &root)
+			if err != nil {
+				t.Fatalf("response isn't well-formed XML: %v\n%s", err, rr.Body)
+			}
+			if root.XMLName.Local != "response" {
+				t.Fatalf("got root element %q; want response", root.XMLName.Local)
+			}
+
+			got := decodeXMLValue(root)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v; want %#v\n%s", got, tt.want, rr.Body)
+			}
+		})
+	}
+}
+
+func TestIsXMLName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"title", true},
+		{"deleted_at", true},
+		{"_private", true},
+		{"total_processing_time_μs", true},
+		{"a-b.c1", true},
+		{"", false},
+		{"Science Fiction", false},
+		{"movies[0].title", false},
+		{"1980s", false},
+		{"-leading", false},
+		{"ns:name", false},
+		{"xml", false},
+		{"XMLSchema", false},
+	}
+
+	for _, tt := range tests {
+		if got := isXMLName(tt.name); got != tt.want {
+			t.Errorf("isXMLName(%q) = %t; want %t", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	AuditMovieCreate      = "movie.create"
+	AuditMovieUpdate      = "movie.update"
+	AuditMovieDelete      = "movie.delete"
+	AuditMovieRestore     = "movie.restore"
+	AuditMovieImport      = "movie.import"
+	AuditUserCreate       = "user.create"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditPermissionGrant  = "permission.grant"
+	AuditPermissionRevoke = "permission.revoke"
+)
+
+// AuditEntry records a write: who made it, what it did and to which record.
+// ActorID is nil for writes made by anonymous users, such as registration.
+// Changes summarizes the write, usually as the fields that changed.
+type AuditEntry struct {
+	ID         int64          `json:"id"`
+	ActorID    *int64         `json:"actor_id"`
+	Action     string         `json:"action"`
+	TargetType string         `json:"target_type"`
+	TargetID   *int64         `json:"target_id"`
+	Changes    map[string]any `json:"changes,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+type auditContextKey struct{}
+
+// WithAudit returns a context that makes the next audited write made with it
+// record entry in the same transaction as the write. Writes made with a
+// context that carries no entry aren't audited; that keeps internal updates,
+// like failed login counters, out of the log.
+func WithAudit(ctx context.Context, entry *AuditEntry) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, entry)
+}
+
+// AuditEntryFrom returns the audit entry ctx carries, or nil if it carries none.
+func AuditEntryFrom(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(auditContextKey{}).(*AuditEntry)
+	return entry
+}
+
+type dryRunContextKey struct{}
+
+// WithDryRun returns a context in which audited writes are made and then
+// rolled back, so that they go through the database's checks and return the
+// rows they would have written, without changing anything.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunContextKey{}, true)
+}
+
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunContextKey{}).(bool)
+	return dryRun
+}
+
+// setAuditTarget fills in the target of the context's entry, for inserts that
+// only learn the ID of their record once the write is done.
+func setAuditTarget(ctx context.Context, id int64) {
+	if entry := AuditEntryFrom(ctx); entry != nil && entry.TargetID == nil {
+		entry.TargetID = &id
+	}
+}
+
+// querier is the part of *sql.DB and *sql.Tx that models use, so that a write
+// can run with or without a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// audited runs fn against db. When ctx carries an audit entry, fn runs in a
+// transaction that also records the entry, so the write and its audit row
+// are committed or rolled back together. In a dry run, fn runs in a
+// transaction that is always rolled back and nothing is audited.
+func audited(ctx context.Context, db *sql.DB, fn func(q querier) error) error {
+	if AuditEntryFrom(ctx) == nil && !IsDryRun(ctx) {
+		return fn(db)
+	}
+	return transact(ctx, db, fn)
+}
+
+// transact is audited for writes that need a transaction of their own, even
+// when nothing is audited.
+func transact(ctx context.Context, db *sql.DB, fn func(q querier) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil || IsDryRun(ctx) {
+		return err
+	}
+
+	err = recordAudit(ctx, tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordAudit inserts the context's audit entry, if it has one, for writes
+// that already run in their own transaction.
+func recordAudit(ctx context.Context, q querier) error {
+	entry := AuditEntryFrom(ctx)
+	if entry == nil {
+		return nil
+	}
+
+	var changes []byte
+	if len(entry.Changes) > 0 {
+		var err error
+		changes, err = json.Marshal(entry.Changes)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO audit_log (actor_id, action, target_type, target_id, changes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	return q.QueryRowContext(ctx, query, entry.ActorID, entry.Action, entry.TargetType, entry.TargetID, changes).Scan(&entry.ID, &entry.CreatedAt)
+}
+
+type AuditModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+type IAuditModel interface {
+	GetAll(ctx context.Context, actorID *int64, action, targetType string, targetID *int64, filters Filters) ([]*AuditEntry, Metadata, error)
+}
+
+// GetAll lists audit entries, optionally only those by one actor, with one
+// action, or about one target. Empty or nil arguments match everything.
+func (m AuditModel) GetAll(ctx context.Context, actorID *int64, action, targetType string, targetID *int64, filters Filters) ([]*AuditEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, actor_id, action, target_type, target_id, changes, created_at
+		FROM audit_log
+		WHERE ($1::bigint IS NULL OR actor_id = $1)
+		AND ($2 = '' OR action = $2)
+		AND ($3 = '' OR target_type = $3)
+		AND ($4::bigint IS NULL OR target_id = $4)
+		ORDER BY %s %s, id DESC
+		LIMIT $5 OFFSET $6`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := []any{actorID, action, targetType, targetID, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+
+		err := rows.Scan(
+			&totalRecords,
+			&entry.ID,
+			&entry.ActorID,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&changes,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		if changes != nil {
+			err = json.Unmarshal(changes, &entry.Changes)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return entries, metadata, nil
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuditModelMovieUpdate(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	audit := AuditModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(title string, version int32) (*AuditEntry, error) {
+		entry := &AuditEntry{
+			ActorID:    &alice.Id,
+			Action:     AuditMovieUpdate,
+			TargetType: "movie",
+			TargetID:   &movie.Id,
+			Changes:    map[string]any{"title": map[string]any{"from": movie.Title, "to": title}},
+		}
+		updated := *movie
+		updated.Title = title
+		updated.Version = version
+		err := movies.Update(WithAudit(ctx, entry), &updated)
+		if err == nil {
+			*movie = updated
+		}
+		return entry, err
+	}
+
+	entry, err := update("Moana 2", movie.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ID == 0 || entry.CreatedAt.IsZero() {
+		t.Errorf("got entry %+v; want it filled in from the stored row", entry)
+	}
+
+	// An update that fails writes no audit row either.
+	_, err = update("Moana 3", movie.Version-1)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Fatalf("got err %v; want ErrEditConflict", err)
+	}
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "-id", SortSafeList: []string{"-id"}}
+	entries, metadata, err := audit.GetAll(ctx, nil, "", "", nil, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The unaudited insert isn't in the log.
+	if len(entries) != 1 || metadata.TotalRecords != 1 {
+		t.Fatalf("got %d entries of %d; want only the update", len(entries), metadata.TotalRecords)
+	}
+
+	got := entries[0]
+	if got.ID != entry.ID || *got.ActorID != alice.Id || got.Action != AuditMovieUpdate || got.TargetType != "movie" || *got.TargetID != movie.Id {
+		t.Errorf("got entry %+v; want the update of movie %d by user %d", got, movie.Id, alice.Id)
+	}
+	if want := "map[title:map[from:Moana to:Moana 2]]"; fmt.Sprint(got.Changes) != want {
+		t.Errorf("got changes %v; want %s", got.Changes, want)
+	}
+}
+
+func TestAuditModelGetAll(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	audit := AuditModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+
+	var ids []int64
+	for i, actor := range []*User{alice, bob, alice} {
+		movie := validMovie("animation")
+		movie.Title = fmt.Sprintf("Moana %d", i+1)
+		entry := &AuditEntry{ActorID: &actor.Id, Action: AuditMovieCreate, TargetType: "movie"}
+		err := movies.Insert(WithAudit(ctx, entry), movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Inserts learn their target once the row is written.
+		if entry.TargetID == nil || *entry.TargetID != movie.Id {
+			t.Fatalf("got target %v; want movie %d", entry.TargetID, movie.Id)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	tests := []struct {
+		name     string
+		actorID  *int64
+		action   string
+		targetID *int64
+		page     int
+		want     []int64
+		last     int
+	}{
+		{name: "everything", page: 1, want: []int64{ids[2], ids[1]}, last: 2},
+		{name: "second page", page: 2, want: []int64{ids[0]}, last: 2},
+		{name: "by actor", actorID: &alice.Id, page: 1, want: []int64{ids[2], ids[0]}, last: 1},
+		{name: "by target", targetID: &ids[1], page: 1, want: []int64{ids[1]}, last: 1},
+		{name: "by another action", action: AuditMovieDelete, page: 1, want: nil, last: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: tt.page, PageSize: 2, Sort: "-id", SortSafeList: []string{"-id"}}
+			entries, metadata, err := audit.GetAll(ctx, tt.actorID, tt.action, "", tt.targetID, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int64
+			for _, entry := range entries {
+				got = append(got, *entry.TargetID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got targets %v; want %v", got, tt.want)
+			}
+			if metadata.LastPage != tt.last {
+				t.Errorf("got last page %d; want %d", metadata.LastPage, tt.last)
+			}
+		})
+	}
+}
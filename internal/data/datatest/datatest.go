@@ -0,0 +1,140 @@
+// Package datatest gives tests a migrated PostgreSQL database. Tests that use
+// it are skipped unless GREENLIGHT_TEST_DB_DSN names a database the tests may
+// create schemas in.
+package datatest
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// DSNEnv is the environment variable holding the test database's DSN.
+const DSNEnv = "GREENLIGHT_TEST_DB_DSN"
+
+// NewDB returns a connection to a fresh schema with every migration applied.
+// The schema is dropped when the test ends, so tests may run in parallel
+// against the same database.
+func NewDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", DSNEnv)
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	suffix := make([]byte, 6)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "greenlight_test_" + hex.EncodeToString(suffix)
+
+	// citext lives in the schema it was first created in, which is on the
+	// default search path, so it's created before switching to the new schema.
+	for _, stmt := range []string{"CREATE EXTENSION IF NOT EXISTS citext", "CREATE SCHEMA " + schema} {
+		_, err = admin.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer admin.Close()
+
+		_, err = admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	migrate(t, db)
+	return db
+}
+
+// withSearchPath puts schema ahead of public on the search path of every
+// connection opened with the returned DSN.
+func withSearchPath(dsn, schema string) string {
+	searchPath := schema + ",public"
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		return dsn + separator + "search_path=" + strings.ReplaceAll(searchPath, ",", "%2C")
+	}
+	return dsn + " search_path=" + searchPath
+}
+
+// migrate applies the up migrations in order.
+func migrate(t testing.TB, db *sql.DB) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(moduleRoot(t), "migrations", "*.up.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		stmt, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.Exec(string(stmt))
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(file), err)
+		}
+	}
+}
+
+// moduleRoot finds the directory holding go.mod, starting from the directory
+// of the test being run.
+func moduleRoot(t testing.TB) string {
+	t.Helper()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		_, err := os.Stat(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatal("go.mod not found")
+		}
+		dir = parent
+	}
+}
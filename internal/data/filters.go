@@ -1,25 +1,123 @@
 package data
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
 	"strings"
+	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/validator"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
-	SortSafeList []string
+	Page           int
+	PageSize       int
+	Sort           string
+	SortSafeList   []string
+	CursorMode     bool
+	Cursor         string
+	CursorKey      []byte
+	YearFrom       int
+	YearTo         int
+	RuntimeMin     int
+	RuntimeMax     int
+	IncludeDeleted bool
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+
+	// PageSizeClamped records that the requested page size was larger than
+	// MaxPageSize and has been reduced to it.
+	PageSizeClamped bool
 }
 
+const MaxPageSize = 100
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	v.Check(f.PageSize <= MaxPageSize, "page_size", fmt.Sprintf("must be a maximum of %d", MaxPageSize))
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	currentYear := time.Now().Year()
+	if f.YearFrom != 0 {
+		v.Check(f.YearFrom >= 1888 && f.YearFrom <= currentYear, "year_from", "must be between 1888 and the current year")
+	}
+	if f.YearTo != 0 {
+		v.Check(f.YearTo >= 1888 && f.YearTo <= currentYear, "year_to", "must be between 1888 and the current year")
+	}
+	if f.YearFrom != 0 && f.YearTo != 0 {
+		v.Check(f.YearFrom <= f.YearTo, "year_from", "must not be after year_to")
+	}
+
+	if f.RuntimeMin != 0 {
+		v.Check(f.RuntimeMin > 0, "runtime_min", "must be a positive integer")
+	}
+	if f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMax > 0, "runtime_max", "must be a positive integer")
+	}
+	if f.RuntimeMin != 0 && f.RuntimeMax != 0 {
+		v.Check(f.RuntimeMin <= f.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+	}
+
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() {
+		v.Check(f.CreatedAfter.Before(f.CreatedBefore), "created_after", "must be before created_before")
+	}
+
+	if f.CursorMode {
+		v.Check(f.Sort == "id" || f.Sort == "-id", "sort", "must be id or -id when using a cursor")
+		if f.Cursor != "" {
+			_, err := DecodeCursor(f.CursorKey, f.Cursor)
+			v.Check(err == nil, "cursor", "invalid cursor")
+		}
+	}
+}
+
+// ValidateFields checks that every name in a sparse fieldset is one of the
+// record's JSON field names.
+func ValidateFields(v *validator.Validator, fields []string, permittedFields []string) {
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, permittedFields...), "fields", fmt.Sprintf("unknown field %q", field))
+	}
+}
+
+func EncodeCursor(key []byte, id int64) string {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(id))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(payload))
+}
+
+func DecodeCursor(key []byte, cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return 0, ErrInvalidCursor
+	}
+
+	payload, signature := raw[:8], raw[8:]
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, ErrInvalidCursor
+	}
+
+	id := int64(binary.BigEndian.Uint64(payload))
+	if id < 1 {
+		return 0, ErrInvalidCursor
+	}
+
+	return id, nil
 }
 
 func (f Filters) sortColumn() string {
@@ -39,29 +137,81 @@ func (f Filters) sortDirection() string {
 }
 
 func (f Filters) limit() int {
+	if f.CursorMode {
+		return f.PageSize + 1
+	}
 	return f.PageSize
 }
 func (f Filters) offset() int {
+	if f.CursorMode {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
 
+func (f Filters) cursorID() int64 {
+	if !f.CursorMode || f.Cursor == "" {
+		return 0
+	}
+	id, err := DecodeCursor(f.CursorKey, f.Cursor)
+	if err != nil {
+		panic("unsafe cursor parameter: " + f.Cursor)
+	}
+	return id
+}
+
+// createdAfter and createdBefore return the bounds as query arguments, with
+// NULL standing for an unset bound.
+func (f Filters) createdAfter() any {
+	if f.CreatedAfter.IsZero() {
+		return nil
+	}
+	return f.CreatedAfter
+}
+
+func (f Filters) createdBefore() any {
+	if f.CreatedBefore.IsZero() {
+		return nil
+	}
+	return f.CreatedBefore
+}
+
+func (f Filters) cursorOperator() string {
+	if f.sortDirection() == "DESC" {
+		return "<"
+	}
+	return ">"
+}
+
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	Clamped      bool   `json:"clamped,omitempty"`
 }
 
-func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+func calculateMetadata(totalRecords int, filters Filters) Metadata {
 	if totalRecords == 0 {
-		return Metadata{}
+		return Metadata{Clamped: filters.PageSizeClamped}
 	}
 	return Metadata{
-		CurrentPage:  page,
-		PageSize:     pageSize,
+		CurrentPage:  filters.Page,
+		PageSize:     filters.PageSize,
 		FirstPage:    1,
-		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(filters.PageSize))),
 		TotalRecords: totalRecords,
+		Clamped:      filters.PageSizeClamped,
+	}
+}
+
+func calculateCursorMetadata[T any](records []T, filters Filters, id func(T) int64) ([]T, Metadata) {
+	metadata := Metadata{PageSize: filters.PageSize, Clamped: filters.PageSizeClamped}
+	if len(records) > filters.PageSize {
+		records = records[:filters.PageSize]
+		metadata.NextCursor = EncodeCursor(filters.CursorKey, id(records[len(records)-1]))
 	}
+	return records, metadata
 }
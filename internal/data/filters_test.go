@@ -0,0 +1,203 @@
+package data
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+var testCursorKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestDecodeCursor(t *testing.T) {
+	valid := EncodeCursor(testCursorKey, 42)
+
+	raw, err := base64.RawURLEncoding.DecodeString(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Point the cursor at id 43 without re-signing it.
+	raw[7]++
+	tampered := base64.RawURLEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name   string
+		key    []byte
+		cursor string
+		want   int64
+		err    error
+	}{
+		{name: "valid", key: testCursorKey, cursor: valid, want: 42},
+		{name: "tampered id", key: testCursorKey, cursor: tampered, err: ErrInvalidCursor},
+		{name: "other key", key: []byte("another key of at least 32 bytes"), cursor: valid, err: ErrInvalidCursor},
+		{name: "truncated", key: testCursorKey, cursor: valid[:len(valid)-2], err: ErrInvalidCursor},
+		{name: "not base64", key: testCursorKey, cursor: "not a cursor!", err: ErrInvalidCursor},
+		{name: "empty", key: testCursorKey, cursor: "", err: ErrInvalidCursor},
+		{name: "id zero", key: testCursorKey, cursor: EncodeCursor(testCursorKey, 0), err: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeCursor(tt.key, tt.cursor)
+			if err != tt.err {
+				t.Fatalf("got err %v; want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got id %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCursorMetadataWalk pages through ids the way the keyset query does,
+// fetching one row past the page, and checks that following next_cursor
+// visits every id exactly once.
+func TestCursorMetadataWalk(t *testing.T) {
+	ids := []int64{1, 2, 4, 7, 8, 9, 15, 16, 23}
+
+	for _, pageSize := range []int{1, 2, 4, len(ids), len(ids) + 1} {
+		filters := Filters{PageSize: pageSize, CursorMode: true, CursorKey: testCursorKey, Sort: "id"}
+
+		var seen []int64
+		for pages := 0; ; pages++ {
+			if pages > len(ids) {
+				t.Fatalf("page size %d: walk didn't end", pageSize)
+			}
+
+			after := filters.cursorID()
+			var rows []int64
+			for _, id := range ids {
+				if id > after && len(rows) < filters.limit() {
+					rows = append(rows, id)
+				}
+			}
+
+			page, metadata := calculateCursorMetadata(rows, filters, func(id int64) int64 { return id })
+			seen = append(seen, page...)
+
+			if metadata.NextCursor == "" {
+				break
+			}
+			filters.Cursor = metadata.NextCursor
+		}
+
+		if len(seen) != len(ids) {
+			t.Fatalf("page size %d: visited %v; want %v", pageSize, seen, ids)
+		}
+		for i := range ids {
+			if seen[i] != ids[i] {
+				t.Fatalf("page size %d: visited %v; want %v", pageSize, seen, ids)
+			}
+		}
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{name: "none"},
+		{name: "known", fields: []string{"title", "year"}},
+		{name: "unknown", fields: []string{"title", "budget"}, want: `unknown field "budget"`},
+		{name: "empty name", fields: []string{""}, want: `unknown field ""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateFields(v, tt.fields, MovieFields)
+
+			if got := v.Errors["fields"]; got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFiltersRanges(t *testing.T) {
+	nextYear := time.Now().Year() + 1
+	created := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		set    func(f *Filters)
+		errors map[string]string
+	}{
+		{name: "none", set: func(f *Filters) {}},
+		{name: "years in order", set: func(f *Filters) { f.YearFrom, f.YearTo = 1990, 2000 }},
+		{name: "one year", set: func(f *Filters) { f.YearFrom, f.YearTo = 2000, 2000 }},
+		{name: "years inverted", set: func(f *Filters) { f.YearFrom, f.YearTo = 2001, 2000 }, errors: map[string]string{"year_from": "must not be after year_to"}},
+		{name: "year before film", set: func(f *Filters) { f.YearFrom = 1887 }, errors: map[string]string{"year_from": "must be between 1888 and the current year"}},
+		{name: "first year of film", set: func(f *Filters) { f.YearFrom = 1888 }},
+		{name: "year in the future", set: func(f *Filters) { f.YearTo = nextYear }, errors: map[string]string{"year_to": "must be between 1888 and the current year"}},
+		{name: "runtimes in order", set: func(f *Filters) { f.RuntimeMin, f.RuntimeMax = 90, 120 }},
+		{name: "one runtime", set: func(f *Filters) { f.RuntimeMin, f.RuntimeMax = 90, 90 }},
+		{name: "runtimes inverted", set: func(f *Filters) { f.RuntimeMin, f.RuntimeMax = 121, 120 }, errors: map[string]string{"runtime_min": "must not be greater than runtime_max"}},
+		{name: "negative runtime", set: func(f *Filters) { f.RuntimeMax = -1 }, errors: map[string]string{"runtime_max": "must be a positive integer"}},
+		{name: "created window", set: func(f *Filters) { f.CreatedAfter, f.CreatedBefore = created, created.Add(time.Second) }},
+		{name: "created after only", set: func(f *Filters) { f.CreatedAfter = created }},
+		{name: "created window empty", set: func(f *Filters) { f.CreatedAfter, f.CreatedBefore = created, created }, errors: map[string]string{"created_after": "must be before created_before"}},
+		{name: "created window inverted", set: func(f *Filters) { f.CreatedAfter, f.CreatedBefore = created, created.Add(-time.Hour) }, errors: map[string]string{"created_after": "must be before created_before"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+			tt.set(&f)
+
+			v := validator.New()
+			ValidateFilters(v, f)
+
+			if len(v.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v; want %v", v.Errors, tt.errors)
+			}
+			for key, message := range tt.errors {
+				if v.Errors[key] != message {
+					t.Errorf("errors[%q] = %q; want %q", key, v.Errors[key], message)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataClamped(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata Metadata
+		want     Metadata
+	}{
+		{
+			name:     "page",
+			metadata: calculateMetadata(250, Filters{Page: 2, PageSize: MaxPageSize, PageSizeClamped: true}),
+			want:     Metadata{CurrentPage: 2, PageSize: MaxPageSize, FirstPage: 1, LastPage: 3, TotalRecords: 250, Clamped: true},
+		},
+		{
+			name:     "page not clamped",
+			metadata: calculateMetadata(250, Filters{Page: 2, PageSize: MaxPageSize}),
+			want:     Metadata{CurrentPage: 2, PageSize: MaxPageSize, FirstPage: 1, LastPage: 3, TotalRecords: 250},
+		},
+		{
+			name:     "no results",
+			metadata: calculateMetadata(0, Filters{Page: 1, PageSize: MaxPageSize, PageSizeClamped: true}),
+			want:     Metadata{Clamped: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.metadata != tt.want {
+				t.Errorf("got %+v; want %+v", tt.metadata, tt.want)
+			}
+		})
+	}
+
+	// Cursor pages carry the hint too.
+	ids := []int64{1, 2, 3}
+	_, metadata := calculateCursorMetadata(ids, Filters{PageSize: 2, PageSizeClamped: true, CursorMode: true, CursorKey: testCursorKey}, func(id int64) int64 { return id })
+	if !metadata.Clamped || metadata.NextCursor == "" {
+		t.Errorf("got cursor metadata %+v; want it clamped with a next cursor", metadata)
+	}
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// IdempotencyKey records a client-supplied Idempotency-Key together with a
+// fingerprint of the request it was first used with. Status is zero while
+// that request is still being processed.
+type IdempotencyKey struct {
+	UserID      int64
+	Key         string
+	Fingerprint []byte
+	Status      int
+	Response    []byte
+	Expiry      time.Time
+}
+
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must not be empty")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+type IdempotencyKeyModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+type IIdempotencyKeyModel interface {
+	Reserve(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotencyKey, error)
+	Complete(ctx context.Context, userID int64, key string, status int, response []byte) error
+	Release(ctx context.Context, userID int64, key string) error
+}
+
+// Reserve claims the key for the user. It returns nil when the caller now owns
+// the key and should process the request, or the existing record when the key
+// is already in use. Expired keys are reclaimed.
+func (m IdempotencyKeyModel) Reserve(ctx context.Context, userID int64, key string, fingerprint []byte, ttl time.Duration) (*IdempotencyKey, error) {
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint, expiry)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = 0, response = NULL, created_at = NOW(), expiry = EXCLUDED.expiry
+		WHERE idempotency_keys.expiry < NOW()
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, query, userID, key, fingerprint, time.Now().Add(ttl)).Scan(&id)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	query = `
+		SELECT user_id, key, fingerprint, status, response, expiry
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2`
+
+	existing := IdempotencyKey{}
+
+	err = m.DB.QueryRowContext(ctx, query, userID, key).Scan(
+		&existing.UserID,
+		&existing.Key,
+		&existing.Fingerprint,
+		&existing.Status,
+		&existing.Response,
+		&existing.Expiry,
+	)
+	if err != nil {
+		switch {
+		// The key was released between the two queries; report it as still in
+		// progress and let the client retry.
+		case errors.Is(err, sql.ErrNoRows):
+			return &IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint}, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &existing, nil
+}
+
+func (m IdempotencyKeyModel) Complete(ctx context.Context, userID int64, key string, status int, response []byte) error {
+	query := `
+		UPDATE idempotency_keys
+		SET status = $3, response = $4
+		WHERE user_id = $1 AND key = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key, status, response)
+	return err
+}
+
+// Release forgets a key whose request failed, so that a retry can be
+// processed normally.
+func (m IdempotencyKeyModel) Release(ctx context.Context, userID int64, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND status = 0`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, key)
+	return err
+}
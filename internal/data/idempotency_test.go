@@ -0,0 +1,103 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+)
+
+func TestIdempotencyKeyModelReserve(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	keys := IdempotencyKeyModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+	fingerprint := []byte("POST /v1/movies")
+
+	// Concurrent requests with the same key: exactly one owns it and the
+	// rest see it in progress.
+	const requests = 8
+	results := make([]*IdempotencyKey, requests)
+	errs := make([]error, requests)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = keys.Reserve(ctx, user.Id, "key-1", fingerprint, time.Hour)
+		}(i)
+	}
+	wg.Wait()
+
+	owners := 0
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		switch {
+		case results[i] == nil:
+			owners++
+		case results[i].Status != 0:
+			t.Errorf("in-progress key has status %d", results[i].Status)
+		}
+	}
+	if owners != 1 {
+		t.Fatalf("%d requests own the key; want 1", owners)
+	}
+
+	err := keys.Complete(ctx, user.Id, "key-1", 201, []byte(`{"id": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		key    string
+		ttl    time.Duration
+		status int
+		owns   bool
+	}{
+		{name: "replay", key: "key-1", ttl: time.Hour, status: 201},
+		{name: "other key", key: "key-2", ttl: -time.Minute, owns: true},
+		// key-2 was reserved already expired, so it is reclaimed.
+		{name: "expired key", key: "key-2", ttl: time.Hour, owns: true},
+		{name: "reclaimed key in progress", key: "key-2", ttl: time.Hour},
+	}
+
+	for _, step := range steps {
+		existing, err := keys.Reserve(ctx, user.Id, step.key, fingerprint, step.ttl)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if (existing == nil) != step.owns {
+			t.Fatalf("%s: got %+v; want owned %t", step.name, existing, step.owns)
+		}
+		if existing != nil {
+			if existing.Status != step.status || !bytes.Equal(existing.Fingerprint, fingerprint) {
+				t.Errorf("%s: got status %d; want %d", step.name, existing.Status, step.status)
+			}
+			if step.status != 0 && !bytes.Contains(existing.Response, []byte(`"id"`)) {
+				t.Errorf("%s: got response %s", step.name, existing.Response)
+			}
+		}
+	}
+
+	// Releasing frees a key in progress but never a completed one.
+	for _, key := range []string{"key-1", "key-2"} {
+		err := keys.Release(ctx, user.Id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if existing, _ := keys.Reserve(ctx, user.Id, "key-1", fingerprint, time.Hour); existing == nil || existing.Status != 201 {
+		t.Errorf("completed key after release: %+v", existing)
+	}
+	if existing, _ := keys.Reserve(ctx, user.Id, "key-2", fingerprint, time.Hour); existing != nil {
+		t.Errorf("released key still reserved: %+v", existing)
+	}
+}
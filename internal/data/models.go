@@ -3,6 +3,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -15,14 +16,32 @@ type Models struct {
 	Users       IUserModel
 	Tokens      ITokenModel
 	Permissions IPermissionModel
+	Reviews     IReviewModel
+	Watchlist   IWatchlistModel
+	Idempotency IIdempotencyKeyModel
+	Audit       IAuditModel
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels returns the database-backed models. Each query is bounded by
+// queryTimeout, bulk writes such as batch inserts and imports by bulkTimeout,
+// and exports only by the caller's context. Movie listings read from replica
+// when it is not nil, up to movieHistoryDepth prior versions of each movie are
+// kept and uniqueTitles says whether movie titles must be unique, ignoring
+// case.
+func NewModels(db, replica *sql.DB, queryTimeout, bulkTimeout time.Duration, movieHistoryDepth int, uniqueTitles bool) Models {
+	if replica == nil {
+		replica = db
+	}
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:      MovieModel{DB: db, ReadDB: replica, Timeout: queryTimeout, BulkTimeout: bulkTimeout, HistoryDepth: movieHistoryDepth, UniqueTitles: uniqueTitles},
+		Users:       UserModel{DB: db, Timeout: queryTimeout},
+		Tokens:      TokenModel{DB: db, Timeout: queryTimeout},
+		Permissions: PermissionModel{DB: db, Timeout: queryTimeout},
+		Reviews:     ReviewModel{DB: db, Timeout: queryTimeout},
+		Watchlist:   WatchlistModel{DB: db, Timeout: queryTimeout},
+		Idempotency: IdempotencyKeyModel{DB: db, Timeout: queryTimeout},
+		Audit:       AuditModel{DB: db, Timeout: queryTimeout},
 	}
 }
 
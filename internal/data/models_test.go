@@ -0,0 +1,287 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingConnector hands out connections whose statements take delay to
+// return no rows, or give up with the context's error when it ends first, the
+// way a slow database does.
+type stallingConnector struct {
+	delay time.Duration
+}
+
+func (c stallingConnector) Connect(context.Context) (driver.Conn, error) {
+	return stallingConn{delay: c.delay}, nil
+}
+
+func (c stallingConnector) Driver() driver.Driver {
+	return nil
+}
+
+type stallingConn struct {
+	delay time.Duration
+}
+
+func (c stallingConn) wait(ctx context.Context) error {
+	select {
+	case <-time.After(c.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c stallingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return noRows{}, nil
+}
+
+func (c stallingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (c stallingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return stallingTx{}, nil
+}
+
+func (c stallingConn) Prepare(query string) (driver.Stmt, error) { return stallingStmt{c}, nil }
+func (c stallingConn) Close() error                              { return nil }
+func (c stallingConn) Begin() (driver.Tx, error)                 { return stallingTx{}, nil }
+
+type stallingTx struct{}
+
+func (stallingTx) Commit() error   { return nil }
+func (stallingTx) Rollback() error { return nil }
+
+type stallingStmt struct {
+	conn stallingConn
+}
+
+func (s stallingStmt) Close() error  { return nil }
+func (s stallingStmt) NumInput() int { return -1 }
+
+func (s stallingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s stallingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s stallingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, "", args)
+}
+
+func (s stallingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, "", args)
+}
+
+type noRows struct{}
+
+func (noRows) Columns() []string              { return nil }
+func (noRows) Close() error                   { return nil }
+func (noRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestQueryTimeouts(t *testing.T) {
+	const (
+		queryTimeout = 20 * time.Millisecond
+		bulkTimeout  = 100 * time.Millisecond
+	)
+
+	db := sql.OpenDB(stallingConnector{delay: 5 * time.Second})
+	defer db.Close()
+
+	models := NewModels(db, nil, queryTimeout, bulkTimeout, 0, false)
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		call    func(ctx context.Context) error
+	}{
+		{name: "MovieModel.Get", timeout: queryTimeout, call: func(ctx context.Context) error {
+			_, err := models.Movies.Get(ctx, 1)
+			return err
+		}},
+		{name: "MovieModel.GetAll", timeout: queryTimeout, call: func(ctx context.Context) error {
+			_, _, err := models.Movies.GetAll(ctx, "", nil, "all", Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+			return err
+		}},
+		{name: "MovieModel.Insert", timeout: queryTimeout, call: func(ctx context.Context) error {
+			return models.Movies.Insert(ctx, validMovie("drama"))
+		}},
+		{name: "UserModel.GetByEmail", timeout: queryTimeout, call: func(ctx context.Context) error {
+			_, err := models.Users.GetByEmail(ctx, "alice@example.com")
+			return err
+		}},
+		{name: "TokenModel.DeleteExpired", timeout: queryTimeout, call: func(ctx context.Context) error {
+			_, err := models.Tokens.DeleteExpired(ctx)
+			return err
+		}},
+		{name: "MovieModel.InsertBatch", timeout: bulkTimeout, call: func(ctx context.Context) error {
+			return models.Movies.InsertBatch(ctx, []*Movie{validMovie("drama")})
+		}},
+		{name: "MovieModel.Import", timeout: bulkTimeout, call: func(ctx context.Context) error {
+			_, err := models.Movies.Import(ctx, []*Movie{validMovie("drama")}, true)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := tt.call(context.Background())
+			elapsed := time.Since(start)
+
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("got err %v; want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed < tt.timeout || elapsed > tt.timeout+time.Second {
+				t.Errorf("gave up after %s; want about %s", elapsed, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestExportOutlivesBulkTimeout(t *testing.T) {
+	db := sql.OpenDB(stallingConnector{delay: 150 * time.Millisecond})
+	defer db.Close()
+
+	models := NewModels(db, nil, 20*time.Millisecond, 50*time.Millisecond, 0, false)
+
+	err := models.Movies.Export(context.Background(), func(movie *Movie) error { return nil })
+	if err != nil {
+		t.Fatalf("export slower than the bulk timeout: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = models.Movies.Export(ctx, func(movie *Movie) error { return nil })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("export past the caller's deadline: got err %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// recordingConnector hands out connections that answer at once with no rows
+// and count the statements run through them in used.
+type recordingConnector struct {
+	used *atomic.Int64
+}
+
+func (c recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{used: c.used}, nil
+}
+
+func (c recordingConnector) Driver() driver.Driver {
+	return nil
+}
+
+type recordingConn struct {
+	stallingConn
+	used *atomic.Int64
+}
+
+func (c recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.used.Add(1)
+	return c.stallingConn.QueryContext(ctx, query, args)
+}
+
+func (c recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.used.Add(1)
+	return c.stallingConn.ExecContext(ctx, query, args)
+}
+
+func (c recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.used.Add(1)
+	return c.stallingConn.BeginTx(ctx, opts)
+}
+
+func TestMovieModelReadsFromReplica(t *testing.T) {
+	var primaryUsed, replicaUsed atomic.Int64
+	primary := sql.OpenDB(recordingConnector{used: &primaryUsed})
+	defer primary.Close()
+	replica := sql.OpenDB(recordingConnector{used: &replicaUsed})
+	defer replica.Close()
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+	tests := []struct {
+		name string
+		// replica says whether the call reads from the replica rather than
+		// the primary.
+		replica bool
+		call    func(ctx context.Context, movies IMovieModel)
+	}{
+		{name: "GetAll", replica: true, call: func(ctx context.Context, movies IMovieModel) {
+			movies.GetAll(ctx, "", nil, GenresModeAll, filters)
+		}},
+		{name: "GetAllSummary", replica: true, call: func(ctx context.Context, movies IMovieModel) {
+			movies.GetAllSummary(ctx, "", nil, GenresModeAll, filters)
+		}},
+		{name: "GetSimilar", replica: true, call: func(ctx context.Context, movies IMovieModel) {
+			movies.GetSimilar(ctx, &Movie{Id: 1, Genres: []string{"drama"}}, filters)
+		}},
+		{name: "Stats", replica: true, call: func(ctx context.Context, movies IMovieModel) {
+			movies.Stats(ctx)
+		}},
+		{name: "Export", replica: true, call: func(ctx context.Context, movies IMovieModel) {
+			movies.Export(ctx, func(movie *Movie) error { return nil })
+		}},
+		// Get is read before writing against the movie's version, so it
+		// mustn't see a lagging replica.
+		{name: "Get", call: func(ctx context.Context, movies IMovieModel) {
+			movies.Get(ctx, 1)
+		}},
+		{name: "Insert", call: func(ctx context.Context, movies IMovieModel) {
+			movies.Insert(ctx, validMovie("drama"))
+		}},
+		{name: "Update", call: func(ctx context.Context, movies IMovieModel) {
+			movie := validMovie("drama")
+			movie.Id, movie.Version = 1, 1
+			movies.Update(ctx, movie)
+		}},
+		{name: "Delete", call: func(ctx context.Context, movies IMovieModel) {
+			movies.Delete(ctx, 1)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			primaryUsed.Store(0)
+			replicaUsed.Store(0)
+			tt.call(ctx, NewModels(primary, replica, time.Second, time.Second, 0, false).Movies)
+
+			wantPrimary, wantReplica := !tt.replica, tt.replica
+			if got := primaryUsed.Load() > 0; got != wantPrimary {
+				t.Errorf("used the primary: %t; want %t", got, wantPrimary)
+			}
+			if got := replicaUsed.Load() > 0; got != wantReplica {
+				t.Errorf("used the replica: %t; want %t", got, wantReplica)
+			}
+
+			// Without a replica, everything goes to the primary.
+			primaryUsed.Store(0)
+			replicaUsed.Store(0)
+			tt.call(ctx, NewModels(primary, nil, time.Second, time.Second, 0, false).Movies)
+
+			if primaryUsed.Load() == 0 || replicaUsed.Load() != 0 {
+				t.Errorf("without a replica, used the primary %d times and the replica %d times", primaryUsed.Load(), replicaUsed.Load())
+			}
+		})
+	}
+}
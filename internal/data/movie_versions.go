@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MovieVersion is a snapshot of a movie as it was before an update replaced
+// it.
+type MovieVersion struct {
+	Version    int32     `json:"version"`
+	Title      string    `json:"title"`
+	Year       int32     `json:"year,omitempty"`
+	Runtime    Runtime   `json:"runtime,omitempty"`
+	Genres     []string  `json:"genres,omitempty"`
+	Director   string    `json:"director,omitempty"`
+	Rating     string    `json:"rating,omitempty"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// withHistory runs an update of the movie in a transaction that first keeps a
+// snapshot of the row it is about to replace. A version of 0 snapshots the
+// movie whatever its version. Only the HistoryDepth most recent snapshots are
+// kept; with a depth of 0 no history is written.
+func (m MovieModel) withHistory(ctx context.Context, id int64, version int32, fn func(q querier) error) error {
+	if m.HistoryDepth <= 0 {
+		return audited(ctx, m.DB, fn)
+	}
+
+	return transact(ctx, m.DB, func(q querier) error {
+		// The row is locked so that a concurrent update waits for this one
+		// and then snapshots the row as this update leaves it.
+		query := `
+			INSERT INTO movie_versions (movie_id, version, title, year, runtime, genres, director, rating)
+			SELECT id, version, title, year, runtime, genres, director, rating
+			FROM movies
+			WHERE id = $1 AND ($2 = 0 OR version = $2) AND deleted_at IS NULL
+			FOR UPDATE
+			ON CONFLICT DO NOTHING`
+
+		_, err := q.ExecContext(ctx, query, id, version)
+		if err != nil {
+			return err
+		}
+
+		err = fn(q)
+		if err != nil {
+			return err
+		}
+
+		return m.pruneHistory(ctx, q, id)
+	})
+}
+
+// pruneHistory drops all but the HistoryDepth most recent snapshots of the
+// movie. It does nothing when history is disabled.
+func (m MovieModel) pruneHistory(ctx context.Context, q querier, id int64) error {
+	if m.HistoryDepth <= 0 {
+		return nil
+	}
+
+	query := `
+		DELETE FROM movie_versions
+		WHERE movie_id = $1 AND version NOT IN (
+			SELECT version FROM movie_versions
+			WHERE movie_id = $1
+			ORDER BY version DESC
+			LIMIT $2
+		)`
+
+	_, err := q.ExecContext(ctx, query, id, m.HistoryDepth)
+	return err
+}
+
+// History returns the retained snapshots of the movie, oldest first.
+func (m MovieModel) History(ctx context.Context, id int64) ([]*MovieVersion, error) {
+	query := `
+		SELECT version, title, year, runtime, genres, director, rating, replaced_at
+		FROM movie_versions
+		WHERE movie_id = $1
+		ORDER BY version ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []*MovieVersion{}
+
+	for rows.Next() {
+		var version MovieVersion
+
+		err := rows.Scan(
+			&version.Version,
+			&version.Title,
+			&version.Year,
+			&version.Runtime,
+			pq.Array(&version.Genres),
+			&version.Director,
+			&version.Rating,
+			&version.ReplacedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, &version)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
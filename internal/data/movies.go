@@ -5,23 +5,53 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/validator"
 	"github.com/lib/pq"
 )
 
+const (
+	GenresModeAll = "all"
+	GenresModeAny = "any"
+)
+
+var ErrDuplicateTitle = errors.New("duplicate title")
+
+var (
+	ErrTooManyGenres = errors.New("too many genres")
+	ErrLastGenre     = errors.New("last genre")
+)
+
+// MovieLimits bounds the genres a movie may have.
+type MovieLimits struct {
+	MaxGenres      int
+	MaxGenreLength int
+}
+
+var DefaultMovieLimits = MovieLimits{MaxGenres: 5, MaxGenreLength: 50}
+
+var MovieRatings = []string{"G", "PG", "PG-13", "R", "NC-17"}
+
+// MovieFields lists the JSON field names a client may select with the fields
+// query parameter.
+var MovieFields = []string{"id", "title", "year", "runtime", "genres", "director", "rating", "version", "deleted_at"}
+
 type Movie struct {
-	Id        int64     `json:"id"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year"`
-	Runtime   int32     `json:"runtime"`
-	Genres    []string  `json:"genres"`
-	Version   int32     `json:"version"`
-	CreatedAt time.Time `json:"-"`
+	Id        int64      `json:"id"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year"`
+	Runtime   Runtime    `json:"runtime"`
+	Genres    []string   `json:"genres"`
+	Director  string     `json:"director"`
+	Rating    string     `json:"rating"`
+	Version   int32      `json:"version"`
+	CreatedAt time.Time  `json:"-"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func ValidateMovie(v *validator.Validator, movie *Movie) {
+func ValidateMovie(v *validator.Validator, movie *Movie, limits MovieLimits) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
 
@@ -34,48 +64,353 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 	v.Check(movie.Genres != nil, "genres", "must be provided")
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	v.Check(len(movie.Genres) <= limits.MaxGenres, "genres", fmt.Sprintf("must not contain more than %d genres", limits.MaxGenres))
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+	for i, genre := range movie.Genres {
+		validateGenre(v, validator.Index("genres", i), genre, limits)
+	}
+
+	v.Check(movie.Director != "", "director", "must be provided")
+	v.Check(len(movie.Director) <= 100, "director", "must not be more than 100 bytes long")
+
+	v.Check(movie.Rating != "", "rating", "must be provided")
+	v.Check(validator.PermittedValue(movie.Rating, MovieRatings...), "rating", "must be one of G, PG, PG-13, R or NC-17")
+}
+
+// MoviePatch is a JSON Merge Patch for a movie.
+type MoviePatch struct {
+	Title    Patch[string]   `json:"title" xml:"title"`
+	Year     Patch[int32]    `json:"year" xml:"year"`
+	Runtime  Patch[Runtime]  `json:"runtime" xml:"runtime"`
+	Genres   Patch[[]string] `json:"genres" xml:"genres>genre"`
+	Director Patch[string]   `json:"director" xml:"director"`
+	Rating   Patch[string]   `json:"rating" xml:"rating"`
+}
+
+// ValidateMoviePatch rejects explicit nulls. Every movie field is backed by a
+// NOT NULL column and required by ValidateMovie, so none of them is nullable.
+// A field that becomes optional should drop its check here, and the null it
+// receives clears the column.
+func ValidateMoviePatch(v *validator.Validator, patch MoviePatch) {
+	v.Check(!patch.Title.Null, "title", "must not be null")
+	v.Check(!patch.Year.Null, "year", "must not be null")
+	v.Check(!patch.Runtime.Null, "runtime", "must not be null")
+	v.Check(!patch.Genres.Null, "genres", "must not be null")
+	v.Check(!patch.Director.Null, "director", "must not be null")
+	v.Check(!patch.Rating.Null, "rating", "must not be null")
+}
+
+func (patch *MoviePatch) UnmarshalJSON(jsonValue []byte) error {
+	return decodeMergePatch(jsonValue, map[string]patchMember{
+		"title":    &patch.Title,
+		"year":     &patch.Year,
+		"runtime":  &patch.Runtime,
+		"genres":   &patch.Genres,
+		"director": &patch.Director,
+		"rating":   &patch.Rating,
+	})
+}
+
+func (patch MoviePatch) Apply(movie *Movie) {
+	patch.Title.Apply(&movie.Title)
+	patch.Year.Apply(&movie.Year)
+	patch.Runtime.Apply(&movie.Runtime)
+	patch.Genres.Apply(&movie.Genres)
+	patch.Director.Apply(&movie.Director)
+	patch.Rating.Apply(&movie.Rating)
 }
 
 type IMovieModel interface {
-	Insert(movie *Movie) error
-	Get(id int64) (*Movie, error)
-	Update(movie *Movie) error
-	Delete(id int64) error
-	GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) (int32, error)
+	Purge(ctx context.Context, id int64) (int32, error)
+	Restore(ctx context.Context, id int64) (*Movie, error)
+	AddGenre(ctx context.Context, id int64, genre string, maxGenres int) (*Movie, bool, error)
+	RemoveGenre(ctx context.Context, id int64, genre string) (*Movie, bool, error)
+	GetAll(ctx context.Context, title string, genres []string, genresMode string, filters Filters) ([]*Movie, Metadata, error)
+	GetAllSummary(ctx context.Context, title string, genres []string, genresMode string, filters Filters) (*MovieListSummary, error)
+	Export(ctx context.Context, fn func(movie *Movie) error) error
+	InsertBatch(ctx context.Context, movies []*Movie) error
+	Import(ctx context.Context, movies []*Movie, upsert bool) ([]ImportResult, error)
+	Stats(ctx context.Context) (*MovieStats, error)
+	GetSimilar(ctx context.Context, movie *Movie, filters Filters) ([]*Movie, Metadata, error)
+	History(ctx context.Context, id int64) ([]*MovieVersion, error)
 }
 
+type MovieStats struct {
+	TotalMovies    int64            `json:"total_movies"`
+	AverageRuntime float64          `json:"average_runtime"`
+	MinYear        int32            `json:"min_year"`
+	MaxYear        int32            `json:"max_year"`
+	Genres         map[string]int64 `json:"genres"`
+}
+
+// MovieDependents counts the records that refer to a movie.
+type MovieDependents struct {
+	Reviews   int64 `json:"reviews"`
+	Watchlist int64 `json:"watchlist"`
+}
+
+// Total is the number of dependent records of every kind.
+func (d MovieDependents) Total() int64 {
+	return d.Reviews + d.Watchlist
+}
+
+// MovieDependentsError is returned by Delete for a movie that still has
+// dependent records, with their counts.
+type MovieDependentsError struct {
+	Dependents MovieDependents
+}
+
+func (e *MovieDependentsError) Error() string {
+	return fmt.Sprintf("movie has %d dependent records", e.Dependents.Total())
+}
+
+// MovieModel writes to DB. Listings, stats and exports, which can tolerate
+// replication lag, read from ReadDB instead. Get stays on DB because its
+// result feeds version-checked updates. With UniqueTitles set, a write is
+// refused with ErrDuplicateTitle when another live movie has the same title,
+// ignoring case. The unique index behind it is partial: it only covers movies
+// with unique_title set, which leaves out those written before migration
+// 000018 or while UniqueTitles was off, so duplicates among them can't stop
+// the migration or a restart with the setting turned on. The model checks for
+// a live duplicate itself before each write to cover the movies the index
+// doesn't. Bulk writes, which touch many rows at once, are bounded by
+// BulkTimeout instead of Timeout.
 type MovieModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	ReadDB       *sql.DB
+	Timeout      time.Duration
+	BulkTimeout  time.Duration
+	HistoryDepth int
+	UniqueTitles bool
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, director, rating, unique_title)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING id, created_at, version`
 
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Director, movie.Rating, m.UniqueTitles}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+	err := audited(ctx, m.DB, func(q querier) error {
+		err := m.checkTitle(ctx, q, movie.Title, 0)
+		if err != nil {
+			return err
+		}
+
+		err = q.QueryRowContext(ctx, query, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return err
+		}
+		setAuditTarget(ctx, movie.Id)
+		return nil
+	})
+	if isDuplicateTitle(err) {
+		return ErrDuplicateTitle
+	}
+	return err
+}
+
+// isDuplicateTitle reports whether err is a violation of the case-insensitive
+// unique index on the titles of live movies. The index only covers movies
+// written with UniqueTitles set, and catches two such writes racing past
+// checkTitle with the same title.
+func isDuplicateTitle(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "movies_title_lower_key"
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+// checkTitle returns ErrDuplicateTitle when titles are unique and a live movie
+// other than the one with the given id has the title, ignoring case. Movies
+// written before titles were made unique are checked too, which the index
+// can't do.
+func (m MovieModel) checkTitle(ctx context.Context, q querier, title string, id int64) error {
+	if !m.UniqueTitles {
+		return nil
+	}
+
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM movies
+			WHERE lower(title) = lower($1) AND deleted_at IS NULL AND id <> $2
+		)`
+
+	var taken bool
+	err := q.QueryRowContext(ctx, query, title, id).Scan(&taken)
+	if err != nil {
+		return err
+	}
+
+	if taken {
+		return ErrDuplicateTitle
+	}
+	return nil
+}
+
+func (m MovieModel) InsertBatch(ctx context.Context, movies []*Movie) error {
+	query := `
+		INSERT INTO movies (title, year, runtime, genres, director, rating, unique_title)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.BulkTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, movie := range movies {
+		err = m.checkTitle(ctx, tx, movie.Title, 0)
+		if err != nil {
+			return err
+		}
+
+		args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Director, movie.Rating, m.UniqueTitles}
+
+		err = stmt.QueryRowContext(ctx, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			if isDuplicateTitle(err) {
+				return ErrDuplicateTitle
+			}
+			return err
+		}
+	}
+
+	err = recordAudit(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ImportResult says what Import did with one movie.
+type ImportResult int
+
+const (
+	ImportCreated ImportResult = iota
+	ImportUpdated
+	ImportDuplicate
+)
+
+// Import inserts the movies in a single transaction. With upsert set, a movie
+// whose title matches a live movie's updates that movie instead, keeping a
+// snapshot of it like Update does. Otherwise, if titles are unique, a movie
+// whose title is taken is left alone and reported as a duplicate.
+func (m MovieModel) Import(ctx context.Context, movies []*Movie, upsert bool) ([]ImportResult, error) {
+	find := `
+		SELECT id FROM movies
+		WHERE lower(title) = lower($1) AND deleted_at IS NULL
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE`
+
+	insert := `
+		INSERT INTO movies (title, year, runtime, genres, director, rating, unique_title)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, version`
+
+	update := `
+		UPDATE movies
+		SET title = $1, year = $2, runtime = $3, genres = $4, director = $5, rating = $6, unique_title = $7,
+			version = version + 1
+		WHERE id = $8
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.BulkTimeout)
+	defer cancel()
+
+	results := make([]ImportResult, len(movies))
+
+	err := transact(ctx, m.DB, func(q querier) error {
+		for i, movie := range movies {
+			args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Director, movie.Rating, m.UniqueTitles}
+
+			var existing int64
+			if upsert || m.UniqueTitles {
+				err := q.QueryRowContext(ctx, find, movie.Title).Scan(&existing)
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					return err
+				}
+			}
+
+			switch {
+			case existing == 0:
+				err := q.QueryRowContext(ctx, insert, args...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+				if err != nil {
+					return err
+				}
+				results[i] = ImportCreated
+
+			case upsert:
+				if m.HistoryDepth > 0 {
+					snapshot := `
+						INSERT INTO movie_versions (movie_id, version, title, year, runtime, genres, director, rating)
+						SELECT id, version, title, year, runtime, genres, director, rating
+						FROM movies
+						WHERE id = $1
+						ON CONFLICT DO NOTHING`
+
+					_, err := q.ExecContext(ctx, snapshot, existing)
+					if err != nil {
+						return err
+					}
+				}
+
+				err := q.QueryRowContext(ctx, update, append(args, existing)...).Scan(&movie.Id, &movie.CreatedAt, &movie.Version)
+				if err != nil {
+					return err
+				}
+				results[i] = ImportUpdated
+
+				err = m.pruneHistory(ctx, q, movie.Id)
+				if err != nil {
+					return err
+				}
+
+			default:
+				results[i] = ImportDuplicate
+			}
+		}
+		return nil
+	})
+	if isDuplicateTitle(err) {
+		return nil, ErrDuplicateTitle
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
-		FROM movies WHERE id = $1`
+		SELECT id, created_at, title, year, runtime, genres, director, rating, version
+		FROM movies WHERE id = $1 AND deleted_at IS NULL`
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(&movie.Id,
@@ -84,6 +419,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.Director,
+		&movie.Rating,
 		&movie.Version)
 
 	if err != nil {
@@ -97,11 +434,12 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime = $3, genres = $4, director = $5, rating = $6, unique_title = $7,
+			version = version + 1
+		WHERE id = $8 AND version = $9 AND deleted_at IS NULL
 		RETURNING version`
 
 	args := []any{
@@ -109,18 +447,29 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.Director,
+		movie.Rating,
+		m.UniqueTitles,
 		movie.Id,
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	err := m.withHistory(ctx, movie.Id, movie.Version, func(q querier) error {
+		err := m.checkTitle(ctx, q, movie.Title, movie.Id)
+		if err != nil {
+			return err
+		}
+		return q.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
+		case errors.Is(err, ErrDuplicateTitle), isDuplicateTitle(err):
+			return ErrDuplicateTitle
 		default:
 			return err
 		}
@@ -128,49 +477,537 @@ func (m MovieModel) Update(movie *Movie) error {
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+// Delete soft-deletes the movie and returns its new version. A movie that
+// has reviews or is on a watchlist is left alone and a *MovieDependentsError
+// is returned instead; Purge removes it along with them. The movie's row is
+// locked before its dependents are counted, so none can be added between the
+// count and the delete.
+func (m MovieModel) Delete(ctx context.Context, id int64) (int32, error) {
+	if id < 1 {
+		return 0, ErrRecordNotFound
+	}
+
+	// The count runs as a statement of its own, after the lock is taken, so
+	// that it sees dependents committed while it waited for the lock.
+	lock := `
+		SELECT id FROM movies
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	count := `
+		SELECT
+			(SELECT count(*) FROM reviews WHERE movie_id = $1),
+			(SELECT count(*) FROM watchlist WHERE movie_id = $1)`
+
+	query := `
+		UPDATE movies
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var version int32
+
+	err := transact(ctx, m.DB, func(q querier) error {
+		err := q.QueryRowContext(ctx, lock, id).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		var dependents MovieDependents
+		err = q.QueryRowContext(ctx, count, id).Scan(&dependents.Reviews, &dependents.Watchlist)
+		if err != nil {
+			return err
+		}
+		if dependents.Total() > 0 {
+			return &MovieDependentsError{Dependents: dependents}
+		}
+
+		return q.QueryRowContext(ctx, query, id).Scan(&version)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// Purge deletes the movie row, live or soft-deleted, and with it the reviews,
+// watchlist entries and versions that refer to it. Unlike Delete it can't be
+// undone. It returns the version the movie would have had next, so that the
+// change can be reported like any other.
+func (m MovieModel) Purge(ctx context.Context, id int64) (int32, error) {
 	if id < 1 {
-		return ErrRecordNotFound
+		return 0, ErrRecordNotFound
 	}
 
 	query := `
 		DELETE FROM movies
-		WHERE id = $1`
+		WHERE id = $1
+		RETURNING version + 1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, id)
+	var version int32
+
+	err := audited(ctx, m.DB, func(q querier) error {
+		return q.QueryRowContext(ctx, query, id).Scan(&version)
+	})
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+func genresOperator(genresMode string) string {
+	if genresMode == GenresModeAny {
+		return "&&"
 	}
+	return "@>"
+}
+
+func (m MovieModel) Restore(ctx context.Context, id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE movies
+		SET deleted_at = NULL, unique_title = $2, version = version + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		RETURNING id, created_at, title, year, runtime, genres, director, rating, version`
+
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := audited(ctx, m.DB, func(q querier) error {
+		if m.UniqueTitles {
+			var title string
+			err := q.QueryRowContext(ctx, `SELECT title FROM movies WHERE id = $1`, id).Scan(&title)
+			if err != nil {
+				return err
+			}
+
+			err = m.checkTitle(ctx, q, title, id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return q.QueryRowContext(ctx, query, id, m.UniqueTitles).Scan(&movie.Id,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
+			&movie.Version)
+	})
 
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		case isDuplicateTitle(err):
+			return nil, ErrDuplicateTitle
+		default:
+			return nil, err
+		}
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return &movie, nil
+}
+
+// NormalizeGenres trims each genre and drops any that repeat an earlier one,
+// ignoring case. The first spelling of a genre is the one kept. A nil slice
+// stays nil so that validation can still tell the genres were left out.
+func NormalizeGenres(genres []string) []string {
+	if genres == nil {
+		return nil
 	}
-	return nil
+
+	seen := make(map[string]bool, len(genres))
+	normalized := make([]string, 0, len(genres))
+
+	for _, genre := range genres {
+		genre = strings.TrimSpace(genre)
+
+		key := strings.ToLower(genre)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		normalized = append(normalized, genre)
+	}
+	return normalized
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+func ValidateGenre(v *validator.Validator, genre string, limits MovieLimits) {
+	validateGenre(v, "genre", genre, limits)
+}
+
+func validateGenre(v *validator.Validator, key, genre string, limits MovieLimits) {
+	v.Check(genre != "", key, "must be provided")
+	v.Check(len(genre) <= limits.MaxGenreLength, key, fmt.Sprintf("must not be more than %d bytes long", limits.MaxGenreLength))
+}
+
+// AddGenre appends the genre to the movie in a single statement, bumps its
+// version and reports whether the movie changed. A genre the movie already
+// has, in any case, is left alone, and ErrTooManyGenres is returned if the
+// movie already has maxGenres.
+func (m MovieModel) AddGenre(ctx context.Context, id int64, genre string, maxGenres int) (*Movie, bool, error) {
+	query := `
+		UPDATE movies
+		SET genres = array_append(genres, $2), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL AND cardinality(genres) < $3
+			AND NOT EXISTS (SELECT 1 FROM unnest(genres) AS genre WHERE lower(genre) = lower($2))
+		RETURNING id, created_at, title, year, runtime, genres, director, rating, version`
+
+	movie, err := m.updateGenres(ctx, id, query, genre, maxGenres)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return movie, err == nil, err
+	}
+
+	// Nothing was updated, so work out why.
+	movie, err = m.Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if hasGenre(movie.Genres, genre) {
+		return movie, false, nil
+	}
+	return nil, false, ErrTooManyGenres
+}
+
+// RemoveGenre removes the genre, in any case, from the movie in a single
+// statement, bumps its version and reports whether the movie changed.
+// Removing a genre the movie doesn't have is a no-op, but a movie's only genre
+// can't be removed.
+func (m MovieModel) RemoveGenre(ctx context.Context, id int64, genre string) (*Movie, bool, error) {
+	query := `
+		UPDATE movies
+		SET genres = ARRAY(
+				SELECT genre FROM unnest(genres) WITH ORDINALITY AS g(genre, n)
+				WHERE lower(genre) <> lower($2)
+				ORDER BY n
+			),
+			version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL
+			AND EXISTS (SELECT 1 FROM unnest(genres) AS genre WHERE lower(genre) = lower($2))
+			AND EXISTS (SELECT 1 FROM unnest(genres) AS genre WHERE lower(genre) <> lower($2))
+		RETURNING id, created_at, title, year, runtime, genres, director, rating, version`
+
+	movie, err := m.updateGenres(ctx, id, query, genre)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return movie, err == nil, err
+	}
+
+	movie, err = m.Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if !hasGenre(movie.Genres, genre) {
+		return movie, false, nil
+	}
+	return nil, false, ErrLastGenre
+}
+
+func hasGenre(genres []string, genre string) bool {
+	for _, g := range genres {
+		if strings.EqualFold(g, genre) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateGenres runs one of the genre update queries, which take the movie's id
+// as $1 followed by args. sql.ErrNoRows is returned as is, so callers can tell
+// why nothing was updated.
+func (m MovieModel) updateGenres(ctx context.Context, id int64, query string, args ...any) (*Movie, error) {
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.withHistory(ctx, id, 0, func(q querier) error {
+		return q.QueryRowContext(ctx, query, append([]any{id}, args...)...).Scan(
+			&movie.Id,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
+			&movie.Version,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &movie, nil
+}
+
+// movieListQuery selects columns, followed by the relevance of each movie to
+// the title query, from the movies GetAll lists for the given arguments, in
+// the order it lists them.
+func movieListQuery(columns, genresMode string, filters Filters) string {
+	return fmt.Sprintf(`
+		SELECT %s,
+			ts_rank(to_tsvector('simple', title), plainto_tsquery('simple', $1)) AS relevance
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
+		AND (genres %s $2 OR $2 = '{}')
+		AND ($5 = 0 OR id %s $5)
+		AND (year >= $6 OR $6 = 0)
+		AND (year <= $7 OR $7 = 0)
+		AND (runtime >= $8 OR $8 = 0)
+		AND (runtime <= $9 OR $9 = 0)
+		AND (deleted_at IS NULL OR $10)
+		AND (created_at > $11 OR $11 IS NULL)
+		AND (created_at < $12 OR $12 IS NULL)
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $3 OFFSET $4`, columns, genresOperator(genresMode), filters.cursorOperator(), filters.sortColumn(), filters.sortDirection())
+}
+
+// movieListArgs are the arguments of a movieListQuery.
+func movieListArgs(title string, genres []string, filters Filters) []any {
+	return []any{
+		title,
+		pq.Array(genres),
+		filters.limit(),
+		filters.offset(),
+		filters.cursorID(),
+		filters.YearFrom,
+		filters.YearTo,
+		filters.RuntimeMin,
+		filters.RuntimeMax,
+		filters.IncludeDeleted,
+		filters.createdAfter(),
+		filters.createdBefore(),
+	}
+}
+
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters Filters) ([]*Movie, Metadata, error) {
+	query := movieListQuery("count(*) OVER(), id, created_at, title, year, runtime, genres, director, rating, version, deleted_at", genresMode, filters)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := movieListArgs(title, genres, filters)
+
+	rows, err := m.ReadDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		var relevance float64
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.Id,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
+			&movie.Version,
+			&movie.DeletedAt,
+			&relevance,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	if filters.CursorMode {
+		movies, metadata := calculateCursorMetadata(movies, filters, func(m *Movie) int64 { return m.Id })
+		return movies, metadata, nil
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return movies, metadata, nil
+}
+
+// MovieListSummary identifies the content of a page of movies without
+// fetching it.
+type MovieListSummary struct {
+	// Fingerprint changes whenever the page does: it is made of the total
+	// number of matching movies and the id and version of each movie in the
+	// page. The order of the page follows from those and the query, so it
+	// isn't included.
+	Fingerprint string
+	// LastModified is when any movie, listed or not, was last written. It is
+	// taken across the whole table because a deleted movie leaves no trace in
+	// the page it used to be on.
+	LastModified time.Time
+}
+
+// GetAllSummary summarizes the page GetAll would return for the same
+// arguments with a single aggregate query.
+func (m MovieModel) GetAllSummary(ctx context.Context, title string, genres []string, genresMode string, filters Filters) (*MovieListSummary, error) {
+	query := fmt.Sprintf(`
+		SELECT coalesce(max(page.total), 0) || ';' || coalesce(string_agg(page.id || '.' || page.version, ',' ORDER BY page.id), ''),
+			(SELECT coalesce(max(updated_at), 'epoch') FROM movies)
+		FROM (%s) page`, movieListQuery("count(*) OVER() AS total, id, version", genresMode, filters))
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var summary MovieListSummary
+
+	err := m.ReadDB.QueryRowContext(ctx, query, movieListArgs(title, genres, filters)...).Scan(&summary.Fingerprint, &summary.LastModified)
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// Export calls fn for every live movie in id order, reading them through a
+// single cursor. An export runs for as long as the client keeps reading, so
+// it is bounded by ctx rather than by the model's timeouts.
+func (m MovieModel) Export(ctx context.Context, fn func(movie *Movie) error) error {
+	query := `
+		SELECT id, created_at, title, year, runtime, genres, director, rating, version
+		FROM movies
+		WHERE deleted_at IS NULL
+		ORDER BY id ASC`
+
+	rows, err := m.ReadDB.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.Id,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
+			&movie.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Stats aggregates the catalogue of live movies in a single round trip. The
+// genre histogram is returned as two parallel arrays ordered by count.
+func (m MovieModel) Stats(ctx context.Context) (*MovieStats, error) {
+	query := `
+		WITH live AS (
+			SELECT runtime, year, genres FROM movies WHERE deleted_at IS NULL
+		), totals AS (
+			SELECT count(*) AS total, COALESCE(avg(runtime), 0) AS average_runtime,
+				COALESCE(min(year), 0) AS min_year, COALESCE(max(year), 0) AS max_year
+			FROM live
+		), histogram AS (
+			SELECT genre, count(*) AS n
+			FROM live, unnest(genres) AS genre
+			GROUP BY genre
+		)
+		SELECT totals.total, totals.average_runtime, totals.min_year, totals.max_year,
+			COALESCE(array_agg(histogram.genre ORDER BY histogram.n DESC, histogram.genre) FILTER (WHERE histogram.genre IS NOT NULL), '{}'),
+			COALESCE(array_agg(histogram.n ORDER BY histogram.n DESC, histogram.genre) FILTER (WHERE histogram.genre IS NOT NULL), '{}')
+		FROM totals
+		LEFT JOIN histogram ON true
+		GROUP BY totals.total, totals.average_runtime, totals.min_year, totals.max_year`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var stats MovieStats
+	var genres []string
+	var counts []int64
+
+	err := m.ReadDB.QueryRowContext(ctx, query).Scan(
+		&stats.TotalMovies,
+		&stats.AverageRuntime,
+		&stats.MinYear,
+		&stats.MaxYear,
+		pq.Array(&genres),
+		pq.Array(&counts),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Genres = make(map[string]int64, len(genres))
+	for i := range genres {
+		stats.Genres[genres[i]] = counts[i]
+	}
+
+	return &stats, nil
+}
+
+// GetSimilar returns the live movies sharing at least one genre with movie,
+// ranked by the number of genres they have in common and then by year, newest
+// first. The source movie itself is never included.
+func (m MovieModel) GetSimilar(ctx context.Context, movie *Movie, filters Filters) ([]*Movie, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, director, rating, version,
+			cardinality(ARRAY(SELECT unnest(genres) INTERSECT SELECT unnest($2::text[]))) AS overlap
+		FROM movies
+		WHERE id <> $1
+		AND genres && $2
+		AND deleted_at IS NULL
+		ORDER BY overlap DESC, year DESC, id ASC
+		LIMIT $3 OFFSET $4`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{movie.Id, pq.Array(movie.Genres), filters.limit(), filters.offset()}
 
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.ReadDB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -182,6 +1019,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	for rows.Next() {
 		var movie Movie
+		var overlap int
 
 		err := rows.Scan(
 			&totalRecords,
@@ -191,7 +1029,10 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
 			&movie.Version,
+			&overlap,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -203,7 +1044,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{}, err
 	}
 
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	metadata := calculateMetadata(totalRecords, filters)
 
 	return movies, metadata, nil
 }
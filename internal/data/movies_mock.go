@@ -1,23 +1,69 @@
 package data
 
+import "context"
+
 type MockMovieModel struct{}
 
-func (m MockMovieModel) Insert(movie *Movie) error {
+func (m MockMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	return nil
+}
+
+func (m MockMovieModel) InsertBatch(ctx context.Context, movies []*Movie) error {
 	return nil
 }
 
-func (m MockMovieModel) Get(id int64) (*Movie, error) {
+func (m MockMovieModel) Import(ctx context.Context, movies []*Movie, upsert bool) ([]ImportResult, error) {
+	return make([]ImportResult, len(movies)), nil
+}
+
+func (m MockMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	return nil, nil
 }
 
-func (m MockMovieModel) Update(movie *Movie) error {
+func (m MockMovieModel) Update(ctx context.Context, movie *Movie) error {
 	return nil
 }
 
-func (m MockMovieModel) Delete(id int64) error {
+func (m MockMovieModel) Delete(ctx context.Context, id int64) (int32, error) {
+	return 0, nil
+}
+
+func (m MockMovieModel) Purge(ctx context.Context, id int64) (int32, error) {
+	return 0, nil
+}
+
+func (m MockMovieModel) Restore(ctx context.Context, id int64) (*Movie, error) {
+	return nil, nil
+}
+
+func (m MockMovieModel) AddGenre(ctx context.Context, id int64, genre string, maxGenres int) (*Movie, bool, error) {
+	return nil, false, nil
+}
+
+func (m MockMovieModel) RemoveGenre(ctx context.Context, id int64, genre string) (*Movie, bool, error) {
+	return nil, false, nil
+}
+
+func (m MockMovieModel) GetAll(ctx context.Context, title string, genres []string, genresMode string, filters Filters) ([]*Movie, Metadata, error) {
+	return nil, Metadata{}, nil
+}
+
+func (m MockMovieModel) GetAllSummary(ctx context.Context, title string, genres []string, genresMode string, filters Filters) (*MovieListSummary, error) {
+	return &MovieListSummary{}, nil
+}
+
+func (m MockMovieModel) Export(ctx context.Context, fn func(movie *Movie) error) error {
 	return nil
 }
 
-func (m MockMovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MockMovieModel) Stats(ctx context.Context) (*MovieStats, error) {
+	return &MovieStats{Genres: map[string]int64{}}, nil
+}
+
+func (m MockMovieModel) GetSimilar(ctx context.Context, movie *Movie, filters Filters) ([]*Movie, Metadata, error) {
 	return nil, Metadata{}, nil
 }
+
+func (m MockMovieModel) History(ctx context.Context, id int64) ([]*MovieVersion, error) {
+	return nil, nil
+}
@@ -0,0 +1,1693 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// validMovie returns a movie that passes ValidateMovie with the default
+// limits, with the given genres.
+func validMovie(genres ...string) *Movie {
+	return &Movie{
+		Title:    "Moana",
+		Year:     2016,
+		Runtime:  107,
+		Genres:   genres,
+		Director: "Ron Clements",
+		Rating:   "PG",
+	}
+}
+
+// genreList returns n distinct genres.
+func genreList(n int) []string {
+	genres := make([]string, n)
+	for i := range genres {
+		genres[i] = fmt.Sprintf("genre %d", i)
+	}
+	return genres
+}
+
+func TestValidateMovieGenreLimits(t *testing.T) {
+	limits := MovieLimits{MaxGenres: 3, MaxGenreLength: 10}
+
+	tests := []struct {
+		name   string
+		genres []string
+		errors map[string]string
+	}{
+		{
+			name:   "one genre",
+			genres: genreList(1),
+		},
+		{
+			name:   "no genres",
+			genres: []string{},
+			errors: map[string]string{"genres": "must contain at least 1 genre"},
+		},
+		{
+			name:   "at max genres",
+			genres: genreList(3),
+		},
+		{
+			name:   "one over max genres",
+			genres: genreList(4),
+			errors: map[string]string{"genres": "must not contain more than 3 genres"},
+		},
+		{
+			name:   "genre at max length",
+			genres: []string{"comedy", strings.Repeat("a", 10)},
+		},
+		{
+			name:   "genre one byte over max length",
+			genres: []string{"comedy", strings.Repeat("a", 11)},
+			errors: map[string]string{"genres[1]": "must not be more than 10 bytes long"},
+		},
+		{
+			name:   "empty genre",
+			genres: []string{"comedy", "drama", ""},
+			errors: map[string]string{"genres[2]": "must be provided"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateMovie(v, validMovie(tt.genres...), limits)
+
+			if len(v.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v; want %v", v.Errors, tt.errors)
+			}
+			for key, message := range tt.errors {
+				if v.Errors[key] != message {
+					t.Errorf("errors[%q] = %q; want %q", key, v.Errors[key], message)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeGenres(t *testing.T) {
+	tests := []struct {
+		name   string
+		genres []string
+		want   []string
+	}{
+		{"nil", nil, nil},
+		{"empty", []string{}, []string{}},
+		{"already normal", []string{"animation", "Drama"}, []string{"animation", "Drama"}},
+		{"whitespace", []string{" drama", "comedy\t", "\nwestern \n"}, []string{"drama", "comedy", "western"}},
+		{"inner whitespace kept", []string{"science  fiction"}, []string{"science  fiction"}},
+		{"exact duplicates", []string{"drama", "comedy", "drama"}, []string{"drama", "comedy"}},
+		{"case duplicates", []string{"Action", "action", "ACTION"}, []string{"Action"}},
+		{"whitespace and case", []string{"Action", "action", " Drama "}, []string{"Action", "Drama"}},
+		{"blank genres", []string{"drama", " ", ""}, []string{"drama", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeGenres(tt.genres)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNormalizedGenres(t *testing.T) {
+	limits := MovieLimits{MaxGenres: 2, MaxGenreLength: 10}
+
+	tests := []struct {
+		name   string
+		genres []string
+		errors map[string]string
+	}{
+		// Duplicates are collapsed before uniqueness and the genre limit
+		// are checked.
+		{name: "case duplicates", genres: []string{"Action", "action", " ACTION "}},
+		{name: "within the limit once collapsed", genres: []string{"drama", "Drama", "comedy", "COMEDY "}},
+		{name: "over the limit once collapsed", genres: []string{"drama", "comedy", "western"}, errors: map[string]string{"genres": "must not contain more than 2 genres"}},
+		{name: "blank genre", genres: []string{"drama", "  "}, errors: map[string]string{"genres[1]": "must be provided"}},
+		{name: "padding not counted in the length", genres: []string{"   animation   "}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := validator.New()
+			ValidateMovie(v, validMovie(NormalizeGenres(tt.genres)...), limits)
+
+			if len(v.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v; want %v", v.Errors, tt.errors)
+			}
+			for key, message := range tt.errors {
+				if v.Errors[key] != message {
+					t.Errorf("errors[%q] = %q; want %q", key, v.Errors[key], message)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMovieDirectorAndRating(t *testing.T) {
+	tests := []struct {
+		name     string
+		director string
+		rating   string
+		errors   map[string]string
+	}{
+		{name: "G", director: "Ron Clements", rating: "G"},
+		{name: "PG", director: "Ron Clements", rating: "PG"},
+		{name: "PG-13", director: "Ron Clements", rating: "PG-13"},
+		{name: "R", director: "Ron Clements", rating: "R"},
+		{name: "NC-17", director: "Ron Clements", rating: "NC-17"},
+		{name: "unknown rating", director: "Ron Clements", rating: "X", errors: map[string]string{"rating": "must be one of G, PG, PG-13, R or NC-17"}},
+		{name: "lower case rating", director: "Ron Clements", rating: "pg-13", errors: map[string]string{"rating": "must be one of G, PG, PG-13, R or NC-17"}},
+		{name: "no rating", director: "Ron Clements", rating: "", errors: map[string]string{"rating": "must be provided"}},
+		{name: "no director", director: "", rating: "PG", errors: map[string]string{"director": "must be provided"}},
+		{name: "director at max length", director: strings.Repeat("a", 100), rating: "PG"},
+		{name: "director one byte over max length", director: strings.Repeat("a", 101), rating: "PG", errors: map[string]string{"director": "must not be more than 100 bytes long"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := validMovie("animation")
+			movie.Director = tt.director
+			movie.Rating = tt.rating
+
+			v := validator.New()
+			ValidateMovie(v, movie, DefaultMovieLimits)
+
+			if len(v.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v; want %v", v.Errors, tt.errors)
+			}
+			for key, message := range tt.errors {
+				if v.Errors[key] != message {
+					t.Errorf("errors[%q] = %q; want %q", key, v.Errors[key], message)
+				}
+			}
+		})
+	}
+}
+
+// newMovieModel returns a movie model on a fresh database, refusing
+// duplicate titles if uniqueTitles is set.
+func newMovieModel(t *testing.T, uniqueTitles bool) MovieModel {
+	t.Helper()
+
+	db := datatest.NewDB(t)
+	return MovieModel{DB: db, ReadDB: db, Timeout: 5 * time.Second, BulkTimeout: 30 * time.Second, UniqueTitles: uniqueTitles}
+}
+
+func TestMovieModelDirectorAndRating(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	movie.Director = "John Musker"
+	movie.Rating = "PG-13"
+	err = movies.Update(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := movies.Get(ctx, movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Director != "John Musker" || got.Rating != "PG-13" {
+		t.Errorf("Get returned director %q and rating %q; want %q and %q", got.Director, got.Rating, "John Musker", "PG-13")
+	}
+
+	listed, _, err := movies.GetAll(ctx, "", []string{}, "", Filters{Page: 1, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Director != "John Musker" || listed[0].Rating != "PG-13" {
+		t.Errorf("GetAll returned %+v; want the updated director and rating", listed)
+	}
+}
+
+func TestMovieModelGenresBeyondDefaultLimit(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	maxGenres := DefaultMovieLimits.MaxGenres + 3
+
+	movie := validMovie(genreList(maxGenres - 1)...)
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatalf("inserting a movie with %d genres: %v", len(movie.Genres), err)
+	}
+
+	_, changed, err := movies.AddGenre(ctx, movie.Id, "last", maxGenres)
+	if err != nil || !changed {
+		t.Fatalf("adding genre %d: changed %t, err %v", maxGenres, changed, err)
+	}
+
+	_, _, err = movies.AddGenre(ctx, movie.Id, "one too many", maxGenres)
+	if !errors.Is(err, ErrTooManyGenres) {
+		t.Fatalf("adding genre %d: got err %v; want %v", maxGenres+1, err, ErrTooManyGenres)
+	}
+}
+
+func TestMovieModelGenreChanges(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name   string
+		change func() (*Movie, bool, error)
+		err    error
+		// changed, genres and version describe the movie after the step.
+		changed bool
+		genres  []string
+		version int32
+	}{
+		{"append", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id, "musical", 3) }, nil, true, []string{"animation", "musical"}, 2},
+		{"append again", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id, "musical", 3) }, nil, false, []string{"animation", "musical"}, 2},
+		{"append in another case", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id, "MUSICAL", 3) }, nil, false, []string{"animation", "musical"}, 2},
+		{"append up to the limit", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id, "family", 3) }, nil, true, []string{"animation", "musical", "family"}, 3},
+		{"append beyond the limit", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id, "comedy", 3) }, ErrTooManyGenres, false, []string{"animation", "musical", "family"}, 3},
+		{"remove from the middle", func() (*Movie, bool, error) { return movies.RemoveGenre(ctx, movie.Id, "Musical") }, nil, true, []string{"animation", "family"}, 4},
+		{"remove a missing genre", func() (*Movie, bool, error) { return movies.RemoveGenre(ctx, movie.Id, "western") }, nil, false, []string{"animation", "family"}, 4},
+		{"remove", func() (*Movie, bool, error) { return movies.RemoveGenre(ctx, movie.Id, "family") }, nil, true, []string{"animation"}, 5},
+		{"remove the last genre", func() (*Movie, bool, error) { return movies.RemoveGenre(ctx, movie.Id, "animation") }, ErrLastGenre, false, []string{"animation"}, 5},
+		{"append to a missing movie", func() (*Movie, bool, error) { return movies.AddGenre(ctx, movie.Id+1, "drama", 3) }, ErrRecordNotFound, false, []string{"animation"}, 5},
+		{"remove from a missing movie", func() (*Movie, bool, error) { return movies.RemoveGenre(ctx, movie.Id+1, "drama") }, ErrRecordNotFound, false, []string{"animation"}, 5},
+	}
+
+	for _, step := range steps {
+		got, changed, err := step.change()
+		if !errors.Is(err, step.err) {
+			t.Fatalf("%s: got err %v; want %v", step.name, err, step.err)
+		}
+		if changed != step.changed {
+			t.Errorf("%s: reported changed %t; want %t", step.name, changed, step.changed)
+		}
+		if err == nil && (!reflect.DeepEqual(got.Genres, step.genres) || got.Version != step.version) {
+			t.Errorf("%s: returned genres %v at version %d; want %v at version %d", step.name, got.Genres, got.Version, step.genres, step.version)
+		}
+
+		stored, err := movies.Get(ctx, movie.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stored.Genres, step.genres) || stored.Version != step.version {
+			t.Fatalf("%s: stored genres %v at version %d; want %v at version %d", step.name, stored.Genres, stored.Version, step.genres, step.version)
+		}
+	}
+
+	// A soft-deleted movie can't be changed.
+	_, err = movies.Delete(ctx, movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = movies.AddGenre(ctx, movie.Id, "drama", 3)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("appending to a deleted movie got %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+func TestMovieModelDuplicateTitles(t *testing.T) {
+	tests := []struct {
+		name         string
+		uniqueTitles bool
+		want         error
+	}{
+		{name: "unique titles", uniqueTitles: true, want: ErrDuplicateTitle},
+		{name: "titles may repeat", uniqueTitles: false, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := newMovieModel(t, tt.uniqueTitles)
+			ctx := context.Background()
+
+			err := movies.Insert(ctx, validMovie("animation"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			duplicate := validMovie("animation")
+			duplicate.Title = strings.ToUpper(duplicate.Title)
+
+			err = movies.Insert(ctx, duplicate)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("inserting %q got err %v; want %v", duplicate.Title, err, tt.want)
+			}
+
+			results, err := movies.Import(ctx, []*Movie{validMovie("animation")}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ImportCreated
+			if tt.uniqueTitles {
+				want = ImportDuplicate
+			}
+			if results[0] != want {
+				t.Errorf("importing a taken title got result %d; want %d", results[0], want)
+			}
+		})
+	}
+}
+
+func TestMovieModelConcurrentInsertSameTitle(t *testing.T) {
+	movies := newMovieModel(t, true)
+
+	const writers = 8
+
+	errs := make(chan error, writers)
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- movies.Insert(context.Background(), validMovie("animation"))
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	inserted, duplicates := 0, 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			inserted++
+		case errors.Is(err, ErrDuplicateTitle):
+			duplicates++
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if inserted != 1 || duplicates != writers-1 {
+		t.Errorf("got %d inserted and %d duplicates; want 1 and %d", inserted, duplicates, writers-1)
+	}
+}
+
+func TestMovieModelUniqueTitlesToggle(t *testing.T) {
+	lenient := newMovieModel(t, false)
+	strict := lenient
+	strict.UniqueTitles = true
+	ctx := context.Background()
+
+	// Two movies share a title before titles are made unique.
+	var existing []*Movie
+	for i := 0; i < 2; i++ {
+		movie := validMovie("animation")
+		err := lenient.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing = append(existing, movie)
+	}
+
+	err := strict.Insert(ctx, validMovie("animation"))
+	if !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("inserting a third copy of an existing title got %v; want %v", err, ErrDuplicateTitle)
+	}
+
+	renamed := *existing[1]
+	renamed.Title = "Moana 2"
+	err = strict.Update(ctx, &renamed)
+	if err != nil {
+		t.Fatalf("renaming a duplicate away: %v", err)
+	}
+
+	taken := renamed
+	taken.Title = strings.ToLower(existing[0].Title)
+	err = strict.Update(ctx, &taken)
+	if !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("renaming back to a taken title got %v; want %v", err, ErrDuplicateTitle)
+	}
+
+	_, err = strict.Delete(ctx, existing[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = strict.Update(ctx, &taken)
+	if err != nil {
+		t.Fatalf("taking the title of a deleted movie: %v", err)
+	}
+
+	_, err = strict.Restore(ctx, existing[0].Id)
+	if !errors.Is(err, ErrDuplicateTitle) {
+		t.Fatalf("restoring a movie whose title was taken got %v; want %v", err, ErrDuplicateTitle)
+	}
+
+	// A model that doesn't require unique titles, such as another instance
+	// configured differently, may still repeat one.
+	err = lenient.Insert(ctx, validMovie("animation"))
+	if err != nil {
+		t.Fatalf("inserting a duplicate without unique titles: %v", err)
+	}
+}
+
+func TestMovieModelGetAllSummary(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		movie := validMovie("animation")
+		movie.Title = fmt.Sprintf("Movie %d", i)
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first page of two, which the third movie isn't on.
+	filters := Filters{Page: 1, PageSize: 2, Sort: "id", SortSafeList: []string{"id"}}
+
+	summarize := func() *MovieListSummary {
+		t.Helper()
+		summary, err := movies.GetAllSummary(ctx, "", []string{}, GenresModeAll, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	first := summarize()
+	if first.Fingerprint != "3;1.1,2.1" {
+		t.Fatalf("got fingerprint %q; want %q", first.Fingerprint, "3;1.1,2.1")
+	}
+	if again := summarize(); again.Fingerprint != first.Fingerprint || !again.LastModified.Equal(first.LastModified) {
+		t.Fatalf("summary changed without a write: %+v then %+v", first, again)
+	}
+
+	steps := []struct {
+		name        string
+		write       func() error
+		fingerprint string
+	}{
+		{
+			name: "update a listed movie",
+			write: func() error {
+				movie, err := movies.Get(ctx, 2)
+				if err != nil {
+					return err
+				}
+				movie.Year = 2017
+				return movies.Update(ctx, movie)
+			},
+			fingerprint: "3;1.1,2.2",
+		},
+		{
+			name: "delete a listed movie",
+			write: func() error {
+				_, err := movies.Delete(ctx, 1)
+				return err
+			},
+			fingerprint: "2;2.2,3.1",
+		},
+	}
+
+	previous := first
+	for _, step := range steps {
+		err := step.write()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		summary := summarize()
+		if summary.Fingerprint != step.fingerprint {
+			t.Errorf("after %s got fingerprint %q; want %q", step.name, summary.Fingerprint, step.fingerprint)
+		}
+		if summary.LastModified.Before(previous.LastModified) {
+			t.Errorf("after %s LastModified went back from %v to %v", step.name, previous.LastModified, summary.LastModified)
+		}
+		previous = summary
+	}
+}
+
+func TestMovieModelCursorWalk(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	var live []int64
+	for i := 0; i < 11; i++ {
+		movie := validMovie("animation")
+		movie.Title = fmt.Sprintf("Movie %d", i)
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, movie.Id)
+	}
+
+	// A deleted movie in the middle must not leave a gap or end the walk.
+	_, err := movies.Delete(ctx, live[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	live = append(live[:5], live[6:]...)
+
+	for _, sort := range []string{"id", "-id"} {
+		for _, pageSize := range []int{1, 3, len(live)} {
+			t.Run(fmt.Sprintf("%s by %d", sort, pageSize), func(t *testing.T) {
+				filters := Filters{PageSize: pageSize, Sort: sort, SortSafeList: []string{"id", "-id"}, CursorMode: true, CursorKey: testCursorKey}
+
+				var seen []int64
+				for {
+					page, metadata, err := movies.GetAll(ctx, "", []string{}, GenresModeAll, filters)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page) > pageSize {
+						t.Fatalf("got %d movies; want at most %d", len(page), pageSize)
+					}
+					for _, movie := range page {
+						seen = append(seen, movie.Id)
+					}
+
+					if metadata.NextCursor == "" {
+						break
+					}
+					if len(seen) > len(live) {
+						t.Fatalf("walk didn't end after %v", seen)
+					}
+					filters.Cursor = metadata.NextCursor
+				}
+
+				want := make([]int64, len(live))
+				for i := range live {
+					want[i] = live[i]
+					if sort == "-id" {
+						want[i] = live[len(live)-1-i]
+					}
+				}
+				if fmt.Sprint(seen) != fmt.Sprint(want) {
+					t.Errorf("visited %v; want %v", seen, want)
+				}
+			})
+		}
+	}
+}
+
+func TestMovieModelConcurrentUpdate(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round, writers := range []int{2, 8} {
+		current, err := movies.Get(ctx, movie.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make([]error, writers)
+		var wg sync.WaitGroup
+		for i := range errs {
+			stale := *current
+			stale.Year = int32(2000 + i)
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = movies.Update(ctx, &stale)
+			}(i)
+		}
+		wg.Wait()
+
+		won := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrEditConflict):
+				t.Fatalf("%d writers: %v", writers, err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d writers: %d updates succeeded; want 1", writers, won)
+		}
+
+		updated, err := movies.Get(ctx, movie.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := current.Version + 1; updated.Version != want {
+			t.Errorf("round %d: got version %d; want %d", round, updated.Version, want)
+		}
+	}
+}
+
+// tableCounts returns the number of rows in each table a movie write touches.
+func tableCounts(t *testing.T, movies MovieModel) map[string]int {
+	t.Helper()
+
+	counts := map[string]int{}
+	for _, table := range []string{"movies", "movie_versions", "audit_log"} {
+		var n int
+		err := movies.DB.QueryRow("SELECT count(*) FROM " + table).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
+
+func TestMovieModelDryRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		history int
+		action  string
+		write   func(ctx context.Context, movies MovieModel, existing *Movie) (*Movie, error)
+		version int32
+	}{
+		{
+			name:   "insert",
+			action: AuditMovieCreate,
+			write: func(ctx context.Context, movies MovieModel, existing *Movie) (*Movie, error) {
+				movie := validMovie("drama")
+				movie.Title = "Black Panther"
+				return movie, movies.Insert(ctx, movie)
+			},
+			version: 1,
+		},
+		{
+			name:   "update",
+			action: AuditMovieUpdate,
+			write: func(ctx context.Context, movies MovieModel, existing *Movie) (*Movie, error) {
+				existing.Title = "Moana 2"
+				return existing, movies.Update(ctx, existing)
+			},
+			version: 2,
+		},
+		{
+			name:    "update with history",
+			history: 3,
+			action:  AuditMovieUpdate,
+			write: func(ctx context.Context, movies MovieModel, existing *Movie) (*Movie, error) {
+				existing.Title = "Moana 2"
+				return existing, movies.Update(ctx, existing)
+			},
+			version: 2,
+		},
+		{
+			name:    "unaudited update with history",
+			history: 3,
+			write: func(ctx context.Context, movies MovieModel, existing *Movie) (*Movie, error) {
+				existing.Title = "Moana 2"
+				return existing, movies.Update(ctx, existing)
+			},
+			version: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := newMovieModel(t, false)
+			movies.HistoryDepth = tt.history
+
+			existing := validMovie("animation")
+			err := movies.Insert(context.Background(), existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := tableCounts(t, movies)
+
+			ctx := context.Background()
+			if tt.action != "" {
+				ctx = WithAudit(ctx, &AuditEntry{Action: tt.action, TargetType: "movie"})
+			}
+			ctx = WithDryRun(ctx)
+
+			written, err := tt.write(ctx, movies, existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The write still returns the row it would have stored.
+			if written.Id == 0 || written.Version != tt.version {
+				t.Errorf("got id %d at version %d; want a row at version %d", written.Id, written.Version, tt.version)
+			}
+
+			if after := tableCounts(t, movies); fmt.Sprint(after) != fmt.Sprint(before) {
+				t.Errorf("row counts went from %v to %v", before, after)
+			}
+
+			stored, err := movies.Get(context.Background(), existing.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Title != validMovie().Title || stored.Version != 1 {
+				t.Errorf("stored movie changed to %q at version %d", stored.Title, stored.Version)
+			}
+		})
+	}
+}
+
+func TestMovieModelHistory(t *testing.T) {
+	const updates = 5
+
+	for _, depth := range []int{0, 1, 3, updates, updates + 2} {
+		t.Run(fmt.Sprintf("depth %d", depth), func(t *testing.T) {
+			movies := newMovieModel(t, false)
+			movies.HistoryDepth = depth
+			ctx := context.Background()
+
+			movie := validMovie("animation")
+			movie.Title = "Moana 1"
+			err := movies.Insert(ctx, movie)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Alternate between the two kinds of write that keep history: an
+			// update at a known version and a genre change at any version.
+			var replaced []Movie
+			for i := 2; i <= updates+1; i++ {
+				replaced = append(replaced, *movie)
+				if i%2 == 0 {
+					movie.Title = fmt.Sprintf("Moana %d", i)
+					err = movies.Update(ctx, movie)
+				} else {
+					movie, _, err = movies.AddGenre(ctx, movie.Id, fmt.Sprintf("genre %d", i), DefaultMovieLimits.MaxGenres)
+				}
+				if err != nil {
+					t.Fatalf("write %d: %v", i, err)
+				}
+			}
+
+			// A conflicting update fails without keeping a snapshot.
+			stale := *movie
+			stale.Version--
+			err = movies.Update(ctx, &stale)
+			if !errors.Is(err, ErrEditConflict) {
+				t.Fatalf("stale update: got err %v; want %v", err, ErrEditConflict)
+			}
+
+			history, err := movies.History(ctx, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kept := depth
+			if kept > updates {
+				kept = updates
+			}
+			if len(history) != kept {
+				t.Fatalf("got %d versions; want %d", len(history), kept)
+			}
+
+			// The most recent versions are kept, oldest first, each as it was
+			// before the write that replaced it.
+			for i, version := range history {
+				want := replaced[updates-kept+i]
+				if version.Version != want.Version || version.Title != want.Title || fmt.Sprint(version.Genres) != fmt.Sprint(want.Genres) {
+					t.Errorf("history[%d] is version %d %q %v; want version %d %q %v", i, version.Version, version.Title, version.Genres, want.Version, want.Title, want.Genres)
+				}
+				if i > 0 && version.ReplacedAt.Before(history[i-1].ReplacedAt) {
+					t.Errorf("history[%d] was replaced before history[%d]", i, i-1)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieModelExport(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	const seeded = 300
+
+	batch := make([]*Movie, seeded)
+	for i := range batch {
+		batch[i] = validMovie("animation")
+		batch[i].Title = fmt.Sprintf("Movie %d", i)
+	}
+	err := movies.InsertBatch(ctx, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = movies.Delete(ctx, batch[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exported []int64
+	err = movies.Export(ctx, func(movie *Movie) error {
+		exported = append(exported, movie.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exported) != seeded-1 {
+		t.Fatalf("exported %d movies; want %d", len(exported), seeded-1)
+	}
+	for i, id := range exported {
+		if id != batch[i+1].Id {
+			t.Fatalf("movie %d has id %d; want %d, without the deleted movie", i, id, batch[i+1].Id)
+		}
+	}
+}
+
+func TestMovieModelInsertBatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		uniqueTitles bool
+		third        func(movie *Movie)
+		fails        bool
+		wantErr      error
+	}{
+		{name: "all valid", third: func(movie *Movie) {}},
+		// The year check is only enforced by the database, so the third
+		// insert fails after the first two have gone through.
+		{name: "constraint violation", third: func(movie *Movie) { movie.Year = 1500 }, fails: true},
+		{name: "duplicate title", uniqueTitles: true, third: func(movie *Movie) { movie.Title = "MOANA" }, fails: true, wantErr: ErrDuplicateTitle},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movies := newMovieModel(t, tt.uniqueTitles)
+			ctx := context.Background()
+
+			err := movies.Insert(ctx, validMovie("animation"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := tableCounts(t, movies)
+
+			batch := make([]*Movie, 3)
+			for i := range batch {
+				batch[i] = validMovie("drama")
+				batch[i].Title = fmt.Sprintf("Movie %d", i)
+			}
+			tt.third(batch[2])
+
+			err = movies.InsertBatch(ctx, batch)
+			if !tt.fails {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, movie := range batch {
+					got, err := movies.Get(ctx, movie.Id)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got.Title != movie.Title || got.Version != 1 {
+						t.Errorf("batch[%d] has id %d, which holds %q version %d", i, movie.Id, got.Title, got.Version)
+					}
+					if i > 0 && movie.Id <= batch[i-1].Id {
+						t.Errorf("batch[%d] has id %d, not after %d", i, movie.Id, batch[i-1].Id)
+					}
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v; want %v", err, tt.wantErr)
+			}
+			if after := tableCounts(t, movies); !reflect.DeepEqual(after, before) {
+				t.Errorf("got row counts %v after a failed batch; want %v", after, before)
+			}
+			for _, title := range []string{"Movie 0", "Movie 1"} {
+				var n int
+				err = movies.DB.QueryRow("SELECT count(*) FROM movies WHERE title = $1", title).Scan(&n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != 0 {
+					t.Errorf("%q was kept from a failed batch", title)
+				}
+			}
+		})
+	}
+}
+
+func TestMovieModelImport(t *testing.T) {
+	movies := newMovieModel(t, false)
+	movies.HistoryDepth = 3
+	ctx := context.Background()
+
+	moana := validMovie("animation")
+	err := movies.Insert(ctx, moana)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported := func(upsert bool, titles ...string) ([]*Movie, []ImportResult) {
+		t.Helper()
+
+		batch := make([]*Movie, len(titles))
+		for i, title := range titles {
+			batch[i] = validMovie("animation", "musical")
+			batch[i].Title = title
+		}
+		results, err := movies.Import(ctx, batch, upsert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return batch, results
+	}
+
+	// Without upsert, and without unique titles, a taken title is created
+	// again.
+	batch, results := imported(false, "Coco", "MOANA")
+	if fmt.Sprint(results) != fmt.Sprint([]ImportResult{ImportCreated, ImportCreated}) {
+		t.Errorf("got results %v; want both created", results)
+	}
+	if batch[1].Id == moana.Id || batch[1].Version != 1 {
+		t.Errorf("got movie %d at version %d; want a new movie", batch[1].Id, batch[1].Version)
+	}
+
+	// With upsert, the oldest live movie with the title is updated, keeping a
+	// snapshot of it.
+	batch, results = imported(true, "moana", "Encanto")
+	if fmt.Sprint(results) != fmt.Sprint([]ImportResult{ImportUpdated, ImportCreated}) {
+		t.Errorf("got results %v; want updated and created", results)
+	}
+	if batch[0].Id != moana.Id || batch[0].Version != moana.Version+1 {
+		t.Errorf("got movie %d at version %d; want movie %d at version %d", batch[0].Id, batch[0].Version, moana.Id, moana.Version+1)
+	}
+
+	stored, err := movies.Get(ctx, moana.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != "moana" || fmt.Sprint(stored.Genres) != "[animation musical]" {
+		t.Errorf("stored %q %v; want the imported row", stored.Title, stored.Genres)
+	}
+
+	history, err := movies.History(ctx, moana.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Title != moana.Title || history[0].Version != moana.Version {
+		t.Errorf("got history %+v; want the movie as it was before the import", history)
+	}
+
+	// A row the database rejects rolls back the whole import.
+	before := tableCounts(t, movies)
+	broken := []*Movie{validMovie("animation"), validMovie("animation")}
+	broken[0].Title = "Wish"
+	broken[1].Runtime = -1
+	_, err = movies.Import(ctx, broken, true)
+	if err == nil {
+		t.Fatal("importing a negative runtime succeeded")
+	}
+	if after := tableCounts(t, movies); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("a failed import changed the row counts from %v to %v", before, after)
+	}
+}
+
+// dependentRows counts the reviews and watchlist rows that refer to a movie,
+// whether or not it is soft-deleted.
+func dependentRows(t *testing.T, db *sql.DB, movieID int64) MovieDependents {
+	t.Helper()
+
+	var dependents MovieDependents
+	err := db.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM reviews WHERE movie_id = $1),
+			(SELECT count(*) FROM watchlist WHERE movie_id = $1)`, movieID).Scan(&dependents.Reviews, &dependents.Watchlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dependents
+}
+
+// softDelete marks the movie deleted without going through Delete, leaving
+// its dependents in place, as movies deleted before Delete refused ones with
+// dependents may still have them.
+func softDelete(t *testing.T, db *sql.DB, movieID int64) {
+	t.Helper()
+
+	_, err := db.Exec(`UPDATE movies SET deleted_at = NOW(), version = version + 1 WHERE id = $1`, movieID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMovieModelDeleteDependents(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	reviews := ReviewModel{DB: movies.DB, Timeout: 5 * time.Second}
+	watchlist := WatchlistModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+
+	var ids []int64
+	for _, title := range []string{"Moana", "Frozen"} {
+		movie := validMovie("animation")
+		movie.Title = title
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	// Two reviews and one watchlist entry for the first movie; the second
+	// is only on a watchlist, so the counts must not leak between movies.
+	for _, user := range []*User{alice, bob} {
+		err := reviews.Insert(ctx, &Review{MovieID: ids[0], UserID: user.Id, Body: "Great", Rating: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, add := range [][2]int64{{alice.Id, ids[0]}, {bob.Id, ids[1]}} {
+		_, err := watchlist.Add(ctx, add[0], add[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []MovieDependents{{Reviews: 2, Watchlist: 1}, {Watchlist: 1}} {
+		_, err := movies.Delete(ctx, ids[i])
+		var dependentsErr *MovieDependentsError
+		if !errors.As(err, &dependentsErr) {
+			t.Fatalf("deleting movie %d got %v; want a %T", ids[i], err, dependentsErr)
+		}
+		if dependentsErr.Dependents != want {
+			t.Errorf("movie %d has dependents %+v; want %+v", ids[i], dependentsErr.Dependents, want)
+		}
+		if got := dependentRows(t, movies.DB, ids[i]); got != want {
+			t.Errorf("a refused delete left dependents %+v; want %+v", got, want)
+		}
+		_, err = movies.Get(ctx, ids[i])
+		if err != nil {
+			t.Errorf("getting movie %d after a refused delete got %v", ids[i], err)
+		}
+	}
+
+	// Once its only dependent is gone, the second movie can be deleted.
+	err := watchlist.Remove(ctx, bob.Id, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = movies.Delete(ctx, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = movies.Delete(ctx, ids[1]+1)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("deleting a missing movie got %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+// A review added while Delete waits for the movie's row lock must be counted,
+// not left behind a soft-deleted movie.
+func TestMovieModelDeleteConcurrentDependent(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The review's foreign key takes a lock on the movie's row that Delete
+	// has to wait for until the transaction commits.
+	tx, err := movies.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO reviews (movie_id, user_id, body, rating) VALUES ($1, $2, 'Great', 5)`, movie.Id, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := movies.Delete(ctx, movie.Id)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Delete returned %v before the review was committed", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	var dependentsErr *MovieDependentsError
+	if !errors.As(err, &dependentsErr) || dependentsErr.Dependents != (MovieDependents{Reviews: 1}) {
+		t.Fatalf("got %v; want the committed review counted", err)
+	}
+	_, err = movies.Get(ctx, movie.Id)
+	if err != nil {
+		t.Errorf("getting the movie got %v; want it left live", err)
+	}
+}
+
+func TestMovieModelPurge(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	reviews := ReviewModel{DB: movies.DB, Timeout: 5 * time.Second}
+	watchlist := WatchlistModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+
+	tests := []struct {
+		name       string
+		softDelete bool
+	}{
+		{name: "live movie"},
+		{name: "soft-deleted movie", softDelete: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie := validMovie("animation")
+			movie.Title = tt.name
+			err := movies.Insert(ctx, movie)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = reviews.Insert(ctx, &Review{MovieID: movie.Id, UserID: user.Id, Body: "Great", Rating: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = watchlist.Add(ctx, user.Id, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.softDelete {
+				softDelete(t, movies.DB, movie.Id)
+			}
+
+			version, err := movies.Purge(ctx, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := movie.Version + 1
+			if tt.softDelete {
+				want++
+			}
+			if version != want {
+				t.Errorf("got version %d; want %d", version, want)
+			}
+
+			if got := dependentRows(t, movies.DB, movie.Id); got != (MovieDependents{}) {
+				t.Errorf("after a purge got dependents %+v; want none", got)
+			}
+
+			_, err = movies.Restore(ctx, movie.Id)
+			if !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("restoring a purged movie got %v; want %v", err, ErrRecordNotFound)
+			}
+
+			_, err = movies.Purge(ctx, movie.Id)
+			if !errors.Is(err, ErrRecordNotFound) {
+				t.Errorf("purging twice got %v; want %v", err, ErrRecordNotFound)
+			}
+		})
+	}
+}
+
+// listedIDs returns the ids of the movies GetAll lists, in order.
+func listedIDs(t *testing.T, movies MovieModel, genres []string, genresMode string, filters Filters) []int64 {
+	t.Helper()
+
+	if filters.Page == 0 && !filters.CursorMode {
+		filters.Page = 1
+	}
+	if filters.PageSize == 0 {
+		filters.PageSize = 100
+	}
+	if filters.Sort == "" {
+		filters.Sort = "id"
+		filters.SortSafeList = []string{"id"}
+	}
+
+	listed, _, err := movies.GetAll(context.Background(), "", genres, genresMode, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int64{}
+	for _, movie := range listed {
+		ids = append(ids, movie.Id)
+	}
+	return ids
+}
+
+func TestMovieModelRelevanceSort(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	// The weaker match is inserted first, so that ordering by id alone
+	// would put it ahead.
+	var ids []int64
+	for _, title := range []string{"New York Stories", "New York, New York", "Moana"} {
+		movie := validMovie("drama")
+		movie.Title = title
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	tests := []struct {
+		sort string
+		want []int64
+	}{
+		// "New York, New York" names york twice, so it ranks higher. Moana
+		// doesn't match at all.
+		{"-relevance", []int64{ids[1], ids[0]}},
+		{"relevance", []int64{ids[0], ids[1]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			filters := Filters{Page: 1, PageSize: 20, Sort: tt.sort, SortSafeList: []string{"relevance", "-relevance"}}
+			listed, _, err := movies.GetAll(ctx, "york", []string{}, GenresModeAll, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int64{}
+			for _, movie := range listed {
+				got = append(got, movie.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listed %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovieModelGenresMode(t *testing.T) {
+	movies := newMovieModel(t, false)
+
+	var ids []int64
+	for _, genres := range [][]string{{"comedy"}, {"drama"}, {"comedy", "drama"}, {"horror"}, {"comedy", "drama", "horror"}} {
+		movie := validMovie(genres...)
+		movie.Title = strings.Join(genres, " ")
+		err := movies.Insert(context.Background(), movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	tests := []struct {
+		genres []string
+		mode   string
+		want   []int64
+	}{
+		{[]string{"comedy", "drama"}, GenresModeAll, []int64{ids[2], ids[4]}},
+		{[]string{"comedy", "drama"}, GenresModeAny, []int64{ids[0], ids[1], ids[2], ids[4]}},
+		{[]string{"horror"}, GenresModeAll, []int64{ids[3], ids[4]}},
+		{[]string{"horror"}, GenresModeAny, []int64{ids[3], ids[4]}},
+		{[]string{"western"}, GenresModeAny, []int64{}},
+		{[]string{}, GenresModeAll, ids},
+		{[]string{}, GenresModeAny, ids},
+	}
+
+	for _, tt := range tests {
+		got := listedIDs(t, movies, tt.genres, tt.mode, Filters{})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s of %q listed %v; want %v", tt.mode, tt.genres, got, tt.want)
+		}
+	}
+}
+
+func TestMovieModelRanges(t *testing.T) {
+	movies := newMovieModel(t, false)
+
+	var ids []int64
+	for i, year := range []int32{2000, 2005, 2010} {
+		movie := validMovie("drama")
+		movie.Title = fmt.Sprintf("Movie %d", i)
+		movie.Year = year
+		movie.Runtime = Runtime(90 + 15*i)
+		err := movies.Insert(context.Background(), movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	tests := []struct {
+		name    string
+		filters Filters
+		want    []int64
+	}{
+		{"no range", Filters{}, ids},
+		{"years inclusive", Filters{YearFrom: 2005, YearTo: 2010}, ids[1:]},
+		{"one year", Filters{YearFrom: 2005, YearTo: 2005}, ids[1:2]},
+		{"years from", Filters{YearFrom: 2001}, ids[1:]},
+		{"years to", Filters{YearTo: 2005}, ids[:2]},
+		{"runtimes inclusive", Filters{RuntimeMin: 90, RuntimeMax: 105}, ids[:2]},
+		{"one runtime", Filters{RuntimeMin: 120, RuntimeMax: 120}, ids[2:]},
+		{"runtime min", Filters{RuntimeMin: 91}, ids[1:]},
+		{"both ranges", Filters{YearFrom: 2000, YearTo: 2005, RuntimeMin: 100}, ids[1:2]},
+		{"empty range", Filters{YearFrom: 2001, YearTo: 2004}, []int64{}},
+	}
+
+	for _, tt := range tests {
+		if got := listedIDs(t, movies, []string{}, GenresModeAll, tt.filters); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s listed %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMovieModelCreatedWindow(t *testing.T) {
+	movies := newMovieModel(t, false)
+	base := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var ids []int64
+	for i, genre := range []string{"drama", "comedy", "drama"} {
+		movie := validMovie(genre)
+		movie.Title = fmt.Sprintf("Movie %d", i)
+		err := movies.Insert(context.Background(), movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Space the movies a day apart, starting at base.
+		_, err = movies.DB.Exec("UPDATE movies SET created_at = $1 WHERE id = $2", base.AddDate(0, 0, i), movie.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, movie.Id)
+	}
+
+	tests := []struct {
+		name    string
+		genres  []string
+		filters Filters
+		want    []int64
+	}{
+		{"no window", nil, Filters{}, ids},
+		{"after", nil, Filters{CreatedAfter: base}, ids[1:]},
+		{"before", nil, Filters{CreatedBefore: base.AddDate(0, 0, 2)}, ids[:2]},
+		{"between", nil, Filters{CreatedAfter: base.Add(-time.Second), CreatedBefore: base.Add(time.Second)}, ids[:1]},
+		{"other zone", nil, Filters{CreatedAfter: base.In(time.FixedZone("UTC+5", 5*60*60)).Add(time.Hour)}, ids[1:]},
+		{"empty window", nil, Filters{CreatedAfter: base.Add(time.Second), CreatedBefore: base.AddDate(0, 0, 1)}, []int64{}},
+		{"with genres", []string{"drama"}, Filters{CreatedAfter: base}, ids[2:]},
+		{"with a year range", nil, Filters{CreatedBefore: base.AddDate(0, 0, 1), YearFrom: 1900}, ids[:1]},
+	}
+
+	for _, tt := range tests {
+		genres := tt.genres
+		if genres == nil {
+			genres = []string{}
+		}
+		if got := listedIDs(t, movies, genres, GenresModeAll, tt.filters); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s listed %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMovieModelSoftDelete(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	kept := validMovie("drama")
+	kept.Title = "Kept"
+	deleted := validMovie("drama")
+	deleted.Title = "Deleted"
+	for _, movie := range []*Movie{kept, deleted} {
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := movies.Delete(ctx, deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = movies.Get(ctx, deleted.Id)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("getting a deleted movie returned %v; want %v", err, ErrRecordNotFound)
+	}
+	if got := listedIDs(t, movies, []string{}, "", Filters{}); !reflect.DeepEqual(got, []int64{kept.Id}) {
+		t.Errorf("listed %v; want only the live movie %d", got, kept.Id)
+	}
+	if got := listedIDs(t, movies, []string{}, "", Filters{IncludeDeleted: true}); !reflect.DeepEqual(got, []int64{kept.Id, deleted.Id}) {
+		t.Errorf("listed %v with deleted movies; want %v", got, []int64{kept.Id, deleted.Id})
+	}
+	_, err = movies.Delete(ctx, deleted.Id)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("deleting a deleted movie returned %v; want %v", err, ErrRecordNotFound)
+	}
+
+	restored, err := movies.Restore(ctx, deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "Deleted" || restored.Version != 3 {
+		t.Errorf("restored %q at version %d; want %q at version 3", restored.Title, restored.Version, "Deleted")
+	}
+
+	_, err = movies.Get(ctx, deleted.Id)
+	if err != nil {
+		t.Fatalf("getting a restored movie: %v", err)
+	}
+	if got := listedIDs(t, movies, []string{}, "", Filters{}); !reflect.DeepEqual(got, []int64{kept.Id, deleted.Id}) {
+		t.Errorf("listed %v after the restore; want %v", got, []int64{kept.Id, deleted.Id})
+	}
+
+	_, err = movies.Restore(ctx, kept.Id)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("restoring a live movie returned %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+func TestMovieModelStats(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	stats, err := movies.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty := (MovieStats{Genres: map[string]int64{}}); !reflect.DeepEqual(*stats, empty) {
+		t.Errorf("stats of an empty catalogue are %+v; want %+v", *stats, empty)
+	}
+
+	seed := []struct {
+		year    int32
+		runtime Runtime
+		genres  []string
+		deleted bool
+	}{
+		{1994, 100, []string{"drama", "crime"}, false},
+		{2008, 150, []string{"action", "crime", "drama"}, false},
+		{2016, 110, []string{"animation"}, false},
+		{1972, 175, []string{"crime", "drama"}, true},
+	}
+	for i, s := range seed {
+		movie := validMovie(s.genres...)
+		movie.Title = fmt.Sprintf("Movie %d", i)
+		movie.Year = s.year
+		movie.Runtime = s.runtime
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.deleted {
+			_, err = movies.Delete(ctx, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats, err = movies.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MovieStats{
+		TotalMovies:    3,
+		AverageRuntime: 120,
+		MinYear:        1994,
+		MaxYear:        2016,
+		Genres:         map[string]int64{"drama": 2, "crime": 2, "action": 1, "animation": 1},
+	}
+	if !reflect.DeepEqual(*stats, want) {
+		t.Errorf("got stats %+v; want %+v", *stats, want)
+	}
+}
+
+func TestMovieModelDeleteWatchlisted(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	watchlist := WatchlistModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+
+	deleted := validMovie("animation")
+	kept := validMovie("drama")
+	kept.Title = "Whiplash"
+	for _, movie := range []*Movie{deleted, kept} {
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range []*User{alice, bob} {
+			_, err = watchlist.Add(ctx, user.Id, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	added, err := watchlist.Add(ctx, alice.Id, kept.Id)
+	if err != nil || added {
+		t.Errorf("adding a movie twice got %t, %v; want it left as it was", added, err)
+	}
+
+	// A movie on a watchlist isn't soft-deleted, so no watchlist is left
+	// pointing at a hidden movie.
+	_, err = movies.Delete(ctx, deleted.Id)
+	var dependentsErr *MovieDependentsError
+	if !errors.As(err, &dependentsErr) || dependentsErr.Dependents != (MovieDependents{Watchlist: 2}) {
+		t.Fatalf("deleting a watchlisted movie got %v; want its 2 watchlist entries reported", err)
+	}
+
+	for _, user := range []*User{alice, bob} {
+		err = watchlist.Remove(ctx, user.Id, deleted.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = movies.Delete(ctx, deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dependentRows(t, movies.DB, kept.Id); got.Watchlist != 2 {
+		t.Errorf("another movie is on %d watchlists; want 2", got.Watchlist)
+	}
+
+	// A restore brings the movie back, and it can be added again like any
+	// movie.
+	_, err = movies.Restore(ctx, deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err = watchlist.Add(ctx, alice.Id, deleted.Id)
+	if err != nil || !added {
+		t.Errorf("re-adding the restored movie got %t, %v; want it added", added, err)
+	}
+	filters := Filters{Page: 1, PageSize: 20, Sort: "title", SortSafeList: []string{"title"}}
+	listed, _, err := watchlist.GetAllForUser(ctx, alice.Id, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("alice's watchlist has %d movies; want 2", len(listed))
+	}
+}
+
+func TestMovieModelGetSimilar(t *testing.T) {
+	movies := newMovieModel(t, false)
+	ctx := context.Background()
+
+	source := validMovie("drama", "crime", "thriller")
+	source.Title = "Source"
+	err := movies.Insert(ctx, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []struct {
+		title   string
+		year    int32
+		genres  []string
+		deleted bool
+	}{
+		{"Two genres, older", 2000, []string{"drama", "crime"}, false},
+		{"One genre", 1980, []string{"drama"}, false},
+		{"All three genres", 1990, []string{"thriller", "drama", "crime", "mystery"}, false},
+		{"No shared genre", 2020, []string{"comedy"}, false},
+		{"Two genres, newer", 2010, []string{"crime", "thriller"}, false},
+		{"Deleted", 2015, []string{"drama", "crime", "thriller"}, true},
+	}
+	for _, s := range seed {
+		movie := validMovie(s.genres...)
+		movie.Title = s.title
+		movie.Year = s.year
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.deleted {
+			_, err = movies.Delete(ctx, movie.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Ranked by the number of shared genres, then newest first. The source
+	// movie itself, the deleted movie and the one sharing nothing are left
+	// out.
+	want := []string{"All three genres", "Two genres, newer", "Two genres, older", "One genre"}
+
+	var got []string
+	for page := 1; page <= 2; page++ {
+		similar, metadata, err := movies.GetSimilar(ctx, source, Filters{Page: page, PageSize: 2, Sort: "similarity", SortSafeList: []string{"similarity"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.TotalRecords != len(want) || metadata.LastPage != 2 {
+			t.Errorf("page %d has %d records over %d pages; want %d over 2", page, metadata.TotalRecords, metadata.LastPage, len(want))
+		}
+		for _, movie := range similar {
+			got = append(got, movie.Title)
+		}
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
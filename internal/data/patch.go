@@ -0,0 +1,83 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+)
+
+// Patch is one member of a JSON Merge Patch (RFC 7386) document. It tells
+// apart a member that is absent (Set is false), explicitly null (Set and Null
+// are true) and given a value.
+type Patch[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+// decodeJSON sets the patch from the JSON value of the named member. Type
+// errors carry the member's name, which encoding/json doesn't add to errors
+// returned from inside an Unmarshaler.
+func (p *Patch[T]) decodeJSON(name string, jsonValue json.RawMessage) error {
+	p.Set = true
+
+	if bytes.Equal(bytes.TrimSpace(jsonValue), []byte("null")) {
+		var zero T
+		p.Null, p.Value = true, zero
+		return nil
+	}
+
+	p.Null = false
+	err := json.Unmarshal(jsonValue, &p.Value)
+
+	var unmarshalTypeError *json.UnmarshalTypeError
+	if errors.As(err, &unmarshalTypeError) {
+		unmarshalTypeError.Field = name
+	}
+	return err
+}
+
+type patchMember interface {
+	decodeJSON(name string, jsonValue json.RawMessage) error
+}
+
+// decodeMergePatch decodes a JSON object into the members, keyed by name. As
+// with DisallowUnknownFields, any other name is an error.
+func decodeMergePatch(jsonValue []byte, members map[string]patchMember) error {
+	var document map[string]json.RawMessage
+	err := json.Unmarshal(jsonValue, &document)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range document {
+		member, ok := members[name]
+		if !ok {
+			return fmt.Errorf("json: unknown field %q", name)
+		}
+
+		err = member.decodeJSON(name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalXML marks the patch as set. XML has no null, so an element always
+// carries a value, even when it is empty.
+func (p *Patch[T]) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	p.Set = true
+	return d.DecodeElement(&p.Value, &start)
+}
+
+// Apply writes the patched value to dst. A null clears dst to its zero value;
+// callers are expected to have rejected nulls for fields that can't be
+// cleared.
+func (p Patch[T]) Apply(dst *T) {
+	if p.Set {
+		*dst = p.Value
+	}
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+// notePatch has a nullable member, which no movie field is yet.
+type notePatch struct {
+	Note Patch[string]
+}
+
+func (patch *notePatch) UnmarshalJSON(jsonValue []byte) error {
+	return decodeMergePatch(jsonValue, map[string]patchMember{"note": &patch.Note})
+}
+
+func TestPatchNullableField(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Patch[string]
+		// note is the stored value after the patch is applied to "old".
+		note string
+	}{
+		{"absent", `{}`, Patch[string]{}, "old"},
+		{"null", `{"note":null}`, Patch[string]{Set: true, Null: true}, ""},
+		{"null with spaces", `{"note": null }`, Patch[string]{Set: true, Null: true}, ""},
+		{"value", `{"note":"new"}`, Patch[string]{Set: true, Value: "new"}, "new"},
+		{"empty value", `{"note":""}`, Patch[string]{Set: true}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch notePatch
+			err := json.Unmarshal([]byte(tt.body), &patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patch.Note != tt.want {
+				t.Errorf("decoded %+v; want %+v", patch.Note, tt.want)
+			}
+
+			note := "old"
+			patch.Note.Apply(&note)
+			if note != tt.note {
+				t.Errorf("applied, the note is %q; want %q", note, tt.note)
+			}
+		})
+	}
+}
+
+func TestDecodeMergePatchErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+		// typeErrorField is the member a type error names, if there is one.
+		typeErrorField string
+	}{
+		{"unknown member", `{"title":"Moana","budget":1}`, `json: unknown field "budget"`, ""},
+		{"wrong type", `{"year":"2016"}`, "year", "year"},
+		{"not an object", `["title"]`, "cannot unmarshal array", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch MoviePatch
+			err := json.Unmarshal([]byte(tt.body), &patch)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got err %v; want one mentioning %q", err, tt.want)
+			}
+
+			var typeErr *json.UnmarshalTypeError
+			if tt.typeErrorField != "" && (!errors.As(err, &typeErr) || typeErr.Field != tt.typeErrorField) {
+				t.Errorf("got err %#v; want a type error for %s", err, tt.typeErrorField)
+			}
+		})
+	}
+}
+
+func TestValidateMoviePatch(t *testing.T) {
+	movie := Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}, Director: "Ron Clements", Rating: "PG"}
+
+	tests := []struct {
+		name string
+		body string
+		// field is the one rejected, if any.
+		field string
+	}{
+		{name: "absent", body: `{}`},
+		{name: "values", body: `{"title":"Moana 2","director":"David Derrick Jr."}`},
+		{name: "null title", body: `{"title":null}`, field: "title"},
+		{name: "null year", body: `{"year":null}`, field: "year"},
+		{name: "null runtime", body: `{"runtime":null}`, field: "runtime"},
+		{name: "null genres", body: `{"genres":null}`, field: "genres"},
+		{name: "null director", body: `{"director":null}`, field: "director"},
+		{name: "null rating", body: `{"rating":null}`, field: "rating"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch MoviePatch
+			err := json.Unmarshal([]byte(tt.body), &patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v := validator.New()
+			ValidateMoviePatch(v, patch)
+			if tt.field == "" {
+				if !v.Valid() {
+					t.Fatalf("got errors %v; want none", v.Errors)
+				}
+
+				patched := movie
+				patch.Apply(&patched)
+				if patch.Title.Set && patched.Title != patch.Title.Value {
+					t.Errorf("applied, the title is %q; want %q", patched.Title, patch.Title.Value)
+				}
+				if !patch.Year.Set && patched.Year != movie.Year {
+					t.Errorf("an absent year changed to %d", patched.Year)
+				}
+				return
+			}
+			if got := v.Errors[tt.field]; got != "must not be null" {
+				t.Errorf("got %s error %q; want %q", tt.field, got, "must not be null")
+			}
+		})
+	}
+}
+
+func TestPatchUnmarshalXML(t *testing.T) {
+	var patch MoviePatch
+	err := xml.Unmarshal([]byte(`<movie><director></director><genres><genre>drama</genre></genres></movie>`), &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// XML has no null, so an empty element is an empty value.
+	if !patch.Director.Set || patch.Director.Null || patch.Director.Value != "" {
+		t.Errorf("got director %+v; want an empty value", patch.Director)
+	}
+	if !patch.Genres.Set || len(patch.Genres.Value) != 1 || patch.Genres.Value[0] != "drama" {
+		t.Errorf("got genres %+v; want [drama]", patch.Genres)
+	}
+	if patch.Title.Set {
+		t.Errorf("an absent title was set to %+v", patch.Title)
+	}
+}
@@ -5,9 +5,27 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/Soul-Remix/greenlight/internal/validator"
 	"github.com/lib/pq"
 )
 
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var Roles = []string{RoleAdmin, RoleEditor, RoleViewer}
+
+var PermissionCodes = []string{"movies:read", "movies:write", "admin:read", "admin:write"}
+
+func ValidatePermissionCodes(v *validator.Validator, codes []string) {
+	v.Check(len(codes) >= 1, "codes", "must contain at least 1 permission code")
+	for _, code := range codes {
+		v.Check(validator.PermittedValue(code, PermissionCodes...), "codes", "must only contain known permission codes")
+	}
+}
+
 type Permissions []string
 
 func (p Permissions) Include(code string) bool {
@@ -20,15 +38,18 @@ func (p Permissions) Include(code string) bool {
 }
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type IPermissionModel interface {
-	GetAllForUser(userID int64) (Permissions, error)
-	AddForUser(userID int64, codes ...string) error
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	GetAllForRole(ctx context.Context, role string) (Permissions, error)
+	RemoveForUser(ctx context.Context, userID int64, code string) error
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
@@ -36,7 +57,7 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		INNER JOIN users ON users_permissions.user_id = users.id
 		WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -61,14 +82,79 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return audited(ctx, m.DB, func(q querier) error {
+		_, err := q.ExecContext(ctx, query, userID, pq.Array(codes))
+		return err
+	})
+}
+
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, code string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	return audited(ctx, m.DB, func(q querier) error {
+		result, err := q.ExecContext(ctx, query, userID, code)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
+func (m PermissionModel) GetAllForRole(ctx context.Context, role string) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN roles ON roles_permissions.role_id = roles.id
+		WHERE roles.name = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
 }
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+)
+
+func TestUserRolePermissions(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	permissions := PermissionModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := &User{Name: "Alice", Email: "alice@example.com", Activated: true, Locale: "en", Role: RoleEditor}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	direct, err := permissions.GetAllForUser(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(direct) != 0 {
+		t.Fatalf("new user has direct grants %v; want none", direct)
+	}
+
+	tests := []struct {
+		role string
+		want map[string]bool
+	}{
+		{RoleEditor, map[string]bool{"movies:read": true, "movies:write": true}},
+		{RoleViewer, map[string]bool{"movies:read": true, "movies:write": false}},
+		{RoleEditor, map[string]bool{"movies:read": true, "movies:write": true}},
+	}
+
+	for _, tt := range tests {
+		user.Role = tt.role
+		err := users.Update(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := users.Get(ctx, user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		effective, err := permissions.GetAllForUser(ctx, user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		role, err := permissions.GetAllForRole(ctx, stored.Role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		effective = append(effective, role...)
+
+		for code, want := range tt.want {
+			if got := effective.Include(code); got != want {
+				t.Errorf("as %s, has %s = %t; want %t", tt.role, code, got, want)
+			}
+		}
+	}
+}
+
+func TestPermissionModelGetAllForRole(t *testing.T) {
+	db := datatest.NewDB(t)
+	permissions := PermissionModel{DB: db, Timeout: 5 * time.Second}
+
+	tests := []struct {
+		role string
+		want []string
+	}{
+		{RoleAdmin, PermissionCodes},
+		{RoleEditor, []string{"movies:read", "movies:write"}},
+		{RoleViewer, []string{"movies:read"}},
+		{"critic", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := permissions.GetAllForRole(context.Background(), tt.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		want := append([]string(nil), tt.want...)
+		sort.Strings(want)
+		if !reflect.DeepEqual([]string(got), want) {
+			t.Errorf("%s has %q; want %q", tt.role, got, want)
+		}
+	}
+}
+
+func TestPermissionModelAddAndRemove(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	permissions := PermissionModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+
+	for i := 0; i < 2; i++ {
+		err := permissions.AddForUser(ctx, user.Id, "movies:read", "movies:write")
+		if err != nil {
+			t.Fatalf("grant %d: %v", i+1, err)
+		}
+	}
+	got, err := permissions.GetAllForUser(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"movies:read", "movies:write"}; !reflect.DeepEqual([]string(got), want) {
+		t.Errorf("after granting twice the user has %q; want %q", got, want)
+	}
+
+	err = permissions.RemoveForUser(ctx, user.Id, "movies:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = permissions.RemoveForUser(ctx, user.Id, "movies:write")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoking a grant that doesn't exist returned %v; want %v", err, ErrRecordNotFound)
+	}
+
+	got, err = permissions.GetAllForUser(ctx, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"movies:read"}; !reflect.DeepEqual([]string(got), want) {
+		t.Errorf("after revoking the user has %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/validator"
+)
+
+type Review struct {
+	Id         int64     `json:"id"`
+	MovieID    int64     `json:"movie_id"`
+	MovieTitle string    `json:"movie_title,omitempty"`
+	UserID     int64     `json:"user_id"`
+	Body       string    `json:"body"`
+	Rating     int32     `json:"rating"`
+	CreatedAt  time.Time `json:"created_at"`
+	Version    int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Body != "", "body", "must be provided")
+	v.Check(len(review.Body) <= 5000, "body", "must not be more than 5000 bytes long")
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+}
+
+// ReviewModel stores reviews, which live and die with their movie. While a
+// movie is soft-deleted its reviews are kept but hidden: Get, GetAllForMovie
+// and GetAllForUser skip them. Restoring the movie brings them back
+// unchanged, and purging it removes them through the ON DELETE CASCADE on
+// reviews.movie_id.
+type ReviewModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+type IReviewModel interface {
+	Insert(ctx context.Context, review *Review) error
+	Get(ctx context.Context, id int64) (*Review, error)
+	GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error)
+	GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*Review, Metadata, error)
+	Delete(ctx context.Context, id int64) error
+}
+
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	query := `
+		INSERT INTO reviews (movie_id, user_id, body, rating)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	args := []any{review.MovieID, review.UserID, review.Body, review.Rating}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&review.Id, &review.CreatedAt, &review.Version)
+}
+
+func (m ReviewModel) Get(ctx context.Context, id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT reviews.id, reviews.movie_id, reviews.user_id, reviews.body, reviews.rating,
+			reviews.created_at, reviews.version
+		FROM reviews
+		INNER JOIN movies ON movies.id = reviews.movie_id
+		WHERE reviews.id = $1 AND movies.deleted_at IS NULL`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&review.Id,
+		&review.MovieID,
+		&review.UserID,
+		&review.Body,
+		&review.Rating,
+		&review.CreatedAt,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &review, nil
+}
+
+func (m ReviewModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), reviews.id, reviews.movie_id, reviews.user_id, reviews.body, reviews.rating,
+			reviews.created_at, reviews.version
+		FROM reviews
+		INNER JOIN movies ON movies.id = reviews.movie_id
+		WHERE reviews.movie_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY reviews.%s %s, reviews.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.Id,
+			&review.MovieID,
+			&review.UserID,
+			&review.Body,
+			&review.Rating,
+			&review.CreatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return reviews, metadata, nil
+}
+
+// GetAllForUser returns the user's reviews of live movies, each with the
+// title of the movie it is about.
+func (m ReviewModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), reviews.id, reviews.movie_id, movies.title, reviews.user_id, reviews.body,
+			reviews.rating, reviews.created_at, reviews.version
+		FROM reviews
+		INNER JOIN movies ON movies.id = reviews.movie_id
+		WHERE reviews.user_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY reviews.%s %s, reviews.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.Id,
+			&review.MovieID,
+			&review.MovieTitle,
+			&review.UserID,
+			&review.Body,
+			&review.Rating,
+			&review.CreatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return reviews, metadata, nil
+}
+
+func (m ReviewModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM reviews
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
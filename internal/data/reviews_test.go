@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReviewModelSoftDeletedMovie(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	reviews := ReviewModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+	movie := validMovie("animation")
+	err := movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := &Review{MovieID: movie.Id, UserID: user.Id, Body: "Great", Rating: 5}
+	err = reviews.Insert(ctx, review)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := Filters{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+	// visible reports whether the review can be fetched and is listed for
+	// the movie and for its author.
+	visible := func() bool {
+		t.Helper()
+
+		_, err := reviews.Get(ctx, review.Id)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			t.Fatal(err)
+		}
+		got := err == nil
+
+		forMovie, _, err := reviews.GetAllForMovie(ctx, movie.Id, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forUser, _, err := reviews.GetAllForUser(ctx, user.Id, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(forMovie) != len(forUser) || (len(forMovie) == 1) != got {
+			t.Fatalf("Get found the review: %t, but %d listed for the movie and %d for the user", got, len(forMovie), len(forUser))
+		}
+		return got
+	}
+
+	if !visible() {
+		t.Fatal("the review of a live movie is hidden")
+	}
+
+	// Delete refuses a movie with reviews, so the movie is hidden the way
+	// one deleted before it did would be.
+	softDelete(t, movies.DB, movie.Id)
+	if visible() {
+		t.Error("the review of a soft-deleted movie is visible")
+	}
+	if got := dependentRows(t, movies.DB, movie.Id); got.Reviews != 1 {
+		t.Errorf("the soft delete left %d reviews; want 1 kept", got.Reviews)
+	}
+
+	_, err = movies.Restore(ctx, movie.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !visible() {
+		t.Fatal("the review is still hidden after the movie was restored")
+	}
+	restored, err := reviews.Get(ctx, review.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Body != review.Body || restored.Rating != review.Rating || restored.Version != review.Version {
+		t.Errorf("restored review %+v; want it unchanged from %+v", restored, review)
+	}
+}
+
+func TestReviewModelGetAllForUser(t *testing.T) {
+	movies := newMovieModel(t, false)
+	users := UserModel{DB: movies.DB, Timeout: 5 * time.Second}
+	reviews := ReviewModel{DB: movies.DB, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+
+	titles := map[int64]string{}
+	var movieIDs []int64
+	for _, title := range []string{"Moana", "Frozen", "Encanto"} {
+		movie := validMovie("animation")
+		movie.Title = title
+		err := movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles[movie.Id] = title
+		movieIDs = append(movieIDs, movie.Id)
+	}
+
+	// Alice reviews each movie a day after the last, rating them 4, 2 and 5.
+	base := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	var ids []int64
+	for i, rating := range []int32{4, 2, 5} {
+		review := &Review{MovieID: movieIDs[i], UserID: alice.Id, Body: "Seen it", Rating: rating}
+		err := reviews.Insert(ctx, review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = movies.DB.Exec("UPDATE reviews SET created_at = $1 WHERE id = $2", base.AddDate(0, 0, i), review.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, review.Id)
+	}
+	err := reviews.Insert(ctx, &Review{MovieID: movieIDs[0], UserID: bob.Id, Body: "Not for me", Rating: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortSafeList := []string{"created_at", "rating", "-created_at", "-rating"}
+	tests := []struct {
+		sort     string
+		page     int
+		pageSize int
+		want     []int64
+	}{
+		{"-created_at", 1, 20, []int64{ids[2], ids[1], ids[0]}},
+		{"created_at", 1, 20, ids},
+		{"rating", 1, 20, []int64{ids[1], ids[0], ids[2]}},
+		{"-rating", 1, 20, []int64{ids[2], ids[0], ids[1]}},
+		{"-created_at", 1, 2, []int64{ids[2], ids[1]}},
+		{"-created_at", 2, 2, []int64{ids[0]}},
+		{"-created_at", 3, 2, []int64{}},
+	}
+
+	for _, tt := range tests {
+		filters := Filters{Page: tt.page, PageSize: tt.pageSize, Sort: tt.sort, SortSafeList: sortSafeList}
+		listed, metadata, err := reviews.GetAllForUser(ctx, alice.Id, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []int64{}
+		for _, review := range listed {
+			got = append(got, review.Id)
+			if review.UserID != alice.Id {
+				t.Errorf("listed review %d by user %d for Alice", review.Id, review.UserID)
+			}
+			// The title comes from the join with movies.
+			if review.MovieTitle != titles[review.MovieID] {
+				t.Errorf("review %d has movie title %q; want %q", review.Id, review.MovieTitle, titles[review.MovieID])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sorted by %s, page %d of size %d listed %v; want %v", tt.sort, tt.page, tt.pageSize, got, tt.want)
+		}
+
+		if len(listed) > 0 && metadata.TotalRecords != 3 {
+			t.Errorf("sorted by %s, page %d of size %d got %d total records; want 3", tt.sort, tt.page, tt.pageSize, metadata.TotalRecords)
+		}
+	}
+}
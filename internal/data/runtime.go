@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
+
+// Runtime is a movie's running time in minutes. It is written out as a
+// "<minutes> mins" string, but input may also be a plain number or a Go
+// duration string such as "1h47m".
+type Runtime int32
+
+func (r Runtime) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(fmt.Sprintf("%d mins", r))), nil
+}
+
+// MarshalText writes the runtime the same way for XML and other text formats.
+func (r Runtime) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d mins", r)), nil
+}
+
+func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
+	jsonValue = bytes.TrimSpace(jsonValue)
+	if len(jsonValue) > 0 && jsonValue[0] == '"' {
+		unquoted, err := strconv.Unquote(string(jsonValue))
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
+		return r.UnmarshalText([]byte(unquoted))
+	}
+
+	return r.UnmarshalText(jsonValue)
+}
+
+// UnmarshalText is used for XML request bodies and by UnmarshalJSON once any
+// quotes have been removed.
+func (r *Runtime) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+
+	if number, unit, found := strings.Cut(s, " "); found {
+		if unit != "mins" && unit != "min" {
+			return ErrInvalidRuntimeFormat
+		}
+		s = number
+	}
+
+	minutes, err := strconv.ParseInt(s, 10, 32)
+	if err == nil {
+		*r = Runtime(minutes)
+		return nil
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil || duration%time.Minute != 0 || duration.Minutes() > math.MaxInt32 {
+		return ErrInvalidRuntimeFormat
+	}
+
+	*r = Runtime(duration / time.Minute)
+	return nil
+}
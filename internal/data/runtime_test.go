@@ -0,0 +1,89 @@
+package data
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"testing"
+)
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Runtime
+		err   error
+	}{
+		{name: "number", input: `107`, want: 107},
+		{name: "quoted number", input: `"107"`, want: 107},
+		{name: "mins", input: `"107 mins"`, want: 107},
+		{name: "min", input: `"1 min"`, want: 1},
+		{name: "surrounding space", input: ` " 107 mins " `, want: 107},
+		{name: "hours and minutes", input: `"1h47m"`, want: 107},
+		{name: "hours", input: `"2h"`, want: 120},
+		{name: "minutes duration", input: `"90m"`, want: 90},
+		{name: "empty string", input: `""`, err: ErrInvalidRuntimeFormat},
+		{name: "unknown unit", input: `"107 hours"`, err: ErrInvalidRuntimeFormat},
+		{name: "missing number", input: `"mins"`, err: ErrInvalidRuntimeFormat},
+		{name: "two spaces", input: `"107  mins"`, err: ErrInvalidRuntimeFormat},
+		{name: "fraction of a minute", input: `"1h30s"`, err: ErrInvalidRuntimeFormat},
+		{name: "decimal", input: `107.5`, err: ErrInvalidRuntimeFormat},
+		{name: "overflows int32", input: `4294967296`, err: ErrInvalidRuntimeFormat},
+		{name: "bad escape", input: `"107\q mins"`, err: ErrInvalidRuntimeFormat},
+		{name: "boolean", input: `true`, err: ErrInvalidRuntimeFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Runtime
+			err := got.UnmarshalJSON([]byte(tt.input))
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("UnmarshalJSON(%s) got err %v; want %v", tt.input, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("UnmarshalJSON(%s) = %d; want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuntimeMarshal(t *testing.T) {
+	tests := []struct {
+		runtime Runtime
+		json    string
+		xml     string
+	}{
+		{runtime: 107, json: `{"runtime":"107 mins"}`, xml: `<movie><runtime>107 mins</runtime></movie>`},
+		{runtime: 1, json: `{"runtime":"1 mins"}`, xml: `<movie><runtime>1 mins</runtime></movie>`},
+	}
+
+	type movie struct {
+		XMLName xml.Name `json:"-" xml:"movie"`
+		Runtime Runtime  `json:"runtime" xml:"runtime"`
+	}
+
+	for _, tt := range tests {
+		js, err := json.Marshal(movie{Runtime: tt.runtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(js) != tt.json {
+			t.Errorf("json.Marshal(%d) = %s; want %s", tt.runtime, js, tt.json)
+		}
+
+		x, err := xml.Marshal(movie{Runtime: tt.runtime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(x) != tt.xml {
+			t.Errorf("xml.Marshal(%d) = %s; want %s", tt.runtime, x, tt.xml)
+		}
+
+		var decoded movie
+		err = json.Unmarshal(js, &decoded)
+		if err != nil || decoded.Runtime != tt.runtime {
+			t.Errorf("json round trip of %d got %d, err %v", tt.runtime, decoded.Runtime, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SlowQueryConnector wraps connector so that every query and exec that takes
+// longer than threshold is reported to log, along with a label naming the
+// model method that made it, such as "MovieModel.Update". Statements that
+// don't come from a model are labelled with the start of their SQL. A query is
+// timed until its first rows are returned, not while they are read.
+func SlowQueryConnector(connector driver.Connector, threshold time.Duration, log func(label string, elapsed time.Duration)) driver.Connector {
+	return slowQueryConnector{Connector: connector, threshold: threshold, log: log}
+}
+
+type slowQueryConnector struct {
+	driver.Connector
+	threshold time.Duration
+	log       func(label string, elapsed time.Duration)
+}
+
+func (c slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryConn{Conn: conn, connector: c}, nil
+}
+
+// slowQueryConn times the statements run on a connection. The optional
+// interfaces it implements are passed through to the wrapped connection, or
+// fall back to what database/sql would do without them.
+type slowQueryConn struct {
+	driver.Conn
+	connector slowQueryConnector
+}
+
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer c.observe(query, time.Now())
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer c.observe(query, time.Now())
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *slowQueryConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *slowQueryConn) observe(query string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed > c.connector.threshold {
+		c.connector.log(statementLabel(query), elapsed)
+	}
+}
+
+const dataPackage = "github.com/Soul-Remix/greenlight/internal/data."
+
+// statementLabel names the exported model method on the current call stack,
+// skipping unexported helpers and closures, or falls back to the start of
+// the query. database/sql calls the driver on the caller's goroutine, so the
+// model is still on the stack here.
+func statementLabel(query string) string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+
+	for {
+		frame, more := frames.Next()
+
+		if name, ok := strings.CutPrefix(frame.Function, dataPackage); ok {
+			// Closures are named like "MovieModel.Update.func1".
+			parts := strings.Split(name, ".")
+			if len(parts) >= 2 && isExported(parts[0]) && isExported(parts[1]) {
+				return parts[0] + "." + parts[1]
+			}
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	label := strings.Join(strings.Fields(query), " ")
+	if len(label) > 60 {
+		label = label[:60] + "..."
+	}
+	return label
+}
+
+func isExported(name string) bool {
+	for _, r := range name {
+		return unicode.IsUpper(r)
+	}
+	return false
+}
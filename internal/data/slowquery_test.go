@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// sleepyConnector opens connections whose queries and execs take delay and
+// return nothing.
+type sleepyConnector struct {
+	delay time.Duration
+}
+
+func (c sleepyConnector) Connect(context.Context) (driver.Conn, error) {
+	return sleepyConn{delay: c.delay}, nil
+}
+
+func (c sleepyConnector) Driver() driver.Driver {
+	return nil
+}
+
+type sleepyConn struct {
+	delay time.Duration
+}
+
+func (sleepyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (sleepyConn) Close() error                        { return nil }
+func (sleepyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c sleepyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	time.Sleep(c.delay)
+	return emptyRows{}, nil
+}
+
+func (c sleepyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	time.Sleep(c.delay)
+	return driver.RowsAffected(0), nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestSlowQueryConnector(t *testing.T) {
+	const threshold = 20 * time.Millisecond
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		run   func(db *sql.DB) error
+		want  string
+	}{
+		{
+			name:  "slow model query",
+			delay: 2 * threshold,
+			run: func(db *sql.DB) error {
+				_, err := MovieModel{DB: db, Timeout: time.Second}.Get(context.Background(), 1)
+				if !errors.Is(err, ErrRecordNotFound) {
+					return err
+				}
+				return nil
+			},
+			want: "MovieModel.Get",
+		},
+		{
+			name:  "slow statement outside a model",
+			delay: 2 * threshold,
+			run: func(db *sql.DB) error {
+				_, err := db.Exec("UPDATE   movies\n\tSET runtime = runtime + 1")
+				return err
+			},
+			want: "UPDATE movies SET runtime = runtime + 1",
+		},
+		{
+			name: "fast query",
+			run: func(db *sql.DB) error {
+				_, err := MovieModel{DB: db, Timeout: time.Second}.Get(context.Background(), 1)
+				if !errors.Is(err, ErrRecordNotFound) {
+					return err
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type logged struct {
+				label   string
+				elapsed time.Duration
+			}
+			var got []logged
+
+			db := sql.OpenDB(SlowQueryConnector(sleepyConnector{delay: tt.delay}, threshold, func(label string, elapsed time.Duration) {
+				got = append(got, logged{label, elapsed})
+			}))
+			t.Cleanup(func() { db.Close() })
+
+			err := tt.run(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == "" {
+				if len(got) != 0 {
+					t.Errorf("logged %v; want nothing", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("logged %v; want one slow query", got)
+			}
+			if got[0].label != tt.want {
+				t.Errorf("got label %q; want %q", got[0].label, tt.want)
+			}
+			if got[0].elapsed < tt.delay {
+				t.Errorf("got elapsed %s; want at least %s", got[0].elapsed, tt.delay)
+			}
+		})
+	}
+}
+
+func TestStatementLabelTruncates(t *testing.T) {
+	query := "SELECT id, created_at, title, year, runtime, genres, director, rating, version FROM movies"
+	want := "SELECT id, created_at, title, year, runtime, genres, directo..."
+	if got := statementLabel(query); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/validator"
@@ -14,8 +17,12 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
+var ErrTokenReused = errors.New("token has already been used")
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
@@ -24,6 +31,25 @@ type Token struct {
 	Scope     string    `json:"-"`
 }
 
+// TokenSummary describes a stored token without exposing anything that could
+// be used to authenticate with it.
+// UserID and Scope are only filled in by listings that span users or scopes.
+type TokenSummary struct {
+	ID         int64     `json:"id"`
+	Identifier string    `json:"identifier"`
+	UserID     int64     `json:"user_id,omitempty"`
+	Scope      string    `json:"scope,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+// tokenIdentifier is the short prefix of a token's hash used to tell tokens
+// apart. The hash can't be reversed, and the prefix alone can't be matched
+// against a presented token.
+func tokenIdentifier(hash []byte) string {
+	return hex.EncodeToString(hash[:4])
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
@@ -51,46 +77,239 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type ITokenModel interface {
-	New(userID int64, ttl time.Duration, scope string) (*Token, error)
-	Insert(token *Token) error
-	DeleteAllForUser(scope string, userID int64) error
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	Delete(ctx context.Context, scope, tokenPlaintext string) error
+	Use(ctx context.Context, scope, tokenPlaintext string) (int64, error)
+	GetAllForUser(ctx context.Context, scope string, userID int64) ([]*TokenSummary, error)
+	GetAll(ctx context.Context, scope string, userID *int64, filters Filters) ([]*TokenSummary, Metadata, error)
+	DeleteForUser(ctx context.Context, scope string, userID, id int64) error
+	DeleteExpired(ctx context.Context) (int64, error)
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)`
 
 	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+func (m TokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// Use marks a single-use token as consumed and returns the id of the user it
+// belongs to. Presenting a token that was already consumed returns
+// ErrTokenReused along with the user id, so the caller can treat it as a sign
+// the token leaked.
+func (m TokenModel) Use(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT user_id, used_at
+		FROM tokens
+		WHERE scope = $1 AND hash = $2 AND expiry > $3
+		FOR UPDATE`
+
+	var userID int64
+	var usedAt *time.Time
+	err = tx.QueryRowContext(ctx, query, scope, tokenHash[:], time.Now()).Scan(&userID, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	if usedAt != nil {
+		return userID, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE scope = $1 AND hash = $2`, scope, tokenHash[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// GetAllForUser returns the user's unexpired tokens in the given scope, newest
+// first. Each is identified by a short prefix of its hash.
+func (m TokenModel) GetAllForUser(ctx context.Context, scope string, userID int64) ([]*TokenSummary, error) {
+	query := `
+		SELECT id, hash, created_at, expiry
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*TokenSummary{}
+	for rows.Next() {
+		var token TokenSummary
+		var hash []byte
+
+		err := rows.Scan(&token.ID, &hash, &token.CreatedAt, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		token.Identifier = tokenIdentifier(hash)
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetAll lists stored tokens of every user, expired ones included, optionally
+// only those in one scope or belonging to one user. An empty scope or nil
+// userID matches everything.
+func (m TokenModel) GetAll(ctx context.Context, scope string, userID *int64, filters Filters) ([]*TokenSummary, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, hash, user_id, scope, created_at, expiry
+		FROM tokens
+		WHERE ($1 = '' OR scope = $1)
+		AND ($2::bigint IS NULL OR user_id = $2)
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	tokens := []*TokenSummary{}
+
+	for rows.Next() {
+		var token TokenSummary
+		var hash []byte
+
+		err := rows.Scan(&totalRecords, &token.ID, &hash, &token.UserID, &token.Scope, &token.CreatedAt, &token.Expiry)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		token.Identifier = tokenIdentifier(hash)
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return tokens, metadata, nil
+}
+
+func (m TokenModel) DeleteForUser(ctx context.Context, scope string, userID, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, userID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteExpired removes tokens of every scope whose expiry has passed and
+// returns how many were deleted.
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,417 @@
+package data
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+)
+
+func TestTokenRevocation(t *testing.T) {
+	tests := []struct {
+		name string
+		// revoke is given the user's two sessions and revokes some of them.
+		revoke func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error
+		// otherSurvives says whether the session that wasn't presented
+		// still authenticates.
+		otherSurvives bool
+	}{
+		{
+			name: "current session",
+			revoke: func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error {
+				return tokens.Delete(ctx, ScopeAuthentication, current.Plaintext)
+			},
+			otherSurvives: true,
+		},
+		{
+			name: "every session",
+			revoke: func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error {
+				return tokens.DeleteAllForUser(ctx, ScopeAuthentication, user.Id)
+			},
+		},
+		{
+			name: "current session by id",
+			revoke: func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error {
+				sessions, err := tokens.GetAllForUser(ctx, ScopeAuthentication, user.Id)
+				if err != nil {
+					return err
+				}
+				for _, session := range sessions {
+					if session.Identifier == tokenIdentifier(current.Hash) {
+						return tokens.DeleteForUser(ctx, ScopeAuthentication, user.Id, session.ID)
+					}
+				}
+				return ErrRecordNotFound
+			},
+			otherSurvives: true,
+		},
+		{
+			name: "revoke tokens",
+			revoke: func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error {
+				return users.RevokeTokens(ctx, user.Id)
+			},
+		},
+		{
+			name: "password change",
+			revoke: func(ctx context.Context, users UserModel, tokens TokenModel, user *User, current, other *Token) error {
+				err := user.Password.Set("n3wpa55word1234")
+				if err != nil {
+					return err
+				}
+				return users.UpdatePassword(ctx, user)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := datatest.NewDB(t)
+			users := UserModel{DB: db, Timeout: 5 * time.Second}
+			tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+			ctx := context.Background()
+
+			user := insertUser(t, users, "alice@example.com")
+			bystander := insertUser(t, users, "bob@example.com")
+
+			var sessions []*Token
+			for _, userID := range []int64{user.Id, user.Id, bystander.Id} {
+				token, err := tokens.New(ctx, userID, time.Hour, ScopeAuthentication)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sessions = append(sessions, token)
+			}
+			current, other, unrelated := sessions[0], sessions[1], sessions[2]
+
+			err := tt.revoke(ctx, users, tokens, user, current, other)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authenticates := func(token *Token) bool {
+				t.Helper()
+				_, err := users.GetForToken(ctx, ScopeAuthentication, token.Plaintext)
+				if err != nil && !errors.Is(err, ErrRecordNotFound) {
+					t.Fatal(err)
+				}
+				return err == nil
+			}
+
+			if authenticates(current) {
+				t.Error("the revoked token still authenticates")
+			}
+			if got := authenticates(other); got != tt.otherSurvives {
+				t.Errorf("the user's other session authenticates: %t; want %t", got, tt.otherSurvives)
+			}
+			if !authenticates(unrelated) {
+				t.Error("another user's session was revoked")
+			}
+		})
+	}
+}
+
+func TestTokenModelNewExpiry(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+
+	for _, ttl := range []time.Duration{10 * time.Minute, 36 * time.Hour} {
+		before := time.Now()
+		token, err := tokens.New(ctx, user.Id, ttl, ScopeActivation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now()
+
+		var stored time.Time
+		err = db.QueryRow("SELECT expiry FROM tokens WHERE hash = $1", token.Hash).Scan(&stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The column keeps whole seconds, so allow for rounding.
+		if stored.Before(before.Add(ttl-time.Second)) || stored.After(after.Add(ttl+time.Second)) {
+			t.Errorf("a token valid for %s expires at %s; want %s", ttl, stored, before.Add(ttl))
+		}
+		if diff := stored.Sub(token.Expiry); diff < -time.Second || diff > time.Second {
+			t.Errorf("stored expiry %s; the token reports %s", stored, token.Expiry)
+		}
+	}
+}
+
+func TestTokenModelUse(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		scope string
+		// before runs between issuing the token and presenting it.
+		before func(ctx context.Context, users UserModel, tokens TokenModel, token *Token) error
+		err    error
+	}{
+		{name: "fresh", ttl: time.Hour, scope: ScopeRefresh},
+		{
+			name:  "already used",
+			ttl:   time.Hour,
+			scope: ScopeRefresh,
+			before: func(ctx context.Context, users UserModel, tokens TokenModel, token *Token) error {
+				_, err := tokens.Use(ctx, ScopeRefresh, token.Plaintext)
+				return err
+			},
+			err: ErrTokenReused,
+		},
+		{name: "expired", ttl: -time.Minute, scope: ScopeRefresh, err: ErrRecordNotFound},
+		{name: "other scope", ttl: time.Hour, scope: ScopeAuthentication, err: ErrRecordNotFound},
+		{
+			name:  "revoked",
+			ttl:   time.Hour,
+			scope: ScopeRefresh,
+			before: func(ctx context.Context, users UserModel, tokens TokenModel, token *Token) error {
+				return users.RevokeTokens(ctx, token.UserID)
+			},
+			err: ErrRecordNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := datatest.NewDB(t)
+			users := UserModel{DB: db, Timeout: 5 * time.Second}
+			tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+			ctx := context.Background()
+
+			user := insertUser(t, users, "alice@example.com")
+
+			token, err := tokens.New(ctx, user.Id, tt.ttl, tt.scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.before != nil {
+				err = tt.before(ctx, users, tokens, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			userID, err := tokens.Use(ctx, ScopeRefresh, token.Plaintext)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got err %v; want %v", err, tt.err)
+			}
+
+			// The owner is reported on reuse so their sessions can be ended.
+			wantID := user.Id
+			if errors.Is(tt.err, ErrRecordNotFound) {
+				wantID = 0
+			}
+			if userID != wantID {
+				t.Errorf("got user id %d; want %d", userID, wantID)
+			}
+		})
+	}
+}
+
+func TestTokenModelGetAllForUser(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+	bystander := insertUser(t, users, "bob@example.com")
+
+	issue := func(userID int64, ttl time.Duration, scope string) *Token {
+		t.Helper()
+		token, err := tokens.New(ctx, userID, ttl, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	older := issue(user.Id, time.Hour, ScopeAuthentication)
+	newer := issue(user.Id, 2*time.Hour, ScopeAuthentication)
+	issue(user.Id, -time.Minute, ScopeAuthentication)
+	issue(user.Id, time.Hour, ScopeRefresh)
+	issue(bystander.Id, time.Hour, ScopeAuthentication)
+
+	sessions, err := tokens.GetAllForUser(ctx, ScopeAuthentication, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions; want the 2 unexpired authentication tokens", len(sessions))
+	}
+
+	for i, want := range []*Token{newer, older} {
+		got := sessions[i]
+		if got.Identifier != tokenIdentifier(want.Hash) {
+			t.Errorf("session %d has identifier %s; want %s", i, got.Identifier, tokenIdentifier(want.Hash))
+		}
+		if strings.Contains(want.Plaintext, got.Identifier) {
+			t.Errorf("session %d identifier %s gives away part of the token", i, got.Identifier)
+		}
+		// Expiry is stored to the second.
+		if diff := got.Expiry.Sub(want.Expiry); diff < -time.Second || diff > time.Second {
+			t.Errorf("session %d expires at %s; want %s", i, got.Expiry, want.Expiry)
+		}
+	}
+
+	err = tokens.DeleteForUser(ctx, ScopeAuthentication, bystander.Id, sessions[0].ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("revoking another user's session returned %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+func TestTokenModelDeleteExpired(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+
+	var expired, live []*Token
+	for _, scope := range []string{ScopeActivation, ScopeAuthentication, ScopePasswordReset, ScopeRefresh} {
+		token, err := tokens.New(ctx, user.Id, -time.Minute, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired = append(expired, token)
+
+		token, err = tokens.New(ctx, user.Id, time.Hour, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, token)
+	}
+
+	stored := func(token *Token) bool {
+		var exists bool
+		err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM tokens WHERE hash = $1)`, token.Hash).Scan(&exists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	purged, err := tokens.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != int64(len(expired)) {
+		t.Errorf("purged %d tokens; want %d", purged, len(expired))
+	}
+	for _, token := range expired {
+		if stored(token) {
+			t.Errorf("expired %s token was kept", token.Scope)
+		}
+	}
+	for _, token := range live {
+		if !stored(token) {
+			t.Errorf("live %s token was purged", token.Scope)
+		}
+	}
+
+	purged, err = tokens.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Errorf("a second run purged %d tokens; want 0", purged)
+	}
+}
+
+func TestTokenModelGetAll(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+
+	issued := map[string]*Token{}
+	for _, tt := range []struct {
+		name   string
+		userID int64
+		ttl    time.Duration
+		scope  string
+	}{
+		{"alice session", alice.Id, time.Hour, ScopeAuthentication},
+		{"alice expired session", alice.Id, -time.Minute, ScopeAuthentication},
+		{"alice refresh", alice.Id, 3 * time.Hour, ScopeRefresh},
+		{"bob session", bob.Id, 2 * time.Hour, ScopeAuthentication},
+		{"bob activation", bob.Id, 30 * time.Minute, ScopeActivation},
+	} {
+		token, err := tokens.New(ctx, tt.userID, tt.ttl, tt.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		issued[tt.name] = token
+	}
+
+	tests := []struct {
+		name   string
+		scope  string
+		userID *int64
+		sort   string
+		page   int
+		want   []string
+	}{
+		{name: "everything, newest first", sort: "-id", page: 1, want: []string{"bob activation", "bob session", "alice refresh"}},
+		{name: "second page", sort: "-id", page: 2, want: []string{"alice expired session", "alice session"}},
+		{name: "by scope, expired included", scope: ScopeAuthentication, sort: "-id", page: 1, want: []string{"bob session", "alice expired session", "alice session"}},
+		{name: "by user", userID: &bob.Id, sort: "-id", page: 1, want: []string{"bob activation", "bob session"}},
+		{name: "by scope and user", scope: ScopeAuthentication, userID: &alice.Id, sort: "-id", page: 1, want: []string{"alice expired session", "alice session"}},
+		{name: "by expiry", sort: "expiry", page: 1, want: []string{"alice expired session", "bob activation", "alice session"}},
+		{name: "by expiry, latest first", sort: "-expiry", page: 1, want: []string{"alice refresh", "bob session", "alice session"}},
+		{name: "scope nobody has", scope: ScopePasswordReset, sort: "-id", page: 1, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters := Filters{Page: tt.page, PageSize: 3, Sort: tt.sort, SortSafeList: []string{tt.sort}}
+			summaries, _, err := tokens.GetAll(ctx, tt.scope, tt.userID, filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, summary := range summaries {
+				for name, token := range issued {
+					if summary.Identifier == tokenIdentifier(token.Hash) {
+						got = append(got, name)
+						if summary.UserID != token.UserID || summary.Scope != token.Scope {
+							t.Errorf("%s is reported for user %d in scope %s", name, summary.UserID, summary.Scope)
+						}
+					}
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+
+			// Neither the plaintext nor the hash is ever reported.
+			js, err := json.Marshal(summaries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(js), `"hash"`) {
+				t.Errorf("the listing has a hash field: %s", js)
+			}
+			for name, token := range issued {
+				if strings.Contains(string(js), token.Plaintext) || strings.Contains(string(js), hex.EncodeToString(token.Hash)) {
+					t.Errorf("the listing gives away %s: %s", name, js)
+				}
+			}
+		})
+	}
+}
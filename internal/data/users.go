@@ -5,9 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Soul-Remix/greenlight/internal/validator"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -24,7 +26,21 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Locale    string    `json:"locale"`
+	Role      string    `json:"role,omitempty"`
 	Version   int       `json:"-"`
+
+	FailedLogins int        `json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+
+	// TokenVersion is carried by the user's JWTs, which are only accepted
+	// while it matches. Bumping it revokes every JWT issued to the user.
+	TokenVersion int `json:"-"`
+}
+
+// IsLocked reports whether the account is inside a lockout window at t.
+func (u *User) IsLocked(t time.Time) bool {
+	return u.LockedUntil != nil && u.LockedUntil.After(t)
 }
 
 func (u *User) IsAnonymous() bool {
@@ -74,6 +90,10 @@ func ValidateUser(v *validator.Validator, user *User) {
 	v.Check(user.Name != "", "name", "must be provided")
 	v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 	ValidateEmail(v, user.Email)
+	v.Check(validator.Matches(user.Locale, validator.LocaleRX), "locale", "must be a valid language tag")
+	if user.Role != "" {
+		v.Check(validator.PermittedValue(user.Role, Roles...), "role", "must be one of admin, editor or viewer")
+	}
 
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
@@ -85,27 +105,45 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type IUserModel interface {
-	Insert(user *User) error
-	GetByEmail(email string) (*User, error)
-	Update(user *User) error
-	GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	UpdatePassword(ctx context.Context, user *User) error
+	RevokeTokens(ctx context.Context, userID int64) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	Delete(ctx context.Context, userID int64) error
+	RecordFailedLogin(ctx context.Context, user *User, maxAttempts int, lockout time.Duration) error
+	ResetFailedLogins(ctx context.Context, user *User) error
+	GetAll(ctx context.Context, name, email string, activated *bool, filters Filters) ([]*User, Metadata, error)
 }
 
-func (m UserModel) Insert(user *User) error {
+// Insert creates the user. Its role's permissions aren't copied to it: they
+// are looked up through the role whenever they are checked, so changing the
+// role or the permissions of a role takes effect at once.
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		VALUES ($1, $2, $3, $4)
-		RETURNING id, created_at, version`
+		INSERT INTO users (name, email, password_hash, activated, locale, role_id)
+		VALUES ($1, $2, $3, $4, $5, (SELECT id FROM roles WHERE name = $6))
+		RETURNING id, created_at, version, token_version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Locale, user.Role}
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Id, &user.CreatedAt, &user.Version)
+	err := audited(ctx, m.DB, func(q querier) error {
+		err := q.QueryRowContext(ctx, query, args...).Scan(&user.Id, &user.CreatedAt, &user.Version, &user.TokenVersion)
+		if err != nil {
+			return err
+		}
+		setAuditTarget(ctx, user.Id)
+		return nil
+	})
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -117,14 +155,59 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale,
+			COALESCE(roles.name, ''), users.version, users.failed_logins, users.locked_until,
+			users.token_version
+		FROM users
+		LEFT JOIN roles ON roles.id = users.role_id
+		WHERE users.id = $1`
+
+	var user User
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.Id,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Version,
+		&user.FailedLogins,
+		&user.LockedUntil,
+		&user.TokenVersion,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale,
+			COALESCE(roles.name, ''), users.version, users.failed_logins, users.locked_until,
+			users.token_version
 		FROM users
-		WHERE email = $1`
+		LEFT JOIN roles ON roles.id = users.role_id
+		WHERE users.email = $1`
 
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -134,7 +217,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
+		&user.Role,
 		&user.Version,
+		&user.FailedLogins,
+		&user.LockedUntil,
+		&user.TokenVersion,
 	)
 	if err != nil {
 		switch {
@@ -147,11 +235,12 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, password_hash = $3, activated = $4, locale = $5,
+			role_id = (SELECT id FROM roles WHERE name = $6), version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version`
 
 	args := []any{
@@ -159,40 +248,107 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Locale,
+		user.Role,
 		user.Id,
 		user.Version,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
-	if err != nil {
-		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
+	err := audited(ctx, m.DB, func(q querier) error {
+		return q.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	})
+	return userUpdateError(err)
+}
+
+func userUpdateError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		return ErrDuplicateEmail
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrEditConflict
+	default:
+		return err
+	}
+}
+
+// UpdatePassword stores the user's new password hash and, in the same
+// transaction, deletes their authentication, refresh and password reset
+// tokens and bumps their token version, so that no session started with the
+// old password outlives it.
+func (m UserModel) UpdatePassword(ctx context.Context, user *User) error {
+	query := `
+		UPDATE users
+		SET password_hash = $1, version = version + 1, token_version = token_version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING version, token_version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := transact(ctx, m.DB, func(q querier) error {
+		err := q.QueryRowContext(ctx, query, user.Password.hash, user.Id, user.Version).Scan(&user.Version, &user.TokenVersion)
+		if err != nil {
 			return err
 		}
-	}
-	return nil
+
+		query := `
+			DELETE FROM tokens
+			WHERE user_id = $1 AND scope = ANY($2)`
+
+		scopes := []string{ScopeAuthentication, ScopeRefresh, ScopePasswordReset}
+
+		_, err = q.ExecContext(ctx, query, user.Id, pq.Array(scopes))
+		return err
+	})
+	return userUpdateError(err)
+}
+
+// RevokeTokens deletes the user's authentication and refresh tokens and bumps
+// their token version, which also revokes any JWTs they hold, in a single
+// transaction.
+func (m UserModel) RevokeTokens(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return transact(ctx, m.DB, func(q querier) error {
+		query := `
+			DELETE FROM tokens
+			WHERE user_id = $1 AND scope = ANY($2)`
+
+		scopes := []string{ScopeAuthentication, ScopeRefresh}
+
+		_, err := q.ExecContext(ctx, query, userID, pq.Array(scopes))
+		if err != nil {
+			return err
+		}
+
+		_, err = q.ExecContext(ctx, `UPDATE users SET token_version = token_version + 1 WHERE id = $1`, userID)
+		return err
+	})
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.locale,
+			COALESCE(roles.name, ''), users.version, users.failed_logins, users.locked_until,
+			users.token_version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
+		LEFT JOIN roles ON roles.id = users.role_id
 		WHERE tokens.hash = $1
 		AND tokens.scope = $2
-		AND tokens.expiry > $3`
+		AND tokens.expiry > $3
+		AND tokens.used_at IS NULL`
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -202,7 +358,12 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Locale,
+		&user.Role,
 		&user.Version,
+		&user.FailedLogins,
+		&user.LockedUntil,
+		&user.TokenVersion,
 	)
 	if err != nil {
 		switch {
@@ -214,3 +375,151 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	}
 	return &user, nil
 }
+
+func (m UserModel) Delete(ctx context.Context, userID int64) error {
+	if userID < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_permissions WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = recordAudit(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RecordFailedLogin increments the user's failed login counter. Once it
+// reaches maxAttempts the account is locked for the lockout duration and the
+// counter starts again from zero. The user's lockout fields are updated in
+// place.
+func (m UserModel) RecordFailedLogin(ctx context.Context, user *User, maxAttempts int, lockout time.Duration) error {
+	query := `
+		UPDATE users
+		SET failed_logins = CASE WHEN failed_logins + 1 >= $2 THEN 0 ELSE failed_logins + 1 END,
+			locked_until = CASE WHEN failed_logins + 1 >= $2 THEN $3 ELSE locked_until END
+		WHERE id = $1
+		RETURNING failed_logins, locked_until`
+
+	args := []any{user.Id, maxAttempts, time.Now().Add(lockout)}
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.FailedLogins, &user.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m UserModel) ResetFailedLogins(ctx context.Context, user *User) error {
+	query := `
+		UPDATE users
+		SET failed_logins = 0, locked_until = NULL
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, user.Id)
+	if err != nil {
+		return err
+	}
+
+	user.FailedLogins = 0
+	user.LockedUntil = nil
+	return nil
+}
+
+// GetAll lists users whose name and email contain the given substrings,
+// ignoring case, and optionally only those with the given activation status.
+func (m UserModel) GetAll(ctx context.Context, name, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), users.id, users.created_at, users.name, users.email, users.activated, users.locale,
+			COALESCE(roles.name, '')
+		FROM users
+		LEFT JOIN roles ON roles.id = users.role_id
+		WHERE (strpos(lower(users.name), lower($1)) > 0 OR $1 = '')
+		AND (strpos(lower(users.email), lower($2)) > 0 OR $2 = '')
+		AND (users.activated = $3 OR $3 IS NULL)
+		ORDER BY users.%s %s, users.id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, email, activated, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.Id,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Activated,
+			&user.Locale,
+			&user.Role,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return users, metadata, nil
+}
@@ -0,0 +1,316 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Soul-Remix/greenlight/internal/data/datatest"
+)
+
+// insertUser creates an activated user with the given email address.
+func insertUser(t *testing.T, users UserModel, email string) *User {
+	t.Helper()
+
+	user := &User{Name: "Alice", Email: email, Activated: true, Locale: "en"}
+	err := user.Password.Set("pa55word1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestUserModelTokenVersion(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+	if user.TokenVersion != 1 {
+		t.Fatalf("new user has token version %d; want 1", user.TokenVersion)
+	}
+
+	steps := []struct {
+		name string
+		do   func() error
+	}{
+		{"revoke tokens", func() error { return users.RevokeTokens(ctx, user.Id) }},
+		{"reset password", func() error {
+			user, err := users.Get(ctx, user.Id)
+			if err != nil {
+				return err
+			}
+			err = user.Password.Set("n3wpa55word1234")
+			if err != nil {
+				return err
+			}
+			return users.UpdatePassword(ctx, user)
+		}},
+	}
+
+	want := user.TokenVersion
+	for _, step := range steps {
+		err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		want++
+
+		got, err := users.Get(ctx, user.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.TokenVersion != want {
+			t.Errorf("after %s token version is %d; want %d", step.name, got.TokenVersion, want)
+		}
+	}
+}
+
+func TestUserModelDelete(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	tokens := TokenModel{DB: db, Timeout: 5 * time.Second}
+	permissions := PermissionModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	bob := insertUser(t, users, "bob@example.com")
+	for _, user := range []*User{alice, bob} {
+		for _, scope := range []string{ScopeActivation, ScopeAuthentication, ScopeRefresh, ScopePasswordReset} {
+			_, err := tokens.New(ctx, user.Id, time.Hour, scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := permissions.AddForUser(ctx, user.Id, "movies:write")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows := func(table string, userID int64) int {
+		t.Helper()
+		var n int
+		err := db.QueryRow(`SELECT count(*) FROM `+table+` WHERE user_id = $1`, userID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	err := users.Delete(ctx, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = users.Get(ctx, alice.Id)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("getting the deleted user returned %v; want %v", err, ErrRecordNotFound)
+	}
+	for _, table := range []string{"tokens", "users_permissions"} {
+		if n := rows(table, alice.Id); n != 0 {
+			t.Errorf("%d %s rows left behind", n, table)
+		}
+	}
+	if n := rows("tokens", bob.Id); n != 4 {
+		t.Errorf("another user has %d tokens left; want 4", n)
+	}
+	if n := rows("users_permissions", bob.Id); n != 1 {
+		t.Errorf("another user has %d permissions left; want 1", n)
+	}
+
+	err = users.Delete(ctx, alice.Id)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("deleting the user again returned %v; want %v", err, ErrRecordNotFound)
+	}
+}
+
+func TestUserModelUpdateDuplicateEmail(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	alice := insertUser(t, users, "alice@example.com")
+	insertUser(t, users, "bob@example.com")
+
+	alice.Email = "bob@example.com"
+	err := users.Update(ctx, alice)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("taking another user's email got %v; want %v", err, ErrDuplicateEmail)
+	}
+
+	stored, err := users.Get(ctx, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != "alice@example.com" || stored.Version != 1 {
+		t.Errorf("stored %s at version %d; want the user unchanged", stored.Email, stored.Version)
+	}
+}
+
+func TestUserModelFailedLogins(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	user := insertUser(t, users, "alice@example.com")
+
+	for i := 1; i < 3; i++ {
+		err := users.RecordFailedLogin(ctx, user, 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.FailedLogins != i || user.IsLocked(time.Now()) {
+			t.Fatalf("after %d failures got count %d and lock until %v; want no lock", i, user.FailedLogins, user.LockedUntil)
+		}
+	}
+
+	err := users.RecordFailedLogin(ctx, user, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.IsLocked(time.Now()) || user.IsLocked(time.Now().Add(time.Hour+time.Minute)) {
+		t.Fatalf("after 3 failures locked until %v; want about an hour from now", user.LockedUntil)
+	}
+
+	stored, err := users.GetByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.IsLocked(time.Now()) {
+		t.Error("the lock wasn't stored")
+	}
+
+	err = users.ResetFailedLogins(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = users.GetByEmail(ctx, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailedLogins != 0 || stored.LockedUntil != nil {
+		t.Errorf("after a reset got count %d and lock until %v", stored.FailedLogins, stored.LockedUntil)
+	}
+}
+
+func TestUserModelGetAll(t *testing.T) {
+	db := datatest.NewDB(t)
+	users := UserModel{DB: db, Timeout: 5 * time.Second}
+	ctx := context.Background()
+
+	seed := []struct {
+		name      string
+		email     string
+		activated bool
+	}{
+		{"Carol", "carol@example.com", true},
+		{"alice", "alice@example.com", false},
+		{"Bob", "bob@example.org", true},
+		{"Dave", "dave@example.com", true},
+		{"Alicia", "alicia@example.org", false},
+	}
+	for _, s := range seed {
+		user := &User{Name: s.name, Email: s.email, Activated: s.activated, Locale: "en"}
+		err := user.Password.Set("pa55word1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = users.Insert(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	activated, deactivated := true, false
+	sorts := []string{"id", "created_at", "name", "-id", "-created_at", "-name"}
+
+	tests := []struct {
+		name      string
+		nameQuery string
+		email     string
+		activated *bool
+		filters   Filters
+		want      []string
+		metadata  Metadata
+	}{
+		{
+			name:     "first page",
+			filters:  Filters{Page: 1, PageSize: 2, Sort: "id"},
+			want:     []string{"Carol", "alice"},
+			metadata: Metadata{CurrentPage: 1, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5},
+		},
+		{
+			name:     "last page",
+			filters:  Filters{Page: 3, PageSize: 2, Sort: "id"},
+			want:     []string{"Alicia"},
+			metadata: Metadata{CurrentPage: 3, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5},
+		},
+		{
+			name:      "activated",
+			activated: &activated,
+			filters:   Filters{Page: 1, PageSize: 20, Sort: "id"},
+			want:      []string{"Carol", "Bob", "Dave"},
+			metadata:  Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 3},
+		},
+		{
+			name:      "not activated",
+			activated: &deactivated,
+			filters:   Filters{Page: 1, PageSize: 20, Sort: "id"},
+			want:      []string{"alice", "Alicia"},
+			metadata:  Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:      "name, ignoring case",
+			nameQuery: "ALI",
+			filters:   Filters{Page: 1, PageSize: 20, Sort: "id"},
+			want:      []string{"alice", "Alicia"},
+			metadata:  Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:     "email",
+			email:    "example.org",
+			filters:  Filters{Page: 1, PageSize: 20, Sort: "-name"},
+			want:     []string{"Bob", "Alicia"},
+			metadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:     "no match",
+			email:    "example.net",
+			filters:  Filters{Page: 1, PageSize: 20, Sort: "id"},
+			want:     []string{},
+			metadata: Metadata{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filters.SortSafeList = sorts
+			got, metadata, err := users.GetAll(ctx, tt.nameQuery, tt.email, tt.activated, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			for _, user := range got {
+				names = append(names, user.Name)
+				if user.Password.hash != nil {
+					t.Errorf("%s was listed with a password hash", user.Name)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("got %q; want %q", names, tt.want)
+			}
+			if metadata != tt.metadata {
+				t.Errorf("got metadata %+v; want %+v", metadata, tt.metadata)
+			}
+		})
+	}
+}
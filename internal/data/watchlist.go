@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type WatchlistModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+type IWatchlistModel interface {
+	Add(ctx context.Context, userID, movieID int64) (bool, error)
+	Remove(ctx context.Context, userID, movieID int64) error
+	GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error)
+}
+
+// Add puts the movie on the user's watchlist and reports whether it was newly
+// added. Adding a movie that is already there is not an error.
+func (m WatchlistModel) Add(ctx context.Context, userID, movieID int64) (bool, error) {
+	query := `
+		INSERT INTO watchlist (user_id, movie_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func (m WatchlistModel) Remove(ctx context.Context, userID, movieID int64) error {
+	query := `
+		DELETE FROM watchlist
+		WHERE user_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m WatchlistModel) GetAllForUser(ctx context.Context, userID int64, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movies.id, movies.created_at, movies.title, movies.year, movies.runtime,
+			movies.genres, movies.director, movies.rating, movies.version
+		FROM watchlist
+		INNER JOIN movies ON movies.id = watchlist.movie_id
+		WHERE watchlist.user_id = $1 AND movies.deleted_at IS NULL
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.Id,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Director,
+			&movie.Rating,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters)
+
+	return movies, metadata, nil
+}
@@ -2,17 +2,24 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Level int8
 
 const (
-	LevelInfo Level = iota // Has the value 0.
+	LevelDebug Level = iota - 1 // Has the value -1.
+	LevelInfo                   // Has the value 0.
+	LevelWarning
 	LevelError
 	LevelFatal
 	LevelOff
@@ -20,68 +27,167 @@ const (
 
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarning:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+func ParseLevel(s string) (Level, error) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarning, LevelError, LevelFatal, LevelOff} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+type Entry struct {
+	Level      string            `json:"level"`
+	Time       string            `json:"time"`
+	Message    string            `json:"message"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Trace      string            `json:"trace,omitempty"`
+}
+
+// Formatter renders a single log entry, without the trailing newline.
+type Formatter func(entry Entry) []byte
+
+func JSONFormatter(entry Entry) []byte {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
+	}
+	return line
+}
+
+var levelColors = map[string]string{
+	LevelDebug.String():   "\x1b[90m",
+	LevelInfo.String():    "\x1b[36m",
+	LevelWarning.String(): "\x1b[33m",
+	LevelError.String():   "\x1b[31m",
+	LevelFatal.String():   "\x1b[35m",
+}
+
+func TextFormatter(entry Entry) []byte {
+	var b strings.Builder
+
+	b.WriteString(entry.Time)
+	b.WriteString(" ")
+	b.WriteString(levelColors[entry.Level])
+	b.WriteString(fmt.Sprintf("%-5s", entry.Level))
+	b.WriteString("\x1b[0m ")
+	b.WriteString(entry.Message)
+
+	keys := make([]string, 0, len(entry.Properties))
+	for key := range entry.Properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		b.WriteString(" " + key + "=" + textValue(entry.Properties[key]))
+	}
+
+	if entry.Trace != "" {
+		b.WriteString(" trace=" + textValue(entry.Trace))
+	}
+
+	return []byte(b.String())
+}
+
+func textValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
 type Logger struct {
 	out      io.Writer
-	minLevel Level
+	format   Formatter
+	minLevel atomic.Int32
 	mu       sync.Mutex
 }
 
-func New(out io.Writer, minLevel Level) *Logger {
-	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+func New(out io.Writer, minLevel Level, format Formatter) *Logger {
+	if format == nil {
+		format = JSONFormatter
 	}
+
+	l := &Logger{out: out, format: format}
+	l.SetLevel(minLevel)
+	return l
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+func (l *Logger) GetLevel() Level {
+	return Level(l.minLevel.Load())
+}
+
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, properties)
 }
 
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
 	l.print(LevelInfo, message, properties)
 }
+
+func (l *Logger) PrintWarning(message string, properties map[string]string) {
+	l.print(LevelWarning, message, properties)
+}
+
 func (l *Logger) PrintError(err error, properties map[string]string) {
 	l.print(LevelError, err.Error(), properties)
 }
+
+// PrintErrorTrace logs err with the given stack trace instead of the stack of
+// the caller, for errors such as recovered panics whose origin is elsewhere.
+func (l *Logger) PrintErrorTrace(err error, trace []byte, properties map[string]string) {
+	l.printTrace(LevelError, err.Error(), properties, string(trace))
+}
+
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
 	l.print(LevelFatal, err.Error(), properties)
 	os.Exit(1)
 }
 
 func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
-	if level < l.minLevel {
+	trace := ""
+	if level >= LevelError && level >= l.GetLevel() {
+		trace = string(debug.Stack())
+	}
+	return l.printTrace(level, message, properties, trace)
+}
+
+func (l *Logger) printTrace(level Level, message string, properties map[string]string, trace string) (int, error) {
+	if level < l.GetLevel() {
 		return 0, nil
 	}
-	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
-	}{
+	entry := Entry{
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
 		Properties: properties,
+		Trace:      trace,
 	}
 
-	if level >= LevelError {
-		aux.Trace = string(debug.Stack())
-	}
-
-	var line []byte
+	line := l.format(entry)
 
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message: " + err.Error())
-	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -0,0 +1,196 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// messages returns the messages of the JSON entries written to buf, and
+// empties it.
+func messages(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+
+	var got []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry Entry
+		err := dec.Decode(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry.Message)
+	}
+	buf.Reset()
+	return got
+}
+
+func TestLoggerSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, LevelInfo, JSONFormatter)
+
+	printAll := func() {
+		logger.PrintDebug("debug", nil)
+		logger.PrintInfo("info", nil)
+		logger.PrintWarning("warning", nil)
+		logger.PrintError(errors.New("error"), nil)
+	}
+
+	steps := []struct {
+		level Level
+		want  []string
+	}{
+		{LevelInfo, []string{"info", "warning", "error"}},
+		{LevelDebug, []string{"debug", "info", "warning", "error"}},
+		{LevelError, []string{"error"}},
+		{LevelOff, nil},
+		{LevelInfo, []string{"info", "warning", "error"}},
+	}
+
+	for _, step := range steps {
+		logger.SetLevel(step.level)
+		if got := logger.GetLevel(); got != step.level {
+			t.Fatalf("GetLevel returned %s after setting %s", got, step.level)
+		}
+
+		printAll()
+		got := messages(t, &buf)
+		if len(got) != len(step.want) {
+			t.Fatalf("at %s logged %q; want %q", step.level, got, step.want)
+		}
+		for i := range got {
+			if got[i] != step.want[i] {
+				t.Errorf("at %s logged %q; want %q", step.level, got, step.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Level
+		wantErr bool
+	}{
+		{s: "debug", want: LevelDebug},
+		{s: "INFO", want: LevelInfo},
+		{s: "Warn", want: LevelWarning},
+		{s: "error", want: LevelError},
+		{s: "fatal", want: LevelFatal},
+		{s: "off", want: LevelOff},
+		{s: "warning", want: LevelInfo, wantErr: true},
+		{s: "", want: LevelInfo, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLevel(%q) returned error %v; want one: %t", tt.s, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseLevel(%q) = %s; want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// parseText reads a line written by TextFormatter back into an Entry. The
+// message may contain spaces, so it's taken as known.
+func parseText(t *testing.T, line, message string) Entry {
+	t.Helper()
+
+	line = ansiEscape.ReplaceAllString(line, "")
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) != 2 {
+		t.Fatalf("no level in %q", line)
+	}
+	entry := Entry{Time: fields[0]}
+
+	rest := strings.TrimLeft(fields[1], " ")
+	entry.Level, rest, _ = strings.Cut(rest, " ")
+	rest = strings.TrimLeft(rest, " ")
+	if !strings.HasPrefix(rest, message) {
+		t.Fatalf("%q doesn't carry the message %q", line, message)
+	}
+	entry.Message = message
+	rest = rest[len(message):]
+
+	for rest != "" {
+		if rest[0] != ' ' {
+			t.Fatalf("expected a space before %q", rest)
+		}
+		key, value, ok := strings.Cut(rest[1:], "=")
+		if !ok {
+			t.Fatalf("expected key=value in %q", rest)
+		}
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				t.Fatalf("bad quoted value in %q: %v", value, err)
+			}
+			rest = value[len(quoted):]
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+			if rest != "" {
+				rest = " " + rest
+			}
+		}
+
+		if key == "trace" {
+			entry.Trace = value
+			continue
+		}
+		if entry.Properties == nil {
+			entry.Properties = map[string]string{}
+		}
+		entry.Properties[key] = value
+	}
+	return entry
+}
+
+func TestFormattersRenderSameFields(t *testing.T) {
+	entries := []Entry{
+		{Level: "INFO", Time: "2023-04-01T12:00:00Z", Message: "starting server"},
+		{
+			Level:   "ERROR",
+			Time:    "2023-04-01T12:00:01Z",
+			Message: "request failed",
+			Properties: map[string]string{
+				"method": "GET",
+				"url":    "/v1/movies?title=the club",
+				"quote":  `say "hi"`,
+				"pair":   "a=b",
+				"empty":  "",
+			},
+			Trace: "goroutine 1 [running]:\nmain.main()",
+		},
+		{Level: "DEBUG", Time: "2023-04-01T12:00:02Z", Message: "cache hit", Properties: map[string]string{"key": "movie:1"}},
+	}
+
+	for _, want := range entries {
+		var fromJSON Entry
+		err := json.Unmarshal(JSONFormatter(want), &fromJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromJSON, want) {
+			t.Errorf("JSON rendered %+v; want %+v", fromJSON, want)
+		}
+
+		text := string(TextFormatter(want))
+		if strings.Contains(text, "\n") {
+			t.Errorf("text output spans lines: %q", text)
+		}
+		if fromText := parseText(t, text, want.Message); !reflect.DeepEqual(fromText, want) {
+			t.Errorf("text rendered %+v; want %+v", fromText, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// header is fixed: only HMAC-SHA256 signed tokens are issued or accepted.
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type Claims interface {
+	Valid(now time.Time) error
+}
+
+type RegisteredClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (c RegisteredClaims) Valid(now time.Time) error {
+	if c.ExpiresAt == 0 || now.Unix() >= c.ExpiresAt {
+		return ErrExpiredToken
+	}
+	return nil
+}
+
+func Sign(claims Claims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signature(unsigned, secret), nil
+}
+
+// Parse verifies the token's signature and decodes its payload into claims,
+// which must be a pointer. ErrExpiredToken is returned for a correctly signed
+// token whose claims are no longer valid.
+func Parse(token string, secret []byte, claims Claims) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return ErrInvalidToken
+	}
+
+	expected := signature(parts[0]+"."+parts[1], secret)
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	return claims.Valid(time.Now())
+}
+
+func signature(unsigned string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,171 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// Limiter decides whether the client identified by key may make a request.
+// When it may not, Allow also returns how long until the client's next token
+// is available. Peek answers the same question without taking a token, for
+// callers that only charge the client once they know the outcome.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+	Peek(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+type MemoryLimiter struct {
+	rps     float64
+	burst   int
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewMemory(rps float64, burst int) *MemoryLimiter {
+	l := &MemoryLimiter{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*client),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			l.mu.Lock()
+			for key, client := range l.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.clients[key]; !found {
+		l.clients[key] = &client{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+	}
+
+	now := time.Now()
+	l.clients[key].lastSeen = now
+
+	// A reservation reports how long the next token is away. Cancelling it
+	// hands the token back, so a rejected request doesn't push the wait out
+	// further.
+	reservation := l.clients[key].limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Duration(float64(time.Second) / l.rps), nil
+	}
+
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay, nil
+	}
+	return true, 0, nil
+}
+
+func (l *MemoryLimiter) Peek(ctx context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	client, found := l.clients[key]
+	if !found {
+		return true, 0, nil
+	}
+
+	tokens := client.limiter.TokensAt(time.Now())
+	if tokens >= 1 {
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - tokens) / l.rps * float64(time.Second)), nil
+}
+
+// tokenBucketScript refills the bucket stored at KEYS[1] based on the time
+// elapsed since it was last touched and takes a single token if one is
+// available. It uses the Redis server clock so every API instance agrees on
+// the refill rate. It returns whether a token was available and, if not, the
+// milliseconds until one will be. ARGV[3] is the number of tokens to take, 1
+// for Allow and 0 for Peek.
+var tokenBucketScript = redis.NewScript(`
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "timestamp")
+local tokens = tonumber(bucket[1])
+local timestamp = tonumber(bucket[2])
+if tokens == nil then
+	tokens = burst
+	timestamp = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - timestamp) * rps)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - cost
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rps * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "timestamp", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rps * 1000) + 1000)
+
+return {allowed, wait}
+`)
+
+type RedisLimiter struct {
+	client *redis.Client
+	rps    float64
+	burst  int
+}
+
+func NewRedis(client *redis.Client, rps float64, burst int) *RedisLimiter {
+	return &RedisLimiter{
+		client: client,
+		rps:    rps,
+		burst:  burst,
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	return l.run(ctx, key, 1)
+}
+
+func (l *RedisLimiter) Peek(ctx context.Context, key string) (bool, time.Duration, error) {
+	return l.run(ctx, key, 0)
+}
+
+func (l *RedisLimiter) run(ctx context.Context, key string, cost int) (bool, time.Duration, error) {
+	result, err := tokenBucketScript.Run(ctx, l.client, []string{"limiter:" + key}, l.rps, l.burst, cost).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("limiter: unexpected script result %v", result)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testLimiter checks a limiter with a burst of 3 and a refill rate slow
+// enough that no token comes back while the test runs.
+func testLimiter(t *testing.T, l Limiter, prefix string) {
+	ctx := context.Background()
+	alice, bob := prefix+"alice", prefix+"bob"
+
+	for i := 0; i < 3; i++ {
+		ok, _, err := l.Peek(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("peek before request %d was refused", i+1)
+		}
+
+		ok, _, err = l.Allow(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+
+	ok, wait, err := l.Allow(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("a request beyond the burst was allowed")
+	}
+	// At 0.001 requests per second the next token is 1000s away, less the
+	// little time the test has taken so far.
+	if wait <= 990*time.Second || wait > 1000*time.Second {
+		t.Errorf("got wait %s; want just under 1000s", wait)
+	}
+
+	// A rejected request gives its token back, so asking again doesn't push
+	// the wait out.
+	ok, again, err := l.Allow(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || again > wait {
+		t.Errorf("asking again got %t and wait %s; want false and no more than %s", ok, again, wait)
+	}
+
+	ok, peekWait, err := l.Peek(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || peekWait <= 0 {
+		t.Errorf("peek at an empty bucket got %t and wait %s; want false and a positive wait", ok, peekWait)
+	}
+
+	ok, _, err = l.Allow(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("another key was limited along with the exhausted one")
+	}
+}
+
+// testLimiterConcurrent checks that concurrent requests for one key never
+// take more tokens than the burst.
+func testLimiterConcurrent(t *testing.T, l Limiter, key string) {
+	const burst, requests = 5, 40
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, _, err := l.Allow(context.Background(), key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != burst {
+		t.Errorf("%d of %d concurrent requests were allowed; want %d", allowed, requests, burst)
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	testLimiter(t, NewMemory(0.001, 3), "")
+	testLimiterConcurrent(t, NewMemory(0.001, 5), "carol")
+}
+
+// TestRedisLimiter runs against the Redis server at GREENLIGHT_TEST_REDIS_URL,
+// a redis:// URL, and is skipped when it isn't set.
+func TestRedisLimiter(t *testing.T) {
+	url := os.Getenv("GREENLIGHT_TEST_REDIS_URL")
+	if url == "" {
+		t.Skip("GREENLIGHT_TEST_REDIS_URL not set")
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(opts)
+	t.Cleanup(func() { client.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		t.Fatalf("redis at %s: %v", url, err)
+	}
+
+	// Keys are unique to the run so that buckets left by an earlier run
+	// don't count.
+	prefix := fmt.Sprintf("test-%d-", time.Now().UnixNano())
+	t.Cleanup(func() {
+		keys, err := client.Keys(context.Background(), "limiter:"+prefix+"*").Result()
+		if err == nil && len(keys) > 0 {
+			client.Del(context.Background(), keys...)
+		}
+	})
+
+	testLimiter(t, NewRedis(client, 0.001, 3), prefix)
+	testLimiterConcurrent(t, NewRedis(client, 0.001, 5), prefix+"carol")
+}
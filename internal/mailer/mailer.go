@@ -3,6 +3,14 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"net/textproto"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -12,63 +20,251 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
+var ErrQueueFull = errors.New("mail queue is full")
+
+// Delivery counters published on /debug/vars. A message counts once, however
+// many attempts it took, and fails if it was never delivered, including when
+// it couldn't be queued.
+var (
+	totalMessages  = expvar.NewInt("mailer_total")
+	failedMessages = expvar.NewInt("mailer_failed")
+)
+
+const DefaultLocale = "en"
+
+type message struct {
+	recipient    string
+	locale       string
+	templateFile string
+	data         any
+}
+
+type IMailer interface {
+	Send(recipient, locale, templateFile string, data any) error
+	Enqueue(recipient, locale, templateFile string, data any) error
+	Ping() error
+	Start(workers int, wg *sync.WaitGroup, logError func(error))
+	Close()
+	Queued() int
+}
+
+const baseRetryDelay = 500 * time.Millisecond
+
+// Mailer delivers templated messages over SMTP. Without a host it has nowhere
+// to deliver to, so it renders each message and passes it to console instead,
+// which lets activation and password reset flows be tried out locally.
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	dialer      *mail.Dialer
+	sender      string
+	queue       chan message
+	maxAttempts int
+	console     func(message string, properties map[string]string)
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
+func New(host string, port int, username, password, sender string, queueSize, maxAttempts int, console func(message string, properties map[string]string)) Mailer {
 	dialer := mail.NewDialer(host, port, username, password)
 	dialer.Timeout = 5 * time.Second
 
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		dialer:      dialer,
+		sender:      sender,
+		queue:       make(chan message, queueSize),
+		maxAttempts: maxAttempts,
+		console:     console,
 	}
 }
 
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// Start launches workers goroutines that drain the queue until Close is
+// called. Each worker is tracked by wg so callers can wait for queued mail to
+// be delivered during shutdown.
+func (m Mailer) Start(workers int, wg *sync.WaitGroup, logError func(error)) {
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range m.queue {
+				m.deliver(msg, logError)
+			}
+		}()
+	}
+}
+
+func (m Mailer) deliver(msg message, logError func(error)) {
+	defer func() {
+		if err := recover(); err != nil {
+			logError(fmt.Errorf("%s", err))
+		}
+	}()
+
+	err := m.Send(msg.recipient, msg.locale, msg.templateFile, msg.data)
+	if err != nil {
+		logError(err)
+	}
+}
+
+func (m Mailer) Enqueue(recipient, locale, templateFile string, data any) error {
+	select {
+	case m.queue <- message{recipient: recipient, locale: locale, templateFile: templateFile, data: data}:
+		return nil
+	default:
+		totalMessages.Add(1)
+		failedMessages.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting new messages. Workers exit once the queue is empty.
+func (m Mailer) Close() {
+	close(m.queue)
+}
+
+// Queued returns the number of messages waiting for a worker.
+func (m Mailer) Queued() int {
+	return len(m.queue)
+}
+
+func (m Mailer) Ping() error {
 	if m.dialer.Host == "" {
 		return nil
 	}
 
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	conn, err := m.dialer.Dial()
 	if err != nil {
 		return err
 	}
+	return conn.Close()
+}
 
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+func (m Mailer) Send(recipient, locale, templateFile string, data any) error {
+	totalMessages.Add(1)
+
+	err := m.send(recipient, locale, templateFile, data)
 	if err != nil {
-		return err
+		failedMessages.Add(1)
+	}
+	return err
+}
+
+func (m Mailer) send(recipient, locale, templateFile string, data any) error {
+	if m.dialer.Host == "" {
+		return m.sendToConsole(recipient, locale, templateFile, data)
 	}
 
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	msg, err := m.newMessage(recipient, locale, templateFile, data)
 	if err != nil {
 		return err
 	}
 
-	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	return retry(m.maxAttempts, baseRetryDelay, func() error {
+		return m.dialer.DialAndSend(msg)
+	})
+}
+
+// sendToConsole renders the message as it would have been sent and hands its
+// plain text part to the console function.
+func (m Mailer) sendToConsole(recipient, locale, templateFile string, data any) error {
+	subject, plainBody, _, err := render(locale, templateFile, data)
 	if err != nil {
 		return err
 	}
 
+	if m.console != nil {
+		m.console("email not sent, no SMTP host is configured", map[string]string{
+			"recipient": recipient,
+			"subject":   subject,
+			"body":      plainBody,
+		})
+	}
+	return nil
+}
+
+// newMessage renders a template into a multipart/alternative message. The
+// plain text part comes first so clients that cannot display HTML still have
+// something to show.
+func (m Mailer) newMessage(recipient, locale, templateFile string, data any) (*mail.Message, error) {
+	subject, plainBody, htmlBody, err := render(locale, templateFile, data)
+	if err != nil {
+		return nil, err
+	}
+
 	msg := mail.NewMessage()
 	msg.SetHeader("To", recipient)
 	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		if err == nil {
-			return nil
+	msg.SetHeader("Subject", subject)
+	msg.SetBody("text/plain", plainBody)
+	msg.AddAlternative("text/html", htmlBody)
+
+	return msg, nil
+}
+
+// render executes the subject, plainBody and htmlBody blocks of a template.
+func render(locale, templateFile string, data any) (subject, plainBody, htmlBody string, err error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, templatePath(locale, templateFile))
+	if err != nil {
+		return "", "", "", err
+	}
+
+	blocks := make([]string, 3)
+	for i, name := range []string{"subject", "plainBody", "htmlBody"} {
+		buf := new(bytes.Buffer)
+		err = tmpl.ExecuteTemplate(buf, name, data)
+		if err != nil {
+			return "", "", "", err
 		}
+		blocks[i] = buf.String()
+	}
 
-		time.Sleep(500 * time.Millisecond)
+	return blocks[0], blocks[1], blocks[2], nil
+}
+
+// templatePath resolves a template such as "user_welcome.tmpl" to its
+// localized file, e.g. "templates/user_welcome.fr.tmpl" for "fr-CA", falling
+// back to the DefaultLocale variant when no translation exists.
+func templatePath(locale, templateFile string) string {
+	name := strings.TrimSuffix(templateFile, ".tmpl")
+
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if language != "" {
+		path := fmt.Sprintf("templates/%s.%s.tmpl", name, language)
+		if _, err := fs.Stat(templateFS, path); err == nil {
+			return path
+		}
 	}
-	return err
+
+	return fmt.Sprintf("templates/%s.%s.tmpl", name, DefaultLocale)
+}
+
+// retry calls send up to maxAttempts times, doubling the delay between
+// attempts and adding up to 50% random jitter. Permanent failures are
+// returned straight away.
+func retry(maxAttempts int, delay time.Duration, send func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = send()
+		if err == nil || isPermanent(err) {
+			return err
+		}
+
+		if attempt < maxAttempts {
+			jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+			time.Sleep(delay + jitter)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("mailer: giving up after %d attempts: %w", maxAttempts, err)
+}
+
+// isPermanent reports whether err is an SMTP 5xx reply, such as an unknown
+// recipient or a rejected sender, which will not succeed on a retry.
+func isPermanent(err error) bool {
+	var sendErr *mail.SendError
+	if errors.As(err, &sendErr) {
+		err = sendErr.Cause
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500 && protoErr.Code < 600
+	}
+	return false
 }
@@ -0,0 +1,50 @@
+package mailer
+
+import "sync"
+
+type SentMessage struct {
+	Recipient    string
+	Locale       string
+	TemplateFile string
+	Data         any
+}
+
+// MockMailer records every message handed to it instead of talking to an
+// SMTP server. Enqueued messages are recorded immediately.
+type MockMailer struct {
+	mu   sync.Mutex
+	sent []SentMessage
+}
+
+func (m *MockMailer) Send(recipient, locale, templateFile string, data any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, SentMessage{Recipient: recipient, Locale: locale, TemplateFile: templateFile, Data: data})
+	return nil
+}
+
+func (m *MockMailer) Enqueue(recipient, locale, templateFile string, data any) error {
+	return m.Send(recipient, locale, templateFile, data)
+}
+
+func (m *MockMailer) Ping() error {
+	return nil
+}
+
+func (m *MockMailer) Start(workers int, wg *sync.WaitGroup, logError func(error)) {}
+
+func (m *MockMailer) Close() {}
+
+func (m *MockMailer) Queued() int {
+	return 0
+}
+
+func (m *MockMailer) Sent() []SentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sent := make([]SentMessage, len(m.sent))
+	copy(sent, m.sent)
+	return sent
+}
@@ -0,0 +1,446 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// newConsoleMailer returns a Mailer without an SMTP host, so each message is
+// handed to deliver instead of being sent.
+func newConsoleMailer(queueSize int, deliver func(recipient string)) Mailer {
+	return New("", 0, "", "", "", queueSize, 1, func(message string, properties map[string]string) {
+		deliver(properties["recipient"])
+	})
+}
+
+func TestMailerQueueDrains(t *testing.T) {
+	const workers, messages = 2, 10
+
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	release := make(chan struct{})
+	m := newConsoleMailer(messages, func(recipient string) {
+		<-release
+		mu.Lock()
+		delivered = append(delivered, recipient)
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	m.Start(workers, &wg, func(err error) { t.Error(err) })
+
+	var want []string
+	for i := 0; i < messages; i++ {
+		recipient := fmt.Sprintf("user%02d@example.com", i)
+		want = append(want, recipient)
+
+		err := m.Enqueue(recipient, "en", "user_welcome.tmpl", map[string]any{"userId": i})
+		if err != nil {
+			t.Fatalf("enqueue %d: %v", i+1, err)
+		}
+	}
+
+	// The workers are held up by release, so at most one message each has
+	// left the queue.
+	if queued := m.Queued(); queued < messages-workers {
+		t.Errorf("%d messages queued behind %d busy workers; want at least %d", queued, workers, messages-workers)
+	}
+
+	close(release)
+	m.Close()
+	wg.Wait()
+
+	sort.Strings(delivered)
+	if fmt.Sprint(delivered) != fmt.Sprint(want) {
+		t.Errorf("delivered %q; want %q", delivered, want)
+	}
+	if queued := m.Queued(); queued != 0 {
+		t.Errorf("%d messages left in the queue after shutdown", queued)
+	}
+}
+
+func TestMailerQueueFull(t *testing.T) {
+	m := newConsoleMailer(1, func(string) {})
+
+	err := m.Enqueue("alice@example.com", "en", "user_welcome.tmpl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Enqueue("bob@example.com", "en", "user_welcome.tmpl", nil)
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("enqueueing onto a full queue returned %v; want %v", err, ErrQueueFull)
+	}
+}
+
+// flakySender fails with err until it has been called failures times.
+type flakySender struct {
+	failures int
+	err      error
+	attempts int
+}
+
+func (s *flakySender) send() error {
+	s.attempts++
+	if s.attempts <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	transient := &textproto.Error{Code: 421, Msg: "service not available"}
+	permanent := &mail.SendError{Cause: &textproto.Error{Code: 550, Msg: "no such user"}}
+
+	tests := []struct {
+		name         string
+		sender       *flakySender
+		maxAttempts  int
+		wantAttempts int
+		wantErr      error
+	}{
+		{"succeeds first time", &flakySender{}, 3, 1, nil},
+		{"fails twice then succeeds", &flakySender{failures: 2, err: transient}, 5, 3, nil},
+		{"network error", &flakySender{failures: 1, err: errors.New("connection reset")}, 3, 2, nil},
+		{"gives up", &flakySender{failures: 10, err: transient}, 3, 3, transient},
+		{"permanent failure", &flakySender{failures: 10, err: permanent}, 3, 1, permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := retry(tt.maxAttempts, time.Millisecond, tt.sender.send)
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("got error %v; want none", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+			if tt.sender.attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts; want %d", tt.sender.attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryBacksOff(t *testing.T) {
+	var times []time.Time
+	retry(4, 10*time.Millisecond, func() error {
+		times = append(times, time.Now())
+		return errors.New("connection reset")
+	})
+
+	if len(times) != 4 {
+		t.Fatalf("made %d attempts; want 4", len(times))
+	}
+
+	// Jitter only adds to the delay, which doubles after each attempt.
+	atLeast := 10 * time.Millisecond
+	for i := 1; i < len(times); i++ {
+		gap := times[i].Sub(times[i-1])
+		if gap < atLeast {
+			t.Errorf("delay %d was %s; want at least %s", i, gap, atLeast)
+		}
+		atLeast *= 2
+	}
+}
+
+func TestTemplatePath(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   string
+	}{
+		{"en", "templates/user_welcome.en.tmpl"},
+		{"fr", "templates/user_welcome.fr.tmpl"},
+		{"fr-CA", "templates/user_welcome.fr.tmpl"},
+		{"FR", "templates/user_welcome.fr.tmpl"},
+		{"de", "templates/user_welcome.en.tmpl"},
+		{"", "templates/user_welcome.en.tmpl"},
+	}
+
+	for _, tt := range tests {
+		if got := templatePath(tt.locale, "user_welcome.tmpl"); got != tt.want {
+			t.Errorf("templatePath(%q) = %s; want %s", tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestRenderLocales(t *testing.T) {
+	data := map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "tokenExpiry": "2023-04-04 12:00 UTC", "userId": int64(7)}
+
+	tests := []struct {
+		locale  string
+		subject string
+	}{
+		{"en", "Welcome to Greenlight!"},
+		{"fr", "Bienvenue sur Greenlight !"},
+		{"de", "Welcome to Greenlight!"},
+	}
+
+	for _, tt := range tests {
+		subject, plainBody, htmlBody, err := render(tt.locale, "user_welcome.tmpl", data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.locale, err)
+		}
+		if subject != tt.subject {
+			t.Errorf("%s: got subject %q; want %q", tt.locale, subject, tt.subject)
+		}
+
+		// Every translation is given the same data.
+		for _, body := range []string{plainBody, htmlBody} {
+			if !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") || !strings.Contains(body, "7") {
+				t.Errorf("%s: body is missing the token or user id:\n%s", tt.locale, body)
+			}
+		}
+	}
+}
+
+func TestNewMessageIsMultipartAlternative(t *testing.T) {
+	m := New("smtp.example.com", 587, "", "", "Greenlight <no-reply@greenlight.example.com>", 1, 1, nil)
+	data := map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "tokenExpiry": "2023-04-04 12:00 UTC", "userId": int64(7)}
+
+	msg, err := m.newMessage("alice@example.com", "en", "user_welcome.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	_, err = msg.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := netmail.ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := parsed.Header.Get("To"); got != "alice@example.com" {
+		t.Errorf("got To %q", got)
+	}
+	if got := parsed.Header.Get("Subject"); got != "Welcome to Greenlight!" {
+		t.Errorf("got Subject %q", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %s; want multipart/alternative", mediaType)
+	}
+
+	// Clients show the last alternative they understand, so the plain text
+	// part comes first.
+	wantParts := []struct {
+		contentType string
+		contains    string
+	}{
+		{"text/plain", "your user ID number is 7"},
+		{"text/html", "<html>"},
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for i, want := range wantParts {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i+1, err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if contentType != want.contentType {
+			t.Errorf("part %d is %s; want %s", i+1, contentType, want.contentType)
+		}
+
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), want.contains) || !strings.Contains(string(body), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			t.Errorf("part %d (%s) is missing its content:\n%s", i+1, want.contentType, body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("got more than two parts: %v", err)
+	}
+}
+
+func TestSendWithoutHost(t *testing.T) {
+	type logged struct {
+		message    string
+		properties map[string]string
+	}
+	var got []logged
+	m := New("", 0, "", "", "", 1, 1, func(message string, properties map[string]string) {
+		got = append(got, logged{message, properties})
+	})
+	data := map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "tokenExpiry": "2023-04-04 12:00 UTC", "userId": int64(7)}
+
+	err := m.Send("alice@example.com", "en", "user_welcome.tmpl", data)
+	if err != nil {
+		t.Fatalf("sending without a host returned %v; want the message logged", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("logged %d messages; want 1", len(got))
+	}
+
+	properties := got[0].properties
+	if !strings.Contains(got[0].message, "no SMTP host") {
+		t.Errorf("logged %q; want it to say no SMTP host is configured", got[0].message)
+	}
+	if properties["recipient"] != "alice@example.com" || properties["subject"] != "Welcome to Greenlight!" {
+		t.Errorf("logged recipient %q and subject %q", properties["recipient"], properties["subject"])
+	}
+	// The plain text part is logged, with the token a developer needs to
+	// carry on.
+	if body := properties["body"]; !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") || strings.Contains(body, "<html>") {
+		t.Errorf("logged body:\n%s\nwant the plain text part with the token", body)
+	}
+
+	// A template that doesn't render is still an error.
+	err = m.Send("alice@example.com", "en", "missing.tmpl", data)
+	if err == nil {
+		t.Error("sending a missing template without a host succeeded")
+	}
+	if len(got) != 1 {
+		t.Errorf("logged %d messages after a failed render; want 1", len(got))
+	}
+
+	// Without a console function the message is dropped.
+	err = New("", 0, "", "", "", 1, 1, nil).Send("alice@example.com", "en", "user_welcome.tmpl", data)
+	if err != nil {
+		t.Errorf("sending without a host or console returned %v", err)
+	}
+}
+
+// fakeSMTP accepts a connection at a time on a local port and speaks just
+// enough SMTP to take a message. It rejects recipients at bounce.example.com
+// with a permanent error, as a server does for an unknown mailbox.
+func fakeSMTP(t *testing.T) (host string, port int) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveSMTP(textproto.NewConn(conn))
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func serveSMTP(c *textproto.Conn) {
+	defer c.Close()
+
+	c.PrintfLine("220 localhost ready")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(strings.ToUpper(line), " ")
+
+		switch verb {
+		case "EHLO", "HELO", "MAIL", "RSET", "NOOP":
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.Contains(line, "@bounce.example.com") {
+				c.PrintfLine("550 no such user")
+			} else {
+				c.PrintfLine("250 OK")
+			}
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			_, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSendCounters(t *testing.T) {
+	host, port := fakeSMTP(t)
+	m := New(host, port, "", "", "Greenlight <no-reply@greenlight.example.com>", 1, 3, nil)
+	data := map[string]any{"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "tokenExpiry": "2023-04-04 12:00 UTC", "userId": int64(7)}
+
+	total, failed := totalMessages.Value(), failedMessages.Value()
+	counted := func(wantTotal, wantFailed int64) {
+		t.Helper()
+		if got := totalMessages.Value() - total; got != wantTotal {
+			t.Errorf("mailer_total went up by %d; want %d", got, wantTotal)
+		}
+		if got := failedMessages.Value() - failed; got != wantFailed {
+			t.Errorf("mailer_failed went up by %d; want %d", got, wantFailed)
+		}
+	}
+
+	err := m.Send("alice@example.com", "en", "user_welcome.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted(1, 0)
+
+	err = m.Send("bob@bounce.example.com", "en", "user_welcome.tmpl", data)
+	if err == nil {
+		t.Fatal("sending to a rejected recipient succeeded")
+	}
+	counted(2, 1)
+
+	// A message that never renders fails too.
+	err = m.Send("alice@example.com", "en", "missing.tmpl", data)
+	if err == nil {
+		t.Fatal("sending a missing template succeeded")
+	}
+	counted(3, 2)
+
+	// So does one that can't be queued; it never reaches Send. The queued
+	// one is still waiting, as there are no workers.
+	err = m.Enqueue("carol@example.com", "en", "user_welcome.tmpl", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Enqueue("dave@example.com", "en", "user_welcome.tmpl", data)
+	if !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got err %v; want %v", err, ErrQueueFull)
+	}
+	counted(4, 3)
+	if queued := m.Queued(); queued != 1 {
+		t.Errorf("%d messages queued; want 1", queued)
+	}
+
+	// The worker counts the queued message when it sends it.
+	var wg sync.WaitGroup
+	m.Start(1, &wg, func(err error) { t.Error(err) })
+	m.Close()
+	wg.Wait()
+	counted(5, 3)
+}
@@ -1,11 +1,17 @@
 package validator
 
-import "regexp"
+import (
+	"regexp"
+	"strconv"
+)
 
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+var LocaleRX = regexp.MustCompile("^[a-zA-Z]{2,3}(?:-[a-zA-Z0-9]{2,8})*$")
+
 type Validator struct {
 	Errors map[string]string
+	prefix string
 }
 
 func New() *Validator {
@@ -16,7 +22,33 @@ func (v *Validator) Valid() bool {
 	return len(v.Errors) == 0
 }
 
+// At returns a validator for the value at path, such as "movies[3]", that
+// shares v's errors. Keys checked through it are prefixed with the path, so
+// "runtime" is recorded as "movies[3].runtime". Its Valid reports on all of
+// the shared errors, not just those under path.
+func (v *Validator) At(path string) *Validator {
+	return &Validator{Errors: v.Errors, prefix: v.path(path)}
+}
+
+func (v *Validator) path(key string) string {
+	switch {
+	case v.prefix == "":
+		return key
+	case key == "" || key[0] == '[':
+		return v.prefix + key
+	default:
+		return v.prefix + "." + key
+	}
+}
+
+// Index returns the path of the element i of the named array, e.g.
+// "genres[2]".
+func Index(name string, i int) string {
+	return name + "[" + strconv.Itoa(i) + "]"
+}
+
 func (v *Validator) AddError(key, message string) {
+	key = v.path(key)
 	if _, exists := v.Errors[key]; !exists {
 		v.Errors[key] = message
 	}
@@ -0,0 +1,43 @@
+package validator
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAt(t *testing.T) {
+	v := New()
+	v.Check(false, "movies", "must not be empty")
+
+	second := v.At(Index("movies", 1))
+	second.Check(false, "year", "must be greater than 1888")
+	second.At(Index("genres", 0)).Check(false, "", "must be provided")
+	second.At("genres").Check(false, "[2]", "must not be more than 50 bytes long")
+
+	fourth := v.At(Index("movies", 3))
+	fourth.Check(false, "title", "must be provided")
+	fourth.Check(false, "title", "must not be more than 500 bytes long")
+	fourth.Check(true, "runtime", "must be provided")
+
+	want := map[string]string{
+		"movies":              "must not be empty",
+		"movies[1].year":      "must be greater than 1888",
+		"movies[1].genres[0]": "must be provided",
+		"movies[1].genres[2]": "must not be more than 50 bytes long",
+		"movies[3].title":     "must be provided",
+	}
+	if fmt.Sprint(v.Errors) != fmt.Sprint(want) {
+		t.Errorf("got errors %v; want %v", v.Errors, want)
+	}
+
+	// The errors are shared, so every validator sees them all.
+	if fourth.Valid() || v.At(Index("movies", 0)).Valid() {
+		t.Error("a validator sharing errors reported valid")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	if got := Index("genres", 12); got != "genres[12]" {
+		t.Errorf("got %q; want genres[12]", got)
+	}
+}
@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventMovieRestored = "movie.restored"
+)
+
+// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body,
+// prefixed with "sha256=".
+const SignatureHeader = "X-Signature"
+
+const baseRetryDelay = 500 * time.Millisecond
+
+type Event struct {
+	Type       string    `json:"type"`
+	MovieID    int64     `json:"movie_id"`
+	Version    int32     `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+type Notifier struct {
+	client      *http.Client
+	urls        []string
+	secret      []byte
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+func New(urls []string, secret string, maxAttempts int) Notifier {
+	return Notifier{
+		client:      &http.Client{Timeout: 5 * time.Second},
+		urls:        urls,
+		secret:      []byte(secret),
+		maxAttempts: maxAttempts,
+		retryDelay:  baseRetryDelay,
+	}
+}
+
+// URLs returns the endpoints every event is delivered to.
+func (n Notifier) URLs() []string {
+	return n.urls
+}
+
+// Sign returns the X-Signature value for body.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts the event to url, retrying with exponential backoff and
+// jitter on network errors and 5xx or 429 responses. Other 4xx responses are
+// treated as permanent.
+func (n Notifier) Deliver(url string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	signature := Sign(n.secret, body)
+
+	delay := n.retryDelay
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		var retryable bool
+		retryable, err = n.post(url, body, signature)
+		if err == nil || !retryable {
+			return err
+		}
+
+		if attempt < n.maxAttempts {
+			jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+			time.Sleep(delay + jitter)
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("webhook: giving up on %s after %d attempts: %w", url, n.maxAttempts, err)
+}
+
+func (n Notifier) post(url string, body []byte, signature string) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook: %s responded %s", url, res.Status)
+	default:
+		return false, fmt.Errorf("webhook: %s responded %s", url, res.Status)
+	}
+}
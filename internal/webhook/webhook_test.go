@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const secret = "s3cret"
+
+// newNotifier returns a notifier for url that retries without waiting long.
+func newNotifier(url string, maxAttempts int) Notifier {
+	n := New([]string{url}, secret, maxAttempts)
+	n.retryDelay = time.Millisecond
+	return n
+}
+
+func TestDeliverSignsEvent(t *testing.T) {
+	event := Event{Type: EventMovieUpdated, MovieID: 7, Version: 3, OccurredAt: time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)}
+
+	var received Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// The receiver checks the signature the way a downstream system
+		// would, with its copy of the shared secret.
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(Sign([]byte(secret), body))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("got Content-Type %q; want application/json", got)
+		}
+
+		err = json.Unmarshal(body, &received)
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	err := newNotifier(receiver.URL, 1).Deliver(receiver.URL, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != event {
+		t.Errorf("received %+v; want %+v", received, event)
+	}
+
+	// A notifier with another secret is turned away.
+	n := newNotifier(receiver.URL, 1)
+	n.secret = []byte("not the secret")
+	err = n.Deliver(receiver.URL, event)
+	if err == nil {
+		t.Error("a payload signed with the wrong secret was accepted")
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are the responses to successive attempts; the last one
+		// repeats.
+		statuses     []int
+		maxAttempts  int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{"first attempt", []int{http.StatusOK}, 3, 1, false},
+		{"recovers after server errors", []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusAccepted}, 3, 3, false},
+		{"recovers after rate limiting", []int{http.StatusTooManyRequests, http.StatusNoContent}, 3, 2, false},
+		{"gives up", []int{http.StatusBadGateway}, 3, 3, true},
+		{"permanent failure", []int{http.StatusBadRequest}, 3, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(attempts.Add(1)) - 1
+				if i >= len(tt.statuses) {
+					i = len(tt.statuses) - 1
+				}
+				w.WriteHeader(tt.statuses[i])
+			}))
+			t.Cleanup(receiver.Close)
+
+			err := newNotifier(receiver.URL, tt.maxAttempts).Deliver(receiver.URL, Event{Type: EventMovieCreated, MovieID: 1, Version: 1})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got err %v; want error %t", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("made %d attempts; want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDeliverRetriesNetworkErrors(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	url := receiver.URL
+	receiver.Close()
+
+	start := time.Now()
+	err := newNotifier(url, 3).Deliver(url, Event{Type: EventMovieDeleted, MovieID: 1, Version: 2})
+	if err == nil {
+		t.Fatal("delivery to a closed server succeeded")
+	}
+	// Two backoffs of at least 1ms and 2ms come between the three attempts.
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("gave up after %s; want it to back off between attempts", elapsed)
+	}
+}
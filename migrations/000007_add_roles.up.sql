@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS roles (id bigserial PRIMARY KEY, name text UNIQUE NOT NULL);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS role_id bigint REFERENCES roles ON DELETE SET NULL;
+-- Add the default roles and map them to the existing permissions.
+INSERT INTO roles (name)
+VALUES ('admin'),
+    ('editor'),
+    ('viewer');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name IN ('admin', 'editor')
+    OR (roles.name = 'viewer' AND permissions.code = 'movies:read');
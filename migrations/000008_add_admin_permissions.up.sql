@@ -0,0 +1,6 @@
+INSERT INTO permissions (code)
+VALUES ('admin:read'),
+    ('admin:write');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code IN ('admin:read', 'admin:write');
@@ -0,0 +1,4 @@
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS director text NOT NULL DEFAULT '';
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS rating text NOT NULL DEFAULT '';
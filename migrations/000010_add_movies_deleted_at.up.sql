@@ -0,0 +1,2 @@
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
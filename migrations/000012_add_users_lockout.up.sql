@@ -0,0 +1,4 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0;
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
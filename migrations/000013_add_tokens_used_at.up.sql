@@ -0,0 +1,2 @@
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
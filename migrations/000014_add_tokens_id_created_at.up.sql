@@ -0,0 +1,4 @@
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE tokens
+ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS reviews (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    body text NOT NULL,
+    rating integer NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+ALTER TABLE reviews
+ADD CONSTRAINT reviews_rating_check CHECK (rating BETWEEN 1 AND 5);
+CREATE INDEX IF NOT EXISTS reviews_movie_id_idx ON reviews (movie_id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movies_title_lower_key;
+DROP INDEX IF EXISTS movies_title_lower_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS unique_title;
@@ -0,0 +1,7 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS unique_title boolean NOT NULL DEFAULT false;
+-- Movies that exist before this migration are left out of the unique index, so
+-- duplicates among them don't stop it from running. Movies written after it
+-- are in the index unless the writer clears unique_title.
+ALTER TABLE movies ALTER COLUMN unique_title SET DEFAULT true;
+CREATE INDEX IF NOT EXISTS movies_title_lower_idx ON movies (lower(title)) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS movies_title_lower_key ON movies (lower(title)) WHERE deleted_at IS NULL AND unique_title;
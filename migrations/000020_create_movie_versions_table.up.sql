@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS movie_versions (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    version integer NOT NULL,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text [] NOT NULL,
+    director text NOT NULL,
+    rating text NOT NULL,
+    replaced_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (movie_id, version)
+);
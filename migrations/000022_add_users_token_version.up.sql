@@ -0,0 +1,2 @@
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS token_version integer NOT NULL DEFAULT 1;
\ No newline at end of file
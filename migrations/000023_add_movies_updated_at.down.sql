@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movies_set_updated_at ON movies;
+DROP FUNCTION IF EXISTS movies_set_updated_at();
+DROP INDEX IF EXISTS movies_updated_at_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS updated_at;
\ No newline at end of file
@@ -0,0 +1,13 @@
+ALTER TABLE movies
+ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS movies_updated_at_idx ON movies (updated_at);
+-- Every write to a movie, including soft deletes and restores, bumps
+-- updated_at, which movie listings use for Last-Modified.
+CREATE OR REPLACE FUNCTION movies_set_updated_at() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER movies_set_updated_at BEFORE UPDATE ON movies
+FOR EACH ROW EXECUTE FUNCTION movies_set_updated_at();
\ No newline at end of file